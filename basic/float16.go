@@ -0,0 +1,80 @@
+package basic
+
+// IEEE 754 半精度浮点数(float16)与 float32 之间的转换
+
+import "math"
+
+// Float32ToFloat16
+//
+//	@Description: 把 float32 转换为 IEEE 754 半精度浮点数的位表示,按就近舍入(相同时取偶数)。
+//	超出半精度范围(约 ±65504)的值变为 ±Inf,过小的值变为非规格化数或 ±0,NaN 保持为 NaN
+//	@param f
+//	@return uint16 半精度浮点数的位表示
+func Float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23) & 0xff
+	mant := bits & 0x7fffff
+
+	if exp == 0xff {
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	}
+
+	// 换算到半精度的指数偏置(15)
+	e := exp - 127 + 15
+	if e >= 0x1f {
+		return sign | 0x7c00
+	}
+	if e <= 0 {
+		// 非规格化数:值为 m * 2^-24,m = (1.mant) 右移 14-e 位
+		if e < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - e)
+		half := mant >> shift
+		rem := mant & (1<<shift - 1)
+		halfway := uint32(1) << (shift - 1)
+		if rem > halfway || (rem == halfway && half&1 == 1) {
+			// 进位可能使结果变为最小的规格化数,位表示仍然正确
+			half++
+		}
+		return sign | uint16(half)
+	}
+
+	half := uint32(e)<<10 | mant>>13
+	rem := mant & 0x1fff
+	if rem > 0x1000 || (rem == 0x1000 && half&1 == 1) {
+		// 尾数进位会进到指数位,最大值进位后恰好变为 Inf
+		half++
+	}
+	return sign | uint16(half)
+}
+
+// Float16ToFloat32
+//
+//	@Description: 把半精度浮点数的位表示转换为 float32,转换是精确的
+//	@param h 半精度浮点数的位表示
+//	@return float32
+func Float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		// ±0 与非规格化数:mant * 2^-24
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	default:
+		return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+	}
+}
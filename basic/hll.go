@@ -0,0 +1,119 @@
+package basic
+
+// 基于 HyperLogLog 的向量去重基数估计
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	minHLLPrecision = 4
+	maxHLLPrecision = 16
+)
+
+// VectorHLL 使用 HyperLogLog 近似统计不同向量的个数,只保存 2^precision 个寄存器
+type VectorHLL struct {
+	precision uint
+	registers []uint8
+}
+
+// NewVectorHLL
+//
+//	@Description: 创建 HyperLogLog 计数器,precision 越大误差越小(标准误差约 1.04/sqrt(2^precision)),
+//	precision 会被限制在 [4, 16] 之间
+//	@param precision 寄存器个数的以 2 为底的对数
+//	@return *VectorHLL
+func NewVectorHLL(precision int) *VectorHLL {
+	if precision < minHLLPrecision {
+		precision = minHLLPrecision
+	}
+	if precision > maxHLLPrecision {
+		precision = maxHLLPrecision
+	}
+	return &VectorHLL{
+		precision: uint(precision),
+		registers: make([]uint8, 1<<uint(precision)),
+	}
+}
+
+// Add
+//
+//	@Description: 添加一个向量。分量会先按 DefaultEpsilon 取整后再哈希,
+//	因此只相差浮点误差的向量被视为同一个向量,ID 不参与计算
+//	@receiver h
+//	@param vec
+func (h *VectorHLL) Add(vec Vector) {
+	hash := hashVectorValues(vec.Values)
+	index := hash >> (64 - h.precision)
+	// 剩余位中第一个 1 出现的位置,末尾补 1 防止全 0 时越界
+	rest := hash<<h.precision | 1<<(h.precision-1)
+	rank := uint8(bits.LeadingZeros64(rest)) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Count
+//
+//	@Description: 估计已添加的不同向量个数
+//	@receiver h
+//	@return uint64
+func (h *VectorHLL) Count() uint64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := hllAlpha(len(h.registers)) * m * m / sum
+	// 小基数时使用线性计数修正
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// hllAlpha HyperLogLog 的偏差修正常数
+func hllAlpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/float64(m))
+	}
+}
+
+// hashVectorValues
+//
+//	@Description: 对取整后的分量做 FNV-1a 哈希,再用 splitmix64 的混合函数打散各个比特
+//	@param values
+//	@return uint64
+func hashVectorValues(values []float64) uint64 {
+	hasher := fnv.New64a()
+	var buf [8]byte
+	for _, val := range values {
+		rounded := math.Round(val / DefaultEpsilon)
+		if rounded == 0 {
+			rounded = 0 // 统一 -0 与 +0
+		}
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(rounded))
+		hasher.Write(buf[:])
+	}
+	hash := hasher.Sum64()
+	hash ^= hash >> 30
+	hash *= 0xbf58476d1ce4e5b9
+	hash ^= hash >> 27
+	hash *= 0x94d049bb133111eb
+	hash ^= hash >> 31
+	return hash
+}
@@ -0,0 +1,226 @@
+package basic
+
+// 基于数据集协方差的马氏距离
+
+import (
+	"errors"
+	"math"
+)
+
+// mahalanobisRegularization 协方差矩阵对角线上加的正则项相对于平均方差的比例,保证矩阵可逆
+const mahalanobisRegularization = 1e-6
+
+// defaultMahalanobisRefreshInterval NewMahalanobis 默认的重新求逆间隔(Update 次数)
+const defaultMahalanobisRefreshInterval = 100
+
+// Mahalanobis 马氏距离 sqrt((a-b)^T Σ^-1 (a-b)),Σ 为数据集的协方差矩阵。
+// 相比欧几里得距离,它消除了各维度尺度不同以及维度之间相关性的影响。
+// 协方差可以通过 Update 随数据流增量更新;Update 与 Distance 不能并发调用
+type Mahalanobis struct {
+	InvCovariance [][]float64 // 正则化后的协方差矩阵的逆
+
+	// 增量更新所需的统计量,旧版本保存的模型中为空,此时不支持 Update
+	Count           int         // 已计入的向量数
+	Mean            []float64   // 已计入向量的均值
+	CoMoment        [][]float64 // 离差乘积之和 Σ(x-mean)(x-mean)^T,除以 Count-1 即为协方差
+	RefreshInterval int         // 每累计这么多次 Update 重新求一次逆,<= 1 时每次都重新求逆
+
+	pending int // 上次求逆之后的 Update 次数
+}
+
+// NewMahalanobis
+//
+//	@Description: 由数据集估计协方差矩阵,在对角线上加正则项后求逆,得到马氏距离
+//	@param vectors 数据集,至少两个维度一致的向量
+//	@return *Mahalanobis
+//	@return error 数据不足、维度不一致或协方差矩阵不可逆时返回错误
+func NewMahalanobis(vectors []Vector) (*Mahalanobis, error) {
+	if len(vectors) < 2 {
+		return nil, errors.New("at least two vectors are needed to estimate the covariance")
+	}
+	dim := len(vectors[0].Values)
+	if dim == 0 {
+		return nil, errors.New("vectors should not be empty")
+	}
+	for _, vec := range vectors {
+		if len(vec.Values) != dim {
+			return nil, errors.New("vectors should have the same dimension")
+		}
+	}
+
+	mean := Centroid(vectors).Values
+	coMoment := make([][]float64, dim)
+	for i := range coMoment {
+		coMoment[i] = make([]float64, dim)
+	}
+	for _, vec := range vectors {
+		for i := 0; i < dim; i++ {
+			di := vec.Values[i] - mean[i]
+			for j := i; j < dim; j++ {
+				coMoment[i][j] += di * (vec.Values[j] - mean[j])
+			}
+		}
+	}
+	for i := 0; i < dim; i++ {
+		for j := i + 1; j < dim; j++ {
+			coMoment[j][i] = coMoment[i][j]
+		}
+	}
+
+	m := &Mahalanobis{
+		Count:           len(vectors),
+		Mean:            mean,
+		CoMoment:        coMoment,
+		RefreshInterval: defaultMahalanobisRefreshInterval,
+	}
+	if err := m.Refresh(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Update
+//
+//	@Description: 用 Welford 算法把 vec 计入均值与协方差的估计,O(dim^2)。
+//	每累计 RefreshInterval 次更新才重新求逆(O(dim^3)),以摊薄求逆的开销,其间 Distance 使用上次求逆的结果。
+//	估计基于所有已计入的向量,新数据的影响随数据量增加而逐步体现
+//	@receiver m
+//	@param vec 新向量
+//	@return error 维度不一致、模型没有增量统计量或重新求逆失败时返回错误
+func (m *Mahalanobis) Update(vec Vector) error {
+	if m.Mean == nil {
+		return errors.New("the model has no statistics for incremental updates")
+	}
+	dim := len(m.Mean)
+	if len(vec.Values) != dim {
+		return errors.New("vector dimension does not match the model")
+	}
+
+	m.Count++
+	delta := make([]float64, dim)
+	for i := range delta {
+		delta[i] = vec.Values[i] - m.Mean[i]
+		m.Mean[i] += delta[i] / float64(m.Count)
+	}
+	// 离差乘积之和的增量为 (x - 旧均值)(x - 新均值)^T
+	for i := 0; i < dim; i++ {
+		for j := 0; j < dim; j++ {
+			m.CoMoment[i][j] += delta[i] * (vec.Values[j] - m.Mean[j])
+		}
+	}
+
+	m.pending++
+	if m.pending >= m.RefreshInterval {
+		return m.Refresh()
+	}
+	return nil
+}
+
+// Refresh
+//
+//	@Description: 由当前的统计量重新计算协方差矩阵,在对角线上加正则项后求逆
+//	@receiver m
+//	@return error 模型没有增量统计量或协方差矩阵不可逆时返回错误
+func (m *Mahalanobis) Refresh() error {
+	if m.Mean == nil || m.Count < 2 {
+		return errors.New("the model has no statistics for incremental updates")
+	}
+	dim := len(m.Mean)
+	cov := make([][]float64, dim)
+	trace := 0.0
+	for i := range cov {
+		cov[i] = make([]float64, dim)
+		for j := range cov[i] {
+			cov[i][j] = m.CoMoment[i][j] / float64(m.Count-1)
+		}
+		trace += cov[i][i]
+	}
+
+	// 正则项与数据尺度成比例;所有维度方差都为 0 时退化为单位矩阵附近
+	lambda := mahalanobisRegularization * trace / float64(dim)
+	if lambda == 0 {
+		lambda = mahalanobisRegularization
+	}
+	for i := 0; i < dim; i++ {
+		cov[i][i] += lambda
+	}
+
+	inv, err := invertMatrix(cov)
+	if err != nil {
+		return err
+	}
+	m.InvCovariance = inv
+	m.pending = 0
+	return nil
+}
+
+// Distance
+//
+//	@Description: 计算两个向量之间的马氏距离
+//	@receiver m
+//	@param a 向量 a
+//	@param b 向量 b
+//	@return float64 距离
+func (m *Mahalanobis) Distance(a, b Vector) float64 {
+	dim := len(m.InvCovariance)
+	diff := make([]float64, dim)
+	for i := 0; i < dim; i++ {
+		diff[i] = a.Values[i] - b.Values[i]
+	}
+	sum := 0.0
+	for i := 0; i < dim; i++ {
+		sum += diff[i] * Dot(m.InvCovariance[i], diff)
+	}
+	// 浮点误差可能使结果略小于 0
+	return math.Sqrt(math.Max(sum, 0))
+}
+
+// invertMatrix
+//
+//	@Description: 使用带部分主元选择的 Gauss-Jordan 消元求方阵的逆,不修改输入
+//	@param matrix 方阵
+//	@return [][]float64 逆矩阵
+//	@return error 矩阵奇异时返回错误
+func invertMatrix(matrix [][]float64) ([][]float64, error) {
+	n := len(matrix)
+	// 增广矩阵 [A | I]
+	aug := make([][]float64, n)
+	for i := range aug {
+		aug[i] = make([]float64, 2*n)
+		copy(aug[i], matrix[i])
+		aug[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(aug[row][col]) > math.Abs(aug[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(aug[pivot][col]) < 1e-12 {
+			return nil, errors.New("matrix is singular")
+		}
+		aug[col], aug[pivot] = aug[pivot], aug[col]
+
+		scale := aug[col][col]
+		for j := range aug[col] {
+			aug[col][j] /= scale
+		}
+		for row := 0; row < n; row++ {
+			if row == col || aug[row][col] == 0 {
+				continue
+			}
+			factor := aug[row][col]
+			for j := range aug[row] {
+				aug[row][j] -= factor * aug[col][j]
+			}
+		}
+	}
+
+	inv := make([][]float64, n)
+	for i := range inv {
+		inv[i] = aug[i][n:]
+	}
+	return inv, nil
+}
@@ -0,0 +1,109 @@
+package basic
+
+import "math"
+
+// DistanceFunc 自定义距离函数,距离越小越相似
+type DistanceFunc func(a, b []float64) float64
+
+// Metric 距离度量类型
+type Metric int
+
+const (
+	// Euclidean 欧几里得距离
+	Euclidean Metric = iota
+	// Cosine 余弦距离,即 1 - 余弦相似度
+	Cosine
+	// InnerProduct 内积距离,即内积的相反数,内积越大距离越小
+	InnerProduct
+	// Manhattan 曼哈顿距离(L1 距离)
+	Manhattan
+)
+
+// Distance
+//
+//	@Description: 按度量类型计算两个数组之间的距离,距离越小越相似
+//	@receiver m 度量类型
+//	@param a 数组a
+//	@param b 数组b
+//	@return float64 距离
+func (m Metric) Distance(a, b []float64) float64 {
+	switch m {
+	case Cosine:
+		return CosineDistance(a, b)
+	case InnerProduct:
+		return -Dot(a, b)
+	case Manhattan:
+		return ManhattanDistance(a, b)
+	default:
+		return EuclidDistance(a, b)
+	}
+}
+
+// DistanceVec
+//
+//	@Description: 按度量类型计算两个向量之间的距离
+//	@receiver m 度量类型
+//	@param a 向量 a
+//	@param b 向量 b
+//	@return float64 距离
+func (m Metric) DistanceVec(a, b Vector) float64 {
+	return m.Distance(a.Values, b.Values)
+}
+
+func (m Metric) String() string {
+	switch m {
+	case Euclidean:
+		return "euclidean"
+	case Cosine:
+		return "cosine"
+	case InnerProduct:
+		return "inner_product"
+	case Manhattan:
+		return "manhattan"
+	default:
+		return "unknown"
+	}
+}
+
+// Dot
+//
+//	@Description: 计算两个数组的内积
+//	@param a 数组a
+//	@param b 数组b
+//	@return float64 内积
+func Dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := 0; i < len(a); i++ {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// CosineDistance
+//
+//	@Description: 计算两个数组之间的余弦距离 1 - cos(a, b),任一数组为零向量时返回 1
+//	@param a 数组a
+//	@param b 数组b
+//	@return float64 余弦距离
+func CosineDistance(a, b []float64) float64 {
+	normA := math.Sqrt(Dot(a, a))
+	normB := math.Sqrt(Dot(b, b))
+	if normA == 0 || normB == 0 {
+		return 1
+	}
+	return 1 - Dot(a, b)/(normA*normB)
+}
+
+// ManhattanDistance
+//
+//	@Description: 计算两个数组之间的曼哈顿距离,即各分量差的绝对值之和
+//	@param a 数组a
+//	@param b 数组b
+//	@return float64 曼哈顿距离
+func ManhattanDistance(a, b []float64) float64 {
+	sum := 0.0
+	for i := 0; i < len(a); i++ {
+		sum += math.Abs(a[i] - b[i])
+	}
+	return sum
+}
@@ -30,6 +30,147 @@ func EuclidDistanceVec(a, b Vector) float64 {
 	return EuclidDistance(a.Values, b.Values)
 }
 
+// Normalize
+//
+//	@Description: 对向量做 L2 归一化,返回新的向量,零向量原样返回
+//	@param vec 待归一化向量
+//	@return Vector 归一化后的向量
+func Normalize(vec Vector) Vector {
+	norm := 0.0
+	for _, val := range vec.Values {
+		norm += val * val
+	}
+	norm = math.Sqrt(norm)
+	values := make([]float64, len(vec.Values))
+	if norm == 0 {
+		copy(values, vec.Values)
+		return Vector{ID: vec.ID, Values: values}
+	}
+	for i, val := range vec.Values {
+		values[i] = val / norm
+	}
+	return Vector{ID: vec.ID, Values: values}
+}
+
+// Centroid
+//
+//	@Description: 计算一组向量的算术平均中心
+//	@param vectors 向量集合
+//	@return Vector 平均中心,集合为空时返回空向量
+func Centroid(vectors []Vector) Vector {
+	if len(vectors) == 0 {
+		return Vector{}
+	}
+	values := make([]float64, len(vectors[0].Values))
+	for _, vec := range vectors {
+		for i, val := range vec.Values {
+			values[i] += val
+		}
+	}
+	for i := range values {
+		values[i] /= float64(len(vectors))
+	}
+	return Vector{Values: values}
+}
+
+// GeometricMedian
+//
+//	@Description: 使用 Weiszfeld 算法迭代计算一组向量的几何中位数(到各点距离之和最小的点),
+//	相比算术平均对离群点更鲁棒。以算术平均为初始值,两次迭代间的位移小于 tol 或达到 maxIter 时停止
+//	@param vectors 向量集合
+//	@param maxIter 最大迭代次数
+//	@param tol 收敛阈值
+//	@return Vector 几何中位数
+func GeometricMedian(vectors []Vector, maxIter int, tol float64) Vector {
+	median := Centroid(vectors)
+	if len(vectors) == 0 {
+		return median
+	}
+	dim := len(median.Values)
+	for iter := 0; iter < maxIter; iter++ {
+		next := make([]float64, dim)
+		weightSum := 0.0
+		for _, vec := range vectors {
+			dist := EuclidDistance(median.Values, vec.Values)
+			// 当前估计恰好落在某个样本点上时跳过该点,避免除零
+			if dist < DefaultEpsilon {
+				continue
+			}
+			weight := 1 / dist
+			for i, val := range vec.Values {
+				next[i] += val * weight
+			}
+			weightSum += weight
+		}
+		if weightSum == 0 {
+			break
+		}
+		for i := range next {
+			next[i] /= weightSum
+		}
+		shift := EuclidDistance(median.Values, next)
+		median.Values = next
+		if shift < tol {
+			break
+		}
+	}
+	return median
+}
+
+// DiversityScore
+//
+//	@Description: 计算结果集中两两向量之间欧几里得距离的平均值,值越大说明结果越分散,
+//	可用于衡量 MMR 等多样性检索的效果。少于两个向量时返回 0
+//	@param vectors 结果集
+//	@return float64 平均两两距离
+func DiversityScore(vectors []Vector) float64 {
+	if len(vectors) < 2 {
+		return 0
+	}
+	sum := 0.0
+	for i := 0; i < len(vectors); i++ {
+		for j := i + 1; j < len(vectors); j++ {
+			sum += EuclidDistanceVec(vectors[i], vectors[j])
+		}
+	}
+	pairs := len(vectors) * (len(vectors) - 1) / 2
+	return sum / float64(pairs)
+}
+
+// ApproxDiameter
+//
+//	@Description: 用迭代最远点启发式估计数据集的直径(两两距离的最大值):从随机一点出发,
+//	每轮跳到离当前点最远的点,返回过程中见到的最大距离。复杂度 O(n·iterations),
+//	结果是直径的下界,且不小于直径的一半
+//	@param vectors 数据集
+//	@param iterations 跳转轮数,至少为 1
+//	@return float64 估计的直径,少于两个向量时返回 0
+func ApproxDiameter(vectors []Vector, iterations int) float64 {
+	if len(vectors) < 2 {
+		return 0
+	}
+	if iterations < 1 {
+		iterations = 1
+	}
+	current := rand.Intn(len(vectors))
+	diameter := 0.0
+	for i := 0; i < iterations; i++ {
+		farthest, maxDist := current, 0.0
+		for j, vec := range vectors {
+			if d := EuclidDistanceVec(vectors[current], vec); d > maxDist {
+				farthest, maxDist = j, d
+			}
+		}
+		if maxDist <= diameter {
+			// 没有找到更远的点,继续跳转只会在同一对点之间往返
+			break
+		}
+		diameter = maxDist
+		current = farthest
+	}
+	return diameter
+}
+
 // GenerateRandomVector
 //
 //	@Description: 生成随机 Vector
@@ -13,21 +13,33 @@ type Vector struct {
 
 type VectorSet map[string]struct{}
 
-const epsilon = 1e-9
+// DefaultEpsilon Equals 判断分量相等时使用的默认容差
+const DefaultEpsilon = 1e-9
 
 func (v Vector) Equals(other Vector) bool {
+	return v.EqualsWithin(other, DefaultEpsilon)
+}
+
+// EqualsWithin
+//
+//	@Description: 在给定容差下判断两个向量是否相等,每个分量之差的绝对值都小于 epsilon 时视为相等
+//	@receiver v
+//	@param other
+//	@param epsilon 分量容差
+//	@return bool
+func (v Vector) EqualsWithin(other Vector, epsilon float64) bool {
 	if len(v.Values) != len(other.Values) {
 		return false
 	}
 	for i, val := range v.Values {
-		if !floatEquals(val, other.Values[i]) {
+		if !floatEquals(val, other.Values[i], epsilon) {
 			return false
 		}
 	}
 	return true
 }
 
-func floatEquals(a, b float64) bool {
+func floatEquals(a, b, epsilon float64) bool {
 	return math.Abs(a-b) < epsilon
 }
 
@@ -59,6 +71,42 @@ func TwoVectorArrIntersectionRatio(vectors1, vectors2 []Vector, includeId bool)
 	return float64(intersectionCount) / float64(totalUniqueVectors)
 }
 
+// ResultOverlap
+//
+//	@Description: 按 ID 计算两个查询结果集的 Jaccard 相似度及公共 ID
+//	@param a 结果集 a
+//	@param b 结果集 b
+//	@return jaccard 按 ID 计算的 Jaccard 相似度
+//	@return common 两个结果集共有的 ID,按其在 a 中出现的顺序排列
+func ResultOverlap(a, b []Vector) (jaccard float64, common []int64) {
+	idsA := make(map[int64]struct{}, len(a))
+	for _, v := range a {
+		idsA[v.ID] = struct{}{}
+	}
+	idsB := make(map[int64]struct{}, len(b))
+	for _, v := range b {
+		idsB[v.ID] = struct{}{}
+	}
+
+	common = make([]int64, 0)
+	seen := make(map[int64]struct{}, len(a))
+	for _, v := range a {
+		if _, found := seen[v.ID]; found {
+			continue
+		}
+		seen[v.ID] = struct{}{}
+		if _, found := idsB[v.ID]; found {
+			common = append(common, v.ID)
+		}
+	}
+
+	union := len(idsA) + len(idsB) - len(common)
+	if union == 0 {
+		return 0.0, common
+	}
+	return float64(len(common)) / float64(union), common
+}
+
 func (v Vector) String(includeId bool) string {
 	stringValues := make([]string, len(v.Values))
 	for i, value := range v.Values {
@@ -107,3 +155,67 @@ func (pq *PriorityQueue) Pop() interface{} {
 	*pq = old[0 : n-1]
 	return item
 }
+
+// SearchResult 检索结果:向量及其到查询向量的距离,是各索引之间传递带距离结果的公共类型
+type SearchResult struct {
+	Vector   Vector
+	Distance float64
+}
+
+// VectorDistPair 向量及其(估计)距离,PQ 的最大堆元素
+type VectorDistPair struct {
+	Vector Vector
+	Dist   float64
+}
+
+// ItemsToVectors
+//
+//	@Description: 按原顺序取出优先队列元素中的向量
+//	@param items
+//	@return []Vector
+func ItemsToVectors(items []*Item) []Vector {
+	vectors := make([]Vector, len(items))
+	for i, item := range items {
+		vectors[i] = item.Value
+	}
+	return vectors
+}
+
+// ItemsToResults
+//
+//	@Description: 按原顺序把优先队列元素转换为 SearchResult
+//	@param items
+//	@return []SearchResult
+func ItemsToResults(items []*Item) []SearchResult {
+	results := make([]SearchResult, len(items))
+	for i, item := range items {
+		results[i] = SearchResult{Vector: item.Value, Distance: item.Distance}
+	}
+	return results
+}
+
+// VectorDistPairsToResults
+//
+//	@Description: 按原顺序把 VectorDistPair 转换为 SearchResult
+//	@param pairs
+//	@return []SearchResult
+func VectorDistPairsToResults(pairs []VectorDistPair) []SearchResult {
+	results := make([]SearchResult, len(pairs))
+	for i, pair := range pairs {
+		results[i] = SearchResult{Vector: pair.Vector, Distance: pair.Dist}
+	}
+	return results
+}
+
+// ResultsToVectors
+//
+//	@Description: 按原顺序取出 SearchResult 中的向量
+//	@param results
+//	@return []Vector
+func ResultsToVectors(results []SearchResult) []Vector {
+	vectors := make([]Vector, len(results))
+	for i, res := range results {
+		vectors[i] = res.Vector
+	}
+	return vectors
+}
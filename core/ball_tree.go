@@ -4,8 +4,10 @@ import (
 	"container/heap"
 	"encoding/gob"
 	"errors"
-	"hh_vectordb/basic"
+	"io"
+	"math"
 	"os"
+	"time"
 )
 
 type VectorDistance struct {
@@ -38,13 +40,31 @@ type BallTree struct {
 	Right   *BallTree
 	IsLeaf  bool
 	Payload Vector
+
+	distFunc DistanceFunc // metric set by WithMetric and shared by every node, nil means Euclidean
+}
+
+// NewBallTree builds a ball tree over vectors. The BallTree does not support WithNormalize and
+// ignores it; use NewBallTreeChecked to get an error instead.
+func NewBallTree(vectors []Vector, opts ...Option) *BallTree {
+	return buildBallTree(vectors, newIndexOptions(opts).distance)
+}
+
+// NewBallTreeChecked is NewBallTree, but returns an error when given WithNormalize.
+func NewBallTreeChecked(vectors []Vector, opts ...Option) (*BallTree, error) {
+	o := newIndexOptions(opts)
+	if err := checkNormalizeUnsupported(o); err != nil {
+		return nil, err
+	}
+	return buildBallTree(vectors, o.distance), nil
 }
 
-func NewBallTree(vectors []Vector) *BallTree {
+func buildBallTree(vectors []Vector, distFunc DistanceFunc) *BallTree {
 	if len(vectors) == 0 || vectors == nil {
 		return &BallTree{
-			IsLeaf:  true,
-			Payload: Vector{},
+			IsLeaf:   true,
+			Payload:  Vector{},
+			distFunc: distFunc,
 		}
 	}
 
@@ -54,12 +74,13 @@ func NewBallTree(vectors []Vector) *BallTree {
 			payload = vectors[0]
 		}
 		return &BallTree{
-			IsLeaf:  true,
-			Payload: payload,
+			IsLeaf:   true,
+			Payload:  payload,
+			distFunc: distFunc,
 		}
 	}
 
-	center, radius := computeBoundingSphere(vectors)
+	center, radius := computeBoundingSphere(vectors, distFunc)
 	left, right := splitV1(vectors)
 
 	// Check if split is working correctly
@@ -68,14 +89,32 @@ func NewBallTree(vectors []Vector) *BallTree {
 	}
 
 	return &BallTree{
-		Center: center,
-		Radius: radius,
-		Left:   NewBallTree(left),
-		Right:  NewBallTree(right),
+		Center:   center,
+		Radius:   radius,
+		Left:     buildBallTree(left, distFunc),
+		Right:    buildBallTree(right, distFunc),
+		distFunc: distFunc,
 	}
 }
 
-func computeBoundingSphere(vectors []Vector) (Vector, float64) {
+// dist measures the distance between a and b with the tree's metric.
+func (tree *BallTree) dist(a, b Vector) float64 {
+	return measure(tree.distFunc, a, b)
+}
+
+// setDistFunc assigns distFunc to every node of the tree.
+func (tree *BallTree) setDistFunc(distFunc DistanceFunc) {
+	if tree == nil {
+		return
+	}
+	tree.distFunc = distFunc
+	tree.Left.setDistFunc(distFunc)
+	tree.Right.setDistFunc(distFunc)
+}
+
+// computeBoundingSphere returns the centroid of vectors and the largest distance from it,
+// so the sphere contains every vector under any metric.
+func computeBoundingSphere(vectors []Vector, distFunc DistanceFunc) (Vector, float64) {
 	if len(vectors) == 0 {
 		return Vector{}, 0.0 // Return a default vector and radius of 0
 	}
@@ -96,7 +135,7 @@ func computeBoundingSphere(vectors []Vector) (Vector, float64) {
 
 	maxDist := 0.0
 	for _, v := range vectors {
-		dist := basic.EuclidDistanceVec(center, v)
+		dist := measure(distFunc, center, v)
 		if dist > maxDist {
 			maxDist = dist
 		}
@@ -148,8 +187,8 @@ func (tree *BallTree) Insert(vec Vector) error {
 		}
 
 		tree.IsLeaf = false
-		tree.Left = NewBallTree(nil)
-		tree.Right = NewBallTree(nil)
+		tree.Left = buildBallTree(nil, tree.distFunc)
+		tree.Right = buildBallTree(nil, tree.distFunc)
 
 		err := tree.Left.Insert(left[0])
 		if err != nil {
@@ -158,44 +197,76 @@ func (tree *BallTree) Insert(vec Vector) error {
 		return tree.Right.Insert(right[0])
 	}
 
-	if basic.EuclidDistanceVec(tree.Center, vec) <= tree.Radius {
+	if tree.dist(tree.Center, vec) <= tree.Radius {
 		if tree.Left == nil {
-			tree.Left = NewBallTree(nil)
+			tree.Left = buildBallTree(nil, tree.distFunc)
 		}
 		return tree.Left.Insert(vec)
 	} else {
 		if tree.Right == nil {
-			tree.Right = NewBallTree(nil)
+			tree.Right = buildBallTree(nil, tree.distFunc)
 		}
 		return tree.Right.Insert(vec)
 	}
 }
 
 func (tree *BallTree) Nearest(query Vector) (Vector, error) {
-	if tree.IsLeaf {
+	if tree.IsLeaf || tree.isEmpty() {
 		return tree.Payload, nil
 	}
 
-	distToLeft := basic.EuclidDistanceVec(tree.Left.Center, query) - tree.Left.Radius
-	distToRight := basic.EuclidDistanceVec(tree.Right.Center, query) - tree.Right.Radius
+	distToLeft := tree.childBound(tree.Left, query)
+	distToRight := tree.childBound(tree.Right, query)
 
 	if distToLeft < distToRight {
 		closest, _ := tree.Left.Nearest(query)
 		other, _ := tree.Right.Nearest(query)
-
-		if basic.EuclidDistanceVec(query, closest) < basic.EuclidDistanceVec(query, other) {
-			return closest, nil
-		}
-		return other, nil
+		return tree.closer(query, closest, other), nil
 	}
 
 	closest, _ := tree.Right.Nearest(query)
 	other, _ := tree.Left.Nearest(query)
+	return tree.closer(query, closest, other), nil
+}
 
-	if basic.EuclidDistanceVec(query, closest) < basic.EuclidDistanceVec(query, other) {
-		return closest, nil
+// closer returns whichever of a and b is nearer to query, skipping the empty payload of a deleted leaf.
+func (tree *BallTree) closer(query, a, b Vector) Vector {
+	if b.Values == nil {
+		return a
+	}
+	if a.Values == nil || tree.dist(query, b) <= tree.dist(query, a) {
+		return b
 	}
-	return other, nil
+	return a
+}
+
+// isEmpty reports whether the node holds no vector: an unfilled leaf, or a leaf emptied by Delete.
+func (tree *BallTree) isEmpty() bool {
+	if tree.IsLeaf {
+		return tree.Payload.Values == nil
+	}
+	return tree.Left == nil && tree.Right == nil
+}
+
+// childBound returns a lower bound on the distance from query to any vector under child. Leaves carry
+// no bounding sphere, so their bound is the exact distance to the payload, and empty nodes get +Inf.
+func (tree *BallTree) childBound(child *BallTree, query Vector) float64 {
+	switch {
+	case child == nil || child.isEmpty():
+		return math.Inf(1)
+	case child.IsLeaf:
+		return tree.dist(query, child.Payload)
+	default:
+		return tree.dist(child.Center, query) - child.Radius
+	}
+}
+
+func (tree *BallTree) NearestExcludingSelf(query Vector) (Vector, error) {
+	vectors, err := tree.Vectors()
+	if err != nil {
+		return Vector{}, err
+	}
+	return nearestExcludingSelf(tree, query, len(vectors))
 }
 
 func (tree *BallTree) Vectors() ([]Vector, error) {
@@ -229,13 +300,23 @@ func (tree *BallTree) Vectors() ([]Vector, error) {
 }
 
 func (tree *BallTree) Delete(vec Vector) error {
+	return tree.deleteMatching(vec, Vector.Equals)
+}
+
+// deleteExact deletes the payload with both the ID and the values of vec, leaving duplicates of its
+// values under other IDs in place.
+func (tree *BallTree) deleteExact(vec Vector) error {
+	return tree.deleteMatching(vec, sameVector)
+}
+
+func (tree *BallTree) deleteMatching(vec Vector, match func(a, b Vector) bool) error {
 	if tree == nil {
 		return errors.New("tree is nil")
 	}
 
 	// Check if we're at a leaf node.
 	if tree.IsLeaf {
-		if tree.Payload.Equals(vec) {
+		if match(tree.Payload, vec) {
 			// This is the vector to delete.
 			tree.Payload = Vector{} // Reset the payload.
 			tree.IsLeaf = false     // Mark the tree as non-leaf, making it effectively empty.
@@ -245,13 +326,13 @@ func (tree *BallTree) Delete(vec Vector) error {
 	}
 
 	// Try to delete from the left subtree.
-	err := tree.Left.Delete(vec)
+	err := tree.Left.deleteMatching(vec, match)
 	if err == nil {
 		return nil // If to delete was successful in the left tree, return.
 	}
 
 	// If not found in left subtree, try the right subtree.
-	err = tree.Right.Delete(vec)
+	err = tree.Right.deleteMatching(vec, match)
 	if err == nil {
 		return nil // If to delete was successful in the right tree, return.
 	}
@@ -260,14 +341,25 @@ func (tree *BallTree) Delete(vec Vector) error {
 	return errors.New("vector not found")
 }
 
+// DeleteAndReturn deletes the vector with the given ID and returns the removed payload.
+func (tree *BallTree) DeleteAndReturn(id int64) (Vector, error) {
+	return deleteAndReturn(tree, id)
+}
+
 func (tree *BallTree) KNearest(query Vector, k int) ([]Vector, error) {
+	return tree.KNearestWithStats(query, k, nil)
+}
+
+// KNearestWithStats is KNearest that also adds the visited nodes and distance computations to stats.
+// A nil stats disables the accounting.
+func (tree *BallTree) KNearestWithStats(query Vector, k int, stats *SearchStats) ([]Vector, error) {
 	if k <= 0 {
 		return nil, errors.New("k should be greater than 0")
 	}
 
 	h := &DistanceHeap{}
 	heap.Init(h)
-	tree.kNearestRecursive(query, k, h)
+	tree.kNearestRecursive(query, k, h, stats)
 
 	vectors := make([]Vector, 0, k)
 	for h.Len() > 0 {
@@ -282,9 +374,79 @@ func (tree *BallTree) KNearest(query Vector, k int) ([]Vector, error) {
 	return vectors, nil
 }
 
-func (tree *BallTree) kNearestRecursive(query Vector, k int, h *DistanceHeap) {
+// VerifiedNearest is a debugging aid: it checks the BallTree's 1-nearest answer against a brute-force scan
+// and falls back to the scanned answer when they disagree. The bool reports whether they matched.
+func (tree *BallTree) VerifiedNearest(query Vector) (Vector, bool, error) {
+	return verifiedNearest(tree, query, tree.dist)
+}
+
+// SelfRank queries with the stored vector for id and returns the 0-based rank of id in the top-k,
+// or -1 if it is outside the top-k. It measures the self-recall of an index in leave-one-out tests.
+func (tree *BallTree) SelfRank(id int64, k int) (int, error) {
+	return selfRank(tree, id, k)
+}
+
+// KNearestReversed returns the same top-k as KNearest, ordered from farthest to nearest.
+func (tree *BallTree) KNearestReversed(query Vector, k int) ([]Vector, error) {
+	return kNearestReversed(tree, query, k)
+}
+
+// KNearestWithinBudget is a best-first k-nearest search over the ball hierarchy that returns the
+// best results found so far once the time budget is spent.
+func (tree *BallTree) KNearestWithinBudget(query Vector, k int, budget time.Duration) ([]Vector, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
+	}
+	if budget <= 0 {
+		return nil, errors.New("budget should be greater than 0")
+	}
+	start := time.Now()
+
+	pq := make(PriorityQueue, 0, k)
+	frontier := &frontierQueue{}
+	heap.Push(frontier, frontierItem{node: tree, bound: 0})
+	for visited := 0; frontier.Len() > 0; visited++ {
+		if visited%budgetCheckInterval == 0 && pq.Len() > 0 && time.Since(start) > budget {
+			break
+		}
+		item := heap.Pop(frontier).(frontierItem)
+		if pq.Len() == k && item.bound >= pq[0].Distance {
+			break
+		}
+		node := item.node.(*BallTree)
+		if node.IsLeaf {
+			if node.Payload.Values != nil {
+				pushCandidate(&pq, node.Payload, tree.dist(query, node.Payload), k)
+			}
+			continue
+		}
+		for _, child := range []*BallTree{node.Left, node.Right} {
+			if child == nil {
+				continue
+			}
+			// Leaves carry no bounding sphere, their bound is the exact distance to the payload.
+			var bound float64
+			if child.IsLeaf {
+				if child.Payload.Values == nil {
+					continue
+				}
+				bound = tree.dist(query, child.Payload)
+			} else {
+				bound = math.Max(item.bound, tree.dist(query, child.Center)-child.Radius)
+			}
+			heap.Push(frontier, frontierItem{node: child, bound: bound})
+		}
+	}
+	return drainAscending(&pq), nil
+}
+
+func (tree *BallTree) kNearestRecursive(query Vector, k int, h *DistanceHeap, stats *SearchStats) {
+	if tree.isEmpty() {
+		return
+	}
 	if tree.IsLeaf {
-		dist := basic.EuclidDistanceVec(tree.Payload, query)
+		stats.visit(1)
+		dist := tree.dist(tree.Payload, query)
 		if h.Len() < k || dist < (*h)[0].dist {
 			heap.Push(h, VectorDistance{tree.Payload, dist})
 		}
@@ -294,21 +456,36 @@ func (tree *BallTree) kNearestRecursive(query Vector, k int, h *DistanceHeap) {
 		return
 	}
 
-	distToLeft := basic.EuclidDistanceVec(tree.Left.Center, query) - tree.Left.Radius
-	distToRight := basic.EuclidDistanceVec(tree.Right.Center, query) - tree.Right.Radius
+	stats.visit(2)
+	distToLeft := tree.childBound(tree.Left, query)
+	distToRight := tree.childBound(tree.Right, query)
 
 	// Recur to the closer child first
-	if distToLeft < distToRight {
-		tree.Left.kNearestRecursive(query, k, h)
-		if h.Len() < k || distToRight < (*h)[0].dist {
-			tree.Right.kNearestRecursive(query, k, h)
-		}
-	} else {
-		tree.Right.kNearestRecursive(query, k, h)
-		if h.Len() < k || distToLeft < (*h)[0].dist {
-			tree.Left.kNearestRecursive(query, k, h)
-		}
+	near, far, farBound := tree.Left, tree.Right, distToRight
+	if distToLeft >= distToRight {
+		near, far, farBound = tree.Right, tree.Left, distToLeft
+	}
+	near.kNearestRecursive(query, k, h, stats)
+	kth := math.Inf(1)
+	if h.Len() >= k {
+		kth = (*h)[0].dist
+	}
+	visitFar := farBound < kth
+	stats.decide(tree.Center, farBound, kth, !visitFar)
+	if visitFar {
+		far.kNearestRecursive(query, k, h, stats)
+	}
+}
+
+// KNearestExplainPruning is KNearest that also returns, for every internal node visited, whether
+// the farther child was pruned and the bounds that decided it.
+func (tree *BallTree) KNearestExplainPruning(query Vector, k int) ([]Vector, []PruneDecision, error) {
+	stats := &SearchStats{RecordPruning: true}
+	results, err := tree.KNearestWithStats(query, k, stats)
+	if err != nil {
+		return nil, nil, err
 	}
+	return results, stats.PruneDecisions, nil
 }
 
 func splitV2(vectors []Vector) ([]Vector, []Vector) {
@@ -405,6 +582,10 @@ func (tree *BallTree) InsertBatch(vectors []Vector) error {
 	return nil
 }
 
+func (tree *BallTree) InsertPaged(fetch func(offset, limit int) ([]Vector, error), pageSize int) error {
+	return insertPaged(fetch, pageSize, tree.InsertBatch)
+}
+
 func (tree *BallTree) DeleteBatch(vectors []Vector) error {
 	for _, v := range vectors {
 		if err := tree.Delete(v); err != nil {
@@ -419,13 +600,18 @@ func (tree *BallTree) SearchWithinRange(query Vector, radius float64) ([]Vector,
 	return tree.searchInRangeRecursive(query, radius)
 }
 
+// SearchWithinAnnulus returns the vectors whose distance to the query lies in [minRadius, maxRadius].
+func (tree *BallTree) SearchWithinAnnulus(query Vector, minRadius, maxRadius float64) ([]Vector, error) {
+	return searchWithinAnnulus(tree, query, minRadius, maxRadius, tree.dist)
+}
+
 func (tree *BallTree) searchInRangeRecursive(query Vector, radius float64) ([]Vector, error) {
 	if tree == nil {
 		return nil, nil
 	}
 
 	if tree.IsLeaf {
-		if basic.EuclidDistanceVec(tree.Payload, query) <= radius {
+		if tree.dist(tree.Payload, query) <= radius {
 			return []Vector{tree.Payload}, nil
 		}
 		return nil, nil
@@ -443,6 +629,47 @@ func (tree *BallTree) searchInRangeRecursive(query Vector, radius float64) ([]Ve
 	return vectors, nil
 }
 
+// Describe returns the number of vectors, their dimension (0 when empty) and the type name "ball_tree",
+// counted by walking the tree.
+func (tree *BallTree) Describe() (count int, dim int, indexType string, err error) {
+	return describe(tree, "ball_tree")
+}
+
+// Config reports the construction parameters. The BallTree is only configured by its metric.
+func (tree *BallTree) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"metric": metricName(tree.distFunc),
+	}
+}
+
+// Save writes the BallTree to w.
+func (tree *BallTree) Save(w io.Writer) error {
+	encoder := gob.NewEncoder(w)
+	return encoder.Encode(tree)
+}
+
+// Load reads a BallTree written by Save from r. The metric is not persisted,
+// the loaded nodes keep using the receiver's metric.
+func (tree *BallTree) Load(r io.Reader) error {
+	distFunc := tree.distFunc
+	decoder := gob.NewDecoder(r)
+	if err := decoder.Decode(tree); err != nil {
+		return err
+	}
+	tree.setDistFunc(distFunc)
+	return nil
+}
+
+// SaveToFileCompressed saves the BallTree to a gzip-compressed file.
+func (tree *BallTree) SaveToFileCompressed(filename string) error {
+	return saveCompressed(filename, tree.Save)
+}
+
+// LoadFromFileCompressed loads the BallTree from a file written by SaveToFileCompressed.
+func (tree *BallTree) LoadFromFileCompressed(filename string) error {
+	return loadCompressed(filename, tree.Load)
+}
+
 // SaveToFile saves the BallTree to a file.
 func (tree *BallTree) SaveToFile(filename string) error {
 	file, err := os.Create(filename)
@@ -451,8 +678,7 @@ func (tree *BallTree) SaveToFile(filename string) error {
 	}
 	defer file.Close()
 
-	encoder := gob.NewEncoder(file)
-	return encoder.Encode(tree)
+	return tree.Save(file)
 }
 
 // LoadFromFile loads the BallTree from a file.
@@ -463,6 +689,5 @@ func (tree *BallTree) LoadFromFile(filename string) error {
 	}
 	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	return decoder.Decode(tree)
+	return tree.Load(file)
 }
@@ -0,0 +1,243 @@
+package core
+
+// 索引评估与基准测试相关的工具函数
+
+import (
+	"errors"
+	"hh_vectordb/basic"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// MeasureBuildMemory
+//
+//	@Description: 测量构建索引后常驻堆内存的增量。构建前后都会触发 GC,
+//	因此结果是索引本身占用的内存,不包含构建过程中已被回收的临时对象
+//	@param build 构建索引的函数
+//	@return buildBytes 索引占用的堆内存字节数
+//	@return err build 返回 nil 时返回错误
+func MeasureBuildMemory(build func() NearestNeighborSearch) (buildBytes int64, err error) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	index := build()
+	if index == nil {
+		return 0, errors.New("build returned a nil index")
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(index)
+
+	return int64(after.HeapAlloc) - int64(before.HeapAlloc), nil
+}
+
+// MeasureQueryMemory
+//
+//	@Description: 测量对一批查询执行 KNearest 期间分配的堆内存总量
+//	@param index 待测索引
+//	@param queries 查询向量
+//	@param k top-k
+//	@return queryBytes 查询期间累计分配的字节数
+//	@return err
+func MeasureQueryMemory(index NearestNeighborSearch, queries []Vector, k int) (queryBytes int64, err error) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for _, query := range queries {
+		if _, err := index.KNearest(query, k); err != nil {
+			return 0, err
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+	return int64(after.TotalAlloc - before.TotalAlloc), nil
+}
+
+// ExactKNNParallel
+//
+//	@Description: 并发计算一批查询的精确 k-近邻,用作召回率测试的真值。
+//	按 CPU 核数启动 worker,每个 worker 对分到的查询做一次完整的暴力扫描,
+//	结果与 BruteForceSearch.KNearest 一致(距离相同时按 ID 升序)
+//	@param data 数据集
+//	@param queries 查询向量
+//	@param k top-k
+//	@return [][]Vector 与 queries 一一对应的精确 k-近邻
+func ExactKNNParallel(data, queries []Vector, k int) [][]Vector {
+	return exactKNNParallel(data, queries, k, basic.EuclidDistanceVec)
+}
+
+// exactKNNParallel 与 ExactKNNParallel 相同,但按给定的距离函数计算真值
+func exactKNNParallel(data, queries []Vector, k int, distance func(a, b Vector) float64) [][]Vector {
+	results := make([][]Vector, len(queries))
+	numWorkers := runtime.NumCPU()
+	if numWorkers > len(queries) {
+		numWorkers = len(queries)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = topKByFunc(queries[i], data, k, distance)
+			}
+		}()
+	}
+	for i := range queries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// RecallCurve
+//
+//	@Description: 一次性计算多个 k 下的平均召回率。每个查询只以 max(ks) 查询一次,
+//	recall@k 取结果与精确 k-近邻(基于 index.Vectors() 按索引使用的距离函数计算)的前 k 个做比较
+//	@param index 待评估的索引
+//	@param queries 查询向量
+//	@param ks 需要计算召回率的 k 列表
+//	@return map[int]float64 k 到平均召回率的映射
+//	@return error
+func RecallCurve(index NearestNeighborSearch, queries []Vector, ks []int) (map[int]float64, error) {
+	if len(ks) == 0 {
+		return nil, errors.New("ks should not be empty")
+	}
+	if len(queries) == 0 {
+		return nil, errors.New("queries should not be empty")
+	}
+	maxK := 0
+	for _, k := range ks {
+		if k <= 0 {
+			return nil, errors.New("k should be greater than 0")
+		}
+		if k > maxK {
+			maxK = k
+		}
+	}
+
+	data, err := index.Vectors()
+	if err != nil {
+		return nil, err
+	}
+	truths := exactKNNParallel(data, queries, maxK, indexDistance(index))
+
+	curve := make(map[int]float64, len(ks))
+	for i, query := range queries {
+		results, err := index.KNearest(query, maxK)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range ks {
+			curve[k] += recallByID(prefix(truths[i], k), prefix(results, k))
+		}
+	}
+	for k := range curve {
+		curve[k] /= float64(len(queries))
+	}
+	return curve, nil
+}
+
+// prefix 返回 vectors 的前 k 个元素,不足 k 个时返回全部
+func prefix(vectors []Vector, k int) []Vector {
+	if k > len(vectors) {
+		return vectors
+	}
+	return vectors[:k]
+}
+
+// Top1Accuracy
+//
+//	@Description: 统计 index.Nearest 返回的向量 ID 与精确最近邻(按索引使用的距离函数计算)ID 一致的查询比例,
+//	比完整的召回率曲线更轻量,适合在 CI 中做快速的质量检查。
+//	近似索引对某个查询找不到任何候选(Nearest 返回错误)时记为未命中
+//	@param index 待评估的索引
+//	@param queries 查询向量
+//	@return float64 命中比例
+//	@return error
+func Top1Accuracy(index NearestNeighborSearch, queries []Vector) (float64, error) {
+	if len(queries) == 0 {
+		return 0, errors.New("queries should not be empty")
+	}
+	data, err := index.Vectors()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, errors.New("no vectors in the database")
+	}
+	truths := exactKNNParallel(data, queries, 1, indexDistance(index))
+
+	hits := 0
+	for i, query := range queries {
+		nearest, err := index.Nearest(query)
+		if err != nil {
+			continue
+		}
+		if nearest.ID == truths[i][0].ID {
+			hits++
+		}
+	}
+	return float64(hits) / float64(len(queries)), nil
+}
+
+// SpeedupOverBruteForce
+//
+//	@Description: 在同一批查询上分别计时 index 与基于 index.Vectors() 构建、使用索引同一距离函数的暴力搜索的 KNearest,
+//	返回暴力搜索总耗时与索引总耗时之比,以及以暴力搜索结果为真值的平均召回率。
+//	两者按查询交替执行,以减少缓存预热等顺序因素对比值的影响
+//	@param index 待评估的索引
+//	@param queries 查询向量
+//	@param k top-k
+//	@return speedup 大于 1 表示索引比暴力搜索快
+//	@return recall
+//	@return err
+func SpeedupOverBruteForce(index NearestNeighborSearch, queries []Vector, k int) (speedup, recall float64, err error) {
+	if len(queries) == 0 {
+		return 0, 0, errors.New("queries should not be empty")
+	}
+	if k <= 0 {
+		return 0, 0, errors.New("k should be greater than 0")
+	}
+	data, err := index.Vectors()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) == 0 {
+		return 0, 0, errors.New("no vectors in the database")
+	}
+	distance := indexDistance(index)
+	bruteForce := NewBruteForceSearch(data, WithMetric(func(a, b []float64) float64 {
+		return distance(Vector{Values: a}, Vector{Values: b})
+	}))
+
+	var bruteForceTime, indexTime time.Duration
+	for _, query := range queries {
+		start := time.Now()
+		truth, err := bruteForce.KNearest(query, k)
+		if err != nil {
+			return 0, 0, err
+		}
+		bruteForceTime += time.Since(start)
+
+		start = time.Now()
+		results, err := index.KNearest(query, k)
+		if err != nil {
+			return 0, 0, err
+		}
+		indexTime += time.Since(start)
+
+		recall += recallByID(truth, results)
+	}
+	if indexTime <= 0 {
+		indexTime = 1
+	}
+	return float64(bruteForceTime) / float64(indexTime), recall / float64(len(queries)), nil
+}
@@ -3,20 +3,71 @@ package core
 // 暴力搜索算法
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"hh_vectordb/basic"
+	"io"
 	"math"
+	"math/rand"
 	"os"
+	"runtime"
 	"sort"
+	"sync"
+	"time"
 )
 
 type BruteForceSearch struct {
-	data []Vector
+	data      []Vector
+	normalize bool         // 是否为归一化(余弦)模式,插入和查询的向量都会做 L2 归一化
+	reduced   *reducedView // 随机投影降维视图,与 data 按下标一一对应
+	epsilon   float64      // Delete/Contains 判断向量相等的容差,为 0 时使用 basic.DefaultEpsilon
+
+	mahalanobis *basic.Mahalanobis // 非 nil 时查询使用马氏距离代替欧几里得距离
+	distFunc    DistanceFunc       // WithMetric 指定的距离函数,为 nil 时使用欧几里得距离
+	duplicates  DuplicateValuePolicy
+	valueCounts map[string]int // 去重策略生效时记录每组分量出现的次数,键由 valuesKey 生成
+
+	lastAccess  map[int64]uint64 // 开启访问跟踪后记录每个 ID 最近一次被插入或出现在 KNearest 结果中的逻辑时间
+	accessClock uint64
+
+	// mu 保护 data 切片头。data 中已有的元素不会被原地修改:插入只在末尾追加,
+	// 删除与淘汰都会重新分配切片,因此 EachVector 持有的快照在迭代期间保持不变
+	mu sync.RWMutex
+}
+
+// reducedView 随机投影得到的降维副本,用于快速召回候选
+type reducedView struct {
+	projection [][]float64 // targetDim x dim 的随机投影矩阵
+	data       []Vector
+}
+
+// project
+//
+//	@Description: 将向量投影到低维空间,保留原向量 ID
+//	@receiver r
+//	@param vec
+//	@return Vector
+func (r *reducedView) project(vec Vector) Vector {
+	values := make([]float64, len(r.projection))
+	for i, row := range r.projection {
+		values[i] = basic.Dot(row, vec.Values)
+	}
+	return Vector{ID: vec.ID, Values: values}
+}
+
+// bruteForceGob 暴力搜索的持久化结构
+type bruteForceGob struct {
+	Data        []Vector
+	Normalize   bool
+	Mahalanobis *basic.Mahalanobis
 }
 
-func NewBruteForceSearch(vectors []Vector) *BruteForceSearch {
-	searcher := &BruteForceSearch{}
+func NewBruteForceSearch(vectors []Vector, opts ...Option) *BruteForceSearch {
+	o := newIndexOptions(opts)
+	searcher := &BruteForceSearch{normalize: o.normalize, distFunc: o.distance, duplicates: o.duplicates}
+	searcher.resetValueCounts()
 	for _, vec := range vectors {
 		err := searcher.Insert(vec)
 		if err != nil {
@@ -26,6 +77,95 @@ func NewBruteForceSearch(vectors []Vector) *BruteForceSearch {
 	return searcher
 }
 
+// NewBruteForceSearchNormalized
+//
+//	@Description: 创建归一化(余弦)模式的暴力搜索,向量与查询都会先做 L2 归一化,
+//	此时欧几里得距离排序与余弦相似度排序一致
+//	@param vectors
+//	@param opts 可选参数,如 WithMetric
+//	@return *BruteForceSearch
+func NewBruteForceSearchNormalized(vectors []Vector, opts ...Option) *BruteForceSearch {
+	o := newIndexOptions(opts)
+	searcher := &BruteForceSearch{normalize: true, distFunc: o.distance, duplicates: o.duplicates}
+	searcher.resetValueCounts()
+	for _, vec := range vectors {
+		err := searcher.Insert(vec)
+		if err != nil {
+			return nil
+		}
+	}
+	return searcher
+}
+
+// NewBruteForceSearchMahalanobis
+//
+//	@Description: 创建使用马氏距离的暴力搜索,协方差由 vectors 估计。
+//	之后插入的向量不会自动更新协方差,数据分布变化时可以通过 Mahalanobis().Update 增量更新
+//	@param vectors
+//	@return *BruteForceSearch
+//	@return error 协方差估计失败时返回错误
+func NewBruteForceSearchMahalanobis(vectors []Vector) (*BruteForceSearch, error) {
+	mahalanobis, err := basic.NewMahalanobis(vectors)
+	if err != nil {
+		return nil, err
+	}
+	searcher := &BruteForceSearch{mahalanobis: mahalanobis}
+	if err := searcher.InsertBatch(vectors); err != nil {
+		return nil, err
+	}
+	return searcher, nil
+}
+
+// Mahalanobis
+//
+//	@Description: 返回查询使用的马氏距离模型,可用于增量更新协方差;未使用马氏距离时返回 nil
+//	@receiver b
+//	@return *basic.Mahalanobis
+func (b *BruteForceSearch) Mahalanobis() *basic.Mahalanobis {
+	return b.mahalanobis
+}
+
+// distance
+//
+//	@Description: 查询使用的距离,优先使用马氏距离,其次是 WithMetric 指定的距离函数,默认为欧几里得距离
+//	@receiver b
+//	@param a
+//	@param c
+//	@return float64
+func (b *BruteForceSearch) distance(a, c Vector) float64 {
+	if b.mahalanobis != nil {
+		return b.mahalanobis.Distance(a, c)
+	}
+	return measure(b.distFunc, a, c)
+}
+
+// topK 按查询使用的距离返回 vectors 中离 query 最近的 k 个
+func (b *BruteForceSearch) topK(query Vector, vectors []Vector, k int) []Vector {
+	return topKByFunc(query, vectors, k, b.distance)
+}
+
+// IsNormalized
+//
+//	@Description: 是否为归一化(余弦)模式
+//	@receiver b
+//	@return bool
+func (b *BruteForceSearch) IsNormalized() bool {
+	return b.normalize
+}
+
+// prepare
+//
+//	@Description: 归一化模式下对向量做 L2 归一化
+//	@receiver b
+//	@param vec
+//	@return Vector
+func (b *BruteForceSearch) prepare(vec Vector) Vector {
+	if b.normalize {
+		return basic.Normalize(vec)
+	}
+	return vec
+}
+
 // Insert
 //
 //	@Description: 暴力搜索插入
@@ -33,10 +173,89 @@ func NewBruteForceSearch(vectors []Vector) *BruteForceSearch {
 //	@param vec 插入向量
 //	@return error
 func (b *BruteForceSearch) Insert(vec Vector) error {
+	vec = b.prepare(vec)
+	if b.valueCounts != nil && b.valueCounts[valuesKey(vec.Values)] > 0 {
+		if b.duplicates == ErrorDuplicateValues {
+			return errors.New("a vector with identical values already exists")
+		}
+		return nil
+	}
+	if b.reduced != nil {
+		if len(vec.Values) != len(b.reduced.projection[0]) {
+			return errors.New("vector dimension does not match the reduced view")
+		}
+		b.reduced.data = append(b.reduced.data, b.reduced.project(vec))
+	}
+	b.mu.Lock()
 	b.data = append(b.data, vec)
+	b.mu.Unlock()
+	b.countValues(vec.Values, 1)
+	b.touch(vec.ID)
 	return nil
 }
 
+// valuesKey 把分量的精确值编码为 map 键,0 与 -0 视为相同
+func valuesKey(values []float64) string {
+	buf := make([]byte, 8*len(values))
+	for i, val := range values {
+		if val == 0 {
+			val = 0
+		}
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(val))
+	}
+	return string(buf)
+}
+
+// resetValueCounts
+//
+//	@Description: 去重策略生效时由 data 重新统计 valueCounts,否则清空,在创建与加载后调用
+//	@receiver b
+func (b *BruteForceSearch) resetValueCounts() {
+	if b.duplicates == AllowDuplicateValues {
+		b.valueCounts = nil
+		return
+	}
+	b.valueCounts = make(map[string]int, len(b.data))
+	for _, vec := range b.data {
+		b.countValues(vec.Values, 1)
+	}
+}
+
+// countValues 去重策略生效时把 values 的出现次数加上 delta,减到 0 时删除该键
+func (b *BruteForceSearch) countValues(values []float64, delta int) {
+	if b.valueCounts == nil {
+		return
+	}
+	key := valuesKey(values)
+	if count := b.valueCounts[key] + delta; count > 0 {
+		b.valueCounts[key] = count
+	} else {
+		delete(b.valueCounts, key)
+	}
+}
+
+// removeAt
+//
+//	@Description: 删除下标为 index 的向量,同时维护降维视图。
+//	data 会被复制到新的切片中,不影响 EachVector 正在迭代的快照
+//	@receiver b
+//	@param index
+func (b *BruteForceSearch) removeAt(index int) {
+	if b.lastAccess != nil {
+		delete(b.lastAccess, b.data[index].ID)
+	}
+	b.countValues(b.data[index].Values, -1)
+	data := make([]Vector, 0, len(b.data)-1)
+	data = append(data, b.data[:index]...)
+	data = append(data, b.data[index+1:]...)
+	b.mu.Lock()
+	b.data = data
+	b.mu.Unlock()
+	if b.reduced != nil {
+		b.reduced.data = append(b.reduced.data[:index], b.reduced.data[index+1:]...)
+	}
+}
+
 // Nearest
 //
 //	@Description: 暴力搜索求解最近邻
@@ -45,11 +264,12 @@ func (b *BruteForceSearch) Insert(vec Vector) error {
 //	@return Vector
 //	@return error
 func (b *BruteForceSearch) Nearest(query Vector) (Vector, error) {
+	query = b.prepare(query)
 	var nearest Vector
 	var minDist = math.MaxFloat64
 
 	for _, vec := range b.data {
-		dist := basic.EuclidDistanceVec(vec, query)
+		dist := b.distance(vec, query)
 		if dist < minDist {
 			minDist = dist
 			nearest = vec
@@ -63,6 +283,36 @@ func (b *BruteForceSearch) Nearest(query Vector) (Vector, error) {
 	return nearest, nil
 }
 
+// NearestExcludingSelf
+//
+//	@Description: 暴力搜索求解最近邻,跳过与查询向量完全相同的向量
+//	@receiver b
+//	@param query
+//	@return Vector
+//	@return error
+func (b *BruteForceSearch) NearestExcludingSelf(query Vector) (Vector, error) {
+	query = b.prepare(query)
+	var nearest Vector
+	var minDist = math.MaxFloat64
+
+	for _, vec := range b.data {
+		// 是否为查询向量本身按取值判断,与度量无关;内积等度量下距离可以为负
+		if basic.EuclidDistanceVec(vec, query) < selfMatchEpsilon {
+			continue
+		}
+		if dist := b.distance(vec, query); dist < minDist {
+			minDist = dist
+			nearest = vec
+		}
+	}
+
+	if minDist == math.MaxFloat64 {
+		return Vector{}, errors.New("no vector other than exact matches found")
+	}
+
+	return nearest, nil
+}
+
 // KNearest
 //
 //	@Description: 暴力搜索求解k-近邻
@@ -72,33 +322,380 @@ func (b *BruteForceSearch) Nearest(query Vector) (Vector, error) {
 //	@return []Vector
 //	@return error
 func (b *BruteForceSearch) KNearest(query Vector, k int) ([]Vector, error) {
-	type IDDist struct {
-		Vector   Vector
-		Distance float64
+	query = b.prepare(query)
+	// 距离相同时按 ID 升序排列,保证结果稳定可复现
+	result := b.topK(query, b.data, k)
+	for _, vec := range result {
+		b.touch(vec.ID)
+	}
+	return result, nil
+}
+
+// KNearestReversed
+//
+//	@Description: 返回与 KNearest 相同的 top-k,按距离从远到近排列
+//	@receiver b
+//	@param query
+//	@param k
+//	@return []Vector
+//	@return error
+func (b *BruteForceSearch) KNearestReversed(query Vector, k int) ([]Vector, error) {
+	return kNearestReversed(b, query, k)
+}
+
+// KNearestBanded
+//
+//	@Description: 返回按距离分段的 top-k。bandEdges 严格递增,第 i 段为 [bandEdges[i-1], bandEdges[i]),
+//	第 0 段为距离小于 bandEdges[0] 的结果,第 len(bandEdges) 段为距离不小于最后一个边界的结果
+//	@receiver b
+//	@param query
+//	@param k
+//	@param bandEdges 分段边界
+//	@return map[int][]Vector 段号到该段结果的映射,每段内按距离升序,没有结果的段不出现
+//	@return error bandEdges 不是严格递增时返回错误
+func (b *BruteForceSearch) KNearestBanded(query Vector, k int, bandEdges []float64) (map[int][]Vector, error) {
+	for i := 1; i < len(bandEdges); i++ {
+		if bandEdges[i] <= bandEdges[i-1] {
+			return nil, errors.New("band edges should be strictly increasing")
+		}
+	}
+	results, err := b.KNearest(query, k)
+	if err != nil {
+		return nil, err
+	}
+	query = b.prepare(query)
+	bands := make(map[int][]Vector)
+	for _, vec := range results {
+		d := b.distance(query, vec)
+		band := sort.Search(len(bandEdges), func(i int) bool { return d < bandEdges[i] })
+		bands[band] = append(bands[band], vec)
+	}
+	return bands, nil
+}
+
+// SelfRank
+//
+//	@Description: 以 ID 为 id 的向量查询 top-k,返回其自身的排名(从 0 开始),不在 top-k 中时返回 -1
+//	@receiver b
+//	@param id
+//	@param k
+//	@return int
+//	@return error
+func (b *BruteForceSearch) SelfRank(id int64, k int) (int, error) {
+	return selfRank(b, id, k)
+}
+
+// EnableAccessTracking
+//
+//	@Description: 开启访问跟踪,之后插入或出现在 KNearest 结果中的向量会刷新其最近访问时间,
+//	配合 EvictToSize 可以把索引当作有容量上限的 LRU 缓存使用。已有向量视为同一时刻被访问
+//	@receiver b
+func (b *BruteForceSearch) EnableAccessTracking() {
+	if b.lastAccess != nil {
+		return
+	}
+	b.lastAccess = make(map[int64]uint64, len(b.data))
+	for _, vec := range b.data {
+		b.lastAccess[vec.ID] = 0
+	}
+}
+
+// touch
+//
+//	@Description: 开启访问跟踪时刷新向量的最近访问时间
+//	@receiver b
+//	@param id
+func (b *BruteForceSearch) touch(id int64) {
+	if b.lastAccess == nil {
+		return
+	}
+	b.accessClock++
+	b.lastAccess[id] = b.accessClock
+}
+
+// EvictToSize
+//
+//	@Description: 按最近访问时间淘汰最久未被访问的向量,直到向量数量不超过 maxSize。需要先开启访问跟踪
+//	@receiver b
+//	@param maxSize 保留的最大向量数量
+//	@return int 被淘汰的向量数量,未开启访问跟踪时返回 0
+func (b *BruteForceSearch) EvictToSize(maxSize int) int {
+	if b.lastAccess == nil || maxSize < 0 || len(b.data) <= maxSize {
+		return 0
+	}
+	order := make([]int, len(b.data))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return b.lastAccess[b.data[order[i]].ID] < b.lastAccess[b.data[order[j]].ID]
+	})
+	evicted := len(b.data) - maxSize
+	evict := make(map[int]struct{}, evicted)
+	for _, i := range order[:evicted] {
+		evict[i] = struct{}{}
+	}
+
+	// 保持剩余向量的相对顺序,data 写入新切片以免影响快照,降维视图原地压缩
+	data := make([]Vector, 0, maxSize)
+	for i, vec := range b.data {
+		if _, found := evict[i]; found {
+			delete(b.lastAccess, vec.ID)
+			b.countValues(vec.Values, -1)
+			continue
+		}
+		if b.reduced != nil {
+			b.reduced.data[len(data)] = b.reduced.data[i]
+		}
+		data = append(data, vec)
+	}
+	kept := len(data)
+	b.mu.Lock()
+	b.data = data
+	b.mu.Unlock()
+	if b.reduced != nil {
+		b.reduced.data = b.reduced.data[:kept]
+	}
+	return evicted
+}
+
+// GetByID
+//
+//	@Description: 根据 ID 查找向量
+//	@receiver b
+//	@param id 向量 ID
+//	@return Vector
+//	@return error
+func (b *BruteForceSearch) GetByID(id int64) (Vector, error) {
+	for _, vec := range b.data {
+		if vec.ID == id {
+			return vec, nil
+		}
+	}
+	return Vector{}, errors.New("vector not found")
+}
+
+// KNearestAmong
+//
+//	@Description: 只在给定 ID 的候选集合中求解精确 k-近邻,用于对外部产生的候选列表重排序
+//	@receiver b
+//	@param query
+//	@param k
+//	@param ids 候选向量 ID
+//	@return []Vector
+//	@return error 存在未找到的 ID 时返回错误
+func (b *BruteForceSearch) KNearestAmong(query Vector, k int, ids []int64) ([]Vector, error) {
+	query = b.prepare(query)
+	wanted := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		wanted[id] = struct{}{}
+	}
+
+	// 一次遍历收集候选向量,避免对每个 ID 调用 GetByID 做线性查找
+	candidates := make([]Vector, 0, len(wanted))
+	for _, vec := range b.data {
+		if _, found := wanted[vec.ID]; found {
+			candidates = append(candidates, vec)
+			delete(wanted, vec.ID)
+		}
+	}
+	if len(wanted) > 0 {
+		return nil, errors.New("vector not found")
+	}
+
+	return b.topK(query, candidates, k), nil
+}
+
+// NearestMultiMetric
+//
+//	@Description: 只扫描一遍数据,同时求出每种度量下的最近邻,用于比较不同度量的结果
+//	@receiver b
+//	@param query
+//	@param metrics 度量列表,重复的度量只计算一次
+//	@return map[Metric]Vector 每种度量下的最近邻,距离相同时取先插入的向量
+//	@return error metrics 为空或没有向量时返回错误
+func (b *BruteForceSearch) NearestMultiMetric(query Vector, metrics []Metric) (map[Metric]Vector, error) {
+	if len(metrics) == 0 {
+		return nil, errors.New("metrics should not be empty")
+	}
+	data := b.snapshot()
+	if len(data) == 0 {
+		return nil, errors.New("no vectors in the database")
+	}
+	query = b.prepare(query)
+	best := make(map[Metric]float64, len(metrics))
+	nearest := make(map[Metric]Vector, len(metrics))
+	for _, metric := range metrics {
+		best[metric] = math.Inf(1)
+	}
+	for _, vec := range data {
+		for metric, minDist := range best {
+			if dist := metric.Distance(vec.Values, query.Values); dist < minDist || nearest[metric].Values == nil {
+				best[metric] = dist
+				nearest[metric] = vec
+			}
+		}
+	}
+	return nearest, nil
+}
+
+// KNearestReRank
+//
+//	@Description: 先按 retrieveMetric 召回 candidateK 个候选,再按 rankMetric 重排序返回前 finalK 个
+//	@receiver b
+//	@param query
+//	@param candidateK 召回的候选数量
+//	@param finalK 最终返回的数量
+//	@param retrieveMetric 召回阶段使用的度量
+//	@param rankMetric 重排序阶段使用的度量
+//	@return []Vector
+//	@return error
+func (b *BruteForceSearch) KNearestReRank(query Vector, candidateK, finalK int, retrieveMetric, rankMetric Metric) ([]Vector, error) {
+	if candidateK <= 0 || finalK <= 0 {
+		return nil, errors.New("candidateK and finalK should be greater than 0")
+	}
+	query = b.prepare(query)
+	candidates := topKByMetric(query, b.data, candidateK, retrieveMetric)
+	return topKByMetric(query, candidates, finalK, rankMetric), nil
+}
+
+// KNearestUntilGap
+//
+//	@Description: 按距离升序返回近邻,直到相邻两个结果的距离跳变超过前一个距离的 gapRatio 倍
+//	(视为自然的簇边界),最多返回 maxK 个。前一个距离为 0 时不做跳变判断
+//	@receiver b
+//	@param query
+//	@param maxK 最多返回的数量
+//	@param gapRatio 距离跳变比例阈值
+//	@return []Vector
+//	@return error
+func (b *BruteForceSearch) KNearestUntilGap(query Vector, maxK int, gapRatio float64) ([]Vector, error) {
+	if maxK <= 0 {
+		return nil, errors.New("maxK should be greater than 0")
+	}
+	if gapRatio < 0 {
+		return nil, errors.New("gapRatio should not be negative")
+	}
+	query = b.prepare(query)
+	candidates := b.topK(query, b.data, maxK)
+	for i := 1; i < len(candidates); i++ {
+		prev := b.distance(query, candidates[i-1])
+		cur := b.distance(query, candidates[i])
+		if prev > 0 && cur-prev > gapRatio*prev {
+			return candidates[:i], nil
+		}
+	}
+	return candidates, nil
+}
+
+// KNearestWithinBudget
+//
+//	@Description: 带时间预算的 k-近邻查询,扫描过程中定期检查耗时,
+//	超出预算时直接返回目前为止找到的最优结果
+//	@receiver b
+//	@param query
+//	@param k
+//	@param budget 时间预算
+//	@return []Vector
+//	@return error
+func (b *BruteForceSearch) KNearestWithinBudget(query Vector, k int, budget time.Duration) ([]Vector, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
+	}
+	if budget <= 0 {
+		return nil, errors.New("budget should be greater than 0")
+	}
+	start := time.Now()
+	query = b.prepare(query)
+
+	pq := make(PriorityQueue, 0, k)
+	for i, vec := range b.data {
+		if i%budgetCheckInterval == 0 && i > 0 && time.Since(start) > budget {
+			break
+		}
+		pushCandidate(&pq, vec, b.distance(query, vec), k)
+	}
+	return drainAscending(&pq), nil
+}
+
+// AddReducedView
+//
+//	@Description: 构建随机投影降维视图,之后的插入和删除会同步维护该视图,
+//	KNearestReduced 在降维视图上快速召回候选再用原始向量精排。降维视图不会被持久化
+//	@receiver b
+//	@param targetDim 降维后的维度
+//	@param seed 随机投影矩阵的随机种子
+//	@return error
+func (b *BruteForceSearch) AddReducedView(targetDim int, seed int64) error {
+	if targetDim <= 0 {
+		return errors.New("targetDim should be greater than 0")
+	}
+	if len(b.data) == 0 {
+		return errors.New("no vectors in the database")
 	}
+	dim := len(b.data[0].Values)
 
-	dists := make([]IDDist, len(b.data))
+	// 高斯随机投影,按 1/sqrt(targetDim) 缩放以近似保持距离
+	rng := rand.New(rand.NewSource(seed))
+	scale := 1 / math.Sqrt(float64(targetDim))
+	projection := make([][]float64, targetDim)
+	for i := range projection {
+		projection[i] = make([]float64, dim)
+		for j := range projection[i] {
+			projection[i][j] = rng.NormFloat64() * scale
+		}
+	}
+
+	view := &reducedView{projection: projection, data: make([]Vector, len(b.data))}
 	for i, vec := range b.data {
-		dists[i] = IDDist{
-			Vector:   vec,
-			Distance: basic.EuclidDistanceVec(query, vec),
+		if len(vec.Values) != dim {
+			return errors.New("vectors have inconsistent dimensions")
 		}
+		view.data[i] = view.project(vec)
+	}
+	b.reduced = view
+	return nil
+}
+
+// KNearestReduced
+//
+//	@Description: 先在降维视图上召回 candidateK 个候选,再用原始向量计算精确距离返回前 k 个
+//	@receiver b
+//	@param query
+//	@param k
+//	@param candidateK 降维视图上召回的候选数量
+//	@return []Vector
+//	@return error
+func (b *BruteForceSearch) KNearestReduced(query Vector, k, candidateK int) ([]Vector, error) {
+	if b.reduced == nil {
+		return nil, errors.New("reduced view is not built")
+	}
+	if candidateK < k {
+		candidateK = k
 	}
+	query = b.prepare(query)
 
+	type IndexDist struct {
+		Index    int
+		Distance float64
+	}
+	reducedQuery := b.reduced.project(query)
+	dists := make([]IndexDist, len(b.reduced.data))
+	for i, vec := range b.reduced.data {
+		dists[i] = IndexDist{Index: i, Distance: basic.EuclidDistanceVec(reducedQuery, vec)}
+	}
 	sort.Slice(dists, func(i, j int) bool {
 		return dists[i].Distance < dists[j].Distance
 	})
-
-	if k > len(b.data) {
-		k = len(b.data)
+	if candidateK > len(dists) {
+		candidateK = len(dists)
 	}
 
-	kNearest := make([]Vector, k)
-	for i := 0; i < k; i++ {
-		kNearest[i] = dists[i].Vector
+	candidates := make([]Vector, candidateK)
+	for i := 0; i < candidateK; i++ {
+		candidates[i] = b.data[dists[i].Index]
 	}
-
-	return kNearest, nil
+	return b.topK(query, candidates, k), nil
 }
 
 // Vectors
@@ -111,37 +708,247 @@ func (b *BruteForceSearch) Vectors() ([]Vector, error) {
 	return b.data, nil
 }
 
-// Delete
+// Describe
 //
-//	@Description: 暴力搜索 删除向量
+//	@Description: 返回向量数、维度与索引类型 "brute_force"
 //	@receiver b
-//	@param vec
+//	@return count
+//	@return dim
+//	@return indexType
+//	@return err
+func (b *BruteForceSearch) Describe() (count int, dim int, indexType string, err error) {
+	data := b.snapshot()
+	if len(data) > 0 {
+		dim = len(data[0].Values)
+	}
+	return len(data), dim, "brute_force", nil
+}
+
+// Config
+//
+//	@Description: 返回构造参数:是否归一化、距离函数、判等容差、降维视图维度以及是否开启访问跟踪
+//	@receiver b
+//	@return map[string]interface{}
+func (b *BruteForceSearch) Config() map[string]interface{} {
+	metric := metricName(b.distFunc)
+	if b.mahalanobis != nil {
+		metric = "mahalanobis"
+	}
+	reducedDim := 0
+	if b.reduced != nil {
+		reducedDim = len(b.reduced.projection)
+	}
+	return map[string]interface{}{
+		"normalize":       b.normalize,
+		"metric":          metric,
+		"epsilon":         b.epsilon,
+		"reduced_dim":     reducedDim,
+		"access_tracking": b.lastAccess != nil,
+	}
+}
+
+// snapshot 返回调用时刻 data 的切片头,容量被截断为长度,之后的追加不会写入快照可见的范围
+func (b *BruteForceSearch) snapshot() []Vector {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.data[:len(b.data):len(b.data)]
+}
+
+// EachVector
+//
+//	@Description: 按插入顺序依次把向量交给 fn,fn 返回 false 时停止。
+//	迭代基于调用时刻的快照,迭代期间(包括在 fn 中或其他 goroutine 中)的插入与删除不会影响本次迭代
+//	@receiver b
+//	@param fn
+func (b *BruteForceSearch) EachVector(fn func(Vector) bool) {
+	for _, vec := range b.snapshot() {
+		if !fn(vec) {
+			return
+		}
+	}
+}
+
+// VectorsPage
+//
+//	@Description: 按插入顺序分页返回向量,用于无状态地遍历大索引。
+//	每页基于调用时刻的快照,数据集在两次调用之间不变时所有向量恰好出现一次
+//	@receiver b
+//	@param token 上一页返回的 nextToken,第一页传空字符串
+//	@param limit 每页大小
+//	@return vectors
+//	@return nextToken 已到末尾时为空
+//	@return err
+func (b *BruteForceSearch) VectorsPage(token string, limit int) (vectors []Vector, nextToken string, err error) {
+	return vectorsPage(b.snapshot(), token, limit)
+}
+
+// VectorsByCentrality
+//
+//	@Description: 按到数据集质心的距离升序返回所有向量及对应距离,离群点排在末尾
+//	@receiver b
+//	@return []Vector
+//	@return []float64 与返回向量一一对应的到质心的距离
 //	@return error
-func (b *BruteForceSearch) Delete(vec Vector) error {
-	index := -1
+func (b *BruteForceSearch) VectorsByCentrality() ([]Vector, []float64, error) {
+	if len(b.data) == 0 {
+		return nil, nil, errors.New("no vectors in the database")
+	}
+	centroid := basic.Centroid(b.data)
+	sorted := b.topK(centroid, b.data, len(b.data))
+	distances := make([]float64, len(sorted))
+	for i, vec := range sorted {
+		distances[i] = b.distance(centroid, vec)
+	}
+	return sorted, distances, nil
+}
+
+// DistanceHistogram
+//
+//	@Description: 计算查询向量到所有向量的距离,并按等宽分桶统计直方图,可用于选择范围搜索的半径。
+//	edges 长度为 buckets+1,第 i 个桶的区间为 [edges[i], edges[i+1]),最后一个桶包含右端点
+//	@receiver b
+//	@param query
+//	@param buckets 分桶数量
+//	@return edges 桶边界
+//	@return counts 每个桶内的向量数量
+//	@return err
+func (b *BruteForceSearch) DistanceHistogram(query Vector, buckets int) (edges []float64, counts []int, err error) {
+	if buckets <= 0 {
+		return nil, nil, errors.New("buckets should be greater than 0")
+	}
+	if len(b.data) == 0 {
+		return nil, nil, errors.New("no vectors in the database")
+	}
+	query = b.prepare(query)
+
+	distances := make([]float64, len(b.data))
+	minDist, maxDist := math.MaxFloat64, 0.0
+	for i, vec := range b.data {
+		distances[i] = b.distance(query, vec)
+		minDist = math.Min(minDist, distances[i])
+		maxDist = math.Max(maxDist, distances[i])
+	}
+
+	width := (maxDist - minDist) / float64(buckets)
+	edges = make([]float64, buckets+1)
+	for i := range edges {
+		edges[i] = minDist + float64(i)*width
+	}
+	edges[buckets] = maxDist
+
+	counts = make([]int, buckets)
+	for _, dist := range distances {
+		bucket := 0
+		if width > 0 {
+			bucket = int((dist - minDist) / width)
+			if bucket >= buckets {
+				bucket = buckets - 1
+			}
+		}
+		counts[bucket]++
+	}
+	return edges, counts, nil
+}
+
+// SetEpsilon
+//
+//	@Description: 设置 Delete/Contains 判断向量相等时的容差,epsilon <= 0 时恢复默认容差
+//	@receiver b
+//	@param epsilon
+func (b *BruteForceSearch) SetEpsilon(epsilon float64) {
+	if epsilon <= 0 {
+		epsilon = 0
+	}
+	b.epsilon = epsilon
+}
+
+// Epsilon
+//
+//	@Description: 当前判断向量相等时使用的容差
+//	@receiver b
+//	@return float64
+func (b *BruteForceSearch) Epsilon() float64 {
+	if b.epsilon == 0 {
+		return basic.DefaultEpsilon
+	}
+	return b.epsilon
+}
+
+// indexOf
+//
+//	@Description: 按索引的相等容差查找向量下标,未找到时返回 -1
+//	@receiver b
+//	@param vec 已经过 prepare 处理的向量
+//	@return int
+func (b *BruteForceSearch) indexOf(vec Vector) int {
+	epsilon := b.Epsilon()
 	for i, v := range b.data {
-		if v.Equals(vec) {
-			index = i
-			break
+		if v.EqualsWithin(vec, epsilon) {
+			return i
 		}
 	}
+	return -1
+}
 
+// Contains
+//
+//	@Description: 判断索引中是否存在与 vec 相等(在容差范围内)的向量
+//	@receiver b
+//	@param vec
+//	@return bool
+func (b *BruteForceSearch) Contains(vec Vector) bool {
+	return b.indexOf(b.prepare(vec)) != -1
+}
+
+// Delete
+//
+//	@Description: 暴力搜索 删除向量
+//	@receiver b
+//	@param vec
+//	@return error
+func (b *BruteForceSearch) Delete(vec Vector) error {
+	index := b.indexOf(b.prepare(vec))
 	if index == -1 {
 		return errors.New("vector not found")
 	}
 
 	// 从切片中删除向量
-	b.data = append(b.data[:index], b.data[index+1:]...)
+	b.removeAt(index)
 	return nil
 }
 
+// DeleteAndReturn
+//
+//	@Description: 按 ID 删除向量,并返回被删除的向量
+//	@receiver b
+//	@param id 向量 ID
+//	@return Vector 被删除的向量
+//	@return error
+func (b *BruteForceSearch) DeleteAndReturn(id int64) (Vector, error) {
+	for i, vec := range b.data {
+		if vec.ID == id {
+			b.removeAt(i)
+			return vec, nil
+		}
+	}
+	return Vector{}, errors.New("vector not found")
+}
+
 // InsertBatch implements the BatchOperator interface
 //
-//	@Description: 批量插入向量
+//	@Description: 批量插入向量,插入前一次性预留 len(existing)+len(batch) 的容量
 //	@receiver b
 //	@param vectors []Vector
 //	@return error
 func (b *BruteForceSearch) InsertBatch(vectors []Vector) error {
+	// 预先扩容,避免逐条 append 时反复扩容
+	if need := len(b.data) + len(vectors); need > cap(b.data) {
+		grown := make([]Vector, len(b.data), need)
+		copy(grown, b.data)
+		b.mu.Lock()
+		b.data = grown
+		b.mu.Unlock()
+	}
 	for _, vec := range vectors {
 		err := b.Insert(vec)
 		if err != nil {
@@ -151,6 +958,17 @@ func (b *BruteForceSearch) InsertBatch(vectors []Vector) error {
 	return nil
 }
 
+// InsertPaged
+//
+//	@Description: 从分页数据源逐页拉取并批量插入,直到拉取到空页,出错时立即停止
+//	@receiver b
+//	@param fetch 分页拉取函数,参数为偏移量和页大小
+//	@param pageSize 每页大小
+//	@return error
+func (b *BruteForceSearch) InsertPaged(fetch func(offset, limit int) ([]Vector, error), pageSize int) error {
+	return insertPaged(fetch, pageSize, b.InsertBatch)
+}
+
 // DeleteBatch implements the BatchOperator interface
 //
 //	@Description: 批量删除向量
@@ -173,28 +991,227 @@ func (b *BruteForceSearch) DeleteBatch(vectors []Vector) error {
 // @receiver b
 // @param query Vector - The query vector.
 // @param radius float64 - The radius within which to search.
-// @return []Vector - A slice of vectors within the specified radius.
-// @return error - An error if something goes wrong.
+// @return []Vector - A slice of vectors within the specified radius, empty if none are in range.
+// @return error - An error if something goes wrong. No match is not an error.
 func (b *BruteForceSearch) SearchWithinRange(query Vector, radius float64) ([]Vector, error) {
+	query = b.prepare(query)
 	var results []Vector
 
 	for _, vec := range b.data {
-		dist := basic.EuclidDistanceVec(vec, query)
+		dist := b.distance(vec, query)
 		if dist <= radius {
 			results = append(results, vec)
 		}
 	}
 
-	if len(results) == 0 {
-		return nil, errors.New("no vectors found within the specified range")
+	return results, nil
+}
+
+// EstimateRangeCount
+//
+//	@Description: 在不执行范围查询的情况下估计半径内的向量数:有放回地随机抽取 sampleSize 个向量,
+//	按落在半径内的比例外推到全部数据。估计的标准误差约为 n*sqrt(p(1-p)/sampleSize),
+//	可用于在查询规划中拒绝范围过大的查询。sampleSize 不小于向量总数时直接返回精确计数
+//	@receiver b
+//	@param query 查询向量
+//	@param radius 半径
+//	@param sampleSize 抽样数量
+//	@return int 估计的结果数量
+//	@return error
+func (b *BruteForceSearch) EstimateRangeCount(query Vector, radius float64, sampleSize int) (int, error) {
+	if sampleSize <= 0 {
+		return 0, errors.New("sampleSize should be greater than 0")
+	}
+	n := len(b.data)
+	if n == 0 {
+		return 0, nil
+	}
+	query = b.prepare(query)
+	if sampleSize >= n {
+		count := 0
+		for _, vec := range b.data {
+			if b.distance(vec, query) <= radius {
+				count++
+			}
+		}
+		return count, nil
+	}
+
+	hits := 0
+	for i := 0; i < sampleSize; i++ {
+		if b.distance(b.data[rand.Intn(n)], query) <= radius {
+			hits++
+		}
+	}
+	return int(math.Round(float64(hits) / float64(sampleSize) * float64(n))), nil
+}
+
+// SearchWithinAnnulus
+//
+//	@Description: 环形范围查询,返回距离在 [minRadius, maxRadius] 内的向量
+//	@receiver b
+//	@param query
+//	@param minRadius 内半径
+//	@param maxRadius 外半径
+//	@return []Vector
+//	@return error
+func (b *BruteForceSearch) SearchWithinAnnulus(query Vector, minRadius, maxRadius float64) ([]Vector, error) {
+	// 先做归一化,保证内半径过滤与范围搜索使用同一个查询向量
+	return searchWithinAnnulus(b, b.prepare(query), minRadius, maxRadius, b.distance)
+}
+
+// SearchWithinRangeConcurrent
+//
+//	@Description: 并发版本的范围搜索,按 CPU 核数把数据切分成若干块,
+//	每个 goroutine 把范围内的向量收集到各自的切片中,最后按块顺序合并,结果顺序与 SearchWithinRange 一致
+//	@receiver b
+//	@param query
+//	@param radius 搜索半径
+//	@return []Vector
+//	@return error
+func (b *BruteForceSearch) SearchWithinRangeConcurrent(query Vector, radius float64) ([]Vector, error) {
+	query = b.prepare(query)
+
+	bounds := splitChunks(len(b.data), runtime.NumCPU())
+	chunks := make([][]Vector, len(bounds))
+	var wg sync.WaitGroup
+	for i, bound := range bounds {
+		wg.Add(1)
+		go func(i int, data []Vector) {
+			defer wg.Done()
+			var local []Vector
+			for _, vec := range data {
+				if b.distance(vec, query) <= radius {
+					local = append(local, vec)
+				}
+			}
+			chunks[i] = local
+		}(i, b.data[bound[0]:bound[1]])
+	}
+	wg.Wait()
+
+	var results []Vector
+	for _, chunk := range chunks {
+		results = append(results, chunk...)
 	}
 
 	return results, nil
 }
 
+// RangeQueryContext 一个查询向量到所有向量的距离,按升序排好,用于对同一查询反复尝试不同半径
+type RangeQueryContext struct {
+	vectors   []Vector  // 按距离升序排列的向量
+	distances []float64 // distances[i] 为 vectors[i] 到查询向量的距离
+}
+
+// PrepareRangeQuery
+//
+//	@Description: 计算查询向量到所有向量的距离并排序,代价为 O(n log n)。
+//	之后每次 Within 只需 O(log n + 结果数),结果基于调用时刻的数据快照,之后的插入与删除不会反映到其中
+//	@receiver b
+//	@param query
+//	@return *RangeQueryContext
+func (b *BruteForceSearch) PrepareRangeQuery(query Vector) *RangeQueryContext {
+	query = b.prepare(query)
+	data := b.snapshot()
+	order := make([]int, len(data))
+	dists := make([]float64, len(data))
+	for i, vec := range data {
+		order[i] = i
+		dists[i] = b.distance(vec, query)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return dists[order[i]] < dists[order[j]]
+	})
+	ctx := &RangeQueryContext{vectors: make([]Vector, len(data)), distances: make([]float64, len(data))}
+	for i, idx := range order {
+		ctx.vectors[i] = data[idx]
+		ctx.distances[i] = dists[idx]
+	}
+	return ctx
+}
+
+// Within
+//
+//	@Description: 二分查找返回距离不超过 radius 的向量,与 SearchWithinRange 的结果集合相同
+//	@receiver c
+//	@param radius
+//	@return []Vector 按距离升序
+func (c *RangeQueryContext) Within(radius float64) []Vector {
+	n := sort.Search(len(c.distances), func(i int) bool {
+		return c.distances[i] > radius
+	})
+	return c.vectors[:n:n]
+}
+
+// Save
+//
+// @Description: Writes the data slice, the normalize flag and the Mahalanobis metric to w.
+// @receiver b
+// @param w io.Writer - The stream to write to.
+// @return error - An error if something goes wrong.
+func (b *BruteForceSearch) Save(w io.Writer) error {
+	encoder := gob.NewEncoder(w)
+	aux := bruteForceGob{
+		Data:        b.data,
+		Normalize:   b.normalize,
+		Mahalanobis: b.mahalanobis,
+	}
+	return encoder.Encode(&aux)
+}
+
+// Load
+//
+// @Description: Reads the data slice, the normalize flag and the Mahalanobis metric written by Save from r.
+// Streams written before the normalize flag was persisted only contain the data slice.
+// @receiver b
+// @param r io.Reader - The stream to read from.
+// @return error - An error if something goes wrong.
+func (b *BruteForceSearch) Load(r io.Reader) error {
+	// 旧格式需要从头重新解码,因此先读入内存
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	aux := bruteForceGob{}
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&aux); err != nil {
+		// 兼容旧格式:流中只有 data 切片
+		var data []Vector
+		if legacyErr := gob.NewDecoder(bytes.NewReader(raw)).Decode(&data); legacyErr != nil {
+			return err
+		}
+		aux = bruteForceGob{Data: data}
+	}
+
+	b.mu.Lock()
+	b.data = aux.Data
+	b.mu.Unlock()
+	b.normalize = aux.Normalize
+	b.mahalanobis = aux.Mahalanobis
+	b.resetValueCounts()
+	// 降维视图与访问记录不持久化,加载后需要重新构建
+	b.reduced = nil
+	if b.lastAccess != nil {
+		b.lastAccess = nil
+		b.EnableAccessTracking()
+	}
+	return nil
+}
+
+// SaveToFileCompressed saves the BruteForceSearch to a gzip-compressed file.
+func (b *BruteForceSearch) SaveToFileCompressed(filename string) error {
+	return saveCompressed(filename, b.Save)
+}
+
+// LoadFromFileCompressed loads the BruteForceSearch from a file written by SaveToFileCompressed.
+func (b *BruteForceSearch) LoadFromFileCompressed(filename string) error {
+	return loadCompressed(filename, b.Load)
+}
+
 // SaveToFile implements the Persistence interface for BruteForceSearch.
 //
-// @Description: Saves the data slice to a file.
+// @Description: Saves the data slice and the normalize flag to a file.
 // @receiver b
 // @param filename string - The name of the file to save to.
 // @return error - An error if something goes wrong.
@@ -205,17 +1222,12 @@ func (b *BruteForceSearch) SaveToFile(filename string) error {
 	}
 	defer file.Close()
 
-	encoder := gob.NewEncoder(file)
-	if err := encoder.Encode(b.data); err != nil {
-		return err
-	}
-
-	return nil
+	return b.Save(file)
 }
 
 // LoadFromFile implements the Persistence interface for BruteForceSearch.
 //
-// @Description: Loads the data slice from a file.
+// @Description: Loads the data slice and the normalize flag from a file.
 // @receiver b
 // @param filename string - The name of the file to load from.
 // @return error - An error if something goes wrong.
@@ -226,10 +1238,5 @@ func (b *BruteForceSearch) LoadFromFile(filename string) error {
 	}
 	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	if err := decoder.Decode(&b.data); err != nil {
-		return err
-	}
-
-	return nil
+	return b.Load(file)
 }
@@ -0,0 +1,240 @@
+package core
+
+// 聚类相关的工具函数
+
+import (
+	"errors"
+	"hh_vectordb/basic"
+	"math"
+	"sort"
+)
+
+// silhouetteExactLimit 超过该规模时,只与最近的其他簇(通过簇中心索引查找)比较
+const silhouetteExactLimit = 2000
+
+// SilhouetteScore
+//
+//	@Description: 计算所有点的平均轮廓系数 s = (b - a) / max(a, b),
+//	a 为点到同簇其他点的平均距离,b 为点到最近的其他簇中各点的平均距离。
+//	数据量较大时先用簇中心的暴力索引找到每个点最近的其他簇,只计算该簇的平均距离
+//	@param vectors 向量集合
+//	@param assignments 每个向量所属的簇编号,负数表示噪声点,不参与计算
+//	@return float64 平均轮廓系数,取值 [-1, 1],簇少于两个时返回 0
+func SilhouetteScore(vectors []Vector, assignments []int) float64 {
+	if len(vectors) == 0 || len(vectors) != len(assignments) {
+		return 0
+	}
+
+	clusters := make(map[int][]Vector)
+	for i, vec := range vectors {
+		if assignments[i] >= 0 {
+			clusters[assignments[i]] = append(clusters[assignments[i]], vec)
+		}
+	}
+	if len(clusters) < 2 {
+		return 0
+	}
+
+	// 簇中心索引,ID 为簇编号
+	var centroidIndex *BruteForceSearch
+	if len(vectors) > silhouetteExactLimit {
+		centroids := make([]Vector, 0, len(clusters))
+		for label, members := range clusters {
+			centroid := basic.Centroid(members)
+			centroid.ID = int64(label)
+			centroids = append(centroids, centroid)
+		}
+		centroidIndex = NewBruteForceSearch(centroids)
+	}
+
+	meanDistance := func(vec Vector, members []Vector, excludeSelf bool) float64 {
+		sum := 0.0
+		count := 0
+		for _, other := range members {
+			if excludeSelf && other.ID == vec.ID {
+				excludeSelf = false
+				continue
+			}
+			sum += basic.EuclidDistanceVec(vec, other)
+			count++
+		}
+		if count == 0 {
+			return 0
+		}
+		return sum / float64(count)
+	}
+
+	total := 0.0
+	count := 0
+	for i, vec := range vectors {
+		label := assignments[i]
+		if label < 0 {
+			continue
+		}
+		count++
+		own := clusters[label]
+		if len(own) < 2 {
+			// 单点簇的轮廓系数定义为 0
+			continue
+		}
+		a := meanDistance(vec, own, true)
+
+		b := -1.0
+		if centroidIndex != nil {
+			nearestCentroids, _ := centroidIndex.KNearest(vec, 2)
+			for _, centroid := range nearestCentroids {
+				if int(centroid.ID) != label {
+					b = meanDistance(vec, clusters[int(centroid.ID)], false)
+					break
+				}
+			}
+		} else {
+			for other, members := range clusters {
+				if other == label {
+					continue
+				}
+				if d := meanDistance(vec, members, false); b < 0 || d < b {
+					b = d
+				}
+			}
+		}
+
+		if maxAB := math.Max(a, b); maxAB > 0 {
+			total += (b - a) / maxAB
+		}
+	}
+
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
+
+// KNNClusters
+//
+//	@Description: 基于互为 k-近邻图的简单图聚类:两个向量互相出现在对方的 k 个最近邻中时连边,
+//	用并查集求连通分量,每个连通分量即为一个簇
+//	@param index 任意最近邻索引
+//	@param k 构图时每个向量的邻居个数
+//	@return [][]int64 每个簇包含的向量 ID,簇内按 ID 升序,簇之间按最小 ID 升序
+//	@return error
+func KNNClusters(index NearestNeighborSearch, k int) ([][]int64, error) {
+	graph, err := BuildKNNGraph(index, k)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := make(map[int64]int64, len(graph))
+	for id := range graph {
+		parent[id] = id
+	}
+	var find func(id int64) int64
+	find = func(id int64) int64 {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+
+	for id, neighbors := range graph {
+		for _, neighbor := range neighbors {
+			if !containsID(graph[neighbor], id) {
+				continue
+			}
+			if rootA, rootB := find(id), find(neighbor); rootA != rootB {
+				parent[rootA] = rootB
+			}
+		}
+	}
+
+	components := make(map[int64][]int64)
+	for id := range graph {
+		root := find(id)
+		components[root] = append(components[root], id)
+	}
+	clusters := make([][]int64, 0, len(components))
+	for _, members := range components {
+		sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+		clusters = append(clusters, members)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i][0] < clusters[j][0] })
+	return clusters, nil
+}
+
+// containsID 判断 ids 中是否包含 id
+func containsID(ids []int64, id int64) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// DBSCANNoise DBSCAN 中噪声点的标签
+const DBSCANNoise = -1
+
+// DBSCAN
+//
+//	@Description: 基于密度的聚类。epsilon 邻域内(含自身)至少有 minPts 个向量的点为核心点,
+//	从核心点出发沿密度可达关系扩展簇,不属于任何簇的点标记为噪声 DBSCANNoise。
+//	邻域查询使用 index.SearchWithinRange,因此 epsilon 按索引自身的度量(如 WithMetric 指定的余弦距离)解释,
+//	可配合同一索引上的 KDistances 选择 epsilon。向量按 ID 升序处理,簇编号从 0 开始依次分配
+//	@param index 任意最近邻索引
+//	@param epsilon 邻域半径
+//	@param minPts 核心点邻域内的最少向量数
+//	@return map[int64]int 向量 ID 到簇编号的映射
+//	@return error
+func DBSCAN(index NearestNeighborSearch, epsilon float64, minPts int) (map[int64]int, error) {
+	if epsilon <= 0 {
+		return nil, errors.New("epsilon should be greater than 0")
+	}
+	if minPts <= 0 {
+		return nil, errors.New("minPts should be greater than 0")
+	}
+	stored, err := index.Vectors()
+	if err != nil {
+		return nil, err
+	}
+	vectors := append([]Vector(nil), stored...)
+	sort.Slice(vectors, func(i, j int) bool { return vectors[i].ID < vectors[j].ID })
+
+	labels := make(map[int64]int, len(vectors))
+	cluster := 0
+	for _, vec := range vectors {
+		if _, visited := labels[vec.ID]; visited {
+			continue
+		}
+		neighbors, err := index.SearchWithinRange(vec, epsilon)
+		if err != nil {
+			return nil, err
+		}
+		if len(neighbors) < minPts {
+			// 之后可能作为边界点被并入某个簇
+			labels[vec.ID] = DBSCANNoise
+			continue
+		}
+
+		labels[vec.ID] = cluster
+		for i := 0; i < len(neighbors); i++ {
+			neighbor := neighbors[i]
+			if label, visited := labels[neighbor.ID]; visited {
+				if label == DBSCANNoise {
+					labels[neighbor.ID] = cluster
+				}
+				continue
+			}
+			labels[neighbor.ID] = cluster
+			expansion, err := index.SearchWithinRange(neighbor, epsilon)
+			if err != nil {
+				return nil, err
+			}
+			// 只有核心点继续扩展
+			if len(expansion) >= minPts {
+				neighbors = append(neighbors, expansion...)
+			}
+		}
+		cluster++
+	}
+	return labels, nil
+}
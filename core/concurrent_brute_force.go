@@ -0,0 +1,173 @@
+package core
+
+// 支持多个 goroutine 高吞吐写入的暴力搜索
+
+import (
+	"errors"
+	"sync"
+)
+
+// defaultWriterBatchSize BatchWriter 默认的缓冲区大小
+const defaultWriterBatchSize = 256
+
+// ConcurrentBruteForce 面向多生产者写入的暴力搜索。
+// 每个生产者通过 NewWriter 获取自己的 BatchWriter,向量先写入该写入器私有的缓冲区,
+// 缓冲区写满或调用 Flush 时才在锁内一次性追加到索引,从而把每个向量一次加锁降为每批一次。
+// 查询持有读锁,只能看到已经刷新的向量;与 SafeIndex 相同,内部索引不能开启访问跟踪
+type ConcurrentBruteForce struct {
+	inner *BruteForceSearch
+	mu    sync.RWMutex
+}
+
+// BatchWriter 单个生产者的写入缓冲区,不能被多个 goroutine 同时使用
+type BatchWriter struct {
+	index     *ConcurrentBruteForce
+	buffer    []Vector
+	batchSize int
+}
+
+// NewConcurrentBruteForce
+//
+//	@Description: 创建多生产者写入的暴力搜索
+//	@param vectors 初始向量
+//	@param opts 传给内部 BruteForceSearch 的选项
+//	@return *ConcurrentBruteForce
+func NewConcurrentBruteForce(vectors []Vector, opts ...Option) *ConcurrentBruteForce {
+	return &ConcurrentBruteForce{inner: NewBruteForceSearch(vectors, opts...)}
+}
+
+// NewWriter
+//
+//	@Description: 为一个生产者创建写入器
+//	@receiver c
+//	@param batchSize 缓冲区写满多少个向量后刷新,<= 0 时使用默认值 256
+//	@return *BatchWriter
+func (c *ConcurrentBruteForce) NewWriter(batchSize int) *BatchWriter {
+	if batchSize <= 0 {
+		batchSize = defaultWriterBatchSize
+	}
+	return &BatchWriter{index: c, buffer: make([]Vector, 0, batchSize), batchSize: batchSize}
+}
+
+// Insert
+//
+//	@Description: 缓冲 vec,缓冲区写满时刷新到索引
+//	@receiver w
+//	@param vec
+//	@return error
+func (w *BatchWriter) Insert(vec Vector) error {
+	w.buffer = append(w.buffer, vec)
+	if len(w.buffer) >= w.batchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush
+//
+//	@Description: 在锁内把缓冲区中的向量全部追加到索引。生产者结束写入前必须调用,否则剩余向量对查询不可见
+//	@receiver w
+//	@return error
+func (w *BatchWriter) Flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	err := w.index.InsertBatch(w.buffer)
+	w.buffer = w.buffer[:0]
+	return err
+}
+
+// Pending 返回缓冲区中尚未刷新的向量数
+func (w *BatchWriter) Pending() int {
+	return len(w.buffer)
+}
+
+// Insert
+//
+//	@Description: 不经缓冲直接在锁内插入单个向量
+//	@receiver c
+//	@param vec
+//	@return error
+func (c *ConcurrentBruteForce) Insert(vec Vector) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inner.Insert(vec)
+}
+
+// InsertBatch
+//
+//	@Description: 在一次加锁内插入多个向量。逐个追加而不调用 BruteForceSearch.InsertBatch,
+//	因为后者按本批大小精确扩容,频繁的小批量刷新会导致每次都复制全部数据
+//	@receiver c
+//	@param vectors
+//	@return error
+func (c *ConcurrentBruteForce) InsertBatch(vectors []Vector) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, vec := range vectors {
+		if err := c.inner.Insert(vec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ConcurrentBruteForce) Nearest(query Vector) (Vector, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.inner.Nearest(query)
+}
+
+func (c *ConcurrentBruteForce) KNearest(query Vector, k int) ([]Vector, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.inner.KNearest(query, k)
+}
+
+func (c *ConcurrentBruteForce) SearchWithinRange(query Vector, radius float64) ([]Vector, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.inner.SearchWithinRange(query, radius)
+}
+
+func (c *ConcurrentBruteForce) Delete(vec Vector) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inner.Delete(vec)
+}
+
+func (c *ConcurrentBruteForce) DeleteBatch(vectors []Vector) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inner.DeleteBatch(vectors)
+}
+
+// Vectors
+//
+//	@Description: 返回已刷新向量的副本,不包含各写入器缓冲区中的向量
+//	@receiver c
+//	@return []Vector
+//	@return error
+func (c *ConcurrentBruteForce) Vectors() ([]Vector, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]Vector(nil), c.inner.snapshot()...), nil
+}
+
+// Describe
+//
+//	@Description: 返回已刷新的向量数、维度与索引类型 "concurrent_brute_force"
+//	@receiver c
+//	@return count
+//	@return dim
+//	@return indexType
+//	@return err
+func (c *ConcurrentBruteForce) Describe() (count int, dim int, indexType string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	count, dim, _, err = c.inner.Describe()
+	return count, dim, "concurrent_brute_force", err
+}
@@ -1,29 +1,125 @@
 package core
 
 import (
+	"container/heap"
 	"encoding/gob"
 	"errors"
-	"hh_vectordb/basic"
+	"io"
 	"math"
+	"math/rand"
 	"os"
 	"sort"
 )
 
+const (
+	defaultCoverBase     = 1.5
+	minCoverBase         = 1.1
+	maxCoverBase         = 4.0
+	coverBaseSamplePairs = 1000
+)
+
 type CoverTreeNode struct {
 	Point     Vector
 	Level     int
 	Children  []*CoverTreeNode
-	MaxMetric float64
+	MaxMetric float64 // upper bound on the distance from Point to any point in its subtree
 }
 
 type CoverTree struct {
 	Root *CoverTreeNode
 	Size int
 	Base float64
+
+	distFunc DistanceFunc // metric set by WithMetric, nil means Euclidean
+}
+
+// NewCoverTree creates an empty cover tree with the given base. The CoverTree does not support
+// WithNormalize and ignores it; use NewCoverTreeChecked to get an error instead.
+func NewCoverTree(base float64, opts ...Option) *CoverTree {
+	return &CoverTree{Base: base, distFunc: newIndexOptions(opts).distance}
+}
+
+// NewCoverTreeChecked is NewCoverTree, but returns an error when given WithNormalize.
+func NewCoverTreeChecked(base float64, opts ...Option) (*CoverTree, error) {
+	if err := checkNormalizeUnsupported(newIndexOptions(opts)); err != nil {
+		return nil, err
+	}
+	return NewCoverTree(base, opts...), nil
+}
+
+// dist measures the distance between a and b with the tree's metric.
+func (ct *CoverTree) dist(a, b Vector) float64 {
+	return measure(ct.distFunc, a, b)
+}
+
+// RecommendCoverBase suggests a base from sampled pairwise distances. The base is chosen so that
+// the levels between the small-scale and the large-scale distances of the data number about
+// log2(n), which keeps the tree neither a deep chain (base too small) nor flat (base too large).
+func RecommendCoverBase(vectors []Vector) float64 {
+	return recommendCoverBase(vectors, nil)
 }
 
-func NewCoverTree(base float64) *CoverTree {
-	return &CoverTree{Base: base}
+// recommendCoverBase is RecommendCoverBase under the given metric.
+func recommendCoverBase(vectors []Vector, distFunc DistanceFunc) float64 {
+	if len(vectors) < 2 {
+		return defaultCoverBase
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	dists := make([]float64, 0, coverBaseSamplePairs)
+	for i := 0; i < coverBaseSamplePairs; i++ {
+		a := vectors[rng.Intn(len(vectors))]
+		b := vectors[rng.Intn(len(vectors))]
+		if d := measure(distFunc, a, b); d > 0 {
+			dists = append(dists, d)
+		}
+	}
+	if len(dists) < 2 {
+		return defaultCoverBase
+	}
+	sort.Float64s(dists)
+
+	minDist := dists[len(dists)/100]
+	maxDist := dists[len(dists)-1]
+	levels := math.Log2(float64(len(vectors)))
+	if minDist <= 0 || maxDist <= minDist || levels < 1 {
+		return defaultCoverBase
+	}
+
+	base := math.Pow(maxDist/minDist, 1/levels)
+	return math.Max(minCoverBase, math.Min(maxCoverBase, base))
+}
+
+// NewCoverTreeAuto builds a cover tree over vectors using RecommendCoverBase. It returns an error
+// when given WithNormalize, and the error of the first vector that cannot be inserted, e.g. an
+// exact duplicate.
+func NewCoverTreeAuto(vectors []Vector, opts ...Option) (*CoverTree, error) {
+	ct, err := NewCoverTreeChecked(recommendCoverBase(vectors, newIndexOptions(opts).distance), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := ct.InsertBatch(vectors); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// Height returns the number of nodes on the longest root-to-leaf path.
+func (ct *CoverTree) Height() int {
+	return coverTreeHeight(ct.Root)
+}
+
+func coverTreeHeight(node *CoverTreeNode) int {
+	if node == nil {
+		return 0
+	}
+	height := 0
+	for _, child := range node.Children {
+		if h := coverTreeHeight(child); h > height {
+			height = h
+		}
+	}
+	return height + 1
 }
 
 func (ct *CoverTree) Insert(vec Vector) error {
@@ -43,22 +139,24 @@ func (ct *CoverTree) Insert(vec Vector) error {
 
 	// Only create a new root if there's no other option
 	newRoot := &CoverTreeNode{
-		Point:    vec,
-		Level:    ct.Root.Level + 1,
-		Children: []*CoverTreeNode{ct.Root},
+		Point:     vec,
+		Level:     ct.Root.Level + 1,
+		Children:  []*CoverTreeNode{ct.Root},
+		MaxMetric: ct.dist(vec, ct.Root.Point) + ct.Root.MaxMetric,
 	}
 	ct.Root = newRoot
 	return nil
 }
 
 func (ct *CoverTree) insert(node *CoverTreeNode, vec Vector) error {
-	d := basic.EuclidDistanceVec(node.Point, vec)
+	d := ct.dist(node.Point, vec)
 	if d == 0 {
 		return errors.New("duplicate vector")
 	}
 
 	childLevel := node.Level - 1
 	if d < math.Pow(ct.Base, float64(childLevel)) {
+		node.MaxMetric = math.Max(node.MaxMetric, d)
 		for _, child := range node.Children {
 			if err := ct.insert(child, vec); err == nil {
 				return nil
@@ -76,11 +174,19 @@ func (ct *CoverTree) Nearest(query Vector) (Vector, error) {
 	return vec, err
 }
 
+func (ct *CoverTree) NearestExcludingSelf(query Vector) (Vector, error) {
+	vectors, err := ct.Vectors()
+	if err != nil {
+		return Vector{}, err
+	}
+	return nearestExcludingSelf(ct, query, len(vectors))
+}
+
 func (ct *CoverTree) nearest(node *CoverTreeNode, query Vector, currentBest float64) (float64, Vector, error) {
 	if node == nil {
 		return currentBest, Vector{}, nil
 	}
-	d := basic.EuclidDistanceVec(node.Point, query)
+	d := ct.dist(node.Point, query)
 	if d < currentBest {
 		currentBest = d
 	}
@@ -89,7 +195,7 @@ func (ct *CoverTree) nearest(node *CoverTreeNode, query Vector, currentBest floa
 	bestVec := node.Point
 
 	for _, child := range node.Children {
-		if basic.EuclidDistanceVec(child.Point, query)-math.Pow(ct.Base, float64(child.Level)) < currentBest {
+		if ct.dist(child.Point, query)-math.Pow(ct.Base, float64(child.Level)) < currentBest {
 			dist, vec, err := ct.nearest(child, query, bestDist)
 			if err != nil {
 				return bestDist, bestVec, err
@@ -108,7 +214,7 @@ func (ct *CoverTree) nearestV2(node *CoverTreeNode, query Vector, currentBestDis
 		return math.MaxFloat64, Vector{}, errors.New("node is nil")
 	}
 
-	d := basic.EuclidDistanceVec(node.Point, query)
+	d := ct.dist(node.Point, query)
 	if d < currentBestDistance {
 		currentBestDistance = d
 	}
@@ -118,7 +224,7 @@ func (ct *CoverTree) nearestV2(node *CoverTreeNode, query Vector, currentBestDis
 	for _, child := range node.Children {
 		// Pruning step: Compute the minimum distance from the query to any point in child's subtree
 		// Note: This is a simplistic bound. You can use more sophisticated bounds based on Cover Tree properties
-		bound := basic.EuclidDistanceVec(child.Point, query) - math.Pow(ct.Base, float64(child.Level))
+		bound := ct.dist(child.Point, query) - math.Pow(ct.Base, float64(child.Level))
 
 		if bound > currentBestDistance {
 			continue // Prune this branch
@@ -143,18 +249,83 @@ func (ct *CoverTree) KNearest(query Vector, k int) ([]Vector, error) {
 	return results, nil
 }
 
+// VerifiedNearest is a debugging aid: it checks the CoverTree's 1-nearest answer against a brute-force scan
+// and falls back to the scanned answer when they disagree. The bool reports whether they matched.
+func (ct *CoverTree) VerifiedNearest(query Vector) (Vector, bool, error) {
+	return verifiedNearest(ct, query, ct.dist)
+}
+
+// KNearestWithMaxDistances is a best-first k-nearest search that prunes subtrees with their
+// MaxMetric radius and stops after maxDistances distance computations, returning the best results
+// found so far. This bounds the latency of queries where pruning fails. maxDistances <= 0 means
+// no cap, in which case the results are exact.
+func (ct *CoverTree) KNearestWithMaxDistances(query Vector, k, maxDistances int) ([]Vector, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
+	}
+	if ct.Root == nil {
+		return []Vector{}, errors.New("tree is empty")
+	}
+
+	pq := make(PriorityQueue, 0, k)
+	frontier := &frontierQueue{}
+	rootDist := ct.dist(query, ct.Root.Point)
+	computed := 1
+	pushCandidate(&pq, ct.Root.Point, rootDist, k)
+	heap.Push(frontier, frontierItem{node: ct.Root, bound: math.Max(0, rootDist-ct.Root.MaxMetric)})
+	for frontier.Len() > 0 {
+		item := heap.Pop(frontier).(frontierItem)
+		if pq.Len() == k && item.bound >= pq[0].Distance {
+			break
+		}
+		for _, child := range item.node.(*CoverTreeNode).Children {
+			if maxDistances > 0 && computed >= maxDistances {
+				return drainAscending(&pq), nil
+			}
+			d := ct.dist(query, child.Point)
+			computed++
+			pushCandidate(&pq, child.Point, d, k)
+			if len(child.Children) > 0 {
+				bound := math.Max(item.bound, d-child.MaxMetric)
+				heap.Push(frontier, frontierItem{node: child, bound: bound})
+			}
+		}
+	}
+	return drainAscending(&pq), nil
+}
+
+// recomputeMaxMetric rebuilds the MaxMetric bounds bottom-up, e.g. for trees saved before they were maintained.
+func (ct *CoverTree) recomputeMaxMetric(node *CoverTreeNode) {
+	node.MaxMetric = 0
+	for _, child := range node.Children {
+		ct.recomputeMaxMetric(child)
+		node.MaxMetric = math.Max(node.MaxMetric, ct.dist(node.Point, child.Point)+child.MaxMetric)
+	}
+}
+
+// SelfRank queries with the stored vector for id and returns the 0-based rank of id in the top-k,
+// or -1 if it is outside the top-k. It measures the self-recall of an index in leave-one-out tests.
+func (ct *CoverTree) SelfRank(id int64, k int) (int, error) {
+	return selfRank(ct, id, k)
+}
+
+// KNearestReversed returns the same top-k as KNearest, ordered from farthest to nearest.
+func (ct *CoverTree) KNearestReversed(query Vector, k int) ([]Vector, error) {
+	return kNearestReversed(ct, query, k)
+}
+
 func (ct *CoverTree) kNearest(node *CoverTreeNode, query Vector, results *[]Vector, k int) {
 	if node == nil {
 		return
 	}
 
-	d := basic.EuclidDistanceVec(node.Point, query)
+	d := ct.dist(node.Point, query)
 
 	// Check if this node's point should be in the top-k results
 	if len(*results) < k {
 		*results = append(*results, node.Point)
 	} else {
-		maxDist := basic.EuclidDistanceVec((*results)[k-1], query)
+		maxDist := ct.dist((*results)[k-1], query)
 		if d < maxDist {
 			(*results)[k-1] = node.Point
 		}
@@ -162,7 +333,7 @@ func (ct *CoverTree) kNearest(node *CoverTreeNode, query Vector, results *[]Vect
 
 	// Sort results by distance to ensure only top-k are kept
 	sort.Slice(*results, func(i, j int) bool {
-		return basic.EuclidDistanceVec((*results)[i], query) < basic.EuclidDistanceVec((*results)[j], query)
+		return ct.dist((*results)[i], query) < ct.dist((*results)[j], query)
 	})
 
 	// Recurse into children nodes
@@ -193,11 +364,21 @@ func (ct *CoverTree) collectVectors(node *CoverTreeNode, results *[]Vector) {
 }
 
 func (ct *CoverTree) Delete(vec Vector) error {
+	return ct.deleteMatching(vec, Vector.Equals)
+}
+
+// deleteExact deletes the point with both the ID and the values of vec, leaving duplicates of its
+// values under other IDs in place.
+func (ct *CoverTree) deleteExact(vec Vector) error {
+	return ct.deleteMatching(vec, sameVector)
+}
+
+func (ct *CoverTree) deleteMatching(vec Vector, match func(a, b Vector) bool) error {
 	if ct.Root == nil {
 		return errors.New("tree is empty")
 	}
 
-	if ct.Root.Point.Equals(vec) {
+	if match(ct.Root.Point, vec) {
 		if len(ct.Root.Children) == 0 {
 			ct.Root = nil
 		} else {
@@ -214,12 +395,17 @@ func (ct *CoverTree) Delete(vec Vector) error {
 		return nil
 	}
 
-	return ct.delete(ct.Root, vec)
+	return ct.delete(ct.Root, vec, match)
 }
 
-func (ct *CoverTree) delete(node *CoverTreeNode, vec Vector) error {
+// DeleteAndReturn deletes the vector with the given ID and returns the removed point.
+func (ct *CoverTree) DeleteAndReturn(id int64) (Vector, error) {
+	return deleteAndReturn(ct, id)
+}
+
+func (ct *CoverTree) delete(node *CoverTreeNode, vec Vector, match func(a, b Vector) bool) error {
 	for i, child := range node.Children {
-		if child.Point.Equals(vec) {
+		if match(child.Point, vec) {
 			// if the node to be deleted has children, promote one of them
 			if len(child.Children) > 0 {
 				promote := child.Children[0]
@@ -240,7 +426,7 @@ func (ct *CoverTree) delete(node *CoverTreeNode, vec Vector) error {
 	}
 
 	for _, child := range node.Children {
-		err := ct.delete(child, vec)
+		err := ct.delete(child, vec, match)
 		if err == nil {
 			return nil
 		}
@@ -267,7 +453,7 @@ func (ct *CoverTree) kNearestV2(node *CoverTreeNode, query Vector, results *[]Ve
 		return
 	}
 
-	d := basic.EuclidDistanceVec(node.Point, query)
+	d := ct.dist(node.Point, query)
 
 	if len(*results) < k {
 		*results = append(*results, node.Point)
@@ -285,7 +471,7 @@ func (ct *CoverTree) kNearestV2(node *CoverTreeNode, query Vector, results *[]Ve
 	// Pruning step
 	if len(*currentBest) == k {
 		maxDist := (*currentBest)[k-1]
-		bound := basic.EuclidDistanceVec(node.Point, query) - math.Pow(ct.Base, float64(node.Level))
+		bound := ct.dist(node.Point, query) - math.Pow(ct.Base, float64(node.Level))
 		if bound >= maxDist {
 			return
 		}
@@ -317,6 +503,10 @@ func (ct *CoverTree) InsertBatch(vectors []Vector) error {
 	return nil
 }
 
+func (ct *CoverTree) InsertPaged(fetch func(offset, limit int) ([]Vector, error), pageSize int) error {
+	return insertPaged(fetch, pageSize, ct.InsertBatch)
+}
+
 func (ct *CoverTree) DeleteBatch(vectors []Vector) error {
 	for _, vec := range vectors {
 		err := ct.Delete(vec)
@@ -338,18 +528,58 @@ func (ct *CoverTree) searchWithinRange(node *CoverTreeNode, query Vector, radius
 		return
 	}
 
-	if basic.EuclidDistanceVec(node.Point, query) <= radius {
+	if ct.dist(node.Point, query) <= radius {
 		*results = append(*results, node.Point)
 	}
 
 	for _, child := range node.Children {
-		bound := basic.EuclidDistanceVec(child.Point, query) - math.Pow(ct.Base, float64(child.Level))
+		bound := ct.dist(child.Point, query) - math.Pow(ct.Base, float64(child.Level))
 		if bound <= radius {
 			ct.searchWithinRange(child, query, radius, results)
 		}
 	}
 }
 
+// Describe returns the number of vectors, their dimension (0 when empty) and the type name "cover_tree",
+// counted by walking the tree.
+func (ct *CoverTree) Describe() (count int, dim int, indexType string, err error) {
+	return describe(ct, "cover_tree")
+}
+
+// Config reports the construction parameters: the base and the metric.
+func (ct *CoverTree) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"base":   ct.Base,
+		"metric": metricName(ct.distFunc),
+	}
+}
+
+func (ct *CoverTree) Save(w io.Writer) error {
+	encoder := gob.NewEncoder(w)
+	return encoder.Encode(ct)
+}
+
+func (ct *CoverTree) Load(r io.Reader) error {
+	decoder := gob.NewDecoder(r)
+	if err := decoder.Decode(ct); err != nil {
+		return err
+	}
+	if ct.Root != nil {
+		ct.recomputeMaxMetric(ct.Root)
+	}
+	return nil
+}
+
+// SaveToFileCompressed saves the CoverTree to a gzip-compressed file.
+func (ct *CoverTree) SaveToFileCompressed(filename string) error {
+	return saveCompressed(filename, ct.Save)
+}
+
+// LoadFromFileCompressed loads the CoverTree from a file written by SaveToFileCompressed.
+func (ct *CoverTree) LoadFromFileCompressed(filename string) error {
+	return loadCompressed(filename, ct.Load)
+}
+
 func (ct *CoverTree) SaveToFile(filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
@@ -357,9 +587,7 @@ func (ct *CoverTree) SaveToFile(filename string) error {
 	}
 	defer file.Close()
 
-	encoder := gob.NewEncoder(file)
-	err = encoder.Encode(ct)
-	return err
+	return ct.Save(file)
 }
 
 func (ct *CoverTree) LoadFromFile(filename string) error {
@@ -369,7 +597,5 @@ func (ct *CoverTree) LoadFromFile(filename string) error {
 	}
 	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	err = decoder.Decode(ct)
-	return err
+	return ct.Load(file)
 }
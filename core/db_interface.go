@@ -1,9 +1,14 @@
 package core
 
-import "hh_vectordb/basic"
+import (
+	"hh_vectordb/basic"
+	"io"
+)
 
 type Vector = basic.Vector
 
+type Metric = basic.Metric
+
 // NearestNeighborSearch 基础的最近邻搜索
 type NearestNeighborSearch interface {
 	// Insert 插入
@@ -30,7 +35,7 @@ type BatchOperator interface {
 	DeleteBatch(vectors []Vector) error
 }
 
-// RangeSearch 范围搜索
+// RangeSearch 范围搜索,范围内没有向量时返回空结果和 nil 错误
 type RangeSearch interface {
 	SearchWithinRange(query Vector, radius float64) ([]Vector, error)
 }
@@ -42,6 +47,10 @@ type KNearestSearch interface {
 
 // Persistence 持久化
 type Persistence interface {
+	// Save 序列化到任意输出流,SaveToFile 基于它实现
+	Save(w io.Writer) error
+	// Load 从任意输入流反序列化,LoadFromFile 基于它实现
+	Load(r io.Reader) error
 	SaveToFile(filename string) error
 	LoadFromFile(filename string) error
 }
@@ -61,6 +70,17 @@ type Statistics interface {
 	Stats() map[string]interface{}
 }
 
+// Configuration 导出索引的构造参数,便于复现与记录日志,与描述运行时状态的 Statistics 互补
+type Configuration interface {
+	Config() map[string]interface{}
+}
+
+// Description 不取出向量的轻量自检,返回向量数、维度(取第一个向量,空索引为 0)与索引类型名,
+// 用于加载索引后核对内容
+type Description interface {
+	Describe() (count int, dim int, indexType string, err error)
+}
+
 // Concurrency 并发操作
 type Concurrency interface {
 	Lock()
@@ -0,0 +1,267 @@
+package core
+
+// 以低精度分量连续存储向量的暴力搜索的公共实现,Float16BruteForce 与 Float32BruteForce 共用
+
+import (
+	"errors"
+	"math"
+)
+
+// flatCodec 分量在 float64 与存储类型 T 之间的转换。实现为零大小的类型,
+// 零值的索引(如 &Float16BruteForce{})无需初始化即可使用
+type flatCodec[T uint16 | float32] interface {
+	// encode 把分量量化为存储类型
+	encode(val float64) T
+	// decode 把存储的分量还原为 float32,距离以 float32 精度计算
+	decode(val T) float32
+	// indexType Describe 返回的索引类型名
+	indexType() string
+}
+
+// flatBruteForce 所有分量连续存放在一个 T 切片中的暴力搜索,由 C 决定分量的编码方式
+type flatBruteForce[T uint16 | float32, C flatCodec[T]] struct {
+	dim    int
+	ids    []int64
+	values []T // 第 i 个向量的分量为 values[i*dim : (i+1)*dim]
+	codec  C
+}
+
+// row 返回第 i 个向量存储的分量
+func (f *flatBruteForce[T, C]) row(i int) []T {
+	return f.values[i*f.dim : (i+1)*f.dim]
+}
+
+// encodeValues 把向量分量编码为存储类型
+func (f *flatBruteForce[T, C]) encodeValues(values []float64) []T {
+	encoded := make([]T, len(values))
+	for j, val := range values {
+		encoded[j] = f.codec.encode(val)
+	}
+	return encoded
+}
+
+// decodeVector 把第 i 个向量还原为 float64 向量
+func (f *flatBruteForce[T, C]) decodeVector(i int) Vector {
+	values := make([]float64, f.dim)
+	for j, val := range f.row(i) {
+		values[j] = float64(f.codec.decode(val))
+	}
+	return Vector{ID: f.ids[i], Values: values}
+}
+
+// distance
+//
+//	@Description: 以 float32 精度计算查询向量与第 i 个向量之间的欧几里得距离
+//	@receiver f
+//	@param query 已转换为 float32 的查询向量
+//	@param i
+//	@return float64
+func (f *flatBruteForce[T, C]) distance(query []float32, i int) float64 {
+	var sum float32
+	for j, val := range f.row(i) {
+		diff := f.codec.decode(val) - query[j]
+		sum += diff * diff
+	}
+	return math.Sqrt(float64(sum))
+}
+
+// toFloat32 把查询向量的分量转换为 float32
+func toFloat32(values []float64) []float32 {
+	result := make([]float32, len(values))
+	for i, val := range values {
+		result[i] = float32(val)
+	}
+	return result
+}
+
+// checkDim 校验向量维度,空索引以第一个向量的维度为准
+func (f *flatBruteForce[T, C]) checkDim(vec Vector) error {
+	if len(f.ids) > 0 && len(vec.Values) != f.dim {
+		return errors.New("vector dimension does not match the index")
+	}
+	return nil
+}
+
+// Insert
+//
+//	@Description: 编码为存储类型后插入
+//	@receiver f
+//	@param vec
+//	@return error
+func (f *flatBruteForce[T, C]) Insert(vec Vector) error {
+	if err := f.checkDim(vec); err != nil {
+		return err
+	}
+	f.dim = len(vec.Values)
+	f.ids = append(f.ids, vec.ID)
+	for _, val := range vec.Values {
+		f.values = append(f.values, f.codec.encode(val))
+	}
+	return nil
+}
+
+// InsertBatch
+//
+//	@Description: 批量插入,预先扩容
+//	@receiver f
+//	@param vectors
+//	@return error
+func (f *flatBruteForce[T, C]) InsertBatch(vectors []Vector) error {
+	if need := len(f.ids) + len(vectors); need > cap(f.ids) && len(vectors) > 0 {
+		ids := make([]int64, len(f.ids), need)
+		copy(ids, f.ids)
+		f.ids = ids
+		values := make([]T, len(f.values), need*len(vectors[0].Values))
+		copy(values, f.values)
+		f.values = values
+	}
+	for _, vec := range vectors {
+		if err := f.Insert(vec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nearest
+//
+//	@Description: 最近邻
+//	@receiver f
+//	@param query
+//	@return Vector 还原为 float64 的向量
+//	@return error
+func (f *flatBruteForce[T, C]) Nearest(query Vector) (Vector, error) {
+	results, err := f.KNearest(query, 1)
+	if err != nil {
+		return Vector{}, err
+	}
+	if len(results) == 0 {
+		return Vector{}, errors.New("no vectors in the database")
+	}
+	return results[0], nil
+}
+
+// KNearest
+//
+//	@Description: k-近邻,使用大小为 k 的最大堆,只还原最终结果
+//	@receiver f
+//	@param query
+//	@param k
+//	@return []Vector 按距离升序,还原为 float64 的向量
+//	@return error
+func (f *flatBruteForce[T, C]) KNearest(query Vector, k int) ([]Vector, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
+	}
+	if err := f.checkDim(query); err != nil {
+		return nil, err
+	}
+	q := toFloat32(query.Values)
+	pq := make(PriorityQueue, 0, k)
+	for i := range f.ids {
+		// 堆中暂存下标,入选的向量在最后统一还原
+		pushCandidate(&pq, Vector{ID: int64(i)}, f.distance(q, i), k)
+	}
+	results := drainAscending(&pq)
+	for i, res := range results {
+		results[i] = f.decodeVector(int(res.ID))
+	}
+	return results, nil
+}
+
+// Vectors
+//
+//	@Description: 返回所有向量,分量为编码后还原的值
+//	@receiver f
+//	@return []Vector
+//	@return error
+func (f *flatBruteForce[T, C]) Vectors() ([]Vector, error) {
+	vectors := make([]Vector, len(f.ids))
+	for i := range vectors {
+		vectors[i] = f.decodeVector(i)
+	}
+	return vectors, nil
+}
+
+// Delete
+//
+//	@Description: 删除编码后与 vec 相等的第一个向量
+//	@receiver f
+//	@param vec
+//	@return error
+func (f *flatBruteForce[T, C]) Delete(vec Vector) error {
+	if len(vec.Values) != f.dim {
+		return errors.New("vector not found")
+	}
+	encoded := f.encodeValues(vec.Values)
+	for i := range f.ids {
+		if flatEqual(f.row(i), encoded) {
+			f.ids = append(f.ids[:i], f.ids[i+1:]...)
+			f.values = append(f.values[:i*f.dim], f.values[(i+1)*f.dim:]...)
+			return nil
+		}
+	}
+	return errors.New("vector not found")
+}
+
+// flatEqual 逐个比较两个向量存储的分量
+func flatEqual[T uint16 | float32](a, b []T) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DeleteBatch
+//
+//	@Description: 批量删除
+//	@receiver f
+//	@param vectors
+//	@return error
+func (f *flatBruteForce[T, C]) DeleteBatch(vectors []Vector) error {
+	for _, vec := range vectors {
+		if err := f.Delete(vec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchWithinRange
+//
+//	@Description: 范围搜索
+//	@receiver f
+//	@param query
+//	@param radius
+//	@return []Vector
+//	@return error
+func (f *flatBruteForce[T, C]) SearchWithinRange(query Vector, radius float64) ([]Vector, error) {
+	if err := f.checkDim(query); err != nil {
+		return nil, err
+	}
+	q := toFloat32(query.Values)
+	var results []Vector
+	for i := range f.ids {
+		if f.distance(q, i) <= radius {
+			results = append(results, f.decodeVector(i))
+		}
+	}
+	return results, nil
+}
+
+// Describe
+//
+//	@Description: 返回向量数、维度与编码方式对应的索引类型
+//	@receiver f
+//	@return count
+//	@return dim
+//	@return indexType
+//	@return err
+func (f *flatBruteForce[T, C]) Describe() (count int, dim int, indexType string, err error) {
+	if len(f.ids) > 0 {
+		dim = f.dim
+	}
+	return len(f.ids), dim, f.codec.indexType(), nil
+}
@@ -0,0 +1,93 @@
+package core
+
+// 以半精度浮点数(float16)存储向量的暴力搜索
+
+import (
+	"encoding/gob"
+	"hh_vectordb/basic"
+	"io"
+	"os"
+)
+
+// Float16BruteForce 把向量分量量化为 IEEE 754 半精度浮点数存储的暴力搜索。
+// 所有分量连续存放在一个 uint16 切片中,每个向量只占 2*dim 字节加 8 字节 ID,约为 float64 存储的 1/4。
+// 计算距离时分量先转换为 float32,精度损失来自量化(相对误差不超过 2^-11),
+// 适合分量范围在 ±65504 以内的数据
+type Float16BruteForce struct {
+	flatBruteForce[uint16, float16Codec]
+}
+
+// float16Codec 半精度分量的编码方式
+type float16Codec struct{}
+
+func (float16Codec) encode(val float64) uint16 { return basic.Float32ToFloat16(float32(val)) }
+func (float16Codec) decode(h uint16) float32   { return basic.Float16ToFloat32(h) }
+func (float16Codec) indexType() string         { return "float16_brute_force" }
+
+// float16Gob Float16BruteForce 的持久化结构
+type float16Gob struct {
+	Dim    int
+	IDs    []int64
+	Values []uint16
+}
+
+// NewFloat16BruteForce
+//
+//	@Description: 创建半精度暴力搜索并插入 vectors,维度由第一个插入的向量确定
+//	@param vectors 初始向量
+//	@return *Float16BruteForce vectors 维度不一致时返回 nil
+func NewFloat16BruteForce(vectors []Vector) *Float16BruteForce {
+	f := &Float16BruteForce{}
+	if err := f.InsertBatch(vectors); err != nil {
+		return nil
+	}
+	return f
+}
+
+// Save
+//
+//	@Description: 以半精度位表示写入 w
+//	@receiver f
+//	@param w
+//	@return error
+func (f *Float16BruteForce) Save(w io.Writer) error {
+	aux := float16Gob{Dim: f.dim, IDs: f.ids, Values: f.values}
+	return gob.NewEncoder(w).Encode(&aux)
+}
+
+// Load
+//
+//	@Description: 从 r 读取 Save 写出的向量
+//	@receiver f
+//	@param r
+//	@return error
+func (f *Float16BruteForce) Load(r io.Reader) error {
+	aux := float16Gob{}
+	if err := gob.NewDecoder(r).Decode(&aux); err != nil {
+		return err
+	}
+	f.dim = aux.Dim
+	f.ids = aux.IDs
+	f.values = aux.Values
+	return nil
+}
+
+func (f *Float16BruteForce) SaveToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return f.Save(file)
+}
+
+func (f *Float16BruteForce) LoadFromFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return f.Load(file)
+}
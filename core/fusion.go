@@ -0,0 +1,56 @@
+package core
+
+// 多路检索结果融合
+
+import "sort"
+
+// rrfRankConstant 加权倒数排名融合(RRF)中的平滑常数,与 RRF 原论文取值一致
+const rrfRankConstant = 60
+
+// FuseResults
+//
+//	@Description: 以加权倒数排名融合(weighted Reciprocal Rank Fusion)合并多个索引的有序结果,例如稠密与稀疏检索的混合召回。
+//	向量按 ID 识别,第 i 个列表中排名为 r(从 1 开始)的向量得分为 weights[i]/(60+r),各列表得分求和后取得分最高的 k 个。
+//	只使用排名而不使用距离,因此不同索引、不同度量下的距离无需归一化
+//	@param lists 各索引的检索结果,每个列表按距离升序
+//	@param weights 各列表的权重,为 nil 时权重均为 1;长度与 lists 不一致时返回 nil
+//	@param k 返回结果数,k <= 0 时返回 nil
+//	@return []SearchResult 按融合得分降序,Distance 为融合得分的倒数(越小越相关),
+//	Vector 取该 ID 第一次出现时的向量;得分相同时先出现的向量排在前面
+func FuseResults(lists [][]SearchResult, weights []float64, k int) []SearchResult {
+	if k <= 0 || (weights != nil && len(weights) != len(lists)) {
+		return nil
+	}
+	type fused struct {
+		vector Vector
+		score  float64
+	}
+	var order []*fused
+	byID := make(map[int64]*fused)
+	for i, list := range lists {
+		weight := 1.0
+		if weights != nil {
+			weight = weights[i]
+		}
+		for rank, res := range list {
+			entry, ok := byID[res.Vector.ID]
+			if !ok {
+				entry = &fused{vector: res.Vector}
+				byID[res.Vector.ID] = entry
+				order = append(order, entry)
+			}
+			entry.score += weight / float64(rrfRankConstant+rank+1)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return order[i].score > order[j].score
+	})
+	if len(order) > k {
+		order = order[:k]
+	}
+	results := make([]SearchResult, len(order))
+	for i, entry := range order {
+		results[i] = SearchResult{Vector: entry.vector, Distance: 1 / entry.score}
+	}
+	return results
+}
@@ -0,0 +1,424 @@
+package core
+
+// 基于 Hilbert 曲线排序的近似最近邻索引
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+const (
+	// maxHilbertBitsPerDim 每个维度最多量化的比特数
+	maxHilbertBitsPerDim = 16
+	// defaultHilbertWindow 查询时在查询 key 两侧各扫描的默认向量数
+	defaultHilbertWindow = 64
+)
+
+// hilbertEntry 按 Hilbert key 排序存储的向量
+type hilbertEntry struct {
+	Key    uint64
+	Vector Vector
+}
+
+// HilbertIndex 把每个向量按维度量化后映射到 Hilbert 曲线上的一维 key,按 key 有序存储。
+// 查询时在查询向量 key 的两侧各取 Window 个向量,再按真实距离精排。
+// Hilbert 曲线能较好地保持局部性,适合中低维数据的廉价近似搜索,维度越高召回率越低
+type HilbertIndex struct {
+	Window int // 查询 key 两侧各扫描的向量数,<= 0 时使用 defaultHilbertWindow
+
+	bits     uint      // 每个维度量化的比特数
+	lower    []float64 // 各维度量化区间的下界
+	upper    []float64 // 各维度量化区间的上界
+	entries  []hilbertEntry
+	distFunc DistanceFunc
+}
+
+// hilbertGob HilbertIndex 的持久化结构
+type hilbertGob struct {
+	Window  int
+	Bits    uint
+	Lower   []float64
+	Upper   []float64
+	Entries []hilbertEntry
+}
+
+// NewHilbertIndex
+//
+//	@Description: 创建 Hilbert 曲线索引。量化区间取 vectors 各维度的最小值与最大值,
+//	之后插入的超出区间的分量会被截断到区间端点。key 为 64 位,每个维度的比特数为 min(16, 64/dim)
+//	@param vectors 初始向量,至少一个,用于确定维度与量化区间
+//	@param window 查询 key 两侧各扫描的向量数,<= 0 时使用默认值
+//	@param opts 可选参数,如 WithMetric;不支持 WithNormalize,传入时返回错误
+//	@return *HilbertIndex
+//	@return error
+func NewHilbertIndex(vectors []Vector, window int, opts ...Option) (*HilbertIndex, error) {
+	o := newIndexOptions(opts)
+	if err := checkNormalizeUnsupported(o); err != nil {
+		return nil, err
+	}
+	if len(vectors) == 0 {
+		return nil, errors.New("at least one vector is needed to determine the quantization range")
+	}
+	dim := len(vectors[0].Values)
+	if dim == 0 || dim > 64 {
+		return nil, errors.New("dimension should be between 1 and 64")
+	}
+
+	lower := append([]float64(nil), vectors[0].Values...)
+	upper := append([]float64(nil), vectors[0].Values...)
+	for _, vec := range vectors {
+		if len(vec.Values) != dim {
+			return nil, errors.New("vectors should have the same dimension")
+		}
+		for i, val := range vec.Values {
+			lower[i] = math.Min(lower[i], val)
+			upper[i] = math.Max(upper[i], val)
+		}
+	}
+
+	bits := uint(64 / dim)
+	if bits > maxHilbertBitsPerDim {
+		bits = maxHilbertBitsPerDim
+	}
+	index := &HilbertIndex{
+		Window:   window,
+		bits:     bits,
+		lower:    lower,
+		upper:    upper,
+		distFunc: o.distance,
+	}
+	if err := index.InsertBatch(vectors); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// key
+//
+//	@Description: 把向量量化为网格坐标后计算其 Hilbert key
+//	@receiver h
+//	@param vec
+//	@return uint64
+func (h *HilbertIndex) key(vec Vector) uint64 {
+	maxCell := float64(uint64(1)<<h.bits - 1)
+	coords := make([]uint64, len(h.lower))
+	for i := range coords {
+		span := h.upper[i] - h.lower[i]
+		if span <= 0 {
+			continue
+		}
+		cell := math.Round((vec.Values[i] - h.lower[i]) / span * maxCell)
+		coords[i] = uint64(math.Max(0, math.Min(maxCell, cell)))
+	}
+	return hilbertKey(coords, h.bits)
+}
+
+// hilbertKey
+//
+//	@Description: 使用 Skilling 的算法把 n 维网格坐标转换为 Hilbert 曲线上的序号:
+//	先把坐标原地转换为"转置"形式的 Hilbert 序号,再把各维度的比特交织成一个整数
+//	@param coords 每个维度的网格坐标,取值 [0, 2^bits),会被修改
+//	@param bits 每个维度的比特数
+//	@return uint64
+func hilbertKey(coords []uint64, bits uint) uint64 {
+	n := len(coords)
+	m := uint64(1) << (bits - 1)
+
+	// 逆向撤销多余的变换
+	for q := m; q > 1; q >>= 1 {
+		p := q - 1
+		for i := 0; i < n; i++ {
+			if coords[i]&q != 0 {
+				coords[0] ^= p
+			} else {
+				t := (coords[0] ^ coords[i]) & p
+				coords[0] ^= t
+				coords[i] ^= t
+			}
+		}
+	}
+
+	// 格雷编码
+	for i := 1; i < n; i++ {
+		coords[i] ^= coords[i-1]
+	}
+	var t uint64
+	for q := m; q > 1; q >>= 1 {
+		if coords[n-1]&q != 0 {
+			t ^= q - 1
+		}
+	}
+	for i := range coords {
+		coords[i] ^= t
+	}
+
+	// 从高位到低位交织各维度的比特
+	var key uint64
+	for b := int(bits) - 1; b >= 0; b-- {
+		for i := 0; i < n; i++ {
+			key = key<<1 | (coords[i]>>uint(b))&1
+		}
+	}
+	return key
+}
+
+// dist 使用索引配置的距离函数计算距离
+func (h *HilbertIndex) dist(a, b Vector) float64 {
+	return measure(h.distFunc, a, b)
+}
+
+// search 返回第一个 key 不小于 key 的位置
+func (h *HilbertIndex) search(key uint64) int {
+	return sort.Search(len(h.entries), func(i int) bool { return h.entries[i].Key >= key })
+}
+
+// Insert
+//
+//	@Description: 按 Hilbert key 有序插入向量
+//	@receiver h
+//	@param vec
+//	@return error
+func (h *HilbertIndex) Insert(vec Vector) error {
+	if len(vec.Values) != len(h.lower) {
+		return errors.New("vector dimension does not match the index")
+	}
+	key := h.key(vec)
+	// 相同 key 的向量按插入顺序排列
+	pos := sort.Search(len(h.entries), func(i int) bool { return h.entries[i].Key > key })
+	h.entries = append(h.entries, hilbertEntry{})
+	copy(h.entries[pos+1:], h.entries[pos:])
+	h.entries[pos] = hilbertEntry{Key: key, Vector: vec}
+	return nil
+}
+
+// InsertBatch
+//
+//	@Description: 批量插入,追加后整体排序一次
+//	@receiver h
+//	@param vectors
+//	@return error
+func (h *HilbertIndex) InsertBatch(vectors []Vector) error {
+	for _, vec := range vectors {
+		if len(vec.Values) != len(h.lower) {
+			return errors.New("vector dimension does not match the index")
+		}
+	}
+	for _, vec := range vectors {
+		h.entries = append(h.entries, hilbertEntry{Key: h.key(vec), Vector: vec})
+	}
+	sort.SliceStable(h.entries, func(i, j int) bool { return h.entries[i].Key < h.entries[j].Key })
+	return nil
+}
+
+// Nearest
+//
+//	@Description: 近似最近邻
+//	@receiver h
+//	@param query
+//	@return Vector
+//	@return error
+func (h *HilbertIndex) Nearest(query Vector) (Vector, error) {
+	results, err := h.KNearest(query, 1)
+	if err != nil {
+		return Vector{}, err
+	}
+	return results[0], nil
+}
+
+// KNearest
+//
+//	@Description: 在查询 key 两侧各取 max(Window, k) 个向量作为候选,按真实距离返回前 k 个
+//	@receiver h
+//	@param query
+//	@param k
+//	@return []Vector
+//	@return error
+func (h *HilbertIndex) KNearest(query Vector, k int) ([]Vector, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
+	}
+	if len(h.entries) == 0 {
+		return nil, errors.New("no vectors in the database")
+	}
+	if len(query.Values) != len(h.lower) {
+		return nil, errors.New("query dimension does not match the index")
+	}
+
+	window := h.Window
+	if window <= 0 {
+		window = defaultHilbertWindow
+	}
+	if window < k {
+		window = k
+	}
+	pos := h.search(h.key(query))
+	start, end := pos-window, pos+window
+	if start < 0 {
+		start = 0
+	}
+	if end > len(h.entries) {
+		end = len(h.entries)
+	}
+
+	candidates := make([]Vector, 0, end-start)
+	for _, entry := range h.entries[start:end] {
+		candidates = append(candidates, entry.Vector)
+	}
+	return topKByFunc(query, candidates, k, h.dist), nil
+}
+
+// Vectors
+//
+//	@Description: 按 Hilbert key 顺序返回所有向量
+//	@receiver h
+//	@return []Vector
+//	@return error
+func (h *HilbertIndex) Vectors() ([]Vector, error) {
+	vectors := make([]Vector, len(h.entries))
+	for i, entry := range h.entries {
+		vectors[i] = entry.Vector
+	}
+	return vectors, nil
+}
+
+// Delete
+//
+//	@Description: 删除与 vec 相等的向量,只需在 vec 的 key 附近查找
+//	@receiver h
+//	@param vec
+//	@return error
+func (h *HilbertIndex) Delete(vec Vector) error {
+	if len(vec.Values) != len(h.lower) {
+		return errors.New("vector not found")
+	}
+	key := h.key(vec)
+	for i := h.search(key); i < len(h.entries) && h.entries[i].Key == key; i++ {
+		if h.entries[i].Vector.Equals(vec) {
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("vector not found")
+}
+
+// DeleteBatch
+//
+//	@Description: 批量删除
+//	@receiver h
+//	@param vectors
+//	@return error
+func (h *HilbertIndex) DeleteBatch(vectors []Vector) error {
+	for _, vec := range vectors {
+		if err := h.Delete(vec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchWithinRange
+//
+//	@Description: 精确的范围搜索,Hilbert 序无法按半径剪枝,因此扫描所有向量
+//	@receiver h
+//	@param query
+//	@param radius
+//	@return []Vector
+//	@return error
+func (h *HilbertIndex) SearchWithinRange(query Vector, radius float64) ([]Vector, error) {
+	var results []Vector
+	for _, entry := range h.entries {
+		if h.dist(query, entry.Vector) <= radius {
+			results = append(results, entry.Vector)
+		}
+	}
+	return results, nil
+}
+
+// Describe
+//
+//	@Description: 返回向量数、维度与索引类型 "hilbert"
+//	@receiver h
+//	@return count
+//	@return dim
+//	@return indexType
+//	@return err
+func (h *HilbertIndex) Describe() (count int, dim int, indexType string, err error) {
+	if len(h.entries) > 0 {
+		dim = len(h.lower)
+	}
+	return len(h.entries), dim, "hilbert", nil
+}
+
+// Config
+//
+//	@Description: 返回构造参数:扫描窗口、维度、每个维度的比特数与距离函数
+//	@receiver h
+//	@return map[string]interface{}
+func (h *HilbertIndex) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"window": h.Window,
+		"dim":    len(h.lower),
+		"bits":   h.bits,
+		"metric": metricName(h.distFunc),
+	}
+}
+
+// Save
+//
+//	@Description: 把量化参数与有序向量写入 w,距离函数不会被保存
+//	@receiver h
+//	@param w
+//	@return error
+func (h *HilbertIndex) Save(w io.Writer) error {
+	aux := hilbertGob{
+		Window:  h.Window,
+		Bits:    h.bits,
+		Lower:   h.lower,
+		Upper:   h.upper,
+		Entries: h.entries,
+	}
+	return gob.NewEncoder(w).Encode(&aux)
+}
+
+// Load
+//
+//	@Description: 从 r 读取 Save 写出的索引
+//	@receiver h
+//	@param r
+//	@return error
+func (h *HilbertIndex) Load(r io.Reader) error {
+	aux := hilbertGob{}
+	if err := gob.NewDecoder(r).Decode(&aux); err != nil {
+		return err
+	}
+	h.Window = aux.Window
+	h.bits = aux.Bits
+	h.lower = aux.Lower
+	h.upper = aux.Upper
+	h.entries = aux.Entries
+	return nil
+}
+
+func (h *HilbertIndex) SaveToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return h.Save(file)
+}
+
+func (h *HilbertIndex) LoadFromFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return h.Load(file)
+}
@@ -3,16 +3,21 @@ package core
 // kd-tree 相关实现
 
 import (
+	"bytes"
 	"container/heap"
 	"encoding/gob"
 	"fmt"
 	"hh_vectordb/basic"
+	"io"
 	"math"
 	"os"
+	"sort"
+	"time"
 )
 
 type PriorityQueue = basic.PriorityQueue
 type Item = basic.Item
+type SearchResult = basic.SearchResult
 
 type KDNode struct {
 	Vector   Vector
@@ -20,14 +25,26 @@ type KDNode struct {
 	Right    *KDNode
 	Axis     int
 	Distance float64
+	Bucket   []*KDNode // 深度达到上限后落在该节点区域内的向量,查询时逐个扫描
 }
 
 type KDTree struct {
-	Root *KDNode
+	Root      *KDNode
+	maxDepth  int          // 树的最大层数,超过后新向量放入分桶叶子,0 表示不限制
+	distFunc  DistanceFunc // WithMetric 指定的距离函数,为 nil 时使用欧几里得距离
+	normalize bool         // 是否为归一化(余弦)模式,插入和查询的向量都会做 L2 归一化
 }
 
-func NewKDTree(vectors []Vector) *KDTree {
-	tree := &KDTree{}
+// kdTreeGob kd-tree 的持久化结构
+type kdTreeGob struct {
+	Root      *KDNode
+	Normalize bool
+	MaxDepth  int // 层数上限,旧格式中没有该字段,加载后为 0 即不限制
+}
+
+func NewKDTree(vectors []Vector, opts ...Option) *KDTree {
+	o := newIndexOptions(opts)
+	tree := &KDTree{distFunc: o.distance, normalize: o.normalize}
 	for _, vec := range vectors {
 		err := tree.Insert(vec)
 		if err != nil {
@@ -44,32 +61,82 @@ func NewKDTree(vectors []Vector) *KDTree {
 //	@param vec 插入向量
 //	@return error
 func (tree *KDTree) Insert(vec Vector) error {
-	tree.Root = insertRecursively(tree.Root, vec, 0)
+	tree.Root = insertRecursively(tree.Root, tree.prepare(vec), 0, 1, tree.maxDepth)
 	return nil
 }
 
+// NewKDTreeWithMaxDepth
+//
+//	@Description: 创建限制最大层数的 kd-tree。有序等退化输入会让 kd-tree 退化成链表,
+//	限制层数后超出部分的向量放入分桶叶子,避免递归过深
+//	@param vectors
+//	@param maxDepth 最大层数,<= 0 表示不限制
+//	@param opts 可选参数,如 WithMetric
+//	@return *KDTree
+func NewKDTreeWithMaxDepth(vectors []Vector, maxDepth int, opts ...Option) *KDTree {
+	if maxDepth < 0 {
+		maxDepth = 0
+	}
+	o := newIndexOptions(opts)
+	tree := &KDTree{maxDepth: maxDepth, distFunc: o.distance, normalize: o.normalize}
+	for _, vec := range vectors {
+		err := tree.Insert(vec)
+		if err != nil {
+			return nil
+		}
+	}
+	return tree
+}
+
 // insertRecursively
 //
 //	@Description: kd-tree 递归插入 vector
 //	@param node 待插入node
 //	@param vec 需要插入的 vector
 //	@param axis 插入维度
+//	@param depth 当前节点所在层数,根节点为 1
+//	@param maxDepth 最大层数,0 表示不限制
 //	@return *KDNode
-func insertRecursively(node *KDNode, vec Vector, axis int) *KDNode {
+func insertRecursively(node *KDNode, vec Vector, axis, depth, maxDepth int) *KDNode {
 	if node == nil {
 		return &KDNode{Vector: vec, Axis: axis}
 	}
 
+	// 达到最大层数后不再向下分裂,放入当前节点的分桶
+	if maxDepth > 0 && depth >= maxDepth {
+		node.Bucket = append(node.Bucket, &KDNode{Vector: vec, Axis: axis})
+		return node
+	}
+
 	// 比较轴上的值，如果小于则插入左子树，否则插入右子树
 	if vec.Values[axis] < node.Vector.Values[axis] {
-		node.Left = insertRecursively(node.Left, vec, (axis+1)%len(vec.Values))
+		node.Left = insertRecursively(node.Left, vec, (axis+1)%len(vec.Values), depth+1, maxDepth)
 	} else {
-		node.Right = insertRecursively(node.Right, vec, (axis+1)%len(vec.Values))
+		node.Right = insertRecursively(node.Right, vec, (axis+1)%len(vec.Values), depth+1, maxDepth)
 	}
 
 	return node
 }
 
+// IsNormalized
+//
+//	@Description: 是否为归一化(余弦)模式
+//	@receiver tree kd-tree
+//	@return bool
+func (tree *KDTree) IsNormalized() bool {
+	return tree.normalize
+}
+
+// prepare 归一化模式下对向量做 L2 归一化
+func (tree *KDTree) prepare(vec Vector) Vector {
+	return normalizeIf(tree.normalize, vec)
+}
+
+// dist 使用 kd-tree 配置的距离函数计算距离
+func (tree *KDTree) dist(a, b Vector) float64 {
+	return measure(tree.distFunc, a, b)
+}
+
 // Nearest
 //
 //	@Description: 查询最近邻
@@ -78,32 +145,51 @@ func insertRecursively(node *KDNode, vec Vector, axis int) *KDNode {
 //	@return Vector 查询出的最近邻向量
 //	@return error
 func (tree *KDTree) Nearest(query Vector) (Vector, error) {
-	nearestNode := nearest(tree.Root, query, nil)
+	nearestNode := nearest(tree.Root, tree.prepare(query), nil, tree.distFunc)
 	if nearestNode == nil {
 		return Vector{}, fmt.Errorf("no nearest neighbor found")
 	}
 	return nearestNode.Vector, nil
 }
 
+// NearestExcludingSelf
+//
+//	@Description: 查询最近邻,跳过与查询向量完全相同的向量
+//	@receiver tree kd-tree
+//	@param query 待查询向量
+//	@return Vector
+//	@return error
+func (tree *KDTree) NearestExcludingSelf(query Vector) (Vector, error) {
+	vectors, _ := tree.Vectors()
+	return nearestExcludingSelf(tree, tree.prepare(query), len(vectors))
+}
+
 // nearest
 //
 //	@Description: 内部方法,查询最近邻
 //	@param node 查询 kd-node
 //	@param query 待查询向量
 //	@param best 目前最优节点
+//	@param distance 距离函数,为 nil 时使用欧几里得距离
 //	@return *KDNode 目前查询的最优节点
-func nearest(node *KDNode, query Vector, best *KDNode) *KDNode {
+func nearest(node *KDNode, query Vector, best *KDNode, distance DistanceFunc) *KDNode {
 	if node == nil {
 		return best
 	}
 
 	// 计算当前节点与查询向量的距离
-	d := basic.EuclidDistance(node.Vector.Values, query.Values)
+	d := measure(distance, node.Vector, query)
 
 	if best == nil || d < best.Distance {
 		best = node
 		best.Distance = d
 	}
+	for _, entry := range node.Bucket {
+		if d := measure(distance, entry.Vector, query); d < best.Distance {
+			best = entry
+			best.Distance = d
+		}
+	}
 
 	// 根据当前轴和查询向量的值决定搜索方向
 	var next, opposite *KDNode
@@ -115,11 +201,11 @@ func nearest(node *KDNode, query Vector, best *KDNode) *KDNode {
 		opposite = node.Left
 	}
 
-	best = nearest(next, query, best)
+	best = nearest(next, query, best, distance)
 
 	// 检查对面的子树是否有更接近的点
 	if math.Abs(query.Values[node.Axis]-node.Vector.Values[node.Axis]) < best.Distance {
-		best = nearest(opposite, query, best)
+		best = nearest(opposite, query, best, distance)
 	}
 
 	return best
@@ -149,6 +235,9 @@ func (tree *KDTree) collectVectors(node *KDNode, vectors *[]Vector) {
 	}
 
 	*vectors = append(*vectors, node.Vector)
+	for _, entry := range node.Bucket {
+		*vectors = append(*vectors, entry.Vector)
+	}
 
 	// 递归遍历左子树和右子树
 	tree.collectVectors(node.Left, vectors)
@@ -163,42 +252,89 @@ func (tree *KDTree) collectVectors(node *KDNode, vectors *[]Vector) {
 //	@return error
 func (tree *KDTree) Delete(vec Vector) error {
 	var deleted bool
-	tree.Root, deleted = deleteRecursively(tree.Root, vec, 0)
+	tree.Root, deleted = deleteRecursively(tree.Root, tree.prepare(vec), 0, Vector.Equals)
 	if !deleted {
 		return fmt.Errorf("vector not found")
 	}
 	return nil
 }
 
+// deleteExact
+//
+//	@Description: 按 ID 与向量值同时匹配删除,值相同但 ID 不同的向量不受影响
+//	@receiver tree kd-tree
+//	@param vec 待删除向量,取自 Vectors,已经过预处理
+//	@return error
+func (tree *KDTree) deleteExact(vec Vector) error {
+	var deleted bool
+	tree.Root, deleted = deleteRecursively(tree.Root, vec, 0, sameVector)
+	if !deleted {
+		return fmt.Errorf("vector not found")
+	}
+	return nil
+}
+
+// DeleteAndReturn
+//
+//	@Description: 按 ID 删除向量,删除前先取出该节点的向量并返回
+//	@receiver tree kd-tree
+//	@param id 向量 ID
+//	@return Vector 被删除的向量
+//	@return error
+func (tree *KDTree) DeleteAndReturn(id int64) (Vector, error) {
+	return deleteAndReturn(tree, id)
+}
+
 // deleteRecursively
 //
 //	@Description: 内部方法,kd-tree 执行递归删除
 //	@param node kd-node
 //	@param vec 待删除向量
 //	@param axis 维度
+//	@param match 判断节点向量是否为待删除向量
 //	@return *KDNode
 //	@return bool 是否删除成功
-func deleteRecursively(node *KDNode, vec Vector, axis int) (*KDNode, bool) {
+func deleteRecursively(node *KDNode, vec Vector, axis int, match func(a, b Vector) bool) (*KDNode, bool) {
 	if node == nil {
 		return nil, false
 	}
 
 	deleted := false
 
-	if node.Vector.Equals(vec) {
+	// 先在分桶中查找
+	for i, entry := range node.Bucket {
+		if match(entry.Vector, vec) {
+			node.Bucket = append(node.Bucket[:i], node.Bucket[i+1:]...)
+			return node, true
+		}
+	}
+
+	if match(node.Vector, vec) {
+		if node.Left == nil && node.Right == nil && len(node.Bucket) > 0 {
+			// 分桶叶子用桶中最后一个向量顶替被删除的向量
+			last := len(node.Bucket) - 1
+			node.Vector = node.Bucket[last].Vector
+			node.Bucket = node.Bucket[:last]
+			return node, true
+		}
 		if node.Right != nil {
 			minNode := findMin(node.Right, axis, (axis+1)%len(vec.Values))
 			node.Vector = minNode.Vector
-			node.Right, deleted = deleteRecursively(node.Right, minNode.Vector, (axis+1)%len(vec.Values))
+			// 顶替用的最小节点必须按 ID 删除,否则可能删掉另一个值相同的向量
+			node.Right, deleted = deleteRecursively(node.Right, minNode.Vector, (axis+1)%len(vec.Values), sameVector)
 		} else if node.Left != nil {
-			return node.Left, true
+			// 直接上提左子树会打乱各层的切分维度,改为用左子树在该维度上的最小值顶替,并把左子树移到右侧
+			minNode := findMin(node.Left, axis, (axis+1)%len(vec.Values))
+			node.Vector = minNode.Vector
+			node.Right, deleted = deleteRecursively(node.Left, minNode.Vector, (axis+1)%len(vec.Values), sameVector)
+			node.Left = nil
 		} else {
 			return nil, true
 		}
 	} else if vec.Values[axis] < node.Vector.Values[axis] {
-		node.Left, deleted = deleteRecursively(node.Left, vec, (axis+1)%len(vec.Values))
+		node.Left, deleted = deleteRecursively(node.Left, vec, (axis+1)%len(vec.Values), match)
 	} else {
-		node.Right, deleted = deleteRecursively(node.Right, vec, (axis+1)%len(vec.Values))
+		node.Right, deleted = deleteRecursively(node.Right, vec, (axis+1)%len(vec.Values), match)
 	}
 
 	return node, deleted
@@ -216,17 +352,28 @@ func findMin(node *KDNode, axis, depthAxis int) *KDNode {
 		return nil
 	}
 
+	// 分桶中的向量也属于该子树,需要一起比较
+	minNode := node
+	for _, entry := range node.Bucket {
+		if entry.Vector.Values[axis] < minNode.Vector.Values[axis] {
+			minNode = entry
+		}
+	}
+
 	if axis == depthAxis {
 		if node.Left == nil {
-			return node
+			return minNode
 		}
-		return findMin(node.Left, axis, (depthAxis+1)%len(node.Vector.Values))
+		leftMin := findMin(node.Left, axis, (depthAxis+1)%len(node.Vector.Values))
+		if leftMin.Vector.Values[axis] < minNode.Vector.Values[axis] {
+			minNode = leftMin
+		}
+		return minNode
 	}
 
 	leftMin := findMin(node.Left, axis, (depthAxis+1)%len(node.Vector.Values))
 	rightMin := findMin(node.Right, axis, (depthAxis+1)%len(node.Vector.Values))
 
-	minNode := node
 	if leftMin != nil && leftMin.Vector.Values[axis] < minNode.Vector.Values[axis] {
 		minNode = leftMin
 	}
@@ -246,21 +393,76 @@ func findMin(node *KDNode, axis, depthAxis int) *KDNode {
 //	@return []Vector 求解的k-近邻向量
 //	@return error
 func (tree *KDTree) KNearest(query Vector, k int) ([]Vector, error) {
+	return tree.KNearestWithStats(query, k, nil)
+}
+
+// KNearestWithStats
+//
+//	@Description: 与 KNearest 相同,同时把访问的节点数与距离计算次数累加到 stats 中
+//	@receiver tree kd-tree
+//	@param query 查询向量
+//	@param k top-k
+//	@param stats 查询统计,为 nil 时不统计
+//	@return []Vector
+//	@return error
+func (tree *KDTree) KNearestWithStats(query Vector, k int, stats *SearchStats) ([]Vector, error) {
 	pq := make(PriorityQueue, 0, k)
 	heap.Init(&pq)
 
-	tree.kNearest(tree.Root, query, 0, k, &pq)
+	tree.kNearest(tree.Root, tree.prepare(query), 0, k, &pq, stats)
+	return drainAscending(&pq), nil
+}
 
-	result := make([]Vector, 0, k)
-	for len(pq) > 0 {
-		item := heap.Pop(&pq).(*Item)
-		result = append(result, item.Value)
-	}
-	// 反转 result,使得 k-近邻的结果是有序的
-	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
-		result[i], result[j] = result[j], result[i]
-	}
-	return result, nil
+// KNearestResults
+//
+//	@Description: 与 KNearest 相同,同时返回每个结果到查询向量的距离
+//	@receiver tree kd-tree
+//	@param query 查询向量
+//	@param k top-k
+//	@return []SearchResult 按距离升序
+//	@return error
+func (tree *KDTree) KNearestResults(query Vector, k int) ([]SearchResult, error) {
+	pq := make(PriorityQueue, 0, k)
+	heap.Init(&pq)
+
+	tree.kNearest(tree.Root, tree.prepare(query), 0, k, &pq, nil)
+	return drainResults(&pq), nil
+}
+
+// VerifiedNearest
+//
+//	@Description: 调试用的最近邻查询,把 kd-tree 的 1-近邻结果与暴力扫描比较,不一致时回退到暴力扫描的结果
+//	@receiver tree kd-tree
+//	@param query 查询向量
+//	@return Vector 最近邻
+//	@return bool 树的结果是否与暴力扫描一致
+//	@return error
+func (tree *KDTree) VerifiedNearest(query Vector) (Vector, bool, error) {
+	return verifiedNearest(tree, tree.prepare(query), tree.dist)
+}
+
+// KNearestReversed
+//
+//	@Description: 返回与 KNearest 相同的 top-k,按距离从远到近排列
+//	@receiver tree kd-tree
+//	@param query 查询向量
+//	@param k top-k
+//	@return []Vector
+//	@return error
+func (tree *KDTree) KNearestReversed(query Vector, k int) ([]Vector, error) {
+	return kNearestReversed(tree, query, k)
+}
+
+// SelfRank
+//
+//	@Description: 以 ID 为 id 的向量查询 top-k,返回其自身的排名(从 0 开始),不在 top-k 中时返回 -1
+//	@receiver tree kd-tree
+//	@param id
+//	@param k
+//	@return int
+//	@return error
+func (tree *KDTree) SelfRank(id int64, k int) (int, error) {
+	return selfRank(tree, id, k)
 }
 
 // kNearest
@@ -272,12 +474,14 @@ func (tree *KDTree) KNearest(query Vector, k int) ([]Vector, error) {
 //	@param axis
 //	@param k
 //	@param pq
-func (tree *KDTree) kNearest(node *KDNode, query basic.Vector, axis, k int, pq *PriorityQueue) {
+//	@param stats 查询统计,可为 nil
+func (tree *KDTree) kNearest(node *KDNode, query basic.Vector, axis, k int, pq *PriorityQueue, stats *SearchStats) {
 	if node == nil {
 		return
 	}
+	stats.visit(1 + len(node.Bucket))
 
-	dist := basic.EuclidDistanceVec(query, node.Vector)
+	dist := tree.dist(query, node.Vector)
 
 	if len(*pq) < k || dist < (*pq)[0].Distance {
 		if len(*pq) == k {
@@ -288,6 +492,9 @@ func (tree *KDTree) kNearest(node *KDNode, query basic.Vector, axis, k int, pq *
 			Distance: dist,
 		})
 	}
+	for _, entry := range node.Bucket {
+		pushCandidate(pq, entry.Vector, tree.dist(query, entry.Vector), k)
+	}
 
 	// Determine which side of the plane the point is in
 	nextBranch := node.Left
@@ -297,14 +504,68 @@ func (tree *KDTree) kNearest(node *KDNode, query basic.Vector, axis, k int, pq *
 		otherBranch = node.Left
 	}
 
-	tree.kNearest(nextBranch, query, (axis+1)%len(query.Values), k, pq)
+	tree.kNearest(nextBranch, query, (axis+1)%len(query.Values), k, pq, stats)
 
 	// Check if other side of plane could have closer points
 	if len(*pq) < k || math.Abs(node.Vector.Values[axis]-query.Values[axis]) < (*pq)[0].Distance {
-		tree.kNearest(otherBranch, query, (axis+1)%len(query.Values), k, pq)
+		tree.kNearest(otherBranch, query, (axis+1)%len(query.Values), k, pq, stats)
 	}
 }
 
+// KNearestWithinBudget
+//
+//	@Description: 带时间预算的 k-近邻查询。按节点区域到查询向量的距离下界做最优优先搜索,
+//	超出预算时返回目前为止的最优结果;预算充足时结果与精确搜索一致
+//	@receiver tree kd-tree
+//	@param query 待查询向量
+//	@param k top-k
+//	@param budget 时间预算
+//	@return []Vector
+//	@return error
+func (tree *KDTree) KNearestWithinBudget(query Vector, k int, budget time.Duration) ([]Vector, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("k should be greater than 0")
+	}
+	if budget <= 0 {
+		return nil, fmt.Errorf("budget should be greater than 0")
+	}
+	start := time.Now()
+	query = tree.prepare(query)
+
+	pq := make(PriorityQueue, 0, k)
+	frontier := &frontierQueue{}
+	if tree.Root != nil {
+		heap.Push(frontier, frontierItem{node: tree.Root, bound: 0})
+	}
+	for visited := 0; frontier.Len() > 0; visited++ {
+		if visited%budgetCheckInterval == 0 && pq.Len() > 0 && time.Since(start) > budget {
+			break
+		}
+		item := heap.Pop(frontier).(frontierItem)
+		if pq.Len() == k && item.bound >= pq[0].Distance {
+			break
+		}
+		node := item.node.(*KDNode)
+		pushCandidate(&pq, node.Vector, tree.dist(query, node.Vector), k)
+		for _, entry := range node.Bucket {
+			pushCandidate(&pq, entry.Vector, tree.dist(query, entry.Vector), k)
+		}
+
+		diff := query.Values[node.Axis] - node.Vector.Values[node.Axis]
+		near, far := node.Left, node.Right
+		if diff >= 0 {
+			near, far = node.Right, node.Left
+		}
+		if near != nil {
+			heap.Push(frontier, frontierItem{node: near, bound: item.bound})
+		}
+		if far != nil {
+			heap.Push(frontier, frontierItem{node: far, bound: math.Max(item.bound, math.Abs(diff))})
+		}
+	}
+	return drainAscending(&pq), nil
+}
+
 func (tree *KDTree) InsertBatch(vectors []Vector) error {
 	for _, vec := range vectors {
 		if err := tree.Insert(vec); err != nil {
@@ -314,6 +575,147 @@ func (tree *KDTree) InsertBatch(vectors []Vector) error {
 	return nil
 }
 
+// InsertPaged
+//
+//	@Description: 从分页数据源逐页拉取向量,全部拉取完成后与已有向量一起整体重建为平衡的 kd-tree;
+//	出错时同样会用已拉取的向量重建,然后返回错误
+//	@receiver tree kd-tree
+//	@param fetch 分页拉取函数,参数为偏移量和页大小
+//	@param pageSize 每页大小
+//	@return error
+func (tree *KDTree) InsertPaged(fetch func(offset, limit int) ([]Vector, error), pageSize int) error {
+	vectors, err := tree.Vectors()
+	if err != nil {
+		return err
+	}
+	fetchErr := insertPaged(fetch, pageSize, func(page []Vector) error {
+		for _, vec := range page {
+			vectors = append(vectors, tree.prepare(vec))
+		}
+		return nil
+	})
+	tree.Root = buildBalanced(vectors, 0, 1, tree.maxDepth)
+	return fetchErr
+}
+
+// Rebuild
+//
+//	@Description: 按各层切分维度的中位数重建 kd-tree,使树重新保持平衡
+//	@receiver tree kd-tree
+//	@return error
+func (tree *KDTree) Rebuild() error {
+	vectors, err := tree.Vectors()
+	if err != nil {
+		return err
+	}
+	tree.Root = buildBalanced(vectors, 0, 1, tree.maxDepth)
+	return nil
+}
+
+// kdBound 祖先节点对子树施加的约束:左子树在 Axis 上 < Value,右子树 >= Value
+type kdBound struct {
+	Axis  int
+	Value float64
+	Left  bool
+}
+
+// Validate
+//
+//	@Description: 检查 kd-tree 的切分不变式:每个节点左子树中的向量在该节点切分维度上严格小于节点值,
+//	右子树中的向量大于等于节点值,分桶中的向量同样受祖先节点约束。
+//	gob 加载不会做这些检查,损坏或不匹配的文件会让查询静默返回错误结果,加载后可以先调用 Validate
+//	@receiver tree kd-tree
+//	@return error 第一个违反不变式的位置,树合法时返回 nil
+func (tree *KDTree) Validate() error {
+	return validateKDNode(tree.Root, nil)
+}
+
+// validateKDNode 检查 node 及其分桶满足 bounds,再带上 node 自身的约束递归检查左右子树
+func validateKDNode(node *KDNode, bounds []kdBound) error {
+	if node == nil {
+		return nil
+	}
+	if node.Axis < 0 || node.Axis >= len(node.Vector.Values) {
+		return fmt.Errorf("node %d has axis %d out of range for dimension %d", node.Vector.ID, node.Axis, len(node.Vector.Values))
+	}
+	entries := append([]*KDNode{node}, node.Bucket...)
+	for _, entry := range entries {
+		for _, bound := range bounds {
+			if bound.Axis >= len(entry.Vector.Values) {
+				return fmt.Errorf("vector %d has dimension %d, expected more than %d", entry.Vector.ID, len(entry.Vector.Values), bound.Axis)
+			}
+			val := entry.Vector.Values[bound.Axis]
+			if bound.Left && val >= bound.Value {
+				return fmt.Errorf("vector %d in a left subtree has %v >= %v on axis %d", entry.Vector.ID, val, bound.Value, bound.Axis)
+			}
+			if !bound.Left && val < bound.Value {
+				return fmt.Errorf("vector %d in a right subtree has %v < %v on axis %d", entry.Vector.ID, val, bound.Value, bound.Axis)
+			}
+		}
+	}
+	split := node.Vector.Values[node.Axis]
+	// 复制 bounds,避免左右子树共享底层数组
+	left := append(append([]kdBound(nil), bounds...), kdBound{Axis: node.Axis, Value: split, Left: true})
+	if err := validateKDNode(node.Left, left); err != nil {
+		return err
+	}
+	right := append(append([]kdBound(nil), bounds...), kdBound{Axis: node.Axis, Value: split, Left: false})
+	return validateKDNode(node.Right, right)
+}
+
+// Repair
+//
+//	@Description: Validate 失败时用树中收集到的全部向量重建平衡的 kd-tree
+//	@receiver tree kd-tree
+//	@return repaired 是否进行了重建
+//	@return err
+func (tree *KDTree) Repair() (repaired bool, err error) {
+	if tree.Validate() == nil {
+		return false, nil
+	}
+	if err := tree.Rebuild(); err != nil {
+		return false, err
+	}
+	return true, tree.Validate()
+}
+
+// buildBalanced
+//
+//	@Description: 以中位数为切分点递归构建平衡 kd-tree。与 insertRecursively 保持一致,
+//	左子树在切分维度上严格小于节点值,右子树大于等于节点值
+//	@param vectors 待构建的向量,会被重新排序
+//	@param axis 当前切分维度
+//	@param depth 当前层数,根节点为 1
+//	@param maxDepth 最大层数,达到后剩余向量放入分桶,0 表示不限制
+//	@return *KDNode
+func buildBalanced(vectors []Vector, axis, depth, maxDepth int) *KDNode {
+	if len(vectors) == 0 {
+		return nil
+	}
+	if maxDepth > 0 && depth >= maxDepth {
+		node := &KDNode{Vector: vectors[0], Axis: axis}
+		for _, vec := range vectors[1:] {
+			node.Bucket = append(node.Bucket, &KDNode{Vector: vec, Axis: axis})
+		}
+		return node
+	}
+	sort.Slice(vectors, func(i, j int) bool {
+		return vectors[i].Values[axis] < vectors[j].Values[axis]
+	})
+	// 取中位数所在值的第一个位置,保证与其相等的向量都落在右子树
+	mid := len(vectors) / 2
+	for mid > 0 && vectors[mid-1].Values[axis] == vectors[mid].Values[axis] {
+		mid--
+	}
+	next := (axis + 1) % len(vectors[mid].Values)
+	return &KDNode{
+		Vector: vectors[mid],
+		Axis:   axis,
+		Left:   buildBalanced(vectors[:mid], next, depth+1, maxDepth),
+		Right:  buildBalanced(vectors[mid+1:], next, depth+1, maxDepth),
+	}
+}
+
 func (tree *KDTree) DeleteBatch(vectors []Vector) error {
 	for _, vec := range vectors {
 		if err := tree.Delete(vec); err != nil {
@@ -325,29 +727,211 @@ func (tree *KDTree) DeleteBatch(vectors []Vector) error {
 
 func (tree *KDTree) SearchWithinRange(query Vector, radius float64) ([]Vector, error) {
 	var result []Vector
-	tree.collectInRange(tree.Root, query, radius, &result)
+	tree.collectInRange(tree.Root, tree.prepare(query), radius, &result)
 	return result, nil
 }
 
+// KNearestInBox
+//
+//	@Description: 返回落在轴对齐盒子 [lo, hi] 内(含边界)的向量中距离查询向量最近的 k 个。
+//	同时按盒子边界和当前第 k 近的距离剪枝:切分面在盒子之外的一侧子树直接跳过
+//	@receiver tree kd-tree
+//	@param query 查询向量,可以在盒子之外
+//	@param k top-k
+//	@param lo 盒子各维度的下界
+//	@param hi 盒子各维度的上界
+//	@return []Vector 按距离升序,盒子内向量不足 k 个时全部返回
+//	@return error
+func (tree *KDTree) KNearestInBox(query Vector, k int, lo, hi []float64) ([]Vector, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("k should be greater than 0")
+	}
+	if len(lo) != len(query.Values) || len(hi) != len(query.Values) {
+		return nil, fmt.Errorf("box dimension does not match the query")
+	}
+	pq := make(PriorityQueue, 0, k)
+	tree.kNearestInBox(tree.Root, tree.prepare(query), k, lo, hi, &pq)
+	return drainAscending(&pq), nil
+}
+
+func (tree *KDTree) kNearestInBox(node *KDNode, query Vector, k int, lo, hi []float64, pq *PriorityQueue) {
+	if node == nil {
+		return
+	}
+	if inBox(node.Vector, lo, hi) {
+		pushCandidate(pq, node.Vector, tree.dist(query, node.Vector), k)
+	}
+	for _, entry := range node.Bucket {
+		if inBox(entry.Vector, lo, hi) {
+			pushCandidate(pq, entry.Vector, tree.dist(query, entry.Vector), k)
+		}
+	}
+
+	// 左子树在切分维度上小于节点值,盒子下界不小于节点值时左子树不可能在盒子内;右子树同理
+	split := node.Vector.Values[node.Axis]
+	nextBranch, otherBranch := node.Left, node.Right
+	nextInBox, otherInBox := lo[node.Axis] < split, hi[node.Axis] >= split
+	if query.Values[node.Axis] >= split {
+		nextBranch, otherBranch = node.Right, node.Left
+		nextInBox, otherInBox = otherInBox, nextInBox
+	}
+	if nextInBox {
+		tree.kNearestInBox(nextBranch, query, k, lo, hi, pq)
+	}
+	if otherInBox && (pq.Len() < k || math.Abs(split-query.Values[node.Axis]) < (*pq)[0].Distance) {
+		tree.kNearestInBox(otherBranch, query, k, lo, hi, pq)
+	}
+}
+
+// inBox 判断向量是否落在轴对齐盒子 [lo, hi] 内(含边界)
+func inBox(vec Vector, lo, hi []float64) bool {
+	for i, val := range vec.Values {
+		if val < lo[i] || val > hi[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchWithinAnnulus
+//
+//	@Description: 环形范围查询,返回距离在 [minRadius, maxRadius] 内的向量,外半径复用范围搜索的剪枝
+//	@receiver tree kd-tree
+//	@param query 查询向量
+//	@param minRadius 内半径
+//	@param maxRadius 外半径
+//	@return []Vector
+//	@return error
+func (tree *KDTree) SearchWithinAnnulus(query Vector, minRadius, maxRadius float64) ([]Vector, error) {
+	return searchWithinAnnulus(tree, tree.prepare(query), minRadius, maxRadius, tree.dist)
+}
+
 func (tree *KDTree) collectInRange(node *KDNode, query Vector, radius float64, vectors *[]Vector) {
 	if node == nil {
 		return
 	}
 
-	dist := basic.EuclidDistanceVec(query, node.Vector)
+	dist := tree.dist(query, node.Vector)
 	if dist <= radius {
 		*vectors = append(*vectors, node.Vector)
 	}
+	for _, entry := range node.Bucket {
+		if tree.dist(query, entry.Vector) <= radius {
+			*vectors = append(*vectors, entry.Vector)
+		}
+	}
 
-	if node.Vector.Values[node.Axis]-radius <= query.Values[node.Axis] {
+	// 左子树在切分维度上小于节点值,只有 query-radius 落在节点值左侧时才可能有命中;右子树同理
+	if query.Values[node.Axis]-radius < node.Vector.Values[node.Axis] {
 		tree.collectInRange(node.Left, query, radius, vectors)
 	}
 
-	if node.Vector.Values[node.Axis]+radius >= query.Values[node.Axis] {
+	if query.Values[node.Axis]+radius >= node.Vector.Values[node.Axis] {
 		tree.collectInRange(node.Right, query, radius, vectors)
 	}
 }
 
+// Stats
+//
+//	@Description: 返回 kd-tree 的统计信息:向量数、实际最大层数、层数上限及分桶中的向量数
+//	@receiver tree kd-tree
+//	@return map[string]interface{}
+func (tree *KDTree) Stats() map[string]interface{} {
+	size, bucketed, depth := 0, 0, 0
+	// 用显式栈遍历,避免退化树上递归过深
+	type nodeDepth struct {
+		node  *KDNode
+		depth int
+	}
+	stack := []nodeDepth{}
+	if tree.Root != nil {
+		stack = append(stack, nodeDepth{tree.Root, 1})
+	}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		size += 1 + len(top.node.Bucket)
+		bucketed += len(top.node.Bucket)
+		if top.depth > depth {
+			depth = top.depth
+		}
+		if top.node.Left != nil {
+			stack = append(stack, nodeDepth{top.node.Left, top.depth + 1})
+		}
+		if top.node.Right != nil {
+			stack = append(stack, nodeDepth{top.node.Right, top.depth + 1})
+		}
+	}
+	return map[string]interface{}{
+		"size":            size,
+		"max_depth":       depth,
+		"max_depth_limit": tree.maxDepth,
+		"bucketed":        bucketed,
+	}
+}
+
+// Describe
+//
+//	@Description: 返回向量数、维度与索引类型 "kd_tree",需要遍历整棵树
+//	@receiver tree kd-tree
+//	@return count
+//	@return dim
+//	@return indexType
+//	@return err
+func (tree *KDTree) Describe() (count int, dim int, indexType string, err error) {
+	return describe(tree, "kd_tree")
+}
+
+// Config
+//
+//	@Description: 返回构造参数:层数上限与距离函数
+//	@receiver tree kd-tree
+//	@return map[string]interface{}
+func (tree *KDTree) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"max_depth_limit": tree.maxDepth,
+		"metric":          metricName(tree.distFunc),
+		"normalize":       tree.normalize,
+	}
+}
+
+func (tree *KDTree) Save(w io.Writer) error {
+	encoder := gob.NewEncoder(w)
+	return encoder.Encode(&kdTreeGob{Root: tree.Root, Normalize: tree.normalize, MaxDepth: tree.maxDepth})
+}
+
+func (tree *KDTree) Load(r io.Reader) error {
+	// 旧格式需要从头重新解码,因此先读入内存
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	aux := kdTreeGob{}
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&aux); err != nil {
+		// 兼容旧格式:流中只有根节点
+		var root *KDNode
+		if legacyErr := gob.NewDecoder(bytes.NewReader(raw)).Decode(&root); legacyErr != nil {
+			return err
+		}
+		aux = kdTreeGob{Root: root}
+	}
+	tree.Root = aux.Root
+	tree.normalize = aux.Normalize
+	tree.maxDepth = aux.MaxDepth
+	return nil
+}
+
+// SaveToFileCompressed saves the KDTree to a gzip-compressed file.
+func (tree *KDTree) SaveToFileCompressed(filename string) error {
+	return saveCompressed(filename, tree.Save)
+}
+
+// LoadFromFileCompressed loads the KDTree from a file written by SaveToFileCompressed.
+func (tree *KDTree) LoadFromFileCompressed(filename string) error {
+	return loadCompressed(filename, tree.Load)
+}
+
 func (tree *KDTree) SaveToFile(filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
@@ -355,8 +939,7 @@ func (tree *KDTree) SaveToFile(filename string) error {
 	}
 	defer file.Close()
 
-	encoder := gob.NewEncoder(file)
-	return encoder.Encode(tree.Root)
+	return tree.Save(file)
 }
 
 func (tree *KDTree) LoadFromFile(filename string) error {
@@ -366,6 +949,5 @@ func (tree *KDTree) LoadFromFile(filename string) error {
 	}
 	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	return decoder.Decode(&tree.Root)
+	return tree.Load(file)
 }
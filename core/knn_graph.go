@@ -0,0 +1,96 @@
+package core
+
+// k-近邻图的构建
+
+import "errors"
+
+// BuildKNNGraph
+//
+//	@Description: 对索引中的每个向量查询其 k 个最近邻(不含自身),构建有向 k-近邻图
+//	@param index 任意最近邻索引
+//	@param k 每个向量的邻居个数
+//	@return map[int64][]int64 向量 ID 到其邻居 ID 的映射,邻居按距离从近到远排列
+//	@return error
+func BuildKNNGraph(index NearestNeighborSearch, k int) (map[int64][]int64, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
+	}
+	vectors, err := index.Vectors()
+	if err != nil {
+		return nil, err
+	}
+	graph := make(map[int64][]int64, len(vectors))
+	for _, vec := range vectors {
+		results, err := kNearestExcludingSelf(index, vec, k)
+		if err != nil {
+			return nil, err
+		}
+		neighbors := make([]int64, len(results))
+		for i, res := range results {
+			neighbors[i] = res.ID
+		}
+		graph[vec.ID] = neighbors
+	}
+	return graph, nil
+}
+
+// KDistances
+//
+//	@Description: 计算每个向量到其第 k 个最近邻(不含自身)的距离,使用索引自身的度量。
+//	把结果排序后画出的 k-距离曲线的拐点,可用来选择 DBSCAN 的 epsilon。
+//	索引为精确索引时结果精确,近似索引得到的是近似值
+//	@param index 任意最近邻索引
+//	@param k 第 k 个最近邻
+//	@return map[int64]float64 向量 ID 到其 k-距离的映射
+//	@return error 向量数不超过 k 时返回错误
+func KDistances(index NearestNeighborSearch, k int) (map[int64]float64, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
+	}
+	vectors, err := index.Vectors()
+	if err != nil {
+		return nil, err
+	}
+	distance := indexDistance(index)
+	distances := make(map[int64]float64, len(vectors))
+	for _, vec := range vectors {
+		results, err := kNearestExcludingSelf(index, vec, k)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) < k {
+			return nil, errors.New("not enough neighbors to compute the k-distance")
+		}
+		distances[vec.ID] = distance(vec, results[k-1])
+	}
+	return distances, nil
+}
+
+// kNearestExcludingSelf
+//
+//	@Description: 查询 vec 的 k 个最近邻,排除 ID 与 vec 相同的一个结果(即 vec 自身)
+//	@param index
+//	@param vec 索引中的向量
+//	@param k
+//	@return []Vector 最多 k 个邻居,按距离从近到远排列
+//	@return error
+func kNearestExcludingSelf(index KNearestSearch, vec Vector, k int) ([]Vector, error) {
+	// 多取一个以便排除自身
+	results, err := index.KNearest(vec, k+1)
+	if err != nil {
+		return nil, err
+	}
+	neighbors := make([]Vector, 0, k)
+	skippedSelf := false
+	for _, res := range results {
+		if !skippedSelf && res.ID == vec.ID {
+			skippedSelf = true
+			continue
+		}
+		if len(neighbors) == k {
+			break
+		}
+		neighbors = append(neighbors, res)
+	}
+	return neighbors, nil
+}
@@ -1,29 +1,80 @@
 package core
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"hh_vectordb/basic"
+	"io"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
 )
 
+// lshLogSuffix is appended to the snapshot filename to get the incremental log file.
+const lshLogSuffix = ".log"
+
+// defaultLSHCompactThreshold is the number of logged operations after which
+// SaveIncremental rewrites the full snapshot instead of appending to the log.
+const defaultLSHCompactThreshold = 10000
+
 type LSH struct {
 	HashTables    []map[int64][]Vector
 	HashFuncs     []func(Vector) int64
 	BucketSize    int
 	RandomVectors []Vector
+	// Width is the bucket width w of the p-stable hash floor((a·v+b)/w).
+	// Zero means the legacy distance-to-random-vector hash built by NewLSH.
+	Width float64
+	// HashesPerTable is the number of p-stable hashes concatenated into each table's key.
+	HashesPerTable int
+	// Offsets holds the offset b of every p-stable hash as a fraction of Width, in [0, 1).
+	Offsets []float64
+	// CompactThreshold is the number of logged operations after which SaveIncremental compacts.
+	// Zero means defaultLSHCompactThreshold.
+	CompactThreshold int
+	// MinOccupancy makes Nearest and KNearest ignore a table whose bucket matching the query holds
+	// fewer vectors than this, so nearly empty buckets do not add noise to the candidates.
+	// Zero or one uses every table. SearchWithinRange is not affected.
+	MinOccupancy int
+
+	logging       bool          // whether Insert/Delete are recorded for SaveIncremental
+	snapshotFile  string        // snapshot the current log belongs to
+	loggedEntries int           // operations already appended to the log file
+	pendingLog    []lshLogEntry // operations not yet written to the log file
+	distFunc      DistanceFunc  // metric used to rank candidates, nil means Euclidean
+	normalize     bool          // cosine mode: stored and query vectors are L2-normalized
+}
+
+type lshLogOp uint8
+
+const (
+	lshLogInsert lshLogOp = iota
+	lshLogDelete
+)
+
+// lshLogEntry is a single insert or delete recorded in the incremental log.
+type lshLogEntry struct {
+	Op     lshLogOp
+	Vector Vector
 }
 
 type lshGob struct {
-	HashTables    []map[int64][]Vector
-	BucketSize    int
-	NumHashes     int
-	RandomVectors []Vector
+	HashTables     []map[int64][]Vector
+	BucketSize     int
+	NumHashes      int
+	RandomVectors  []Vector
+	Width          float64
+	HashesPerTable int
+	Offsets        []float64
+	MinOccupancy   int
+	Normalize      bool
 }
 
-func NewLSH(numHashes int, bucketSize int) *LSH {
+func NewLSH(numHashes int, bucketSize int, opts ...Option) *LSH {
+	o := newIndexOptions(opts)
 	hashFuncs := make([]func(Vector) int64, numHashes)
 	hashTables := make([]map[int64][]Vector, numHashes)
 	randomVectors := make([]Vector, numHashes)
@@ -38,10 +89,121 @@ func NewLSH(numHashes int, bucketSize int) *LSH {
 		HashTables:    hashTables,
 		BucketSize:    bucketSize,
 		RandomVectors: randomVectors,
+		distFunc:      o.distance,
+		normalize:     o.normalize,
+	}
+}
+
+// IsNormalized reports whether the LSH is in cosine mode.
+func (l *LSH) IsNormalized() bool {
+	return l.normalize
+}
+
+// prepare L2-normalizes vec in cosine mode.
+func (l *LSH) prepare(vec Vector) Vector {
+	return normalizeIf(l.normalize, vec)
+}
+
+// dist measures the distance between a and b with the metric used to rank candidates.
+func (l *LSH) dist(a, b Vector) float64 {
+	return measure(l.distFunc, a, b)
+}
+
+// NewLSHWithWidth creates an LSH index over dim-dimensional vectors using p-stable (Gaussian)
+// random projections h(v) = floor((a·v+b)/w). Each of the numTables tables keys vectors by
+// numHashes concatenated hashes. A smaller w gives more buckets: fewer candidates, lower recall.
+func NewLSHWithWidth(numHashes, numTables int, dim int, w float64, opts ...Option) *LSH {
+	if numHashes <= 0 || numTables <= 0 || dim <= 0 || w <= 0 {
+		return nil
+	}
+	o := newIndexOptions(opts)
+	projections := make([]Vector, numHashes*numTables)
+	offsets := make([]float64, numHashes*numTables)
+	for i := range projections {
+		values := make([]float64, dim)
+		for j := range values {
+			values[j] = rand.NormFloat64()
+		}
+		projections[i] = Vector{Values: values}
+		offsets[i] = rand.Float64()
+	}
+	l := &LSH{
+		BucketSize:     math.MaxInt32,
+		RandomVectors:  projections,
+		Width:          w,
+		HashesPerTable: numHashes,
+		Offsets:        offsets,
+		distFunc:       o.distance,
+		normalize:      o.normalize,
+	}
+	l.buildHashFuncs()
+	l.HashTables = make([]map[int64][]Vector, len(l.HashFuncs))
+	for i := range l.HashTables {
+		l.HashTables[i] = make(map[int64][]Vector)
+	}
+	return l
+}
+
+// SetBucketWidth changes the bucket width of a p-stable LSH and rehashes every stored vector
+// with the same projections. The incremental log cannot record the new width, so the next
+// SaveIncremental writes a full snapshot.
+func (l *LSH) SetBucketWidth(w float64) error {
+	if l.Width == 0 {
+		return errors.New("bucket width is only supported by LSH created with NewLSHWithWidth")
+	}
+	if w <= 0 {
+		return errors.New("bucket width should be greater than 0")
+	}
+	vectors, err := l.Vectors()
+	if err != nil {
+		return err
+	}
+	l.Width = w
+	l.buildHashFuncs()
+	for i := range l.HashTables {
+		l.HashTables[i] = make(map[int64][]Vector)
+	}
+	// Rehashing is not a logical insert, so keep it out of the incremental log.
+	logging := l.logging
+	l.logging = false
+	defer func() { l.logging = logging }()
+	// Forget the snapshot so the next SaveIncremental compacts and persists the new width.
+	l.snapshotFile = ""
+	return l.InsertBatch(vectors)
+}
+
+// buildHashFuncs recreates HashFuncs from the stored random vectors, offsets and width.
+func (l *LSH) buildHashFuncs() {
+	if l.Width == 0 {
+		l.HashFuncs = make([]func(Vector) int64, len(l.RandomVectors))
+		for i, randomVec := range l.RandomVectors {
+			l.HashFuncs[i] = createHashFuncWithVector(randomVec)
+		}
+		return
+	}
+	numTables := len(l.RandomVectors) / l.HashesPerTable
+	l.HashFuncs = make([]func(Vector) int64, numTables)
+	for i := range l.HashFuncs {
+		start := i * l.HashesPerTable
+		end := start + l.HashesPerTable
+		l.HashFuncs[i] = createPStableHashFunc(l.RandomVectors[start:end], l.Offsets[start:end], l.Width)
+	}
+}
+
+// createPStableHashFunc concatenates floor((a·v+b)/w) over the given projections into one key.
+func createPStableHashFunc(projections []Vector, offsets []float64, w float64) func(Vector) int64 {
+	return func(v Vector) int64 {
+		var key int64 = 17
+		for i, projection := range projections {
+			h := math.Floor((basic.Dot(projection.Values, v.Values) + offsets[i]*w) / w)
+			key = key*1000003 ^ int64(h)
+		}
+		return key
 	}
 }
 
 func (l *LSH) Insert(vec Vector) error {
+	vec = l.prepare(vec)
 	for i, hashFunc := range l.HashFuncs {
 		hashValue := hashFunc(vec)
 		bucket, exists := l.HashTables[i][hashValue]
@@ -56,16 +218,44 @@ func (l *LSH) Insert(vec Vector) error {
 		}
 		l.HashTables[i][hashValue] = append(l.HashTables[i][hashValue], vec)
 	}
+	if l.logging {
+		l.pendingLog = append(l.pendingLog, lshLogEntry{Op: lshLogInsert, Vector: vec})
+	}
 	return nil
 }
 
 func (l *LSH) Nearest(query Vector) (Vector, error) {
+	query = l.prepare(query)
+	candidates := l.getCandidates(query)
+
+	var nearest Vector
+	minDistance := float64(1 << 30) // some large number
+	for _, vec := range candidates {
+		if d := l.dist(query, vec); d < minDistance {
+			nearest = vec
+			minDistance = d
+		}
+	}
+
+	if minDistance == float64(1<<30) {
+		return Vector{}, errors.New("no neighbors found")
+	}
+
+	return nearest, nil
+}
+
+func (l *LSH) NearestExcludingSelf(query Vector) (Vector, error) {
+	query = l.prepare(query)
 	candidates := l.getCandidates(query)
 
 	var nearest Vector
 	minDistance := float64(1 << 30) // some large number
 	for _, vec := range candidates {
-		if d := basic.EuclidDistanceVec(query, vec); d < minDistance {
+		// Self matches are detected by value, the metric may be negative or scale-invariant
+		if basic.EuclidDistanceVec(query, vec) < selfMatchEpsilon {
+			continue
+		}
+		if d := l.dist(query, vec); d < minDistance {
 			nearest = vec
 			minDistance = d
 		}
@@ -79,6 +269,7 @@ func (l *LSH) Nearest(query Vector) (Vector, error) {
 }
 
 func (l *LSH) KNearest(query Vector, k int) ([]Vector, error) {
+	query = l.prepare(query)
 	candidates := l.getCandidates(query)
 
 	if len(candidates) < k {
@@ -86,12 +277,23 @@ func (l *LSH) KNearest(query Vector, k int) ([]Vector, error) {
 	}
 
 	sort.SliceStable(candidates, func(i, j int) bool {
-		return basic.EuclidDistanceVec(query, candidates[i]) < basic.EuclidDistanceVec(query, candidates[j])
+		return l.dist(query, candidates[i]) < l.dist(query, candidates[j])
 	})
 
 	return candidates[:k], nil
 }
 
+// SelfRank queries with the stored vector for id and returns the 0-based rank of id in the top-k,
+// or -1 if it is outside the top-k. It measures the self-recall of an index in leave-one-out tests.
+func (l *LSH) SelfRank(id int64, k int) (int, error) {
+	return selfRank(l, id, k)
+}
+
+// KNearestReversed returns the same top-k as KNearest, ordered from farthest to nearest.
+func (l *LSH) KNearestReversed(query Vector, k int) ([]Vector, error) {
+	return kNearestReversed(l, query, k)
+}
+
 func (l *LSH) Vectors() ([]Vector, error) {
 	seen := make(map[int64]struct{}) // Use a map to keep track of seen vectors.
 	var vectors []Vector
@@ -110,6 +312,7 @@ func (l *LSH) Vectors() ([]Vector, error) {
 
 func (l *LSH) Delete(vec Vector) error {
 	deletedFlag := false // This flag will be set to true if at least one instance of the vector is deleted
+	vec = l.prepare(vec)
 
 	for i, hashFunc := range l.HashFuncs {
 		hashValue := hashFunc(vec)
@@ -141,16 +344,32 @@ func (l *LSH) Delete(vec Vector) error {
 		return errors.New("vector not found in any bucket")
 	}
 
+	if l.logging {
+		l.pendingLog = append(l.pendingLog, lshLogEntry{Op: lshLogDelete, Vector: vec})
+	}
 	return nil
 }
 
+// deleteExact is Delete, which already matches bucket entries by ID.
+func (l *LSH) deleteExact(vec Vector) error {
+	return l.Delete(vec)
+}
+
+// DeleteAndReturn deletes the vector with the given ID from every table and returns it.
+func (l *LSH) DeleteAndReturn(id int64) (Vector, error) {
+	return deleteAndReturn(l, id)
+}
+
 func (l *LSH) getCandidates(query Vector) []Vector {
 	seen := make(map[int64]bool)
 	var candidates []Vector
 
 	for i, hashFunc := range l.HashFuncs {
-		hashValue := hashFunc(query)
-		for _, vec := range l.HashTables[i][hashValue] {
+		bucket := l.HashTables[i][hashFunc(query)]
+		if len(bucket) < l.MinOccupancy {
+			continue
+		}
+		for _, vec := range bucket {
 			if !seen[vec.ID] {
 				candidates = append(candidates, vec)
 				seen[vec.ID] = true
@@ -184,6 +403,50 @@ func randomVector() Vector {
 	}
 }
 
+// EachBucket calls fn for every non-empty bucket of every table, stopping early when fn returns false.
+// The vectors slice is the bucket itself and must not be modified by fn.
+func (l *LSH) EachBucket(fn func(table int, hash int64, vectors []Vector) bool) {
+	for i, table := range l.HashTables {
+		for hash, bucket := range table {
+			if len(bucket) == 0 {
+				continue
+			}
+			if !fn(i, hash, bucket) {
+				return
+			}
+		}
+	}
+}
+
+// LSHBucketStats summarizes bucket occupancy across all hash tables.
+type LSHBucketStats struct {
+	Buckets       int     // number of non-empty buckets
+	Entries       int     // total bucket entries; a vector is counted once per table
+	MaxBucketSize int     // largest bucket
+	AvgBucketSize float64 // Entries / Buckets
+}
+
+// BucketStats reports how vectors are spread over the buckets of all tables.
+func (l *LSH) BucketStats() LSHBucketStats {
+	var stats LSHBucketStats
+	for _, table := range l.HashTables {
+		for _, bucket := range table {
+			if len(bucket) == 0 {
+				continue
+			}
+			stats.Buckets++
+			stats.Entries += len(bucket)
+			if len(bucket) > stats.MaxBucketSize {
+				stats.MaxBucketSize = len(bucket)
+			}
+		}
+	}
+	if stats.Buckets > 0 {
+		stats.AvgBucketSize = float64(stats.Entries) / float64(stats.Buckets)
+	}
+	return stats
+}
+
 func (l *LSH) InsertBatch(vectors []Vector) error {
 	for _, vec := range vectors {
 		if err := l.Insert(vec); err != nil {
@@ -193,6 +456,10 @@ func (l *LSH) InsertBatch(vectors []Vector) error {
 	return nil
 }
 
+func (l *LSH) InsertPaged(fetch func(offset, limit int) ([]Vector, error), pageSize int) error {
+	return insertPaged(fetch, pageSize, l.InsertBatch)
+}
+
 func (l *LSH) DeleteBatch(vectors []Vector) error {
 	for _, vec := range vectors {
 		if err := l.Delete(vec); err != nil {
@@ -202,41 +469,199 @@ func (l *LSH) DeleteBatch(vectors []Vector) error {
 	return nil
 }
 
+// maxRangeProbeBuckets caps the buckets SearchWithinRange probes in one table; a table whose
+// radius-implied hash range is larger is scanned in full instead.
+const maxRangeProbeBuckets = 4096
+
+// SearchWithinRange returns every stored vector within radius of the query. Instead of filtering
+// only the query's own buckets, it probes in every table all buckets whose hash range an in-range
+// vector can fall into, so vectors hashed next to the query are not missed. With the default
+// Euclidean metric the result is exact for vectors present in at least one table.
 func (l *LSH) SearchWithinRange(query Vector, radius float64) ([]Vector, error) {
-	candidates := l.getCandidates(query)
+	query = l.prepare(query)
+	seen := make(map[int64]bool)
 	var results []Vector
-	for _, vec := range candidates {
-		if d := basic.EuclidDistanceVec(query, vec); d <= radius {
-			results = append(results, vec)
+	consider := func(bucket []Vector) {
+		for _, vec := range bucket {
+			if seen[vec.ID] {
+				continue
+			}
+			seen[vec.ID] = true
+			if l.dist(query, vec) <= radius {
+				results = append(results, vec)
+			}
 		}
 	}
-	if len(results) == 0 {
-		return nil, errors.New("no vectors found within range")
+	for i, table := range l.HashTables {
+		keys, ok := l.rangeBuckets(i, query, radius)
+		if !ok {
+			for _, bucket := range table {
+				consider(bucket)
+			}
+			continue
+		}
+		for _, key := range keys {
+			consider(table[key])
+		}
 	}
 	return results, nil
 }
 
-func (l *LSH) SaveToFile(filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+// rangeBuckets returns the keys of the buckets in table that can hold a vector within Euclidean
+// distance radius of the query. ok is false when the keys cannot be bounded: the metric is not
+// Euclidean or there are more than maxRangeProbeBuckets of them.
+func (l *LSH) rangeBuckets(table int, query Vector, radius float64) (keys []int64, ok bool) {
+	if l.distFunc != nil {
+		return nil, false
 	}
-	defer file.Close()
+	if l.Width == 0 {
+		// |d(r, u) - d(r, q)| <= d(u, q) by the triangle inequality
+		d := basic.EuclidDistanceVec(l.RandomVectors[table], query)
+		lo, hi := int64(math.Max(0, d-radius)), int64(d+radius)
+		if hi-lo+1 > maxRangeProbeBuckets {
+			return nil, false
+		}
+		for h := lo; h <= hi; h++ {
+			keys = append(keys, h)
+		}
+		return keys, true
+	}
+
+	// |a·u - a·q| <= |a|·d(u, q), so every hash moves by at most |a|·radius/w buckets
+	start := table * l.HashesPerTable
+	projections := l.RandomVectors[start : start+l.HashesPerTable]
+	los := make([]int64, len(projections))
+	his := make([]int64, len(projections))
+	total := 1
+	for i, projection := range projections {
+		center := (basic.Dot(projection.Values, query.Values) + l.Offsets[start+i]*l.Width) / l.Width
+		spread := math.Sqrt(basic.Dot(projection.Values, projection.Values)) * radius / l.Width
+		los[i], his[i] = int64(math.Floor(center-spread)), int64(math.Floor(center+spread))
+		count := int(his[i] - los[i] + 1)
+		if count <= 0 {
+			return nil, true
+		}
+		if total *= count; total > maxRangeProbeBuckets {
+			return nil, false
+		}
+	}
+	// Combine the hashes the same way createPStableHashFunc does
+	keys = []int64{17}
+	for i := range projections {
+		next := make([]int64, 0, len(keys)*int(his[i]-los[i]+1))
+		for _, key := range keys {
+			for h := los[i]; h <= his[i]; h++ {
+				next = append(next, key*1000003^h)
+			}
+		}
+		keys = next
+	}
+	return keys, true
+}
 
-	encoder := gob.NewEncoder(file)
+// Describe returns the number of vectors, their dimension (0 when empty) and the type name "lsh",
+// counted by collecting the distinct vectors of all tables.
+func (l *LSH) Describe() (count int, dim int, indexType string, err error) {
+	return describe(l, "lsh")
+}
+
+// Config reports the construction parameters. For NewLSH every hash is its own table and
+// width is 0; for NewLSHWithWidth num_hashes is the number of hashes concatenated per table.
+func (l *LSH) Config() map[string]interface{} {
+	numHashes := len(l.HashFuncs)
+	if l.Width > 0 {
+		numHashes = l.HashesPerTable
+	}
+	return map[string]interface{}{
+		"num_hashes":    numHashes,
+		"num_tables":    len(l.HashTables),
+		"bucket_size":   l.BucketSize,
+		"width":         l.Width,
+		"min_occupancy": l.MinOccupancy,
+		"normalize":     l.normalize,
+		"metric":        metricName(l.distFunc),
+	}
+}
+
+// Save writes the hash tables and hash function parameters to w. The incremental log is not
+// involved, SaveToFile should be used when SaveIncremental is in use.
+func (l *LSH) Save(w io.Writer) error {
+	encoder := gob.NewEncoder(w)
 	aux := lshGob{
-		HashTables:    l.HashTables,
-		BucketSize:    l.BucketSize,
-		RandomVectors: l.RandomVectors,
+		HashTables:     l.HashTables,
+		BucketSize:     l.BucketSize,
+		RandomVectors:  l.RandomVectors,
+		Width:          l.Width,
+		HashesPerTable: l.HashesPerTable,
+		Offsets:        l.Offsets,
+		MinOccupancy:   l.MinOccupancy,
+		Normalize:      l.normalize,
 	}
 
 	// Register types with gob. This ensures gob knows about our custom types and their nested structures.
 	gob.Register(map[int64][]Vector{})
 	gob.Register(Vector{})
 
-	if err := encoder.Encode(&aux); err != nil {
+	return encoder.Encode(&aux)
+}
+
+// Load reads an LSH written by Save from r and rebuilds the hash functions.
+// Incremental logging is turned off until the next SaveIncremental.
+func (l *LSH) Load(r io.Reader) error {
+	decoder := gob.NewDecoder(r)
+	aux := lshGob{}
+
+	// Register types with gob. This ensures gob knows about our custom types and their nested structures.
+	gob.Register(map[int64][]Vector{})
+	gob.Register(Vector{})
+
+	if err := decoder.Decode(&aux); err != nil {
+		return err
+	}
+
+	l.HashTables = aux.HashTables
+	l.BucketSize = aux.BucketSize
+	l.RandomVectors = aux.RandomVectors
+	l.Width = aux.Width
+	l.HashesPerTable = aux.HashesPerTable
+	l.Offsets = aux.Offsets
+	l.MinOccupancy = aux.MinOccupancy
+	l.normalize = aux.Normalize
+	l.buildHashFuncs()
+
+	l.logging = false
+	l.pendingLog = nil
+	return nil
+}
+
+// SaveToFileCompressed saves the LSH to a gzip-compressed file. The incremental log is not involved.
+func (l *LSH) SaveToFileCompressed(filename string) error {
+	return saveCompressed(filename, l.Save)
+}
+
+// LoadFromFileCompressed loads the LSH from a file written by SaveToFileCompressed.
+func (l *LSH) LoadFromFileCompressed(filename string) error {
+	return loadCompressed(filename, l.Load)
+}
+
+func (l *LSH) SaveToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
 		return err
 	}
+	defer file.Close()
+
+	if err := l.Save(file); err != nil {
+		return err
+	}
+
+	// A full snapshot supersedes any previously written log.
+	if err := os.Remove(filename + lshLogSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l.snapshotFile = filename
+	l.loggedEntries = 0
+	l.pendingLog = nil
 	return nil
 }
 
@@ -247,25 +672,124 @@ func (l *LSH) LoadFromFile(filename string) error {
 	}
 	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	aux := lshGob{}
+	if err := l.Load(file); err != nil {
+		return err
+	}
 
-	// Register types with gob. This ensures gob knows about our custom types and their nested structures.
-	gob.Register(map[int64][]Vector{})
-	gob.Register(Vector{})
+	// Replay the incremental log written by SaveIncremental, if any, and keep logging to it.
+	if _, err := os.Stat(filename + lshLogSuffix); err == nil {
+		replayed, torn, err := l.replayLog(filename + lshLogSuffix)
+		if err != nil {
+			return err
+		}
+		if torn {
+			// The last frame was cut short by a crash during SaveIncremental, which never reported
+			// success for it. Keep the complete frames and rewrite the snapshot without the torn tail.
+			return l.Compact(filename)
+		}
+		l.logging = true
+		l.snapshotFile = filename
+		l.loggedEntries = replayed
+	}
 
-	if err := decoder.Decode(&aux); err != nil {
-		return err
+	return nil
+}
+
+// SaveIncremental appends the inserts and deletes made since the last save to a log file
+// next to the snapshot instead of re-encoding every hash table. The first call, a call with a
+// different filename, or a log that has grown past CompactThreshold writes a full snapshot.
+func (l *LSH) SaveIncremental(filename string) error {
+	threshold := l.CompactThreshold
+	if threshold <= 0 {
+		threshold = defaultLSHCompactThreshold
+	}
+	if !l.logging || l.snapshotFile != filename || l.loggedEntries+len(l.pendingLog) > threshold {
+		return l.Compact(filename)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return l.Compact(filename)
+	}
+	if len(l.pendingLog) == 0 {
+		return nil
 	}
 
-	l.HashTables = aux.HashTables
-	l.BucketSize = aux.BucketSize
-	l.RandomVectors = aux.RandomVectors
+	file, err := os.OpenFile(filename+lshLogSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-	l.HashFuncs = make([]func(Vector) int64, len(l.RandomVectors))
-	for i, randomVec := range l.RandomVectors {
-		l.HashFuncs[i] = createHashFuncWithVector(randomVec)
+	// Every frame has its own gob stream so frames can be appended independently.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(l.pendingLog); err != nil {
+		return err
+	}
+	if err := binary.Write(file, binary.BigEndian, uint32(buf.Len())); err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return err
 	}
 
+	l.loggedEntries += len(l.pendingLog)
+	l.pendingLog = nil
 	return nil
 }
+
+// Compact writes a full snapshot to filename, removes its log and enables incremental logging.
+func (l *LSH) Compact(filename string) error {
+	if err := l.SaveToFile(filename); err != nil {
+		return err
+	}
+	l.logging = true
+	return nil
+}
+
+// replayLog applies every logged operation in logFilename and returns how many were applied.
+// A final frame that ends before its declared size is skipped and reported as torn.
+func (l *LSH) replayLog(logFilename string) (replayed int, torn bool, err error) {
+	file, err := os.Open(logFilename)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	for {
+		var size uint32
+		if err := binary.Read(file, binary.BigEndian, &size); err != nil {
+			if err == io.EOF {
+				return replayed, false, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return replayed, true, nil
+			}
+			return replayed, false, err
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(file, frame); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return replayed, true, nil
+			}
+			return replayed, false, err
+		}
+
+		var entries []lshLogEntry
+		if err := gob.NewDecoder(bytes.NewReader(frame)).Decode(&entries); err != nil {
+			return replayed, false, err
+		}
+		for _, entry := range entries {
+			switch entry.Op {
+			case lshLogInsert:
+				err = l.Insert(entry.Vector)
+			case lshLogDelete:
+				err = l.Delete(entry.Vector)
+			default:
+				err = errors.New("unknown log operation")
+			}
+			if err != nil {
+				return replayed, false, err
+			}
+			replayed++
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package core
+
+// 索引构造函数的可选参数
+
+import (
+	"errors"
+	"hh_vectordb/basic"
+)
+
+// DistanceFunc 自定义距离函数,距离越小越相似
+type DistanceFunc = basic.DistanceFunc
+
+// Option 索引构造函数的可选参数
+type Option func(*indexOptions)
+
+// indexOptions 所有索引共用的可选配置
+type indexOptions struct {
+	distance   DistanceFunc
+	duplicates DuplicateValuePolicy
+	normalize  bool
+}
+
+// DuplicateValuePolicy 插入分量与已有向量完全相同(不比较 ID)的向量时的处理策略
+type DuplicateValuePolicy int
+
+const (
+	AllowDuplicateValues DuplicateValuePolicy = iota // 照常插入,默认策略
+	SkipDuplicateValues                              // 忽略本次插入,不返回错误
+	ErrorDuplicateValues                             // 不插入并返回错误
+)
+
+// WithMetric
+//
+//	@Description: 使用自定义距离函数代替欧几里得距离,查询、剪枝与建树时都会使用它。
+//	各索引对距离函数的要求不同:
+//	  - BruteForceSearch:任意距离函数都能得到精确结果
+//	  - BallTree、VPTree、CoverTree:依赖三角不等式剪枝,距离函数必须是度量(metric),否则结果可能不精确
+//	  - KDTree:依赖"单个坐标的差值不超过距离"剪枝,适用于 Minkowski 距离(L1、L2、L∞ 等)
+//	  - LSH、PQ:哈希与量化仍基于欧几里得空间,距离函数只用于候选集的精确排序与过滤
+//	自定义距离函数不会被持久化,加载后需要通过构造函数重新指定
+//	@param distance 距离函数
+//	@return Option
+func WithMetric(distance DistanceFunc) Option {
+	return func(o *indexOptions) {
+		o.distance = distance
+	}
+}
+
+// WithDuplicateValues
+//
+//	@Description: 指定插入重复分量的处理策略,用于入库时去重。目前只有 BruteForceSearch 支持,
+//	已有分量记录在哈希集合中,判断重复不需要扫描全部向量。分量按精确值比较,归一化模式下比较的是归一化后的分量。
+//	与距离函数一样不会被持久化
+//	@param policy 处理策略
+//	@return Option
+func WithDuplicateValues(policy DuplicateValuePolicy) Option {
+	return func(o *indexOptions) {
+		o.duplicates = policy
+	}
+}
+
+// WithNormalize
+//
+//	@Description: 使用归一化(余弦)模式:插入、训练与查询的向量都先做 L2 归一化,此时欧几里得距离排序与余弦相似度排序一致。
+//	BruteForceSearch、KDTree、LSH、PQ 支持该选项,归一化模式会随索引一起持久化,加载后的查询同样会自动归一化。
+//	BallTree、VPTree、CoverTree 不支持该选项:NewBallTreeChecked、NewVPTreeChecked、NewCoverTreeChecked、NewCoverTreeAuto
+//	与 NewHilbertIndex 收到时返回错误,NewBallTree、NewVPTree、NewCoverTree 忽略该选项
+//	@return Option
+func WithNormalize() Option {
+	return func(o *indexOptions) {
+		o.normalize = true
+	}
+}
+
+// normalizeIf 归一化模式下返回 L2 归一化后的向量,否则原样返回
+func normalizeIf(normalize bool, vec Vector) Vector {
+	if normalize {
+		return basic.Normalize(vec)
+	}
+	return vec
+}
+
+// errNormalizeUnsupported 不支持归一化模式的索引收到 WithNormalize 时返回的错误
+var errNormalizeUnsupported = errors.New("WithNormalize is not supported by this index")
+
+// checkNormalizeUnsupported 不支持归一化模式的索引在带错误返回的构造函数中调用,收到 WithNormalize 时返回错误
+func checkNormalizeUnsupported(o indexOptions) error {
+	if o.normalize {
+		return errNormalizeUnsupported
+	}
+	return nil
+}
+
+// newIndexOptions 依次应用可选参数
+func newIndexOptions(opts []Option) indexOptions {
+	o := indexOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// measure
+//
+//	@Description: 用索引配置的距离函数计算距离,未配置时使用欧几里得距离
+//	@param distance 距离函数,可为 nil
+//	@param a
+//	@param b
+//	@return float64
+func measure(distance DistanceFunc, a, b Vector) float64 {
+	if distance == nil {
+		return basic.EuclidDistance(a.Values, b.Values)
+	}
+	return distance(a.Values, b.Values)
+}
+
+// metricName
+//
+//	@Description: 返回距离函数在 Config 中的名称。自定义距离函数无法还原名字,统一记为 "custom"
+//	@param distance 距离函数,可为 nil
+//	@return string
+func metricName(distance DistanceFunc) string {
+	if distance == nil {
+		return "euclidean"
+	}
+	return "custom"
+}
+
+// indexDistance
+//
+//	@Description: 返回索引查询时使用的距离函数,使基于索引结果的工具函数(如 KDistances)与
+//	索引的 SearchWithinRange、KNearest 使用同一度量。无法得知时使用欧几里得距离
+//	@param index 索引,包装类索引会返回其内部索引的距离函数
+//	@return func(a, b Vector) float64
+func indexDistance(index interface{}) func(a, b Vector) float64 {
+	switch idx := index.(type) {
+	case *BruteForceSearch:
+		return idx.distance
+	case *ConcurrentBruteForce:
+		return idx.inner.distance
+	case *PQ:
+		return func(a, b Vector) float64 { return measure(idx.distFunc, a, b) }
+	case *SafeIndex:
+		return indexDistance(idx.inner)
+	case *RecordingIndex:
+		return indexDistance(idx.NearestNeighborSearch)
+	case interface{ dist(a, b Vector) float64 }:
+		return idx.dist
+	}
+	return basic.EuclidDistanceVec
+}
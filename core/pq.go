@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"errors"
 	"hh_vectordb/basic"
+	"io"
 	"log"
 	"math"
 	"math/rand"
@@ -27,13 +28,30 @@ type PQ struct {
 	DB        []Vector      // For simplicity, we'll also store the original vectors
 	IDs       [][]int64     // Quantized IDs
 	IDLookup  map[int64]int // Map from vector ID to its index in p.DB
+	Deleted   map[int]bool  // DB slots soft-deleted by SoftDelete, skipped by searches until Compact
+	Normalize bool          // cosine mode set by WithNormalize: training, stored and query vectors are L2-normalized
+
+	// Drift tracking: mean quantization error of the training set vs. that of inserted vectors.
+	// The statistics are saved with the PQ so Staleness and NeedsRetrain survive a reload.
+	maxErrorRatio   float64 // NeedsRetrain reports true once the insert error exceeds this multiple, 0 disables it
+	TrainError      float64 // mean quantization error of the training set, 0 when untrained
+	InsertErrorSum  float64 // summed quantization error of the vectors inserted since training
+	InsertErrorSeen int     // number of vectors inserted since training
+
+	distFunc    DistanceFunc   // metric used for exact re-ranking and filtering, nil means Euclidean
+	codebookGen uint64         // bumped whenever the codebooks are replaced, stale QueryContexts are rejected
+	originals   *diskOriginals // non-nil after LoadPartial: original values are read from disk
+
+	// dbMu guards the DB slice header and Deleted. Stored vectors are never overwritten in place:
+	// Insert only appends and Delete copies into a fresh slice, so snapshots taken by EachVector stay valid.
+	dbMu sync.RWMutex
 }
 
+// defaultMaxErrorRatio is the drift threshold used by NewPQ.
+const defaultMaxErrorRatio = 2.0
+
 // Compute an estimated distance for each encoded vector
-type vectorDistPair struct {
-	vector Vector
-	dist   float64
-}
+type vectorDistPair = basic.VectorDistPair
 
 type ChunkResult struct {
 	Vectors []Vector
@@ -43,7 +61,7 @@ type ChunkResult struct {
 type MaxHeap []vectorDistPair
 
 func (h MaxHeap) Len() int           { return len(h) }
-func (h MaxHeap) Less(i, j int) bool { return h[i].dist > h[j].dist } // Note the > for max heap
+func (h MaxHeap) Less(i, j int) bool { return h[i].Dist > h[j].Dist } // Note the > for max heap
 func (h MaxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
 
 func (h *MaxHeap) Push(x interface{}) {
@@ -58,16 +76,51 @@ func (h *MaxHeap) Pop() interface{} {
 	return x
 }
 
-func NewPQ(m, k int) *PQ {
+func NewPQ(m, k int, opts ...Option) *PQ {
+	o := newIndexOptions(opts)
 	return &PQ{
-		m:         m,
-		k:         k,
-		Codebooks: make([][]Centroid, m),
-		IDLookup:  make(map[int64]int),
+		m:             m,
+		k:             k,
+		Codebooks:     make([][]Centroid, m),
+		IDLookup:      make(map[int64]int),
+		maxErrorRatio: defaultMaxErrorRatio,
+		distFunc:      o.distance,
+		Normalize:     o.normalize,
 	}
 }
 
+// prepare L2-normalizes vec in cosine mode.
+func (p *PQ) prepare(vec Vector) Vector {
+	return normalizeIf(p.Normalize, vec)
+}
+
 func (p *PQ) Train(vectors []Vector, epochs int) {
+	p.train(vectors, nil, epochs)
+}
+
+// TrainWeighted trains the codebooks with weighted k-means: each vector contributes to its
+// centroid's mean in proportion to its weight, while assignment still uses plain distance.
+func (p *PQ) TrainWeighted(vectors []Vector, weights []float64, epochs int) error {
+	if len(weights) != len(vectors) {
+		return errors.New("weights and vectors should have the same length")
+	}
+	for _, w := range weights {
+		if w < 0 {
+			return errors.New("weights should not be negative")
+		}
+	}
+	p.train(vectors, weights, epochs)
+	return nil
+}
+
+func (p *PQ) train(vectors []Vector, weights []float64, epochs int) {
+	if p.Normalize {
+		normalized := make([]Vector, len(vectors))
+		for i, vec := range vectors {
+			normalized[i] = p.prepare(vec)
+		}
+		vectors = normalized
+	}
 	subvectorSize := len(vectors[0].Values) / p.m
 	for i := 0; i < p.m; i++ {
 		// Split vectors into subvectors for current group
@@ -79,14 +132,186 @@ func (p *PQ) Train(vectors []Vector, epochs int) {
 		}
 
 		// Run k-means on subvectors
-		centroids, _ := kmeans(subvectors, p.k, epochs, vectors)
+		centroids, _ := kmeans(subvectors, p.k, epochs, vectors, weights)
 
 		// Store the centroids in the codebook
 		p.Codebooks[i] = centroids
 	}
+	p.codebookGen++
+
+	// Record the training-time error as the baseline for drift detection
+	total := 0.0
+	for _, vec := range vectors {
+		total += p.quantizationError(vec)
+	}
+	p.TrainError = total / float64(len(vectors))
+	p.InsertErrorSum = 0
+	p.InsertErrorSeen = 0
+}
+
+// quantizationError returns the distance between vec and its reconstruction from the codebooks.
+func (p *PQ) quantizationError(vec Vector) float64 {
+	subvectorSize := len(vec.Values) / p.m
+	sum := 0.0
+	for i := 0; i < p.m; i++ {
+		segment := Vector{Values: vec.Values[i*subvectorSize : (i+1)*subvectorSize]}
+		minDist := math.MaxFloat64
+		for _, centroid := range p.Codebooks[i] {
+			minDist = math.Min(minDist, basic.EuclidDistanceVec(segment, centroid.Vector))
+		}
+		sum += minDist * minDist
+	}
+	return math.Sqrt(sum)
+}
+
+// SetMaxErrorRatio sets how many times the training-time quantization error the running mean
+// error of inserted vectors may reach before NeedsRetrain reports true. A ratio <= 0 disables it.
+func (p *PQ) SetMaxErrorRatio(ratio float64) {
+	p.maxErrorRatio = ratio
+}
+
+// NeedsRetrain reports whether the vectors inserted since the last training have drifted
+// away from the codebooks, i.e. their mean quantization error exceeds maxErrorRatio times
+// the training-time error.
+func (p *PQ) NeedsRetrain() bool {
+	if p.maxErrorRatio <= 0 || p.InsertErrorSeen == 0 {
+		return false
+	}
+	return p.Staleness() > p.maxErrorRatio
+}
+
+// Staleness returns the mean quantization error of the vectors inserted since the last training
+// divided by the training-time mean error, so schedulers can retrain once it passes a threshold
+// such as 1.5. It is 1 when nothing has been inserted yet and 0 when the PQ is untrained.
+func (p *PQ) Staleness() float64 {
+	if p.TrainError <= 0 {
+		return 0
+	}
+	if p.InsertErrorSeen == 0 {
+		return 1
+	}
+	return p.InsertErrorSum / float64(p.InsertErrorSeen) / p.TrainError
+}
+
+// Retrain refreshes the codebooks from all stored vectors with the current m/k,
+// re-quantizes them and resets the drift statistics.
+func (p *PQ) Retrain(epochs int) error {
+	return p.Reconfigure(p.m, p.k, epochs)
+}
+
+// Reconfigure retrains the codebooks with new m/k from the stored original vectors
+// and re-quantizes every vector, so PQ parameters can be tuned without re-ingesting data.
+func (p *PQ) Reconfigure(m, k, epochs int) error {
+	if m <= 0 || k <= 0 {
+		return errors.New("m and k should be greater than 0")
+	}
+	if p.originals != nil {
+		return errors.New("cannot retrain a partially loaded PQ")
+	}
+	// Soft-deleted vectors must not take part in training
+	p.Compact()
+	if len(p.DB) < k {
+		return errors.New("not enough vectors to train k centroids")
+	}
+	if len(p.DB[0].Values)%m != 0 {
+		return errors.New("vector dimension should be divisible by m")
+	}
+
+	p.m = m
+	p.k = k
+	p.Codebooks = make([][]Centroid, m)
+	p.train(p.DB, nil, epochs)
+
+	p.IDs = make([][]int64, len(p.DB))
+	for i, vec := range p.DB {
+		p.IDs[i] = p.quantize(vec)
+	}
+	return nil
+}
+
+// Parameters of the cross-validation run by SelectPQSubvectors.
+const (
+	selectPQSampleSize = 2000 // at most this many vectors are used to train and search each candidate
+	selectPQQueries    = 50   // at most this many held-out vectors are used as queries
+	selectPQCentroids  = 16   // centroids per subvector of the candidate quantizers
+	selectPQEpochs     = 10
+)
+
+// SelectPQSubvectors picks the number of subvectors m by cross-validation. Queries are held out
+// from a deterministic subsample of vectors, and for every candidate m that divides the dimension
+// a PQ is trained on the rest and its recall@k against the exact k nearest neighbours is measured.
+// The candidate with the best mean recall wins; ties go to the smaller m, whose codes are shorter.
+func SelectPQSubvectors(vectors []Vector, candidates []int, k int) (bestM int, err error) {
+	if k <= 0 {
+		return 0, errors.New("k should be greater than 0")
+	}
+	if len(vectors) == 0 {
+		return 0, errors.New("vectors should not be empty")
+	}
+	dim := len(vectors[0].Values)
+	var valid []int
+	for _, m := range candidates {
+		if m > 0 && m <= dim && dim%m == 0 {
+			valid = append(valid, m)
+		}
+	}
+	if len(valid) == 0 {
+		return 0, errors.New("no candidate divides the vector dimension")
+	}
+	sort.Ints(valid)
+
+	// Deterministic subsample, split into held-out queries and training/search data
+	r := rand.New(rand.NewSource(1))
+	perm := r.Perm(len(vectors))
+	if len(perm) > selectPQSampleSize {
+		perm = perm[:selectPQSampleSize]
+	}
+	numQueries := len(perm) / 10
+	if numQueries > selectPQQueries {
+		numQueries = selectPQQueries
+	}
+	if numQueries == 0 || len(perm)-numQueries < selectPQCentroids {
+		return 0, errors.New("not enough vectors to cross-validate")
+	}
+	for _, idx := range perm {
+		if len(vectors[idx].Values) != dim {
+			return 0, errors.New("vectors should have the same dimension")
+		}
+	}
+	queries := make([]Vector, numQueries)
+	for i, idx := range perm[:numQueries] {
+		queries[i] = vectors[idx]
+	}
+	train := make([]Vector, len(perm)-numQueries)
+	for i, idx := range perm[numQueries:] {
+		train[i] = vectors[idx]
+	}
+	truths := ExactKNNParallel(train, queries, k)
+
+	bestRecall := -1.0
+	for _, m := range valid {
+		pq := NewPQ(m, selectPQCentroids)
+		pq.Train(train, selectPQEpochs)
+		if err := pq.InsertBatch(train); err != nil {
+			return 0, err
+		}
+		recall := 0.0
+		for i, query := range queries {
+			results, err := pq.KNearest(query, k)
+			if err != nil {
+				return 0, err
+			}
+			recall += recallByID(truths[i], results)
+		}
+		recall /= float64(len(queries))
+		if recall > bestRecall {
+			bestM, bestRecall = m, recall
+		}
+	}
+	return bestM, nil
 }
 
-func kmeans(vectors []Vector, k, epochs int, originalVectors []Vector) ([]Centroid, error) {
+func kmeans(vectors []Vector, k, epochs int, originalVectors []Vector, weights []float64) ([]Centroid, error) {
 	// 1. Initialize centroids randomly
 	centroids := initializeCentroids(vectors, k)
 
@@ -100,7 +325,7 @@ func kmeans(vectors []Vector, k, epochs int, originalVectors []Vector) ([]Centro
 		assignments := assignToNearest(vectors, centroids)
 
 		// Compute new centroids
-		newCentroids := computeCentroids(assignments, k, vectors)
+		newCentroids := computeCentroids(assignments, k, vectors, weights)
 
 		// Log centroids for this iteration
 		for i, centroid := range newCentroids {
@@ -119,23 +344,32 @@ func kmeans(vectors []Vector, k, epochs int, originalVectors []Vector) ([]Centro
 	return centroids, nil
 }
 
-func computeCentroids(assignments map[int][]Vector, k int, vectors []Vector) []Centroid {
+// computeCentroids recomputes each centroid as the (weighted) mean of the vectors assigned to it.
+// A nil weights slice gives every vector weight 1.
+func computeCentroids(assignments map[int][]int, k int, vectors []Vector, weights []float64) []Centroid {
 	newCentroids := make([]Centroid, k)
-	for idx, assignedVectors := range assignments {
-		if len(assignedVectors) == 0 {
-			// Re-initialize the centroid if no vectors are assigned to it
+	for idx := 0; idx < k; idx++ {
+		assigned := assignments[idx]
+		totalWeight := 0.0
+		sum := make([]float64, len(vectors[0].Values))
+		for _, vi := range assigned {
+			w := 1.0
+			if weights != nil {
+				w = weights[vi]
+			}
+			for i, val := range vectors[vi].Values {
+				sum[i] += w * val
+			}
+			totalWeight += w
+		}
+		if totalWeight == 0 {
+			// Re-initialize the centroid if no vectors (or only zero-weight vectors) are assigned to it
 			randomIndex := rand.Intn(len(vectors))
 			newCentroids[idx] = Centroid{ID: int64(idx), Vector: vectors[randomIndex]}
 			continue
 		}
-		sum := make([]float64, len(assignedVectors[0].Values))
-		for _, vec := range assignedVectors {
-			for i, val := range vec.Values {
-				sum[i] += val
-			}
-		}
 		for i := range sum {
-			sum[i] /= float64(len(assignedVectors))
+			sum[i] /= totalWeight
 		}
 		newCentroids[idx] = Centroid{ID: int64(idx), Vector: Vector{Values: sum}}
 	}
@@ -146,23 +380,21 @@ func initializeCentroids(vectors []Vector, k int) []Centroid {
 	// Initialize the random seed
 	rand.Seed(time.Now().UnixNano())
 
-	// Shuffle the list of vectors
-	rand.Shuffle(len(vectors), func(i, j int) {
-		vectors[i], vectors[j] = vectors[j], vectors[i]
-	})
+	// Pick k random vectors without reordering the input, so it stays aligned with its weights
+	perm := rand.Perm(len(vectors))
 
-	// Select the first 'k' vectors
 	centroids := make([]Centroid, k)
 	for i := 0; i < k; i++ {
-		centroids[i] = Centroid{ID: vectors[i].ID, Vector: vectors[i]}
+		vec := vectors[perm[i]]
+		centroids[i] = Centroid{ID: vec.ID, Vector: vec}
 	}
 
 	return centroids
 }
 
-func assignToNearest(vectors []Vector, centroids []Centroid) map[int][]Vector {
-	assignments := make(map[int][]Vector)
-	for _, vec := range vectors {
+func assignToNearest(vectors []Vector, centroids []Centroid) map[int][]int {
+	assignments := make(map[int][]int)
+	for vi, vec := range vectors {
 		minDist := math.MaxFloat64
 		minIdx := 0
 		for idx, centroid := range centroids {
@@ -172,7 +404,7 @@ func assignToNearest(vectors []Vector, centroids []Centroid) map[int][]Vector {
 				minIdx = idx
 			}
 		}
-		assignments[minIdx] = append(assignments[minIdx], vec)
+		assignments[minIdx] = append(assignments[minIdx], vi)
 	}
 	return assignments
 }
@@ -189,10 +421,17 @@ func centroidsEqual(a, b []Centroid) bool {
 }
 
 func (p *PQ) Insert(vec Vector) error {
+	vec = p.prepare(vec)
 	p.IDLookup[vec.ID] = len(p.DB) // Add to IDLookup
+	p.dbMu.Lock()
 	p.DB = append(p.DB, vec)
+	p.dbMu.Unlock()
 	ids := p.quantize(vec)
 	p.IDs = append(p.IDs, ids)
+	if p.TrainError > 0 {
+		p.InsertErrorSum += p.quantizationError(vec)
+		p.InsertErrorSeen++
+	}
 	return nil
 }
 
@@ -210,6 +449,24 @@ func (p *PQ) quantize(vec Vector) []int64 {
 	return ids
 }
 
+// QuantizeBatch encodes vectors against the trained codebooks without inserting them,
+// returning one code per subvector for each vector. Codes are packed into a byte each,
+// so nil is returned when a codebook has more than 256 centroids.
+func (p *PQ) QuantizeBatch(vectors []Vector) [][]uint8 {
+	if p.k > math.MaxUint8+1 {
+		return nil
+	}
+	codes := make([][]uint8, len(vectors))
+	for i, vec := range vectors {
+		ids := p.quantize(p.prepare(vec))
+		codes[i] = make([]uint8, len(ids))
+		for j, id := range ids {
+			codes[i][j] = uint8(id)
+		}
+	}
+	return codes
+}
+
 func (p *PQ) nearestCentroid(query Vector, mIndex int64) (int64, error) {
 	minDist := math.MaxFloat64
 	minIdx := int64(-1)
@@ -231,6 +488,7 @@ func (p *PQ) Nearest(query Vector) (Vector, error) {
 	if len(p.Codebooks) == 0 {
 		return Vector{}, errors.New("codebook is not trained")
 	}
+	query = p.prepare(query)
 
 	// Split the query into m segments
 	segmentLength := len(query.Values) / p.m
@@ -245,7 +503,10 @@ func (p *PQ) Nearest(query Vector) (Vector, error) {
 	// Compute an estimated distance for each encoded vector and find the one with the smallest distance
 	minDistance := math.MaxFloat64
 	var closestVector Vector
-	for _, vec := range p.DB {
+	for i, vec := range p.DB {
+		if p.Deleted[i] {
+			continue
+		}
 		estimatedDist := p.estimateDistance(vec, distancesToCentroids)
 		if estimatedDist < minDistance {
 			minDistance = estimatedDist
@@ -253,7 +514,49 @@ func (p *PQ) Nearest(query Vector) (Vector, error) {
 		}
 	}
 
-	return closestVector, nil
+	if minDistance == math.MaxFloat64 {
+		return closestVector, nil
+	}
+	return p.withValues(closestVector)
+}
+
+// NearestExcludingSelf returns the nearest vector whose true distance to the query is not an exact match.
+func (p *PQ) NearestExcludingSelf(query Vector) (Vector, error) {
+	if len(p.Codebooks) == 0 {
+		return Vector{}, errors.New("codebook is not trained")
+	}
+	return nearestExcludingSelf(p, p.prepare(query), len(p.DB))
+}
+
+// nearestExcludingIDCandidates is the number of PQ candidates NearestExcludingID refines: the same
+// 3x over-fetch as KNearestRefined for k=1, plus one slot for the excluded vector.
+const nearestExcludingIDCandidates = 4
+
+// NearestExcludingID returns the nearest vector whose ID is not excludeID, e.g. to find the closest
+// other vector of a stored one for deduplication. The PQ candidates are re-ranked by exact distance.
+func (p *PQ) NearestExcludingID(query Vector, excludeID int64) (Vector, error) {
+	query = p.prepare(query)
+	candidates, err := p.KNearest(query, nearestExcludingIDCandidates)
+	if err != nil {
+		return Vector{}, err
+	}
+	var nearest Vector
+	found := false
+	minDist := math.MaxFloat64
+	for _, vec := range candidates {
+		if vec.ID == excludeID {
+			continue
+		}
+		if dist := measure(p.distFunc, query, vec); dist < minDist {
+			minDist = dist
+			nearest = vec
+			found = true
+		}
+	}
+	if !found {
+		return Vector{}, errors.New("no vector other than the excluded one found")
+	}
+	return nearest, nil
 }
 
 func (p *PQ) calculateDistancesToCentroids(segment []float64, centroids []Centroid) []float64 {
@@ -319,11 +622,17 @@ func splitVector(values []float64, segmentLength int) [][]float64 {
 	return segments
 }
 
-func (p *PQ) KNearest(query Vector, k int) ([]Vector, error) {
-	if len(p.Codebooks) == 0 {
-		return nil, errors.New("codebook is not trained")
-	}
+// QueryContext holds a query together with its distances to every centroid of every codebook,
+// so the tables can be built once and reused across repeated searches.
+type QueryContext struct {
+	Query                Vector
+	distancesToCentroids [][]float64
+	codebookGen          uint64 // generation of the codebooks the tables were built from
+}
 
+// PrecomputeQuery builds the centroid distance tables for a single query.
+func (p *PQ) PrecomputeQuery(query Vector) *QueryContext {
+	query = p.prepare(query)
 	// Split the query into m segments
 	segmentLength := len(query.Values) / p.m
 	segments := splitVector(query.Values, segmentLength)
@@ -333,29 +642,165 @@ func (p *PQ) KNearest(query Vector, k int) ([]Vector, error) {
 	for i, segment := range segments {
 		distancesToCentroids[i] = p.calculateDistancesToCentroids(segment, p.Codebooks[i])
 	}
+	return &QueryContext{Query: query, distancesToCentroids: distancesToCentroids, codebookGen: p.codebookGen}
+}
+
+// PrecomputeQueryBatch builds the centroid distance tables for every query in the batch.
+func (p *PQ) PrecomputeQueryBatch(queries []Vector) []*QueryContext {
+	contexts := make([]*QueryContext, len(queries))
+	for i, query := range queries {
+		contexts[i] = p.PrecomputeQuery(query)
+	}
+	return contexts
+}
+
+// KNearestBatch runs KNearestWithContext for every precomputed query.
+func (p *PQ) KNearestBatch(contexts []*QueryContext, k int) ([][]Vector, error) {
+	results := make([][]Vector, len(contexts))
+	for i, ctx := range contexts {
+		result, err := p.KNearestWithContext(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+func (p *PQ) KNearest(query Vector, k int) ([]Vector, error) {
+	if len(p.Codebooks) == 0 {
+		return nil, errors.New("codebook is not trained")
+	}
+	return p.KNearestWithContext(p.PrecomputeQuery(query), k)
+}
+
+// SelfRank queries with the stored vector for id and returns the 0-based rank of id in the top-k,
+// or -1 if it is outside the top-k. It measures the self-recall of an index in leave-one-out tests.
+func (p *PQ) SelfRank(id int64, k int) (int, error) {
+	if k <= 0 {
+		return -1, errors.New("k should be greater than 0")
+	}
+	// GetByID also reads the values a partially loaded PQ keeps on disk
+	vec, err := p.GetByID(id)
+	if err != nil {
+		return -1, err
+	}
+	return rankOf(p, vec, k)
+}
+
+// KNearestReversed returns the same top-k as KNearest, ordered from farthest to nearest.
+func (p *PQ) KNearestReversed(query Vector, k int) ([]Vector, error) {
+	return kNearestReversed(p, query, k)
+}
+
+// KNearestWithContext is KNearest using the distance tables of a precomputed query.
+func (p *PQ) KNearestWithContext(ctx *QueryContext, k int) ([]Vector, error) {
+	results, err := p.kNearestResults(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	return basic.ResultsToVectors(results), nil
+}
+
+// KNearestResults is KNearest that also reports the estimated distance of every result.
+func (p *PQ) KNearestResults(query Vector, k int) ([]SearchResult, error) {
+	if len(p.Codebooks) == 0 {
+		return nil, errors.New("codebook is not trained")
+	}
+	return p.kNearestResults(p.PrecomputeQuery(query), k)
+}
+
+func (p *PQ) kNearestResults(ctx *QueryContext, k int) ([]SearchResult, error) {
+	if len(p.Codebooks) == 0 {
+		return nil, errors.New("codebook is not trained")
+	}
+	// Reconfigure, Retrain and loading replace the codebooks, so tables built earlier may index
+	// centroids that no longer exist
+	if ctx == nil || ctx.codebookGen != p.codebookGen || len(ctx.distancesToCentroids) != p.m {
+		return nil, errors.New("query context does not match the codebooks")
+	}
+
+	distancesToCentroids := ctx.distancesToCentroids
 	h := &MaxHeap{}
 	heap.Init(h)
 
-	for _, vec := range p.DB {
+	for i, vec := range p.DB {
+		if p.Deleted[i] {
+			continue
+		}
 		estimatedDist := p.estimateDistance(vec, distancesToCentroids)
 		if h.Len() < k {
-			heap.Push(h, vectorDistPair{vec, estimatedDist})
-		} else if top := (*h)[0]; estimatedDist < top.dist {
+			heap.Push(h, vectorDistPair{Vector: vec, Dist: estimatedDist})
+		} else if top := (*h)[0]; estimatedDist < top.Dist {
 			heap.Pop(h)
-			heap.Push(h, vectorDistPair{vec, estimatedDist})
+			heap.Push(h, vectorDistPair{Vector: vec, Dist: estimatedDist})
 		}
 	}
 
-	// Extract top-k vectors from the heap
-	result := make([]Vector, h.Len())
-	for i := 0; i < len(result); i++ {
-		pair := heap.Pop(h).(vectorDistPair)
-		result[len(result)-1-i] = pair.vector
+	// Extract top-k pairs from the heap, nearest first
+	pairs := make([]vectorDistPair, h.Len())
+	for i := len(pairs) - 1; i >= 0; i-- {
+		pairs[i] = heap.Pop(h).(vectorDistPair)
+	}
+	results := basic.VectorDistPairsToResults(pairs)
+	for i := range results {
+		if err := p.resolveResult(&results[i]); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// SearchWithinEstimatedDistance returns every stored vector whose PQ-estimated distance to the query
+// (the sum of per-subvector centroid distances used by KNearest) is at most maxEstimatedDist,
+// ordered by estimated distance. Unlike KNearest the number of results is not fixed.
+func (p *PQ) SearchWithinEstimatedDistance(query Vector, maxEstimatedDist float64) ([]Vector, error) {
+	if len(p.Codebooks) == 0 {
+		return nil, errors.New("codebook is not trained")
+	}
+	distancesToCentroids := p.PrecomputeQuery(query).distancesToCentroids
+	var pairs []vectorDistPair
+	for i, vec := range p.DB {
+		if p.Deleted[i] {
+			continue
+		}
+		if estimatedDist := p.estimateDistance(vec, distancesToCentroids); estimatedDist <= maxEstimatedDist {
+			pairs = append(pairs, vectorDistPair{Vector: vec, Dist: estimatedDist})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Dist < pairs[j].Dist })
+
+	result := make([]Vector, len(pairs))
+	for i, pair := range pairs {
+		result[i] = pair.Vector
+	}
+	if err := p.resolveVectors(result); err != nil {
+		return nil, err
 	}
 	return result, nil
 }
 
+// KNearestExplain returns the same results as KNearest together with, for every result,
+// the per-subvector partial distances whose sum is the estimated distance used for ranking.
+func (p *PQ) KNearestExplain(query Vector, k int) ([]Vector, [][]float64, error) {
+	ctx := p.PrecomputeQuery(query)
+	results, err := p.KNearestWithContext(ctx, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	partials := make([][]float64, len(results))
+	for i, vec := range results {
+		codes := p.encodeVector(vec)
+		partials[i] = make([]float64, len(codes))
+		for j, code := range codes {
+			partials[i][j] = ctx.distancesToCentroids[j][code]
+		}
+	}
+	return results, partials, nil
+}
+
 func (p *PQ) KNearestRefined(query Vector, k int) ([]Vector, error) {
+	query = p.prepare(query)
 	// Get a larger set of candidates using PQ
 	candidateCount := k * 3 // Here we're using 5 times k, but you can adjust this multiplier
 	candidates, err := p.KNearest(query, candidateCount)
@@ -368,12 +813,12 @@ func (p *PQ) KNearestRefined(query Vector, k int) ([]Vector, error) {
 	heap.Init(h)
 
 	for _, vec := range candidates {
-		dist := basic.EuclidDistance(query.Values, vec.Values)
+		dist := measure(p.distFunc, query, vec)
 		if h.Len() < k {
-			heap.Push(h, vectorDistPair{vec, dist})
-		} else if top := (*h)[0]; dist < top.dist {
+			heap.Push(h, vectorDistPair{Vector: vec, Dist: dist})
+		} else if top := (*h)[0]; dist < top.Dist {
 			heap.Pop(h)
-			heap.Push(h, vectorDistPair{vec, dist})
+			heap.Push(h, vectorDistPair{Vector: vec, Dist: dist})
 		}
 	}
 
@@ -381,13 +826,107 @@ func (p *PQ) KNearestRefined(query Vector, k int) ([]Vector, error) {
 	result := make([]Vector, h.Len())
 	for i := 0; i < len(result); i++ {
 		pair := heap.Pop(h).(vectorDistPair)
-		result[len(result)-1-i] = pair.vector
+		result[len(result)-1-i] = pair.Vector
 	}
 	return result, nil
 }
 
+// KNearestTieredRefined is a cheaper KNearestRefined: only the refineCount best candidates by
+// estimated distance are re-ranked by exact distance, since lower-ranked estimates rarely make it
+// into the final top-k. refineCount <= 0 means k, and values below k are raised to k.
+func (p *PQ) KNearestTieredRefined(query Vector, k, refineCount int) ([]Vector, error) {
+	query = p.prepare(query)
+	if refineCount < k {
+		refineCount = k
+	}
+	candidates, err := p.KNearest(query, refineCount)
+	if err != nil {
+		return nil, err
+	}
+	return topKByFunc(query, candidates, k, func(a, b Vector) float64 {
+		return measure(p.distFunc, a, b)
+	}), nil
+}
+
+// GetByID returns the stored original vector with the given ID.
+func (p *PQ) GetByID(id int64) (Vector, error) {
+	idx, exists := p.IDLookup[id]
+	if !exists {
+		return Vector{}, errors.New("vector not found in the database")
+	}
+	return p.withValues(p.DB[idx])
+}
+
+// KNearestAmong computes exact distances, under the PQ's metric, only for the given IDs and returns
+// the top-k of them. It is the refinement step for candidate lists produced elsewhere.
+func (p *PQ) KNearestAmong(query Vector, k int, ids []int64) ([]Vector, error) {
+	candidates := make([]Vector, 0, len(ids))
+	seen := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		if _, dup := seen[id]; dup {
+			continue
+		}
+		seen[id] = struct{}{}
+		vec, err := p.GetByID(id)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, vec)
+	}
+	return topKByFunc(p.prepare(query), candidates, k, func(a, b Vector) float64 {
+		return measure(p.distFunc, a, b)
+	}), nil
+}
+
 func (p *PQ) Vectors() ([]Vector, error) {
-	return p.DB, nil
+	if len(p.Deleted) == 0 {
+		return p.DB, nil
+	}
+	vectors := make([]Vector, 0, len(p.DB)-len(p.Deleted))
+	for i, vec := range p.DB {
+		if !p.Deleted[i] {
+			vectors = append(vectors, vec)
+		}
+	}
+	return vectors, nil
+}
+
+// EachVector calls fn for every stored vector in insertion order until fn returns false.
+// It iterates over a snapshot of DB taken at call time, so inserts and deletes made during the
+// iteration, from fn or from other goroutines, are not observed and cannot corrupt it.
+func (p *PQ) EachVector(fn func(Vector) bool) {
+	p.dbMu.RLock()
+	// Cap the snapshot at its length so later appends never write into its visible range
+	snapshot := p.DB[:len(p.DB):len(p.DB)]
+	var deleted map[int]bool
+	if len(p.Deleted) > 0 {
+		deleted = make(map[int]bool, len(p.Deleted))
+		for idx := range p.Deleted {
+			deleted[idx] = true
+		}
+	}
+	p.dbMu.RUnlock()
+	for i, vec := range snapshot {
+		if deleted[i] {
+			continue
+		}
+		if !fn(vec) {
+			return
+		}
+	}
+}
+
+// VectorsPage returns up to limit live vectors in insertion order starting at token, which is empty
+// for the first page, and the token of the next page, which is empty at the end. Pages are stable
+// as long as the index does not change between calls.
+func (p *PQ) VectorsPage(token string, limit int) (vectors []Vector, nextToken string, err error) {
+	p.dbMu.RLock()
+	defer p.dbMu.RUnlock()
+	live, err := p.Vectors()
+	if err != nil {
+		return nil, "", err
+	}
+	return vectorsPage(live, token, limit)
 }
 
 func (p *PQ) Delete(vec Vector) error {
@@ -395,12 +934,32 @@ func (p *PQ) Delete(vec Vector) error {
 	if !exists {
 		return errors.New("vector not found in the database")
 	}
-	// Remove vector from p.DB and update IDLookup map
-	p.DB = append(p.DB[:indexToDelete], p.DB[indexToDelete+1:]...)
+	// Remove vector from p.DB (into a fresh slice, leaving snapshots untouched) and update IDLookup map
+	db := make([]Vector, 0, len(p.DB)-1)
+	db = append(db, p.DB[:indexToDelete]...)
+	db = append(db, p.DB[indexToDelete+1:]...)
+	p.dbMu.Lock()
+	p.DB = db
+	if len(p.Deleted) > 0 {
+		// Slots after the deleted one move down by one
+		deleted := make(map[int]bool, len(p.Deleted))
+		for idx := range p.Deleted {
+			if idx > indexToDelete {
+				idx--
+			}
+			deleted[idx] = true
+		}
+		p.Deleted = deleted
+	}
+	p.dbMu.Unlock()
 	delete(p.IDLookup, vec.ID)
 
-	// Adjust IDLookup indices for vectors after the deleted vector
+	// Adjust IDLookup indices for vectors after the deleted vector. Soft-deleted slots stay out
+	// of the lookup, so their IDs are not revived and a re-inserted ID keeps its live slot.
 	for i := indexToDelete; i < len(p.DB); i++ {
+		if p.Deleted[i] {
+			continue
+		}
 		p.IDLookup[p.DB[i].ID] = i
 	}
 	// Remove IDs from p.IDs
@@ -408,7 +967,39 @@ func (p *PQ) Delete(vec Vector) error {
 	return nil
 }
 
+// DeleteAndReturn deletes the vector with the given ID and returns the stored original.
+func (p *PQ) DeleteAndReturn(id int64) (Vector, error) {
+	vec, err := p.GetByID(id)
+	if err != nil {
+		return Vector{}, err
+	}
+	if err := p.Delete(vec); err != nil {
+		return Vector{}, err
+	}
+	return vec, nil
+}
+
+// InsertBatch inserts all vectors after growing DB and IDs to their final size up front, and
+// presizing IDLookup when it is still empty.
 func (p *PQ) InsertBatch(vectors []Vector) error {
+	need := len(p.DB) + len(vectors)
+	if need > cap(p.DB) {
+		grown := make([]Vector, len(p.DB), need)
+		copy(grown, p.DB)
+		p.dbMu.Lock()
+		p.DB = grown
+		p.dbMu.Unlock()
+	}
+	if need > cap(p.IDs) {
+		grown := make([][]int64, len(p.IDs), need)
+		copy(grown, p.IDs)
+		p.IDs = grown
+	}
+	// A map's capacity is not observable and copying it on every batch costs more than it saves,
+	// so IDLookup is only presized while empty and otherwise left to grow on its own.
+	if len(p.IDLookup) == 0 {
+		p.IDLookup = make(map[int64]int, need)
+	}
 	for _, vec := range vectors {
 		err := p.Insert(vec)
 		if err != nil {
@@ -418,6 +1009,132 @@ func (p *PQ) InsertBatch(vectors []Vector) error {
 	return nil
 }
 
+func (p *PQ) InsertPaged(fetch func(offset, limit int) ([]Vector, error), pageSize int) error {
+	return insertPaged(fetch, pageSize, p.InsertBatch)
+}
+
+// MergePQ appends the vectors and codes of other, which must have been quantized with identical
+// codebooks (e.g. shards fed from the same trained codebooks), without re-quantizing them.
+// other's IDLookup positions are shifted by the current size. other is left unchanged.
+func (p *PQ) MergePQ(other *PQ) error {
+	if other == nil {
+		return errors.New("other PQ is nil")
+	}
+	if p.m != other.m || p.k != other.k || !codebooksEqual(p.Codebooks, other.Codebooks) {
+		return errors.New("codebooks of the two PQs differ")
+	}
+	if p.Normalize != other.Normalize {
+		return errors.New("the two PQs use different normalization modes")
+	}
+	if p.originals != nil || other.originals != nil {
+		return errors.New("cannot merge a partially loaded PQ")
+	}
+	if len(other.IDs) != len(other.DB) {
+		return errors.New("other PQ has vectors without codes")
+	}
+	for id := range other.IDLookup {
+		if _, exists := p.IDLookup[id]; exists {
+			return errors.New("vector ID exists in both PQs")
+		}
+	}
+
+	offset := len(p.DB)
+	db := make([]Vector, offset, offset+len(other.DB))
+	copy(db, p.DB)
+	db = append(db, other.DB...)
+	p.dbMu.Lock()
+	p.DB = db
+	for idx := range other.Deleted {
+		if p.Deleted == nil {
+			p.Deleted = make(map[int]bool)
+		}
+		p.Deleted[idx+offset] = true
+	}
+	p.dbMu.Unlock()
+	p.IDs = append(p.IDs, other.IDs...)
+	for id, idx := range other.IDLookup {
+		p.IDLookup[id] = idx + offset
+	}
+	if p.TrainError > 0 {
+		p.InsertErrorSum += other.InsertErrorSum
+		p.InsertErrorSeen += other.InsertErrorSeen
+	}
+	return nil
+}
+
+// codebooksEqual reports whether two sets of codebooks have the same shape and centroid values.
+func codebooksEqual(a, b [][]Centroid) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if len(a[i][j].Vector.Values) != len(b[i][j].Vector.Values) {
+				return false
+			}
+		}
+		if !centroidsEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SoftDelete marks the vector with the given ID as deleted in O(1): its DB slot and code stay in
+// place but are skipped by every search, and the ID can no longer be looked up or deleted.
+// Call Compact once DeletedRatio grows large to reclaim the space.
+func (p *PQ) SoftDelete(id int64) error {
+	idx, exists := p.IDLookup[id]
+	if !exists {
+		return errors.New("vector not found in the database")
+	}
+	p.dbMu.Lock()
+	if p.Deleted == nil {
+		p.Deleted = make(map[int]bool)
+	}
+	p.Deleted[idx] = true
+	p.dbMu.Unlock()
+	delete(p.IDLookup, id)
+	return nil
+}
+
+// DeletedRatio returns the fraction of DB slots that are soft-deleted and waiting for Compact.
+func (p *PQ) DeletedRatio() float64 {
+	if len(p.DB) == 0 {
+		return 0
+	}
+	return float64(len(p.Deleted)) / float64(len(p.DB))
+}
+
+// Compact physically removes the soft-deleted vectors and their codes in one O(n) pass
+// and rebuilds IDLookup. The codebooks are kept as they are.
+func (p *PQ) Compact() {
+	if len(p.Deleted) == 0 {
+		return
+	}
+	live := len(p.DB) - len(p.Deleted)
+	db := make([]Vector, 0, live)
+	ids := make([][]int64, 0, live)
+	lookup := make(map[int64]int, live)
+	for i, vec := range p.DB {
+		if p.Deleted[i] {
+			continue
+		}
+		lookup[vec.ID] = len(db)
+		db = append(db, vec)
+		ids = append(ids, p.IDs[i])
+	}
+	p.dbMu.Lock()
+	p.DB = db
+	p.Deleted = nil
+	p.dbMu.Unlock()
+	p.IDs = ids
+	p.IDLookup = lookup
+}
+
 func (p *PQ) DeleteBatch(vectors []Vector) error {
 	for _, vec := range vectors {
 		err := p.Delete(vec)
@@ -429,6 +1146,7 @@ func (p *PQ) DeleteBatch(vectors []Vector) error {
 }
 
 func (p *PQ) SearchWithinInterval(query Vector, minDist float64, maxDist float64) ([]Vector, error) {
+	query = p.prepare(query)
 	var result []Vector
 	subVectorLength := len(query.Values) / p.m
 	n := 3                           // consider the top 3 centroids, adjust based on your needs
@@ -481,9 +1199,15 @@ func (p *PQ) SearchWithinInterval(query Vector, minDist float64, maxDist float64
 
 	// 2. Refinement step
 	for idx := range candidateIndices {
-		dist := basic.EuclidDistance(query.Values, p.DB[idx].Values)
-		if dist >= minDist && dist <= maxDist {
-			result = append(result, p.DB[idx])
+		if p.Deleted[idx] {
+			continue
+		}
+		vec, err := p.withValues(p.DB[idx])
+		if err != nil {
+			return nil, err
+		}
+		if dist := measure(p.distFunc, query, vec); dist >= minDist && dist <= maxDist {
+			result = append(result, vec)
 		}
 	}
 
@@ -494,18 +1218,89 @@ func (p *PQ) SearchWithinRange(query Vector, radius float64) ([]Vector, error) {
 	return p.SearchWithinInterval(query, 0, radius)
 }
 
+// Describe returns the number of live vectors, their dimension (0 when empty) and the type name "pq".
+func (p *PQ) Describe() (count int, dim int, indexType string, err error) {
+	p.dbMu.RLock()
+	defer p.dbMu.RUnlock()
+	count = len(p.DB) - len(p.Deleted)
+	if p.originals != nil {
+		dim = p.originals.dim
+	} else if count > 0 {
+		dim = len(p.DB[0].Values)
+	}
+	return count, dim, "pq", nil
+}
+
+// Config reports the construction parameters: m, k, whether the codebooks are trained,
+// the drift threshold and the metric.
+func (p *PQ) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"m":               p.m,
+		"k":               p.k,
+		"trained":         len(p.Codebooks) > 0 && len(p.Codebooks[0]) > 0,
+		"max_error_ratio": p.maxErrorRatio,
+		"metric":          metricName(p.distFunc),
+		"normalize":       p.Normalize,
+	}
+}
+
+// Save gob-encodes the PQ. A partially loaded PQ keeps its original vectors on disk and cannot be
+// saved this way, since the encoded DB would have no values.
+func (p *PQ) Save(w io.Writer) error {
+	if p.originals != nil {
+		return errPartialSave
+	}
+	encoder := gob.NewEncoder(w)
+	return encoder.Encode(p)
+}
+
+func (p *PQ) Load(r io.Reader) error {
+	// A fully loaded PQ no longer reads originals from the file of an earlier LoadPartial
+	if err := p.Close(); err != nil {
+		return err
+	}
+	decoder := gob.NewDecoder(r)
+	p.codebookGen++
+	// gob leaves fields missing from the stream untouched, and zero values and empty maps or slices
+	// are never written, so clear everything the stream may replace. Maps are merged into, not replaced.
+	p.TrainError, p.InsertErrorSum, p.InsertErrorSeen = 0, 0, 0
+	p.DB, p.IDs, p.IDLookup, p.Deleted = nil, nil, nil, nil
+	p.Normalize = false
+	if err := decoder.Decode(p); err != nil {
+		return err
+	}
+	if p.IDLookup == nil {
+		p.IDLookup = make(map[int64]int)
+	}
+	return nil
+}
+
+// SaveToFileCompressed saves the PQ to a gzip-compressed file.
+func (p *PQ) SaveToFileCompressed(filename string) error {
+	// Checked before the file is created so an existing file is not truncated
+	if p.originals != nil {
+		return errPartialSave
+	}
+	return saveCompressed(filename, p.Save)
+}
+
+// LoadFromFileCompressed loads the PQ from a file written by SaveToFileCompressed.
+func (p *PQ) LoadFromFileCompressed(filename string) error {
+	return loadCompressed(filename, p.Load)
+}
+
 func (p *PQ) SaveToFile(filename string) error {
+	// Checked before the file is created so an existing file is not truncated
+	if p.originals != nil {
+		return errPartialSave
+	}
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	encoder := gob.NewEncoder(file)
-	if err := encoder.Encode(p); err != nil {
-		return err
-	}
-	return nil
+	return p.Save(file)
 }
 
 func (p *PQ) LoadFromFile(filename string) error {
@@ -515,19 +1310,18 @@ func (p *PQ) LoadFromFile(filename string) error {
 	}
 	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	if err := decoder.Decode(p); err != nil {
-		return err
-	}
-
-	return nil
+	return p.Load(file)
 }
 
-func (p *PQ) processChunk(chunk []Vector, distancesToCentroids [][]float64, ch chan<- ChunkResult) {
+// processChunk scores chunk, which starts at DB slot offset, skipping soft-deleted slots.
+func (p *PQ) processChunk(offset int, chunk []Vector, distancesToCentroids [][]float64, ch chan<- ChunkResult) {
 	vectors := make([]Vector, 0)
 	dists := make([]float64, 0)
 
-	for _, vec := range chunk {
+	for i, vec := range chunk {
+		if p.Deleted[offset+i] {
+			continue
+		}
 		estimatedDist := p.estimateDistance(vec, distancesToCentroids)
 		vectors = append(vectors, vec)
 		dists = append(dists, estimatedDist)
@@ -537,10 +1331,20 @@ func (p *PQ) processChunk(chunk []Vector, distancesToCentroids [][]float64, ch c
 }
 
 func (p *PQ) KNearestConcurrent(query Vector, k int) ([]Vector, error) {
+	return p.KNearestConcurrentWithWorkers(query, k, runtime.NumCPU())
+}
 
+// KNearestConcurrentWithWorkers is KNearestConcurrent with an explicit number of goroutines.
+// The DB is split into at most workers contiguous chunks, so a DB smaller than workers uses one
+// goroutine per vector and every vector is scored exactly once. workers must be positive.
+func (p *PQ) KNearestConcurrentWithWorkers(query Vector, k, workers int) ([]Vector, error) {
+	if workers <= 0 {
+		return nil, errors.New("workers should be greater than 0")
+	}
 	if len(p.Codebooks) == 0 {
 		return nil, errors.New("codebook is not trained")
 	}
+	query = p.prepare(query)
 
 	// Split the query into m segments
 	segmentLength := len(query.Values) / p.m
@@ -552,18 +1356,12 @@ func (p *PQ) KNearestConcurrent(query Vector, k int) ([]Vector, error) {
 		distancesToCentroids[i] = p.calculateDistancesToCentroids(segment, p.Codebooks[i])
 	}
 
-	numCores := runtime.NumCPU()
-	chunkSize := len(p.DB) / numCores
-	ch := make(chan ChunkResult, numCores)
+	chunks := splitChunks(len(p.DB), workers)
+	ch := make(chan ChunkResult, len(chunks))
 
 	// Split the DB and start the goroutines
-	for i := 0; i < numCores; i++ {
-		start := i * chunkSize
-		end := start + chunkSize
-		if i == numCores-1 {
-			end = len(p.DB)
-		}
-		go p.processChunk(p.DB[start:end], distancesToCentroids, ch)
+	for _, chunk := range chunks {
+		go p.processChunk(chunk[0], p.DB[chunk[0]:chunk[1]], distancesToCentroids, ch)
 	}
 
 	h := &MaxHeap{}
@@ -571,16 +1369,16 @@ func (p *PQ) KNearestConcurrent(query Vector, k int) ([]Vector, error) {
 	mu := &sync.Mutex{} // Mutex for thread-safe operations on the heap
 
 	// Collect results from goroutines
-	for i := 0; i < numCores; i++ {
+	for range chunks {
 		result := <-ch
 		for j, vec := range result.Vectors {
 			estimatedDist := result.Dists[j]
 			mu.Lock()
 			if h.Len() < k {
-				heap.Push(h, vectorDistPair{vec, estimatedDist})
-			} else if top := (*h)[0]; estimatedDist < top.dist {
+				heap.Push(h, vectorDistPair{Vector: vec, Dist: estimatedDist})
+			} else if top := (*h)[0]; estimatedDist < top.Dist {
 				heap.Pop(h)
-				heap.Push(h, vectorDistPair{vec, estimatedDist})
+				heap.Push(h, vectorDistPair{Vector: vec, Dist: estimatedDist})
 			}
 			mu.Unlock()
 		}
@@ -590,8 +1388,11 @@ func (p *PQ) KNearestConcurrent(query Vector, k int) ([]Vector, error) {
 	result := make([]Vector, h.Len())
 	for i := 0; i < len(result); i++ {
 		pair := heap.Pop(h).(vectorDistPair)
-		result[len(result)-1-i] = pair.vector
+		result[len(result)-1-i] = pair.Vector
 	}
 
+	if err := p.resolveVectors(result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
@@ -0,0 +1,230 @@
+package core
+
+// Partial loading for PQ: codes and codebooks stay in memory, original vectors are read
+// from disk on demand.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// pqPartialMagic identifies files written by SaveForPartialLoad.
+const pqPartialMagic = "HHPQP\x00\x00\x01"
+
+// errPartialSave is returned when saving a partially loaded PQ, whose DB slots have no values.
+var errPartialSave = errors.New("cannot save a partially loaded PQ")
+
+// pqPartialHeader is the gob-encoded part of a partial-load file. It is followed by the raw
+// little-endian float64 values of every DB slot, Dim values per slot, in slot order.
+type pqPartialHeader struct {
+	M, K      int
+	Dim       int
+	Codebooks [][]Centroid
+	Codes     [][]int64
+	VectorIDs []int64
+	Deleted   map[int]bool
+	Normalize bool
+
+	TrainError      float64
+	InsertErrorSum  float64
+	InsertErrorSeen int
+}
+
+// diskOriginals gives random access to the original vectors of a partially loaded PQ.
+type diskOriginals struct {
+	file   *os.File
+	offset int64 // file offset of the first value
+	dim    int
+	slots  map[int64]int // file slot of every vector ID loaded from the file; DB slots shift on Delete and Compact
+}
+
+// read returns the original values stored for DB slot i.
+func (d *diskOriginals) read(i int) ([]float64, error) {
+	buf := make([]byte, 8*d.dim)
+	if _, err := d.file.ReadAt(buf, d.offset+int64(i)*int64(len(buf))); err != nil {
+		return nil, err
+	}
+	values := make([]float64, d.dim)
+	for j := range values {
+		values[j] = math.Float64frombits(binary.LittleEndian.Uint64(buf[8*j:]))
+	}
+	return values, nil
+}
+
+// SaveForPartialLoad writes the PQ in a layout LoadPartial can open without reading the
+// original vectors into memory: codebooks and codes first, then the raw vector values.
+// All stored vectors must have the same dimension.
+func (p *PQ) SaveForPartialLoad(filename string) error {
+	p.dbMu.RLock()
+	defer p.dbMu.RUnlock()
+	if p.originals != nil {
+		return errPartialSave
+	}
+	if len(p.IDs) != len(p.DB) {
+		return errors.New("codes are out of sync with the stored vectors")
+	}
+	header := pqPartialHeader{
+		M:         p.m,
+		K:         p.k,
+		Codebooks: p.Codebooks,
+		Codes:     p.IDs,
+		VectorIDs: make([]int64, len(p.DB)),
+		Deleted:   p.Deleted,
+		Normalize: p.Normalize,
+
+		TrainError:      p.TrainError,
+		InsertErrorSum:  p.InsertErrorSum,
+		InsertErrorSeen: p.InsertErrorSeen,
+	}
+	for i, vec := range p.DB {
+		if i == 0 {
+			header.Dim = len(vec.Values)
+		} else if len(vec.Values) != header.Dim {
+			return errors.New("all vectors must have the same dimension")
+		}
+		header.VectorIDs[i] = vec.ID
+	}
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(&header); err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// bufio.Writer keeps the first write error and returns it from Flush
+	w := bufio.NewWriter(file)
+	w.WriteString(pqPartialMagic)
+	binary.Write(w, binary.LittleEndian, int64(encoded.Len()))
+	w.Write(encoded.Bytes())
+	for _, vec := range p.DB {
+		if err := binary.Write(w, binary.LittleEndian, vec.Values); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// LoadPartial opens a file written by SaveForPartialLoad keeping only the codebooks and codes
+// in memory. DB slots hold the vector IDs without values; estimated distances only need the
+// codes, while searches, GetByID and exact-distance filtering read the values they return or
+// measure from the file on demand, so their results match a fully loaded PQ. Vectors, EachVector
+// and VectorsPage only report the IDs of loaded vectors. Retrain, Reconfigure, Save, SaveToFile,
+// SaveToFileCompressed, SaveForPartialLoad and merging into or from a partially loaded PQ return an
+// error. The file stays open until Close is called.
+func (p *PQ) LoadPartial(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(pqPartialMagic))
+	var headerLen int64
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != pqPartialMagic {
+		file.Close()
+		return errors.New("not a PQ partial-load file")
+	}
+	if err := binary.Read(r, binary.LittleEndian, &headerLen); err != nil {
+		file.Close()
+		return err
+	}
+	var header pqPartialHeader
+	if err := gob.NewDecoder(&io.LimitedReader{R: r, N: headerLen}).Decode(&header); err != nil {
+		file.Close()
+		return err
+	}
+
+	db := make([]Vector, len(header.VectorIDs))
+	lookup := make(map[int64]int, len(header.VectorIDs))
+	slots := make(map[int64]int, len(header.VectorIDs))
+	for i, id := range header.VectorIDs {
+		db[i] = Vector{ID: id}
+		if !header.Deleted[i] {
+			lookup[id] = i
+			slots[id] = i
+		}
+	}
+	if err := p.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	p.dbMu.Lock()
+	defer p.dbMu.Unlock()
+	p.m, p.k = header.M, header.K
+	p.Codebooks = header.Codebooks
+	p.codebookGen++
+	p.IDs = header.Codes
+	p.DB = db
+	p.IDLookup = lookup
+	p.Deleted = header.Deleted
+	p.Normalize = header.Normalize
+	p.TrainError, p.InsertErrorSum, p.InsertErrorSeen = header.TrainError, header.InsertErrorSum, header.InsertErrorSeen
+	p.originals = &diskOriginals{
+		file:   file,
+		offset: int64(len(pqPartialMagic)) + 8 + headerLen,
+		dim:    header.Dim,
+		slots:  slots,
+	}
+	return nil
+}
+
+// Close releases the file opened by LoadPartial. It is a no-op for fully loaded PQs.
+func (p *PQ) Close() error {
+	if p.originals == nil {
+		return nil
+	}
+	err := p.originals.file.Close()
+	p.originals = nil
+	return err
+}
+
+// withValues returns vec with the values a partially loaded PQ keeps on disk filled in.
+// Vectors that already carry values, e.g. ones inserted after loading, are returned as is.
+func (p *PQ) withValues(vec Vector) (Vector, error) {
+	if p.originals == nil || vec.Values != nil {
+		return vec, nil
+	}
+	slot, ok := p.originals.slots[vec.ID]
+	if !ok {
+		return Vector{}, errors.New("vector not found")
+	}
+	values, err := p.originals.read(slot)
+	if err != nil {
+		return Vector{}, err
+	}
+	vec.Values = values
+	return vec, nil
+}
+
+// resolveResult fills in the values of a result that a partially loaded PQ keeps on disk.
+func (p *PQ) resolveResult(res *SearchResult) error {
+	vec, err := p.withValues(res.Vector)
+	if err != nil {
+		return err
+	}
+	res.Vector = vec
+	return nil
+}
+
+// resolveVectors fills in the values of vectors that a partially loaded PQ keeps on disk.
+func (p *PQ) resolveVectors(vectors []Vector) error {
+	for i, vec := range vectors {
+		resolved, err := p.withValues(vec)
+		if err != nil {
+			return err
+		}
+		vectors[i] = resolved
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package core
+
+// 记录每次查询耗时与召回率的索引装饰器
+
+import (
+	"sync"
+	"time"
+)
+
+// QueryRecord 单次查询的记录
+type QueryRecord struct {
+	K       int
+	Latency time.Duration
+	Recall  float64 // 未提供真值函数时为 -1
+}
+
+// RecordingReport 累计的查询统计
+type RecordingReport struct {
+	Records     []QueryRecord
+	MeanLatency time.Duration
+	MeanRecall  float64 // 未提供真值函数时为 -1
+}
+
+// RecordingIndex 透明代理内部索引,记录每次 Nearest/KNearest 查询的耗时,
+// 提供真值函数时同时计算召回率
+type RecordingIndex struct {
+	NearestNeighborSearch
+	groundTruth func(query Vector, k int) []Vector
+
+	mu      sync.Mutex
+	records []QueryRecord
+}
+
+// NewRecordingIndex
+//
+//	@Description: 创建记录查询指标的索引装饰器
+//	@param inner 被代理的索引
+//	@param groundTruth 返回精确 k-近邻的真值函数,为 nil 时不计算召回率
+//	@return *RecordingIndex
+func NewRecordingIndex(inner NearestNeighborSearch, groundTruth func(query Vector, k int) []Vector) *RecordingIndex {
+	return &RecordingIndex{NearestNeighborSearch: inner, groundTruth: groundTruth}
+}
+
+// Nearest
+//
+//	@Description: 代理最近邻查询,按 k=1 记录
+//	@receiver r
+//	@param query
+//	@return Vector
+//	@return error
+func (r *RecordingIndex) Nearest(query Vector) (Vector, error) {
+	start := time.Now()
+	res, err := r.NearestNeighborSearch.Nearest(query)
+	latency := time.Since(start)
+	if err != nil {
+		return res, err
+	}
+	r.record(query, 1, []Vector{res}, latency)
+	return res, nil
+}
+
+// KNearest
+//
+//	@Description: 代理 k-近邻查询并记录耗时与召回率
+//	@receiver r
+//	@param query
+//	@param k
+//	@return []Vector
+//	@return error
+func (r *RecordingIndex) KNearest(query Vector, k int) ([]Vector, error) {
+	start := time.Now()
+	res, err := r.NearestNeighborSearch.KNearest(query, k)
+	latency := time.Since(start)
+	if err != nil {
+		return res, err
+	}
+	r.record(query, k, res, latency)
+	return res, nil
+}
+
+// record
+//
+//	@Description: 记录一次成功的查询,真值函数的耗时不计入查询耗时
+//	@receiver r
+//	@param query
+//	@param k
+//	@param res 查询结果
+//	@param latency 查询耗时
+func (r *RecordingIndex) record(query Vector, k int, res []Vector, latency time.Duration) {
+	recall := -1.0
+	if r.groundTruth != nil {
+		recall = recallByID(r.groundTruth(query, k), res)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, QueryRecord{K: k, Latency: latency, Recall: recall})
+}
+
+// recallByID
+//
+//	@Description: 按 ID 计算结果对真值的召回率,真值为空时返回 1
+//	@param truth 真值
+//	@param res 查询结果
+//	@return float64
+func recallByID(truth, res []Vector) float64 {
+	if len(truth) == 0 {
+		return 1
+	}
+	found := make(map[int64]struct{}, len(res))
+	for _, vec := range res {
+		found[vec.ID] = struct{}{}
+	}
+	hit := 0
+	for _, vec := range truth {
+		if _, ok := found[vec.ID]; ok {
+			hit++
+		}
+	}
+	return float64(hit) / float64(len(truth))
+}
+
+// Report
+//
+//	@Description: 返回目前为止累计的查询记录及平均耗时、平均召回率
+//	@receiver r
+//	@return RecordingReport
+func (r *RecordingIndex) Report() RecordingReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := RecordingReport{
+		Records:    append([]QueryRecord(nil), r.records...),
+		MeanRecall: -1,
+	}
+	if len(r.records) == 0 {
+		return report
+	}
+	var totalLatency time.Duration
+	totalRecall := 0.0
+	for _, rec := range r.records {
+		totalLatency += rec.Latency
+		totalRecall += rec.Recall
+	}
+	report.MeanLatency = totalLatency / time.Duration(len(r.records))
+	if r.groundTruth != nil {
+		report.MeanRecall = totalRecall / float64(len(r.records))
+	}
+	return report
+}
+
+// Reset
+//
+//	@Description: 清空累计的查询记录
+//	@receiver r
+func (r *RecordingIndex) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = nil
+}
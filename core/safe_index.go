@@ -0,0 +1,223 @@
+package core
+
+// 并发安全的索引包装
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// SafeIndex 用读写锁包装任意索引,使其可以被多个 goroutine 并发使用:
+// 查询持有读锁,插入、删除、更新与加载持有写锁。
+// 内部索引在查询时不能修改自身状态(例如开启了访问跟踪的 BruteForceSearch 不适用)
+type SafeIndex struct {
+	inner NearestNeighborSearch
+	mu    sync.RWMutex
+}
+
+// NewSafeIndex
+//
+//	@Description: 创建并发安全的索引包装,之后不应再绕过包装直接访问 inner
+//	@param inner 被包装的索引
+//	@return *SafeIndex
+func NewSafeIndex(inner NearestNeighborSearch) *SafeIndex {
+	return &SafeIndex{inner: inner}
+}
+
+// Lock 获取写锁,用于需要把多个操作组合为一个原子操作的场景
+func (s *SafeIndex) Lock() { s.mu.Lock() }
+
+// Unlock 释放写锁
+func (s *SafeIndex) Unlock() { s.mu.Unlock() }
+
+// RLock 获取读锁
+func (s *SafeIndex) RLock() { s.mu.RLock() }
+
+// RUnlock 释放读锁
+func (s *SafeIndex) RUnlock() { s.mu.RUnlock() }
+
+func (s *SafeIndex) Insert(vec Vector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inner.Insert(vec)
+}
+
+func (s *SafeIndex) InsertBatch(vectors []Vector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inner.InsertBatch(vectors)
+}
+
+func (s *SafeIndex) Delete(vec Vector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inner.Delete(vec)
+}
+
+func (s *SafeIndex) DeleteBatch(vectors []Vector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inner.DeleteBatch(vectors)
+}
+
+// UpdateBatch
+//
+//	@Description: 在一次写锁内把 vectors 中每个 ID 对应的已有向量替换为新值(先删除旧向量再插入新向量),
+//	并发的读者要么看到全部旧值,要么看到全部新值。
+//	所有 ID 都必须已存在且互不重复,否则不做任何修改并返回错误;删除或插入失败时恢复原有向量后返回错误
+//	@receiver s
+//	@param vectors 新值,按 ID 匹配已有向量
+//	@return error
+func (s *SafeIndex) UpdateBatch(vectors []Vector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.inner.Vectors()
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]Vector, len(stored))
+	for _, vec := range stored {
+		byID[vec.ID] = vec
+	}
+	olds := make([]Vector, len(vectors))
+	seen := make(map[int64]struct{}, len(vectors))
+	for i, vec := range vectors {
+		old, found := byID[vec.ID]
+		if !found {
+			return errors.New("vector to update not found")
+		}
+		if _, duplicated := seen[vec.ID]; duplicated {
+			return errors.New("duplicated vector ID in the update batch")
+		}
+		seen[vec.ID] = struct{}{}
+		olds[i] = old
+	}
+
+	// 按 ID 逐个删除旧向量,值相同的其他向量不受影响;任何一步失败都恢复到更新前的状态
+	removed := make([]Vector, 0, len(olds))
+	for _, old := range olds {
+		if err := deleteByID(s.inner, old); err != nil {
+			return s.rollback(err, nil, removed)
+		}
+		removed = append(removed, old)
+	}
+	if err := s.inner.InsertBatch(vectors); err != nil {
+		return s.rollback(err, vectors, removed)
+	}
+	return nil
+}
+
+// rollback
+//
+//	@Description: UpdateBatch 失败后撤销已做的修改:删除已插入的新向量,重新插入已删除的旧向量
+//	@receiver s
+//	@param cause 导致失败的错误
+//	@param inserted 可能已部分插入的新向量,按 ID 删除,不存在的忽略
+//	@param removed 已删除的旧向量
+//	@return error cause,恢复失败时附带恢复的错误
+func (s *SafeIndex) rollback(cause error, inserted, removed []Vector) error {
+	for _, vec := range inserted {
+		_ = deleteByID(s.inner, vec)
+	}
+	// 逐个插入,不依赖刚刚失败的批量插入
+	for _, vec := range removed {
+		if err := s.inner.Insert(vec); err != nil {
+			return fmt.Errorf("%v; rollback failed: %v", cause, err)
+		}
+	}
+	return cause
+}
+
+// deleteByID
+//
+//	@Description: 支持 DeleteAndReturn 的索引按 ID 删除,其余索引退化为按值删除
+//	@param index 索引
+//	@param vec 待删除向量
+//	@return error
+func deleteByID(index NearestNeighborSearch, vec Vector) error {
+	if deleter, ok := index.(interface {
+		DeleteAndReturn(id int64) (Vector, error)
+	}); ok {
+		_, err := deleter.DeleteAndReturn(vec.ID)
+		return err
+	}
+	return index.Delete(vec)
+}
+
+func (s *SafeIndex) Nearest(query Vector) (Vector, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inner.Nearest(query)
+}
+
+func (s *SafeIndex) KNearest(query Vector, k int) ([]Vector, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inner.KNearest(query, k)
+}
+
+func (s *SafeIndex) SearchWithinRange(query Vector, radius float64) ([]Vector, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inner.SearchWithinRange(query, radius)
+}
+
+// Vectors
+//
+//	@Description: 返回所有向量的副本,内部索引之后的修改不会影响返回的切片
+//	@receiver s
+//	@return []Vector
+//	@return error
+func (s *SafeIndex) Vectors() ([]Vector, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	vectors, err := s.inner.Vectors()
+	if err != nil {
+		return nil, err
+	}
+	return append([]Vector(nil), vectors...), nil
+}
+
+// Describe
+//
+//	@Description: 在读锁内返回内部索引的 Describe 结果,内部索引未实现 Description 时由 Vectors 统计
+//	@receiver s
+//	@return count
+//	@return dim
+//	@return indexType 内部索引的类型名
+//	@return err
+func (s *SafeIndex) Describe() (count int, dim int, indexType string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if inner, ok := s.inner.(Description); ok {
+		return inner.Describe()
+	}
+	return describe(s.inner, "unknown")
+}
+
+func (s *SafeIndex) Save(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inner.Save(w)
+}
+
+func (s *SafeIndex) Load(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inner.Load(r)
+}
+
+func (s *SafeIndex) SaveToFile(filename string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inner.SaveToFile(filename)
+}
+
+func (s *SafeIndex) LoadFromFile(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inner.LoadFromFile(filename)
+}
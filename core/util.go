@@ -0,0 +1,528 @@
+package core
+
+import (
+	"compress/gzip"
+	"container/heap"
+	"errors"
+	"hh_vectordb/basic"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// selfMatchEpsilon 距离小于该值的向量视为与查询向量完全相同
+const selfMatchEpsilon = 1e-9
+
+// nearestExcludingSelf
+//
+//	@Description: 通用的排除自身最近邻查询,逐步扩大 k 直到找到一个与 query 不完全相同的向量
+//	@param index k近邻搜索实现
+//	@param query 查询向量
+//	@param total 索引中向量总数
+//	@return Vector
+//	@return error
+func nearestExcludingSelf(index KNearestSearch, query Vector, total int) (Vector, error) {
+	if total == 0 {
+		return Vector{}, errors.New("no vectors in the database")
+	}
+	for k := 2; ; k *= 2 {
+		if k > total {
+			k = total
+		}
+		results, err := index.KNearest(query, k)
+		if err != nil {
+			return Vector{}, err
+		}
+		for _, vec := range results {
+			if basic.EuclidDistanceVec(query, vec) >= selfMatchEpsilon {
+				return vec, nil
+			}
+		}
+		if k >= total {
+			break
+		}
+	}
+	return Vector{}, errors.New("no vector other than exact matches found")
+}
+
+// kNearestReversed
+//
+//	@Description: 通用的逆序 k-近邻查询,返回与 KNearest 相同的 top-k,但按距离从远到近排列
+//	@param index k近邻搜索实现
+//	@param query 查询向量
+//	@param k top-k
+//	@return []Vector
+//	@return error
+func kNearestReversed(index KNearestSearch, query Vector, k int) ([]Vector, error) {
+	results, err := index.KNearest(query, k)
+	if err != nil {
+		return nil, err
+	}
+	reversed := make([]Vector, len(results))
+	for i, vec := range results {
+		reversed[len(results)-1-i] = vec
+	}
+	return reversed, nil
+}
+
+// searchWithinAnnulus
+//
+//	@Description: 通用的环形范围查询,先用索引自身的范围搜索按外半径剪枝,再过滤掉距离小于内半径的向量
+//	@param index 范围搜索实现
+//	@param query 查询向量
+//	@param minRadius 内半径
+//	@param maxRadius 外半径
+//	@param distance 索引使用的距离函数
+//	@return []Vector 距离在 [minRadius, maxRadius] 内的向量
+//	@return error
+func searchWithinAnnulus(index RangeSearch, query Vector, minRadius, maxRadius float64, distance func(a, b Vector) float64) ([]Vector, error) {
+	if minRadius > maxRadius {
+		return nil, errors.New("minRadius should not be greater than maxRadius")
+	}
+	candidates, err := index.SearchWithinRange(query, maxRadius)
+	if err != nil {
+		return nil, err
+	}
+	var results []Vector
+	for _, vec := range candidates {
+		if distance(query, vec) >= minRadius {
+			results = append(results, vec)
+		}
+	}
+	return results, nil
+}
+
+// topKByMetric
+//
+//	@Description: 按指定度量计算 vectors 到 query 的距离,按距离升序(距离相同按 ID 升序)返回前 k 个
+//	@param query 查询向量
+//	@param vectors 候选向量
+//	@param k top-k
+//	@param metric 距离度量
+//	@return []Vector
+func topKByMetric(query Vector, vectors []Vector, k int, metric Metric) []Vector {
+	return topKByFunc(query, vectors, k, metric.DistanceVec)
+}
+
+// topKByFunc
+//
+//	@Description: 按任意距离函数计算 vectors 到 query 的距离,按距离升序(距离相同按 ID 升序)返回前 k 个
+//	@param query 查询向量
+//	@param vectors 候选向量
+//	@param k top-k
+//	@param distance 距离函数
+//	@return []Vector
+func topKByFunc(query Vector, vectors []Vector, k int, distance func(a, b Vector) float64) []Vector {
+	type IDDist struct {
+		Vector   Vector
+		Distance float64
+	}
+
+	dists := make([]IDDist, len(vectors))
+	for i, vec := range vectors {
+		dists[i] = IDDist{
+			Vector:   vec,
+			Distance: distance(query, vec),
+		}
+	}
+
+	sort.SliceStable(dists, func(i, j int) bool {
+		if dists[i].Distance != dists[j].Distance {
+			return dists[i].Distance < dists[j].Distance
+		}
+		return dists[i].Vector.ID < dists[j].Vector.ID
+	})
+
+	if k > len(dists) {
+		k = len(dists)
+	}
+	if k < 0 {
+		k = 0
+	}
+	result := make([]Vector, k)
+	for i := 0; i < k; i++ {
+		result[i] = dists[i].Vector
+	}
+	return result
+}
+
+// vectorDeleter 能够列出向量并按 ID 与值精确删除的索引
+type vectorDeleter interface {
+	Vectors() ([]Vector, error)
+	deleteExact(vec Vector) error
+}
+
+// sameVector
+//
+//	@Description: ID 相同且值相等时视为同一个向量,用于在存在重复值的索引中精确删除
+//	@param a
+//	@param b
+//	@return bool
+func sameVector(a, b Vector) bool {
+	return a.ID == b.ID && a.Equals(b)
+}
+
+// describe
+//
+//	@Description: 由 Vectors 统计向量数与维度,供没有直接计数的索引实现 Describe
+//	@param index 索引
+//	@param indexType 索引类型名
+//	@return count
+//	@return dim 第一个向量的维度,空索引为 0
+//	@return string
+//	@return error
+func describe(index interface{ Vectors() ([]Vector, error) }, indexType string) (int, int, string, error) {
+	vectors, err := index.Vectors()
+	if err != nil {
+		return 0, 0, indexType, err
+	}
+	if len(vectors) == 0 {
+		return 0, 0, indexType, nil
+	}
+	return len(vectors), len(vectors[0].Values), indexType, nil
+}
+
+// deleteAndReturn
+//
+//	@Description: 按 ID 找到向量后再按 ID 删除,值相同的其他向量不受影响,返回被删除的向量
+//	@param index 索引
+//	@param id 向量 ID
+//	@return Vector 被删除的向量
+//	@return error
+func deleteAndReturn(index vectorDeleter, id int64) (Vector, error) {
+	vectors, err := index.Vectors()
+	if err != nil {
+		return Vector{}, err
+	}
+	for _, vec := range vectors {
+		if vec.ID == id && vec.Values != nil {
+			if err := index.deleteExact(vec); err != nil {
+				return Vector{}, err
+			}
+			return vec, nil
+		}
+	}
+	return Vector{}, errors.New("vector not found")
+}
+
+// selfRank
+//
+//	@Description: 以索引中 ID 为 id 的向量作为查询,返回同一 ID 在 top-k 结果中的排名(从 0 开始),
+//	不在 top-k 中时返回 -1。用于留一法验证近似索引的自召回质量
+//	@param index 索引
+//	@param id 向量 ID
+//	@param k top-k
+//	@return int 排名
+//	@return error 索引中没有该 ID 时返回错误
+func selfRank(index verifiableIndex, id int64, k int) (int, error) {
+	if k <= 0 {
+		return -1, errors.New("k should be greater than 0")
+	}
+	vectors, err := index.Vectors()
+	if err != nil {
+		return -1, err
+	}
+	for _, vec := range vectors {
+		if vec.ID != id || vec.Values == nil {
+			continue
+		}
+		return rankOf(index, vec, k)
+	}
+	return -1, errors.New("vector not found")
+}
+
+// rankOf 以 vec 作为查询,返回 vec.ID 在 top-k 结果中的排名(从 0 开始),不在 top-k 中时返回 -1
+func rankOf(index KNearestSearch, vec Vector, k int) (int, error) {
+	results, err := index.KNearest(vec, k)
+	if err != nil {
+		return -1, err
+	}
+	for rank, res := range results {
+		if res.ID == vec.ID {
+			return rank, nil
+		}
+	}
+	return -1, nil
+}
+
+// budgetCheckInterval 带时间预算的查询每处理多少个向量或节点检查一次是否超时,
+// 至少找到一个候选之后才会因超时提前返回
+const budgetCheckInterval = 256
+
+// SearchStats 单次查询访问的节点数与距离计算次数,用于比较不同树索引及参数下的剪枝效果
+type SearchStats struct {
+	NodesVisited         int
+	DistanceComputations int
+
+	// RecordPruning 为 true 时,BallTree 与 VPTree 的 k-近邻查询会把每个内部节点对后访问分支的剪枝决策
+	// 按访问顺序追加到 PruneDecisions,用于教学与排查剪枝问题
+	RecordPruning  bool
+	PruneDecisions []PruneDecision
+}
+
+// PruneDecision 树索引在一个内部节点上是否跳过后访问分支的决策
+type PruneDecision struct {
+	Node        Vector  // 做决策的节点:BallTree 为节点球心,VPTree 为 vantage point
+	Bound       float64 // 后访问分支中向量到查询向量距离的下界
+	KthDistance float64 // 决策时第 k 近的距离,结果不足 k 个时为 +Inf
+	Pruned      bool    // 是否跳过了后访问分支
+}
+
+// decide 在开启 RecordPruning 时记录一次剪枝决策,stats 为 nil 时不做任何事
+func (s *SearchStats) decide(node Vector, bound, kthDistance float64, pruned bool) {
+	if s == nil || !s.RecordPruning {
+		return
+	}
+	s.PruneDecisions = append(s.PruneDecisions, PruneDecision{
+		Node:        node,
+		Bound:       bound,
+		KthDistance: kthDistance,
+		Pruned:      pruned,
+	})
+}
+
+// visit 记录访问了一个节点并做了 distances 次距离计算,stats 为 nil 时不做任何事
+func (s *SearchStats) visit(distances int) {
+	if s == nil {
+		return
+	}
+	s.NodesVisited++
+	s.DistanceComputations += distances
+}
+
+// verifiableIndex 能够列出全部向量并做 k-近邻查询的索引
+type verifiableIndex interface {
+	KNearestSearch
+	Vectors() ([]Vector, error)
+}
+
+// verifiedNearest
+//
+//	@Description: 用于排查剪枝问题的最近邻查询:先取索引的 1-近邻结果,再与暴力扫描的结果比较距离,
+//	不一致时返回暴力扫描的结果
+//	@param index 索引
+//	@param query 查询向量
+//	@param distance 索引使用的距离函数
+//	@return Vector 最近邻,不一致时为暴力扫描的结果
+//	@return bool 索引结果与暴力扫描结果的距离是否一致
+//	@return error
+func verifiedNearest(index verifiableIndex, query Vector, distance func(a, b Vector) float64) (Vector, bool, error) {
+	vectors, err := index.Vectors()
+	if err != nil {
+		return Vector{}, false, err
+	}
+	exact, exactDist := Vector{}, math.MaxFloat64
+	for _, vec := range vectors {
+		if vec.Values == nil {
+			continue
+		}
+		if d := distance(query, vec); d < exactDist {
+			exact, exactDist = vec, d
+		}
+	}
+	if exactDist == math.MaxFloat64 {
+		return Vector{}, false, errors.New("no vectors in the database")
+	}
+
+	results, err := index.KNearest(query, 1)
+	if err != nil {
+		return Vector{}, false, err
+	}
+	// 距离相同的不同向量都视为正确答案
+	if len(results) == 1 && math.Abs(distance(query, results[0])-exactDist) < selfMatchEpsilon {
+		return results[0], true, nil
+	}
+	return exact, false, nil
+}
+
+// frontierItem 最优优先搜索中待访问的节点及其到查询向量距离的下界
+type frontierItem struct {
+	node  interface{}
+	bound float64
+}
+
+// frontierQueue 按下界升序的最小堆
+type frontierQueue []frontierItem
+
+func (q frontierQueue) Len() int           { return len(q) }
+func (q frontierQueue) Less(i, j int) bool { return q[i].bound < q[j].bound }
+func (q frontierQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *frontierQueue) Push(x interface{}) {
+	*q = append(*q, x.(frontierItem))
+}
+
+func (q *frontierQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[0 : n-1]
+	return item
+}
+
+// pushCandidate
+//
+//	@Description: 将候选向量放入大小为 k 的最大堆,堆满时只保留距离更小的
+//	@param pq 按距离的最大堆
+//	@param vec 候选向量
+//	@param dist 候选向量到查询向量的距离
+//	@param k top-k
+func pushCandidate(pq *PriorityQueue, vec Vector, dist float64, k int) {
+	if pq.Len() < k {
+		heap.Push(pq, &Item{Value: vec, Distance: dist})
+	} else if dist < (*pq)[0].Distance {
+		heap.Pop(pq)
+		heap.Push(pq, &Item{Value: vec, Distance: dist})
+	}
+}
+
+// drainAscending
+//
+//	@Description: 清空最大堆,按距离升序返回其中的向量
+//	@param pq 按距离的最大堆
+//	@return []Vector
+func drainAscending(pq *PriorityQueue) []Vector {
+	return basic.ItemsToVectors(popAscending(pq))
+}
+
+// drainResults
+//
+//	@Description: 清空最大堆,按距离升序返回其中的向量及距离
+//	@param pq 按距离的最大堆
+//	@return []SearchResult
+func drainResults(pq *PriorityQueue) []SearchResult {
+	return basic.ItemsToResults(popAscending(pq))
+}
+
+// popAscending 清空最大堆,按距离升序返回堆中的元素
+func popAscending(pq *PriorityQueue) []*Item {
+	items := make([]*Item, pq.Len())
+	for i := len(items) - 1; i >= 0; i-- {
+		items[i] = heap.Pop(pq).(*Item)
+	}
+	return items
+}
+
+// splitChunks
+//
+//	@Description: 把 [0, n) 切分成最多 workers 个连续区间,每个下标恰好属于一个区间,各区间长度最多相差 1。
+//	n 小于 workers 时只切成 n 个区间,不会产生空区间
+//	@param n 元素个数
+//	@param workers 期望的并发数
+//	@return [][2]int 每个区间的 [start, end)
+func splitChunks(n, workers int) [][2]int {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 0 {
+		return nil
+	}
+	chunks := make([][2]int, workers)
+	for i := range chunks {
+		chunks[i] = [2]int{i * n / workers, (i + 1) * n / workers}
+	}
+	return chunks
+}
+
+// insertPaged
+//
+//	@Description: 按页拉取向量并逐页写入,直到拉取到空页;拉取或写入出错时立即停止并返回错误
+//	@param fetch 分页拉取函数
+//	@param pageSize 每页大小
+//	@param insert 每页向量的写入函数
+//	@return error
+func insertPaged(fetch func(offset, limit int) ([]Vector, error), pageSize int, insert func([]Vector) error) error {
+	if pageSize <= 0 {
+		return errors.New("pageSize should be greater than 0")
+	}
+	for offset := 0; ; {
+		page, err := fetch(offset, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+		if err := insert(page); err != nil {
+			return err
+		}
+		offset += len(page)
+	}
+}
+
+// vectorsPage
+//
+//	@Description: 无状态分页:token 为下一页起始位置的十进制表示,空 token 表示第一页。
+//	只要两次调用之间数据集不变,依次传入返回的 nextToken 即可不重不漏地遍历所有向量
+//	@param vectors 按固定顺序排列的全部向量
+//	@param token 上一页返回的 nextToken
+//	@param limit 每页大小
+//	@return []Vector 本页向量的副本
+//	@return string 下一页的 token,已到末尾时为空
+//	@return error token 非法或 limit <= 0 时返回错误
+func vectorsPage(vectors []Vector, token string, limit int) ([]Vector, string, error) {
+	if limit <= 0 {
+		return nil, "", errors.New("limit should be greater than 0")
+	}
+	start := 0
+	if token != "" {
+		var err error
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(vectors) {
+			return nil, "", errors.New("invalid page token")
+		}
+	}
+	end := start + limit
+	if end >= len(vectors) {
+		return append([]Vector(nil), vectors[start:]...), "", nil
+	}
+	return append([]Vector(nil), vectors[start:end]...), strconv.Itoa(end), nil
+}
+
+// saveCompressed
+//
+//	@Description: 创建文件并将 save 写出的 gob 流用 gzip 压缩后写入
+//	@param filename 文件名
+//	@param save 索引的 Save 方法
+//	@return error
+func saveCompressed(filename string, save func(w io.Writer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zw := gzip.NewWriter(file)
+	if err := save(zw); err != nil {
+		zw.Close()
+		return err
+	}
+	// Close 会写出剩余数据和 gzip 尾部,错误必须返回
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// loadCompressed
+//
+//	@Description: 打开 saveCompressed 写出的文件,解压后交给 load 读取
+//	@param filename 文件名
+//	@param load 索引的 Load 方法
+//	@return error
+func loadCompressed(filename string, load func(r io.Reader) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return load(zr)
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/gob"
 	"errors"
 	"hh_vectordb/basic"
+	"io"
+	"math"
 	"os"
+	"time"
 )
 
 type VPNode struct {
@@ -17,42 +20,73 @@ type VPNode struct {
 
 type VPTree struct {
 	Root *VPNode
+
+	distFunc DistanceFunc // metric set by WithMetric, nil means Euclidean
 }
 
-type VPItem struct {
-	value    Vector
-	priority float64
-	index    int
+// VPDistanceCache memoizes the query-to-vantage-point distances of a single query, keyed by node.
+// Reusing it across searches for the same query (growing k, NearestExcludingSelf's retries) skips
+// every distance already computed, which pays off with expensive custom metrics. Using it with a
+// different query resets it.
+type VPDistanceCache struct {
+	query     Vector
+	distances map[*VPNode]float64
 }
 
-type VPPriorityQueue []*VPItem
+// NewVPDistanceCache creates an empty distance cache.
+func NewVPDistanceCache() *VPDistanceCache {
+	return &VPDistanceCache{distances: make(map[*VPNode]float64)}
+}
 
-func (pq VPPriorityQueue) Len() int           { return len(pq) }
-func (pq VPPriorityQueue) Less(i, j int) bool { return pq[i].priority > pq[j].priority }
-func (pq VPPriorityQueue) Swap(i, j int)      { pq[i], pq[j] = pq[j], pq[i] }
+// Len returns the number of cached distances.
+func (c *VPDistanceCache) Len() int {
+	return len(c.distances)
+}
 
-func (pq *VPPriorityQueue) Push(x interface{}) {
-	n := len(*pq)
-	item := x.(*VPItem)
-	item.index = n
-	*pq = append(*pq, item)
+// bind resets the cache unless it already holds distances for query.
+func (c *VPDistanceCache) bind(query Vector) {
+	if c.query.Values != nil && c.query.Equals(query) {
+		return
+	}
+	c.query = Vector{ID: query.ID, Values: append([]float64(nil), query.Values...)}
+	c.distances = make(map[*VPNode]float64)
 }
 
-func (pq *VPPriorityQueue) Pop() interface{} {
-	old := *pq
-	n := len(old)
-	item := old[n-1]
-	item.index = -1
-	*pq = old[0 : n-1]
-	return item
+// vantageDist returns the distance from query to the node's vantage point through cache (which may
+// be nil) and the number of distance computations it actually performed (0 or 1).
+func (tree *VPTree) vantageDist(node *VPNode, query Vector, cache *VPDistanceCache) (float64, int) {
+	if cache == nil {
+		return tree.dist(query, node.VantagePoint), 1
+	}
+	if d, found := cache.distances[node]; found {
+		return d, 0
+	}
+	d := tree.dist(query, node.VantagePoint)
+	cache.distances[node] = d
+	return d, 1
 }
 
-func NewVPTree(vectors []Vector) *VPTree {
-	tree := &VPTree{}
+// NewVPTree builds a VP-tree over vectors. The VPTree does not support WithNormalize and ignores
+// it; use NewVPTreeChecked to get an error instead.
+func NewVPTree(vectors []Vector, opts ...Option) *VPTree {
+	tree := &VPTree{distFunc: newIndexOptions(opts).distance}
 	tree.Root = tree.buildVPTree(vectors)
 	return tree
 }
 
+// NewVPTreeChecked is NewVPTree, but returns an error when given WithNormalize.
+func NewVPTreeChecked(vectors []Vector, opts ...Option) (*VPTree, error) {
+	if err := checkNormalizeUnsupported(newIndexOptions(opts)); err != nil {
+		return nil, err
+	}
+	return NewVPTree(vectors, opts...), nil
+}
+
+// dist measures the distance between a and b with the tree's metric.
+func (tree *VPTree) dist(a, b Vector) float64 {
+	return measure(tree.distFunc, a, b)
+}
+
 func (tree *VPTree) buildVPTree(vectors []Vector) *VPNode {
 	if len(vectors) == 0 {
 		return nil
@@ -66,7 +100,7 @@ func (tree *VPTree) buildVPTree(vectors []Vector) *VPNode {
 	// Calculate the median distance from the vantage point to all other points
 	distances := make([]float64, len(vectors)-1)
 	for i, v := range vectors[1:] {
-		distances[i] = basic.EuclidDistanceVec(vp, v)
+		distances[i] = tree.dist(vp, v)
 	}
 	mu := basic.Median(distances)
 
@@ -74,7 +108,7 @@ func (tree *VPTree) buildVPTree(vectors []Vector) *VPNode {
 	var rightSet []Vector
 
 	for _, v := range vectors[1:] {
-		if basic.EuclidDistanceVec(vp, v) < mu {
+		if tree.dist(vp, v) < mu {
 			leftSet = append(leftSet, v)
 		} else {
 			rightSet = append(rightSet, v)
@@ -98,6 +132,23 @@ func (tree *VPTree) Nearest(query Vector) (Vector, error) {
 	return results[0], nil
 }
 
+// NearestExcludingSelf retries with a growing k until a non-exact match shows up; the retries share
+// a distance cache so every vantage point is measured at most once.
+func (tree *VPTree) NearestExcludingSelf(query Vector) (Vector, error) {
+	vectors, _ := tree.Vectors()
+	return nearestExcludingSelf(cachedVPSearch{tree: tree, cache: NewVPDistanceCache()}, query, len(vectors))
+}
+
+// cachedVPSearch runs every KNearest of a VPTree through the same distance cache.
+type cachedVPSearch struct {
+	tree  *VPTree
+	cache *VPDistanceCache
+}
+
+func (c cachedVPSearch) KNearest(query Vector, k int) ([]Vector, error) {
+	return c.tree.KNearestWithCache(query, k, c.cache)
+}
+
 func (tree *VPTree) Insert(vec Vector) error {
 	tree.Root = tree.insertRecursive(tree.Root, vec)
 	return nil
@@ -107,7 +158,7 @@ func (tree *VPTree) insertRecursive(vpNode *VPNode, vec Vector) *VPNode {
 	if vpNode == nil {
 		return &VPNode{VantagePoint: vec}
 	}
-	if basic.EuclidDistanceVec(vec, vpNode.VantagePoint) < vpNode.Mu {
+	if tree.dist(vec, vpNode.VantagePoint) < vpNode.Mu {
 		vpNode.Left = tree.insertRecursive(vpNode.Left, vec)
 	} else {
 		vpNode.Right = tree.insertRecursive(vpNode.Right, vec)
@@ -116,46 +167,141 @@ func (tree *VPTree) insertRecursive(vpNode *VPNode, vec Vector) *VPNode {
 }
 
 func (tree *VPTree) KNearest(query Vector, k int) ([]Vector, error) {
-	pq := make(VPPriorityQueue, 0, k)
-	heap.Init(&pq)
+	return tree.KNearestWithStats(query, k, nil)
+}
 
-	tree.kNearestRecursive(tree.Root, query, k, &pq)
+// KNearestWithStats is KNearest that also adds the visited nodes and distance computations to stats.
+// A nil stats disables the accounting.
+func (tree *VPTree) KNearestWithStats(query Vector, k int, stats *SearchStats) ([]Vector, error) {
+	return tree.kNearest(query, k, nil, stats)
+}
 
-	results := make([]Vector, len(pq))
-	for i := len(pq) - 1; i >= 0; i-- {
-		results[i] = heap.Pop(&pq).(*VPItem).value
+// KNearestWithCache is KNearest that looks up and records vantage-point distances in cache,
+// see VPDistanceCache. A nil cache disables the memoization.
+func (tree *VPTree) KNearestWithCache(query Vector, k int, cache *VPDistanceCache) ([]Vector, error) {
+	if cache != nil {
+		cache.bind(query)
 	}
+	return tree.kNearest(query, k, cache, nil)
+}
 
-	return results, nil
+func (tree *VPTree) kNearest(query Vector, k int, cache *VPDistanceCache, stats *SearchStats) ([]Vector, error) {
+	results, err := tree.kNearestResults(query, k, cache, stats)
+	if err != nil {
+		return nil, err
+	}
+	return basic.ResultsToVectors(results), nil
+}
+
+// KNearestExplainPruning is KNearest that also returns, for every node visited, whether the
+// farther subtree was pruned and the bounds that decided it.
+func (tree *VPTree) KNearestExplainPruning(query Vector, k int) ([]Vector, []PruneDecision, error) {
+	stats := &SearchStats{RecordPruning: true}
+	results, err := tree.KNearestWithStats(query, k, stats)
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, stats.PruneDecisions, nil
+}
+
+// KNearestResults is KNearest that also reports the distance of every result to the query.
+func (tree *VPTree) KNearestResults(query Vector, k int) ([]SearchResult, error) {
+	return tree.kNearestResults(query, k, nil, nil)
+}
+
+func (tree *VPTree) kNearestResults(query Vector, k int, cache *VPDistanceCache, stats *SearchStats) ([]SearchResult, error) {
+	pq := make(PriorityQueue, 0, k)
+	heap.Init(&pq)
+
+	tree.kNearestRecursive(tree.Root, query, k, &pq, cache, stats)
+	return drainResults(&pq), nil
 }
 
-func (tree *VPTree) kNearestRecursive(VPNode *VPNode, query Vector, k int, pq *VPPriorityQueue) {
+// VerifiedNearest is a debugging aid: it checks the VPTree's 1-nearest answer against a brute-force scan
+// and falls back to the scanned answer when they disagree. The bool reports whether they matched.
+func (tree *VPTree) VerifiedNearest(query Vector) (Vector, bool, error) {
+	return verifiedNearest(tree, query, tree.dist)
+}
+
+// SelfRank queries with the stored vector for id and returns the 0-based rank of id in the top-k,
+// or -1 if it is outside the top-k. It measures the self-recall of an index in leave-one-out tests.
+func (tree *VPTree) SelfRank(id int64, k int) (int, error) {
+	return selfRank(tree, id, k)
+}
+
+// KNearestReversed returns the same top-k as KNearest, ordered from farthest to nearest.
+func (tree *VPTree) KNearestReversed(query Vector, k int) ([]Vector, error) {
+	return kNearestReversed(tree, query, k)
+}
+
+func (tree *VPTree) kNearestRecursive(VPNode *VPNode, query Vector, k int, pq *PriorityQueue, cache *VPDistanceCache, stats *SearchStats) {
 	if VPNode == nil {
 		return
 	}
+	d, computed := tree.vantageDist(VPNode, query, cache)
+	stats.visit(computed)
 
-	d := basic.EuclidDistanceVec(query, VPNode.VantagePoint)
+	// Keep the current node's vector if it is closer than the furthest found so far
+	pushCandidate(pq, VPNode.VantagePoint, d, k)
 
-	// Check if the current node's vector is closer than the furthest found so far
-	if len(*pq) < k || d < (*pq)[0].priority {
-		if len(*pq) == k {
-			heap.Pop(pq)
-		}
-		heap.Push(pq, &VPItem{value: VPNode.VantagePoint, priority: d})
+	// Points in the left subtree are closer than Mu to the vantage point, the right ones are not.
+	near, far, farBound := VPNode.Left, VPNode.Right, VPNode.Mu-d
+	if d >= VPNode.Mu {
+		near, far, farBound = VPNode.Right, VPNode.Left, d-VPNode.Mu
+	}
+	tree.kNearestRecursive(near, query, k, pq, cache, stats)
+	kth := math.Inf(1)
+	if len(*pq) >= k {
+		kth = (*pq)[0].Distance
+	}
+	visitFar := farBound <= kth
+	if far != nil {
+		// Without a far child there is no pruning decision to record
+		stats.decide(VPNode.VantagePoint, farBound, kth, !visitFar)
+	}
+	if visitFar {
+		tree.kNearestRecursive(far, query, k, pq, cache, stats)
+	}
+
+}
+
+// KNearestWithinBudget is a best-first k-nearest search that returns the best results found so far
+// once the time budget is spent. With enough budget the result equals KNearest.
+func (tree *VPTree) KNearestWithinBudget(query Vector, k int, budget time.Duration) ([]Vector, error) {
+	if k <= 0 {
+		return nil, errors.New("k should be greater than 0")
 	}
+	if budget <= 0 {
+		return nil, errors.New("budget should be greater than 0")
+	}
+	start := time.Now()
 
-	if d < VPNode.Mu {
-		tree.kNearestRecursive(VPNode.Left, query, k, pq)
-		if len(*pq) < k || d+VPNode.Mu <= (*pq)[0].priority {
-			tree.kNearestRecursive(VPNode.Right, query, k, pq)
+	pq := make(PriorityQueue, 0, k)
+	frontier := &frontierQueue{}
+	if tree.Root != nil {
+		heap.Push(frontier, frontierItem{node: tree.Root, bound: 0})
+	}
+	for visited := 0; frontier.Len() > 0; visited++ {
+		if visited%budgetCheckInterval == 0 && pq.Len() > 0 && time.Since(start) > budget {
+			break
 		}
-	} else {
-		tree.kNearestRecursive(VPNode.Right, query, k, pq)
-		if len(*pq) < k || d-VPNode.Mu <= (*pq)[0].priority {
-			tree.kNearestRecursive(VPNode.Left, query, k, pq)
+		item := heap.Pop(frontier).(frontierItem)
+		if pq.Len() == k && item.bound >= pq[0].Distance {
+			break
 		}
-	}
+		node := item.node.(*VPNode)
+		d := tree.dist(query, node.VantagePoint)
+		pushCandidate(&pq, node.VantagePoint, d, k)
 
+		// Points in the left subtree are closer than Mu to the vantage point, the right ones are not.
+		if node.Left != nil {
+			heap.Push(frontier, frontierItem{node: node.Left, bound: math.Max(item.bound, d-node.Mu)})
+		}
+		if node.Right != nil {
+			heap.Push(frontier, frontierItem{node: node.Right, bound: math.Max(item.bound, node.Mu-d)})
+		}
+	}
+	return drainAscending(&pq), nil
 }
 
 func (tree *VPTree) Vectors() ([]Vector, error) {
@@ -175,22 +321,38 @@ func (tree *VPTree) inOrderTraversal(VPNode *VPNode, vectors *[]Vector) {
 
 func (tree *VPTree) Delete(vec Vector) error {
 	success := false
-	tree.Root, success = tree.deleteRecursive(tree.Root, vec)
+	tree.Root, success = tree.deleteRecursive(tree.Root, vec, Vector.Equals)
 	if !success {
 		return errors.New("vector not found")
 	}
 	return nil
 }
 
-func (tree *VPTree) deleteRecursive(VPNode *VPNode, vec Vector) (*VPNode, bool) {
+// deleteExact deletes the point with both the ID and the values of vec, leaving duplicates of its
+// values under other IDs in place.
+func (tree *VPTree) deleteExact(vec Vector) error {
+	success := false
+	tree.Root, success = tree.deleteRecursive(tree.Root, vec, sameVector)
+	if !success {
+		return errors.New("vector not found")
+	}
+	return nil
+}
+
+// DeleteAndReturn deletes the vector with the given ID and returns the removed vantage point.
+func (tree *VPTree) DeleteAndReturn(id int64) (Vector, error) {
+	return deleteAndReturn(tree, id)
+}
+
+func (tree *VPTree) deleteRecursive(VPNode *VPNode, vec Vector, match func(a, b Vector) bool) (*VPNode, bool) {
 	if VPNode == nil {
 		return nil, false
 	}
 
-	if VPNode.VantagePoint.Equals(vec) {
+	if match(VPNode.VantagePoint, vec) {
 		vectors, _ := tree.subTreeVectors(VPNode) // Collect all vectors from the subtree
 		for i, v := range vectors {
-			if v.Equals(vec) {
+			if match(v, vec) {
 				// Remove the vector from the slice
 				vectors = append(vectors[:i], vectors[i+1:]...)
 				break
@@ -198,10 +360,10 @@ func (tree *VPTree) deleteRecursive(VPNode *VPNode, vec Vector) (*VPNode, bool)
 		}
 		return tree.buildVPTree(vectors), true // Rebuild the subtree
 	} else {
-		if basic.EuclidDistanceVec(VPNode.VantagePoint, vec) < VPNode.Mu {
-			VPNode.Left, _ = tree.deleteRecursive(VPNode.Left, vec)
+		if tree.dist(VPNode.VantagePoint, vec) < VPNode.Mu {
+			VPNode.Left, _ = tree.deleteRecursive(VPNode.Left, vec, match)
 		} else {
-			VPNode.Right, _ = tree.deleteRecursive(VPNode.Right, vec)
+			VPNode.Right, _ = tree.deleteRecursive(VPNode.Right, vec, match)
 		}
 	}
 
@@ -233,6 +395,10 @@ func (tree *VPTree) InsertBatch(vectors []Vector) error {
 	return nil
 }
 
+func (tree *VPTree) InsertPaged(fetch func(offset, limit int) ([]Vector, error), pageSize int) error {
+	return insertPaged(fetch, pageSize, tree.InsertBatch)
+}
+
 func (tree *VPTree) DeleteBatch(vectors []Vector) error {
 	for _, vec := range vectors {
 		if err := tree.Delete(vec); err != nil {
@@ -248,12 +414,17 @@ func (tree *VPTree) SearchWithinRange(query Vector, radius float64) ([]Vector, e
 	return results, nil
 }
 
+// SearchWithinAnnulus returns the vectors whose distance to the query lies in [minRadius, maxRadius].
+func (tree *VPTree) SearchWithinAnnulus(query Vector, minRadius, maxRadius float64) ([]Vector, error) {
+	return searchWithinAnnulus(tree, query, minRadius, maxRadius, tree.dist)
+}
+
 func (tree *VPTree) rangeSearchRecursive(node *VPNode, query Vector, radius float64, results *[]Vector) {
 	if node == nil {
 		return
 	}
 
-	d := basic.EuclidDistanceVec(query, node.VantagePoint)
+	d := tree.dist(query, node.VantagePoint)
 
 	if d <= radius {
 		*results = append(*results, node.VantagePoint)
@@ -267,21 +438,49 @@ func (tree *VPTree) rangeSearchRecursive(node *VPNode, query Vector, radius floa
 	}
 }
 
-func (tree *VPTree) SaveToFile(filename string) error {
+// Describe returns the number of vectors, their dimension (0 when empty) and the type name "vp_tree",
+// counted by walking the tree.
+func (tree *VPTree) Describe() (count int, dim int, indexType string, err error) {
+	return describe(tree, "vp_tree")
+}
+
+// Config reports the construction parameters. The VPTree is only configured by its metric.
+func (tree *VPTree) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"metric": metricName(tree.distFunc),
+	}
+}
+
+func (tree *VPTree) Save(w io.Writer) error {
 	// Note: This is a simple serialization implementation using encoding/gob.
 	// Depending on the exact requirements, you might want a different serialization mechanism.
+	dataEncoder := gob.NewEncoder(w)
+	return dataEncoder.Encode(tree)
+}
+
+func (tree *VPTree) Load(r io.Reader) error {
+	dataDecoder := gob.NewDecoder(r)
+	return dataDecoder.Decode(tree)
+}
+
+// SaveToFileCompressed saves the VPTree to a gzip-compressed file.
+func (tree *VPTree) SaveToFileCompressed(filename string) error {
+	return saveCompressed(filename, tree.Save)
+}
+
+// LoadFromFileCompressed loads the VPTree from a file written by SaveToFileCompressed.
+func (tree *VPTree) LoadFromFileCompressed(filename string) error {
+	return loadCompressed(filename, tree.Load)
+}
+
+func (tree *VPTree) SaveToFile(filename string) error {
 	dataFile, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer dataFile.Close()
 
-	dataEncoder := gob.NewEncoder(dataFile)
-	err = dataEncoder.Encode(tree)
-	if err != nil {
-		return err
-	}
-	return nil
+	return tree.Save(dataFile)
 }
 
 func (tree *VPTree) LoadFromFile(filename string) error {
@@ -291,10 +490,5 @@ func (tree *VPTree) LoadFromFile(filename string) error {
 	}
 	defer dataFile.Close()
 
-	dataDecoder := gob.NewDecoder(dataFile)
-	err = dataDecoder.Decode(tree)
-	if err != nil {
-		return err
-	}
-	return nil
+	return tree.Load(dataFile)
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"hh_vectordb/basic"
 	"hh_vectordb/core"
+	"math"
 	"math/rand"
 	"testing"
 	"time"
@@ -341,3 +342,244 @@ func TestBallTreePersistence(t *testing.T) {
 		assert.Equal(t, expected[i].ID, vec.ID)
 	}
 }
+
+func TestBallTreeStrictMetric(t *testing.T) {
+	// 长度不一致时直接 panic 的曼哈顿距离,用来确认叶子节点的空 Center 不会传给距离函数
+	strict := func(a, b []float64) float64 {
+		if len(a) != len(b) {
+			panic("len mismatch")
+		}
+		sum := 0.0
+		for i := range a {
+			sum += math.Abs(a[i] - b[i])
+		}
+		return sum
+	}
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 8, -10, 10)
+	}
+	tree := core.NewBallTree(vecs, core.WithMetric(strict))
+	bf := core.NewBruteForceSearch(vecs, core.WithMetric(strict))
+	for q := 0; q < 10; q++ {
+		query := basic.GenerateRandomVector(int64(-q-1), 8, -10, 10)
+		expected, err := bf.KNearest(query, 5)
+		assert.Nil(t, err)
+		results, err := tree.KNearest(query, 5)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, results)
+		nearest, err := tree.Nearest(query)
+		assert.Nil(t, err)
+		assert.Equal(t, expected[0], nearest)
+	}
+
+	// 删除后留下的空节点同样不参与距离计算
+	assert.Nil(t, tree.Delete(vecs[0]))
+	assert.Nil(t, bf.Delete(vecs[0]))
+	expected, err := bf.KNearest(vecs[0], 5)
+	assert.Nil(t, err)
+	results, err := tree.KNearest(vecs[0], 5)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, results)
+	nearest, err := tree.Nearest(vecs[0])
+	assert.Nil(t, err)
+	assert.Equal(t, expected[0], nearest)
+}
+
+func TestBallTreeNearestExcludingSelf(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	ballTree := core.NewBallTree(vecs)
+	// 查询向量与 ID 为 3 的向量完全相同,应返回次近的 ID 为 1 的向量
+	query := Vector{ID: 100, Values: []float64{4, 7}}
+	res, err := ballTree.NearestExcludingSelf(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.ID)
+}
+
+func TestBallTreeDeleteAndReturn(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	ballTree := core.NewBallTree(vecs)
+	res, err := ballTree.DeleteAndReturn(4)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[4].ID, res.ID)
+	assert.True(t, res.Equals(vecs[4]))
+	remaining, err := ballTree.Vectors()
+	assert.Nil(t, err)
+	for _, vec := range remaining {
+		assert.NotEqual(t, int64(4), vec.ID)
+	}
+	_, err = ballTree.DeleteAndReturn(4)
+	assert.NotNil(t, err)
+}
+
+func TestBallTreeKNearestWithinBudget(t *testing.T) {
+	const numVectors = 5_0000
+	const dim = 10
+	const k = 20
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	tree := core.NewBallTree(vecs)
+	query := basic.GenerateRandomVector(int64(numVectors), dim, -10, 10)
+
+	// 预算充足时与暴力搜索的精确结果一致
+	bs := core.NewBruteForceSearch(vecs)
+	expected, err := bs.KNearest(query, k)
+	assert.Nil(t, err)
+	res, err := tree.KNearestWithinBudget(query, k, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), len(res))
+	for i, vec := range res {
+		assert.Equal(t, expected[i].ID, vec.ID)
+	}
+
+	// 极小的预算下提前返回,结果数量不超过 k
+	res, err = tree.KNearestWithinBudget(query, k, time.Nanosecond)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, len(res), k)
+	assert.Greater(t, len(res), 0)
+
+	_, err = tree.KNearestWithinBudget(query, k, 0)
+	assert.NotNil(t, err)
+}
+
+func TestBallTreeSearchWithinRangeEmpty(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+	}
+	index := core.NewBallTree(vecs)
+	// 范围内没有向量不是错误,返回空结果
+	res, err := index.SearchWithinRange(Vector{ID: 99, Values: []float64{100, 100}}, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+func TestBallTreeKNearestReversed(t *testing.T) {
+	vecs, query := generateReversedTestData()
+	index := core.NewBallTree(vecs)
+	assertKNearestReversed(t, index, query, 10)
+}
+
+func TestBallTreeSearchWithinAnnulus(t *testing.T) {
+	vecs := generateAnnulusTestData()
+	assertAnnulus(t, core.NewBallTree(vecs), vecs)
+}
+
+func TestBallTreeSaveLoadStream(t *testing.T) {
+	vecs := generateStreamTestData(4)
+	assertStreamRoundTrip(t, core.NewBallTree(vecs), &core.BallTree{}, 4)
+}
+
+func TestBallTreeKNearestWithStats(t *testing.T) {
+	centers := [][]float64{{0, 0, 0}, {50, 50, 50}, {-50, 50, 0}, {50, -50, 0}}
+	vecs, _ := generateBlobs(centers, 2000, 5.0)
+	tree := core.NewBallTree(vecs)
+
+	query := Vector{ID: -1, Values: []float64{1, -1, 2}}
+	stats := &core.SearchStats{}
+	res, err := tree.KNearestWithStats(query, 10, stats)
+	assert.Nil(t, err)
+	expected, _ := tree.KNearest(query, 10)
+	assert.Equal(t, expected, res)
+	t.Logf("visited %d of %d nodes, %d distance computations", stats.NodesVisited, 2*len(vecs)-1, stats.DistanceComputations)
+	// 球树共有 2n-1 个节点;按第一维切分的球树并不平衡,这里只要求有剪枝发生
+	assert.Greater(t, stats.NodesVisited, 0)
+	assert.Less(t, stats.NodesVisited, 2*len(vecs)-1)
+
+	// 不传 stats 时不做统计
+	_, err = tree.KNearestWithStats(query, 10, nil)
+	assert.Nil(t, err)
+}
+
+func TestBallTreeVerifiedNearest(t *testing.T) {
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 3, -10, 10)
+	}
+	query := basic.GenerateRandomVector(-1, 3, -10, 10)
+	exact, err := core.NewBruteForceSearch(vecs).Nearest(query)
+	assert.Nil(t, err)
+
+	tree := core.NewBallTree(vecs)
+	res, ok, err := tree.VerifiedNearest(query)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, exact, res)
+
+	// 把包含真实最近邻的子树半径改成负数,剪枝时该子树的下界变得极大而被跳过
+	contains := func(subtree *core.BallTree) bool {
+		members, _ := subtree.Vectors()
+		for _, vec := range members {
+			if vec.ID == exact.ID {
+				return true
+			}
+		}
+		return false
+	}
+	if contains(tree.Left) {
+		tree.Left.Radius = -1e9
+	} else {
+		tree.Right.Radius = -1e9
+	}
+	approx, err := tree.KNearest(query, 1)
+	assert.Nil(t, err)
+	assert.NotEqual(t, exact.ID, approx[0].ID)
+
+	res, ok, err = tree.VerifiedNearest(query)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, exact, res)
+}
+
+func TestBallTreeKNearestExplainPruning(t *testing.T) {
+	// 两个相距很远的一维簇,查询落在第一个簇内时另一个簇所在的分支应被剪掉
+	var vectors []basic.Vector
+	for i, v := range []float64{0, 1, 2, 100, 101, 102} {
+		vectors = append(vectors, basic.Vector{ID: int64(i), Values: []float64{v}})
+	}
+	tree := core.NewBallTree(vectors)
+	query := basic.Vector{Values: []float64{0.5}}
+
+	results, decisions, err := tree.KNearestExplainPruning(query, 2)
+	assert.Nil(t, err)
+	expected, err := tree.KNearest(query, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, results)
+	assert.NotEmpty(t, decisions)
+
+	pruned := 0
+	for _, d := range decisions {
+		assert.False(t, d.Bound < 0 && d.Pruned, "a branch with a negative bound cannot be pruned")
+		if d.Pruned {
+			pruned++
+			assert.Greater(t, d.Bound, 0.0)
+			assert.LessOrEqual(t, d.KthDistance, d.Bound)
+		}
+	}
+	assert.Greater(t, pruned, 0)
+
+	// 未开启 RecordPruning 时不记录
+	stats := &core.SearchStats{}
+	_, err = tree.KNearestWithStats(query, 2, stats)
+	assert.Nil(t, err)
+	assert.Empty(t, stats.PruneDecisions)
+}
@@ -0,0 +1,186 @@
+package test
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"testing"
+)
+
+func TestMeasureBuildMemory(t *testing.T) {
+	const numVectors = 2_0000
+	const dim = 16
+	const k = 10
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 100)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, -10, 10)
+	}
+
+	var lsh *core.LSH
+	lshBytes, err := core.MeasureBuildMemory(func() core.NearestNeighborSearch {
+		lsh = core.NewLSH(20, 10000)
+		_ = lsh.InsertBatch(vecs)
+		return lsh
+	})
+	assert.Nil(t, err)
+	var kdTree *core.KDTree
+	kdBytes, err := core.MeasureBuildMemory(func() core.NearestNeighborSearch {
+		kdTree = core.NewKDTree(vecs)
+		return kdTree
+	})
+	assert.Nil(t, err)
+	assert.Greater(t, lshBytes, int64(0))
+	assert.Greater(t, kdBytes, int64(0))
+
+	lshQueryBytes, err := core.MeasureQueryMemory(lsh, queries, k)
+	assert.Nil(t, err)
+	kdQueryBytes, err := core.MeasureQueryMemory(kdTree, queries, k)
+	assert.Nil(t, err)
+
+	fmt.Printf("LSH: build %d bytes, query %d bytes\n", lshBytes, lshQueryBytes)
+	fmt.Printf("KDTree: build %d bytes, query %d bytes\n", kdBytes, kdQueryBytes)
+
+	_, err = core.MeasureBuildMemory(func() core.NearestNeighborSearch { return nil })
+	assert.NotNil(t, err)
+}
+
+func TestExactKNNParallel(t *testing.T) {
+	const numVectors = 5000
+	const dim = 8
+	const k = 10
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 50)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, -10, 10)
+	}
+
+	bs := core.NewBruteForceSearch(vecs)
+	results := core.ExactKNNParallel(vecs, queries, k)
+	assert.Equal(t, len(queries), len(results))
+	for i, query := range queries {
+		expected, err := bs.KNearest(query, k)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, results[i])
+	}
+
+	assert.Equal(t, 0, len(core.ExactKNNParallel(vecs, nil, k)))
+}
+
+func TestRecallCurve(t *testing.T) {
+	const numVectors = 2000
+	const dim = 6
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 20)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, -10, 10)
+	}
+	ks := []int{1, 5, 10, 50, 100}
+
+	// 精确索引在所有 k 下召回率都为 1
+	curve, err := core.RecallCurve(core.NewKDTree(vecs), queries, ks)
+	assert.Nil(t, err)
+	assert.Equal(t, len(ks), len(curve))
+	for i, k := range ks {
+		assert.InDelta(t, 1.0, curve[k], 1e-9)
+		if i > 0 {
+			assert.GreaterOrEqual(t, curve[k], curve[ks[i-1]])
+		}
+	}
+
+	// 自定义度量的精确索引以同一度量计算真值,召回率同样为 1
+	manhattan, _ := countingManhattan()
+	curve, err = core.RecallCurve(core.NewBruteForceSearch(vecs, core.WithMetric(manhattan)), queries, ks)
+	assert.Nil(t, err)
+	for _, k := range ks {
+		assert.InDelta(t, 1.0, curve[k], 1e-9)
+	}
+
+	bs := core.NewBruteForceSearch(vecs)
+	_, err = core.RecallCurve(bs, queries, nil)
+	assert.NotNil(t, err)
+	_, err = core.RecallCurve(bs, queries, []int{0})
+	assert.NotNil(t, err)
+}
+
+func TestTop1Accuracy(t *testing.T) {
+	const numVectors = 2000
+	const dim = 6
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 50)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, -10, 10)
+	}
+
+	accuracy, err := core.Top1Accuracy(core.NewVPTree(vecs), queries)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, accuracy)
+	manhattan, _ := countingManhattan()
+	accuracy, err = core.Top1Accuracy(core.NewVPTree(vecs, core.WithMetric(manhattan)), queries)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, accuracy)
+
+	// 只有一个哈希表且每个桶只能放一个向量的 LSH 几乎找不到真正的最近邻
+	lsh := core.NewLSH(1, 1)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+	accuracy, err = core.Top1Accuracy(lsh, queries)
+	assert.Nil(t, err)
+	assert.Less(t, accuracy, 1.0)
+
+	_, err = core.Top1Accuracy(lsh, nil)
+	assert.NotNil(t, err)
+}
+
+func TestSpeedupOverBruteForce(t *testing.T) {
+	const numVectors = 5000
+	const dim = 8
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 200)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, -10, 10)
+	}
+
+	// 暴力搜索对暴力搜索:比值约为 1,召回率为 1
+	speedup, recall, err := core.SpeedupOverBruteForce(core.NewBruteForceSearch(vecs), queries, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, recall)
+	assert.InDelta(t, 1.0, speedup, 0.5)
+
+	kdTree := core.NewKDTree(vecs)
+	_, recall, err = core.SpeedupOverBruteForce(kdTree, queries, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, recall)
+
+	// 自定义度量的精确索引以同一度量的暴力搜索为参照,召回率同样为 1
+	_, recall, err = core.SpeedupOverBruteForce(core.NewBruteForceSearch(vecs, core.WithMetric(basic.CosineDistance)), queries, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, recall)
+	manhattan, _ := countingManhattan()
+	_, recall, err = core.SpeedupOverBruteForce(core.NewKDTree(vecs, core.WithMetric(manhattan)), queries, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, recall)
+
+	_, _, err = core.SpeedupOverBruteForce(kdTree, nil, 10)
+	assert.NotNil(t, err)
+}
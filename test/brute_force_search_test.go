@@ -1,10 +1,14 @@
 package test
 
 import (
+	"bytes"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"hh_vectordb/basic"
 	"hh_vectordb/core"
+	"math"
 	"math/rand"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -359,3 +363,1022 @@ func TestBruteForceLoadFromFile(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 1000, len(knVecs))
 }
+
+func TestBruteForceKNearestStableOrder(t *testing.T) {
+	// 所有向量到查询点的距离相同,结果应按 ID 升序稳定输出
+	vecs := []Vector{
+		{ID: 5, Values: []float64{1, 0}},
+		{ID: 2, Values: []float64{0, 1}},
+		{ID: 7, Values: []float64{-1, 0}},
+		{ID: 1, Values: []float64{0, -1}},
+		{ID: 3, Values: []float64{3, 3}},
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := Vector{ID: 100, Values: []float64{0, 0}}
+	for i := 0; i < 20; i++ {
+		res, err := bs.KNearest(query, 4)
+		assert.Nil(t, err)
+		ids := make([]int64, len(res))
+		for j, v := range res {
+			ids[j] = v.ID
+		}
+		assert.Equal(t, []int64{1, 2, 5, 7}, ids)
+	}
+}
+
+func TestBruteForceNearestExcludingSelf(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	// 查询向量与 ID 为 3 的向量完全相同,应返回次近的 ID 为 1 的向量
+	query := Vector{ID: 100, Values: []float64{4, 7}}
+	res, err := bs.NearestExcludingSelf(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.ID)
+
+	// 内积距离为负,也只跳过取值相同的 ID 为 3 的向量,内积最大的是 ID 为 2 的向量
+	res, err = core.NewBruteForceSearch(vecs, core.WithMetric(basic.InnerProduct.Distance)).NearestExcludingSelf(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res.ID)
+
+	// 余弦距离为 0 但取值不同的平行向量不是查询向量本身
+	cosine := core.NewBruteForceSearch([]Vector{
+		{ID: 1, Values: []float64{1, 0}},
+		{ID: 2, Values: []float64{0, 1}},
+	}, core.WithMetric(basic.CosineDistance))
+	res, err = cosine.NearestExcludingSelf(Vector{ID: 100, Values: []float64{2, 0}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.ID)
+}
+
+func TestBruteForceNormalizedPersistence(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{10, 0}},
+		{ID: 1, Values: []float64{0, 1}},
+		{ID: 2, Values: []float64{1, 1}},
+	}
+	bs := core.NewBruteForceSearchNormalized(vecs)
+	saveFilePath := filepath.Join(t.TempDir(), "bf_normalized")
+	err := bs.SaveToFile(saveFilePath)
+	assert.Nil(t, err)
+
+	loaded := &BruteForceSearch{}
+	err = loaded.LoadFromFile(saveFilePath)
+	assert.Nil(t, err)
+	assert.True(t, loaded.IsNormalized())
+
+	// 未归一化的查询向量:欧几里得距离最近的是 ID 2,余弦相似度最高的是 ID 0
+	query := Vector{ID: 100, Values: []float64{5, 0.5}}
+	res, err := loaded.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), res.ID)
+	knVecs, err := loaded.KNearest(query, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 2, 1}, []int64{knVecs[0].ID, knVecs[1].ID, knVecs[2].ID})
+
+	plain := core.NewBruteForceSearch(vecs)
+	res, err = plain.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res.ID)
+}
+
+func generateInsertBenchmarkVectors() []Vector {
+	const numVectors = 100_0000
+	const dim = 8
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	return vecs
+}
+
+func BenchmarkBruteForceInsertOneByOne(b *testing.B) {
+	vecs := generateInsertBenchmarkVectors()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bs := &BruteForceSearch{}
+		for _, vec := range vecs {
+			_ = bs.Insert(vec)
+		}
+	}
+}
+
+func BenchmarkBruteForceInsertBatch(b *testing.B) {
+	vecs := generateInsertBenchmarkVectors()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bs := &BruteForceSearch{}
+		_ = bs.InsertBatch(vecs)
+	}
+}
+
+func TestBruteForceKNearestAmong(t *testing.T) {
+	const numVectors = 2000
+	const dim = 10
+	const k = 10
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := basic.GenerateRandomVector(int64(numVectors), dim, -10, 10)
+
+	// 候选集合为偶数 ID
+	ids := make([]int64, 0, numVectors/2)
+	for i := 0; i < numVectors; i += 2 {
+		ids = append(ids, int64(i))
+	}
+	res, err := bs.KNearestAmong(query, k, ids)
+	assert.Nil(t, err)
+
+	// 对完整的 KNN 结果按候选集合过滤,前 k 个应一致
+	full, err := bs.KNearest(query, numVectors)
+	assert.Nil(t, err)
+	expected := make([]Vector, 0, k)
+	for _, vec := range full {
+		if vec.ID%2 == 0 && len(expected) < k {
+			expected = append(expected, vec)
+		}
+	}
+	assert.Equal(t, expected, res)
+
+	vec, err := bs.GetByID(42)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[42], vec)
+	_, err = bs.KNearestAmong(query, k, []int64{1, int64(numVectors + 1)})
+	assert.NotNil(t, err)
+}
+
+func TestBruteForceKNearestReRank(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{10, 0.5}},   // 余弦最近,欧几里得很远
+		{ID: 1, Values: []float64{1, 0.6}},    // 夹角约 31°
+		{ID: 2, Values: []float64{0.5, 0.1}},  // 欧几里得最近
+		{ID: 3, Values: []float64{0.9, -0.9}}, // 夹角 45°,欧几里得第三近
+		{ID: 4, Values: []float64{-1, 0}},
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := Vector{ID: 100, Values: []float64{1, 0}}
+	ids := func(vecs []Vector) []int64 {
+		res := make([]int64, len(vecs))
+		for i, v := range vecs {
+			res[i] = v.ID
+		}
+		return res
+	}
+
+	res, err := bs.KNearestReRank(query, 3, 3, basic.Cosine, basic.Euclidean)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 1, 0}, ids(res))
+
+	// 只按余弦或只按欧几里得排序时结果都不同
+	res, err = bs.KNearestReRank(query, 3, 3, basic.Cosine, basic.Cosine)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 2, 1}, ids(res))
+	res, err = bs.KNearest(query, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 1, 3}, ids(res))
+
+	_, err = bs.KNearestReRank(query, 0, 3, basic.Cosine, basic.Euclidean)
+	assert.NotNil(t, err)
+}
+
+func TestBruteForceKNearestUntilGap(t *testing.T) {
+	// 距离查询点 1 附近的 5 个向量构成一个簇,其余向量距离约为 10
+	vecs := []Vector{
+		{ID: 0, Values: []float64{1, 0}},
+		{ID: 1, Values: []float64{0, 1.1}},
+		{ID: 2, Values: []float64{-1.2, 0}},
+		{ID: 3, Values: []float64{0, -1.3}},
+		{ID: 4, Values: []float64{1.4, 0}},
+		{ID: 5, Values: []float64{10, 0}},
+		{ID: 6, Values: []float64{0, 10.5}},
+		{ID: 7, Values: []float64{-11, 0}},
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := Vector{ID: 100, Values: []float64{0, 0}}
+
+	res, err := bs.KNearestUntilGap(query, 8, 1.0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(res))
+	for _, vec := range res {
+		assert.Less(t, vec.ID, int64(5))
+	}
+
+	// 受 maxK 限制
+	res, err = bs.KNearestUntilGap(query, 3, 1.0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+
+	// 阈值足够大时返回全部 maxK 个
+	res, err = bs.KNearestUntilGap(query, 8, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(res))
+}
+
+func TestBruteForceDeleteAndReturn(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	res, err := bs.DeleteAndReturn(4)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[4].ID, res.ID)
+	assert.True(t, res.Equals(vecs[4]))
+	remaining, err := bs.Vectors()
+	assert.Nil(t, err)
+	for _, vec := range remaining {
+		assert.NotEqual(t, int64(4), vec.ID)
+	}
+	_, err = bs.DeleteAndReturn(4)
+	assert.NotNil(t, err)
+}
+
+func TestBruteForceKNearestWithinBudget(t *testing.T) {
+	const numVectors = 50_0000
+	const dim = 20
+	const k = 10
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := basic.GenerateRandomVector(int64(numVectors), dim, -10, 10)
+
+	fullStart := time.Now()
+	expected, err := bs.KNearest(query, k)
+	fullElapsed := time.Since(fullStart)
+	assert.Nil(t, err)
+
+	// 预算充足时与精确结果一致
+	res, err := bs.KNearestWithinBudget(query, k, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+
+	// 极小的预算下提前返回部分结果
+	start := time.Now()
+	res, err = bs.KNearestWithinBudget(query, k, time.Microsecond)
+	elapsed := time.Since(start)
+	assert.Nil(t, err)
+	assert.Equal(t, k, len(res))
+	assert.Less(t, elapsed, fullElapsed)
+}
+
+func TestBruteForceKNearestReduced(t *testing.T) {
+	const numVectors = 2000
+	const dim = 64
+	const k = 10
+
+	// 每 k 个向量是同一个中心附近的一组,精确 k-近邻就是查询所在的那一组,
+	// 组间距离远大于组内距离,随机投影后仍能保持
+	rng := rand.New(rand.NewSource(7))
+	vecs := make([]Vector, numVectors)
+	var center []float64
+	for i := 0; i < numVectors; i++ {
+		if i%k == 0 {
+			center = make([]float64, dim)
+			for j := range center {
+				center[j] = rng.Float64()*20 - 10
+			}
+		}
+		values := make([]float64, dim)
+		for j := range values {
+			values[j] = center[j] + rng.NormFloat64()*0.01
+		}
+		vecs[i] = Vector{ID: int64(i), Values: values}
+	}
+	bs := core.NewBruteForceSearch(vecs)
+
+	_, err := bs.KNearestReduced(vecs[0], k, 100)
+	assert.NotNil(t, err)
+	assert.NotNil(t, bs.AddReducedView(0, 42))
+	assert.Nil(t, bs.AddReducedView(16, 42))
+
+	// 候选数量足够时结果与精确 k-近邻一致
+	query := Vector{ID: int64(numVectors), Values: vecs[k*37].Values}
+	expected, err := bs.KNearest(query, k)
+	assert.Nil(t, err)
+	res, err := bs.KNearestReduced(query, k, 5*k)
+	assert.Nil(t, err)
+	assert.Equal(t, k, len(res))
+	jaccard, _ := basic.ResultOverlap(expected, res)
+	assert.Equal(t, 1.0, jaccard)
+	res, err = bs.KNearestReduced(query, k, numVectors)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+
+	// 插入与删除同步维护降维视图
+	inserted := basic.GenerateRandomVector(int64(numVectors+1), dim, 20, 30)
+	assert.Nil(t, bs.Insert(inserted))
+	res, err = bs.KNearestReduced(inserted, 1, 50)
+	assert.Nil(t, err)
+	assert.Equal(t, inserted.ID, res[0].ID)
+
+	assert.Nil(t, bs.Delete(inserted))
+	res, err = bs.KNearestReduced(inserted, 1, 50)
+	assert.Nil(t, err)
+	assert.NotEqual(t, inserted.ID, res[0].ID)
+
+	assert.NotNil(t, bs.Insert(basic.GenerateRandomVector(int64(numVectors+2), dim+1, -10, 10)))
+}
+
+func TestBruteForceEpsilon(t *testing.T) {
+	vec := Vector{ID: 1, Values: []float64{1.0, 2.0, 3.0}}
+	// 模拟 float32 往返带来的精度损失
+	approx := Vector{ID: 1, Values: []float64{1.0 + 1e-7, 2.0, 3.0 - 1e-7}}
+	bs := core.NewBruteForceSearch([]Vector{vec, {ID: 2, Values: []float64{4.0, 5.0, 6.0}}})
+
+	assert.Equal(t, 1e-9, bs.Epsilon())
+	assert.True(t, bs.Contains(vec))
+	assert.False(t, bs.Contains(approx))
+	assert.NotNil(t, bs.Delete(approx))
+
+	bs.SetEpsilon(1e-6)
+	assert.Equal(t, 1e-6, bs.Epsilon())
+	assert.True(t, bs.Contains(approx))
+	assert.Nil(t, bs.Delete(approx))
+	assert.False(t, bs.Contains(vec))
+
+	bs.SetEpsilon(0)
+	assert.Equal(t, 1e-9, bs.Epsilon())
+}
+
+func TestBruteForceVectorsByCentrality(t *testing.T) {
+	bs := core.NewBruteForceSearch(nil)
+	_, _, err := bs.VectorsByCentrality()
+	assert.NotNil(t, err)
+
+	vecs := []Vector{
+		{ID: 1, Values: []float64{0.1, 0.0}},
+		{ID: 2, Values: []float64{-0.1, 0.1}},
+		{ID: 3, Values: []float64{0.0, -0.1}},
+		{ID: 4, Values: []float64{0.05, 0.05}},
+		{ID: 5, Values: []float64{50.0, 50.0}}, // 离群点
+	}
+	bs = core.NewBruteForceSearch(vecs)
+	sorted, distances, err := bs.VectorsByCentrality()
+	assert.Nil(t, err)
+	assert.Equal(t, len(vecs), len(sorted))
+	assert.Equal(t, len(sorted), len(distances))
+	assert.Equal(t, int64(5), sorted[len(sorted)-1].ID)
+	for i := 1; i < len(distances); i++ {
+		assert.LessOrEqual(t, distances[i-1], distances[i])
+	}
+}
+
+// pagedSource 模拟分页数据源,记录拉取次数
+func pagedSource(vecs []Vector, calls *int) func(offset, limit int) ([]Vector, error) {
+	return func(offset, limit int) ([]Vector, error) {
+		*calls++
+		if offset >= len(vecs) {
+			return nil, nil
+		}
+		end := offset + limit
+		if end > len(vecs) {
+			end = len(vecs)
+		}
+		return vecs[offset:end], nil
+	}
+}
+
+func TestBruteForceInsertPaged(t *testing.T) {
+	vecs := make([]Vector, 1000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 8, -10, 10)
+	}
+	bs := core.NewBruteForceSearch(nil)
+	calls := 0
+	assert.Nil(t, bs.InsertPaged(pagedSource(vecs, &calls), 64))
+	// 16 个非空页加 1 个空页
+	assert.Equal(t, 17, calls)
+	all, err := bs.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, vecs, all)
+
+	// 拉取出错时立即停止
+	fetchErr := errors.New("connection reset")
+	bs = core.NewBruteForceSearch(nil)
+	err = bs.InsertPaged(func(offset, limit int) ([]Vector, error) {
+		if offset >= 200 {
+			return nil, fetchErr
+		}
+		return vecs[offset : offset+limit], nil
+	}, 100)
+	assert.Equal(t, fetchErr, err)
+	all, err = bs.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(all))
+
+	assert.NotNil(t, bs.InsertPaged(pagedSource(vecs, &calls), 0))
+}
+
+func TestBruteForceDistanceHistogram(t *testing.T) {
+	vecs := make([]Vector, 10)
+	for i := range vecs {
+		vecs[i] = Vector{ID: int64(i), Values: []float64{float64(i), 0}}
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := Vector{Values: []float64{0, 0}}
+
+	_, _, err := bs.DistanceHistogram(query, 0)
+	assert.NotNil(t, err)
+
+	// 距离为 0..9,分成 3 个宽度为 3 的桶
+	edges, counts, err := bs.DistanceHistogram(query, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{0, 3, 6, 9}, edges)
+	assert.Equal(t, []int{3, 3, 4}, counts)
+
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	assert.Equal(t, len(vecs), total)
+
+	// 所有距离相同时全部落在同一个桶
+	same := core.NewBruteForceSearch([]Vector{{ID: 1, Values: []float64{1, 0}}, {ID: 2, Values: []float64{0, 1}}})
+	_, counts, err = same.DistanceHistogram(query, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 0, 0, 0}, counts)
+}
+
+func TestBruteForceSearchWithinRangeConcurrent(t *testing.T) {
+	vecs := make([]Vector, 10000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 5, -10, 10)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := basic.GenerateRandomVector(int64(len(vecs)), 5, -10, 10)
+
+	expected, err := bs.SearchWithinRange(query, 8)
+	assert.Nil(t, err)
+	res, err := bs.SearchWithinRangeConcurrent(query, 8)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, expected, res)
+
+	res, err = bs.SearchWithinRangeConcurrent(query, -1)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+	res, err = core.NewBruteForceSearch(nil).SearchWithinRangeConcurrent(query, 8)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+func TestBruteForcePrepareRangeQuery(t *testing.T) {
+	vecs := make([]Vector, 2000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 5, -10, 10)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := basic.GenerateRandomVector(int64(len(vecs)), 5, -10, 10)
+	ctx := bs.PrepareRangeQuery(query)
+
+	for _, radius := range []float64{-1, 0, 2, 5, 8, 12, 20, 100} {
+		expected, err := bs.SearchWithinRange(query, radius)
+		assert.Nil(t, err)
+		res := ctx.Within(radius)
+		assert.ElementsMatch(t, expected, res, "radius %v", radius)
+		// 结果按距离升序
+		for i := 1; i < len(res); i++ {
+			assert.LessOrEqual(t, basic.EuclidDistanceVec(res[i-1], query), basic.EuclidDistanceVec(res[i], query))
+		}
+	}
+	assert.Len(t, ctx.Within(100), len(vecs))
+	assert.Empty(t, core.NewBruteForceSearch(nil).PrepareRangeQuery(query).Within(100))
+}
+
+func generateRangeBenchmarkData() (*BruteForceSearch, Vector) {
+	const numVectors = 100_0000
+	const dim = 20
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	return core.NewBruteForceSearch(vecs), basic.GenerateRandomVector(int64(numVectors), dim, -10, 10)
+}
+
+func BenchmarkBruteForceSearchWithinRange(b *testing.B) {
+	bs, query := generateRangeBenchmarkData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = bs.SearchWithinRange(query, 40)
+	}
+}
+
+func BenchmarkBruteForceSearchWithinRangeConcurrent(b *testing.B) {
+	bs, query := generateRangeBenchmarkData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = bs.SearchWithinRangeConcurrent(query, 40)
+	}
+}
+
+func TestBruteForceEvictToSize(t *testing.T) {
+	vecs := make([]Vector, 100)
+	for i := range vecs {
+		vecs[i] = Vector{ID: int64(i), Values: []float64{float64(i), 0}}
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	// 未开启访问跟踪时不淘汰
+	assert.Equal(t, 0, bs.EvictToSize(10))
+
+	bs.EnableAccessTracking()
+	// 访问靠近 0 和靠近 99 的向量
+	_, err := bs.KNearest(Vector{Values: []float64{0, 0}}, 5)
+	assert.Nil(t, err)
+	_, err = bs.KNearest(Vector{Values: []float64{99, 0}}, 5)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 90, bs.EvictToSize(10))
+	remaining, err := bs.Vectors()
+	assert.Nil(t, err)
+	ids := make([]int64, len(remaining))
+	for i, vec := range remaining {
+		ids[i] = vec.ID
+	}
+	assert.Equal(t, []int64{0, 1, 2, 3, 4, 95, 96, 97, 98, 99}, ids)
+
+	// 新插入的向量视为刚被访问
+	assert.Nil(t, bs.Insert(Vector{ID: 100, Values: []float64{50, 0}}))
+	_, err = bs.KNearest(Vector{Values: []float64{99, 0}}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, bs.EvictToSize(3))
+	remaining, err = bs.Vectors()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []Vector{
+		{ID: 98, Values: []float64{98, 0}},
+		{ID: 99, Values: []float64{99, 0}},
+		{ID: 100, Values: []float64{50, 0}},
+	}, remaining)
+	assert.Equal(t, 0, bs.EvictToSize(5))
+}
+
+func TestBruteForceSearchWithinRangeEmpty(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+	}
+	index := core.NewBruteForceSearch(vecs)
+	// 范围内没有向量不是错误,返回空结果
+	res, err := index.SearchWithinRange(Vector{ID: 99, Values: []float64{100, 100}}, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+type reversedKNearestSearch interface {
+	KNearest(query Vector, k int) ([]Vector, error)
+	KNearestReversed(query Vector, k int) ([]Vector, error)
+}
+
+// assertKNearestReversed 断言 KNearestReversed 的结果恰好是 KNearest 结果的逆序
+func assertKNearestReversed(t *testing.T, index reversedKNearestSearch, query Vector, k int) {
+	expected, err := index.KNearest(query, k)
+	assert.Nil(t, err)
+	reversed, err := index.KNearestReversed(query, k)
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), len(reversed))
+	for i := range expected {
+		assert.Equal(t, expected[i], reversed[len(reversed)-1-i])
+	}
+}
+
+func generateReversedTestData() ([]Vector, Vector) {
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = Vector{ID: int64(i), Values: []float64{float64(i % 20), float64(i / 20)}}
+	}
+	return vecs, Vector{ID: 999, Values: []float64{7.3, 4.6}}
+}
+
+func TestBruteForceKNearestReversed(t *testing.T) {
+	vecs, query := generateReversedTestData()
+	index := core.NewBruteForceSearch(vecs)
+	assertKNearestReversed(t, index, query, 10)
+}
+
+// annulusByScan 逐个计算距离得到环形范围查询的期望结果
+func annulusByScan(vecs []Vector, query Vector, minRadius, maxRadius float64) []Vector {
+	var res []Vector
+	for _, vec := range vecs {
+		dist := basic.EuclidDistanceVec(query, vec)
+		if dist >= minRadius && dist <= maxRadius {
+			res = append(res, vec)
+		}
+	}
+	return res
+}
+
+type annulusSearch interface {
+	SearchWithinAnnulus(query Vector, minRadius, maxRadius float64) ([]Vector, error)
+}
+
+// assertAnnulus 断言环形范围查询结果与逐个扫描的结果一致(不考虑顺序)
+func assertAnnulus(t *testing.T, index annulusSearch, vecs []Vector) {
+	query := Vector{ID: -1, Values: []float64{0.5, -0.5, 1}}
+	for _, radii := range [][2]float64{{0, 3}, {2, 5}, {4, 4.5}, {20, 30}} {
+		res, err := index.SearchWithinAnnulus(query, radii[0], radii[1])
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, annulusByScan(vecs, query, radii[0], radii[1]), res)
+	}
+	_, err := index.SearchWithinAnnulus(query, 5, 2)
+	assert.NotNil(t, err)
+}
+
+func generateAnnulusTestData() []Vector {
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 3, -5, 5)
+	}
+	return vecs
+}
+
+func TestBruteForceSearchWithinAnnulus(t *testing.T) {
+	vecs := generateAnnulusTestData()
+	assertAnnulus(t, core.NewBruteForceSearch(vecs), vecs)
+}
+
+// assertStreamRoundTrip 将 saved 通过 Save 写入内存缓冲区,再用 loaded 的 Load 读回,
+// 断言两者存储的向量以及 k-近邻查询结果一致
+func assertStreamRoundTrip(t *testing.T, saved, loaded core.NearestNeighborSearch, dim int) {
+	var buf bytes.Buffer
+	assert.Nil(t, saved.Save(&buf))
+	assert.Nil(t, loaded.Load(&buf))
+
+	want, err := saved.Vectors()
+	assert.Nil(t, err)
+	got, err := loaded.Vectors()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, want, got)
+
+	for i := 0; i < 5; i++ {
+		query := basic.GenerateRandomVector(-1, dim, -10, 10)
+		expected, err := saved.KNearest(query, 10)
+		assert.Nil(t, err)
+		actual, err := loaded.KNearest(query, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func generateStreamTestData(dim int) []Vector {
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	return vecs
+}
+
+func TestBruteForceSaveLoadStream(t *testing.T) {
+	vecs := generateStreamTestData(8)
+	bs := core.NewBruteForceSearchNormalized(vecs)
+	loaded := core.NewBruteForceSearch(nil)
+	assertStreamRoundTrip(t, bs, loaded, 8)
+	assert.True(t, loaded.IsNormalized())
+
+	assert.NotNil(t, loaded.Load(bytes.NewReader([]byte("not a gob stream"))))
+}
+
+func TestBruteForceCompressedPersistence(t *testing.T) {
+	vecs := generateStreamTestData(8)
+	bs := core.NewBruteForceSearch(vecs)
+	filename := filepath.Join(t.TempDir(), "bf.gob.gz")
+	assert.Nil(t, bs.SaveToFileCompressed(filename))
+
+	loaded := core.NewBruteForceSearch(nil)
+	assert.Nil(t, loaded.LoadFromFileCompressed(filename))
+	stored, err := loaded.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, vecs, stored)
+}
+
+func TestBruteForceMahalanobis(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	vecs := generateAnisotropic(2000, []float64{10, 0.1}, r)
+	// x 方向偏移 5(半个标准差)与 y 方向偏移 1(十个标准差)
+	alongX := Vector{ID: 10000, Values: []float64{5, 0}}
+	alongY := Vector{ID: 10001, Values: []float64{0, 1}}
+	vecs = append(vecs, alongX, alongY)
+
+	bs, err := core.NewBruteForceSearchMahalanobis(vecs)
+	assert.Nil(t, err)
+	euclid := core.NewBruteForceSearch(vecs)
+
+	query := Vector{ID: -1, Values: []float64{0, 0}}
+	rank := func(res []Vector, id int64) int {
+		for i, vec := range res {
+			if vec.ID == id {
+				return i
+			}
+		}
+		return len(res)
+	}
+	mahaRes, err := bs.KNearest(query, len(vecs))
+	assert.Nil(t, err)
+	euclidRes, err := euclid.KNearest(query, len(vecs))
+	assert.Nil(t, err)
+	// 欧几里得距离下 y 方向的点更近,马氏距离下则相反
+	assert.Less(t, rank(euclidRes, alongY.ID), rank(euclidRes, alongX.ID))
+	assert.Less(t, rank(mahaRes, alongX.ID), rank(mahaRes, alongY.ID))
+
+	nearest, err := bs.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, mahaRes[0], nearest)
+
+	// 马氏距离随持久化一起保存
+	var buf bytes.Buffer
+	assert.Nil(t, bs.Save(&buf))
+	loaded := core.NewBruteForceSearch(nil)
+	assert.Nil(t, loaded.Load(&buf))
+	loadedRes, err := loaded.KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, mahaRes[:10], loadedRes)
+
+	_, err = core.NewBruteForceSearchMahalanobis(nil)
+	assert.NotNil(t, err)
+}
+
+func TestBruteForceEachVectorSnapshot(t *testing.T) {
+	const n = 1000
+	vecs := make([]Vector, n)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -1, 1)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+
+	// 迭代过程中另一个 goroutine 持续插入并删除,迭代只应看到调用时刻的 n 个向量
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-started
+		for i := 0; i < n; i++ {
+			assert.Nil(t, bs.Insert(basic.GenerateRandomVector(int64(n+i), 4, -1, 1)))
+			if i%10 == 0 {
+				assert.Nil(t, bs.Delete(vecs[i]))
+			}
+		}
+	}()
+	var seen []int64
+	bs.EachVector(func(vec Vector) bool {
+		if len(seen) == 0 {
+			close(started)
+		}
+		seen = append(seen, vec.ID)
+		return true
+	})
+	<-done
+	assert.Len(t, seen, n)
+	for i, id := range seen {
+		assert.Equal(t, int64(i), id)
+	}
+
+	// 在回调中修改索引同样不影响本次迭代
+	count := 0
+	before, _ := bs.Vectors()
+	size := len(before)
+	bs.EachVector(func(vec Vector) bool {
+		count++
+		assert.Nil(t, bs.Insert(basic.GenerateRandomVector(int64(3*n+count), 4, -1, 1)))
+		return true
+	})
+	assert.Equal(t, size, count)
+
+	// 回调返回 false 时提前结束
+	count = 0
+	bs.EachVector(func(vec Vector) bool {
+		count++
+		return count < 3
+	})
+	assert.Equal(t, 3, count)
+}
+
+func TestBruteForceEstimateRangeCount(t *testing.T) {
+	const n = 20000
+	vecs := make([]Vector, n)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -1, 1)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	query := Vector{ID: -1, Values: []float64{0, 0, 0, 0}}
+
+	const sampleSize = 2000
+	for _, radius := range []float64{0.3, 0.8, 1.2} {
+		inRange, err := bs.SearchWithinRange(query, radius)
+		assert.Nil(t, err)
+		actual := float64(len(inRange))
+		estimate, err := bs.EstimateRangeCount(query, radius, sampleSize)
+		assert.Nil(t, err)
+		// 允许 4 倍标准误差
+		p := actual / n
+		stdErr := n * math.Sqrt(p*(1-p)/sampleSize)
+		assert.InDelta(t, actual, float64(estimate), 4*stdErr+1, "radius %v", radius)
+	}
+
+	// 抽样数不小于总数时返回精确计数
+	inRange, _ := bs.SearchWithinRange(query, 0.5)
+	exact, err := bs.EstimateRangeCount(query, 0.5, n)
+	assert.Nil(t, err)
+	assert.Equal(t, len(inRange), exact)
+
+	_, err = bs.EstimateRangeCount(query, 0.5, 0)
+	assert.NotNil(t, err)
+	empty, err := core.NewBruteForceSearch(nil).EstimateRangeCount(query, 0.5, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, empty)
+}
+
+func TestBruteForceSelfRank(t *testing.T) {
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 8, -1, 1)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	for _, vec := range vecs {
+		rank, err := bs.SelfRank(vec.ID, 5)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, rank)
+	}
+
+	_, err := bs.SelfRank(1000, 5)
+	assert.NotNil(t, err)
+	_, err = bs.SelfRank(0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestBruteForceVectorsPage(t *testing.T) {
+	vecs := make([]Vector, 1000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -1, 1)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+
+	seen := make(map[int64]int)
+	token, pages := "", 0
+	for {
+		page, next, err := bs.VectorsPage(token, 64)
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(page), 64)
+		for _, vec := range page {
+			seen[vec.ID]++
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	assert.Equal(t, 16, pages)
+	assert.Equal(t, len(vecs), len(seen))
+	for _, count := range seen {
+		assert.Equal(t, 1, count)
+	}
+
+	_, _, err := bs.VectorsPage("bad", 10)
+	assert.NotNil(t, err)
+	_, _, err = bs.VectorsPage("", 0)
+	assert.NotNil(t, err)
+}
+
+func TestBruteForceKNearestBanded(t *testing.T) {
+	// 到原点的距离依次为 0.5, 1, 1.5, ..., 5
+	vecs := make([]Vector, 10)
+	for i := range vecs {
+		vecs[i] = Vector{ID: int64(i), Values: []float64{0.5 * float64(i+1), 0}}
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	origin := Vector{ID: -1, Values: []float64{0, 0}}
+
+	bands, err := bs.KNearestBanded(origin, 8, []float64{1, 2.5})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int][]Vector{
+		0: {vecs[0]},
+		1: {vecs[1], vecs[2], vecs[3]},
+		2: {vecs[4], vecs[5], vecs[6], vecs[7]},
+	}, bands)
+
+	// 没有结果的段不出现
+	bands, err = bs.KNearestBanded(origin, 2, []float64{0.1, 5})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int][]Vector{1: {vecs[0], vecs[1]}}, bands)
+
+	bands, err = bs.KNearestBanded(origin, 3, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int][]Vector{0: vecs[:3]}, bands)
+
+	_, err = bs.KNearestBanded(origin, 3, []float64{2, 1})
+	assert.NotNil(t, err)
+}
+
+func TestBruteForceDuplicateValuePolicy(t *testing.T) {
+	first := basic.Vector{ID: 1, Values: []float64{1, 2, 3}}
+	same := basic.Vector{ID: 2, Values: []float64{1, 2, 3}}
+	other := basic.Vector{ID: 3, Values: []float64{1, 2, 3.0000001}}
+
+	cases := []struct {
+		policy  core.DuplicateValuePolicy
+		count   int
+		wantErr bool
+	}{
+		{policy: core.AllowDuplicateValues, count: 3, wantErr: false},
+		{policy: core.SkipDuplicateValues, count: 2, wantErr: false},
+		{policy: core.ErrorDuplicateValues, count: 2, wantErr: true},
+	}
+	for _, c := range cases {
+		bs := core.NewBruteForceSearch(nil, core.WithDuplicateValues(c.policy))
+		assert.Nil(t, bs.Insert(first))
+		err := bs.Insert(same)
+		if c.wantErr {
+			assert.NotNil(t, err, "policy %v", c.policy)
+		} else {
+			assert.Nil(t, err, "policy %v", c.policy)
+		}
+		// 分量只要有一点不同就不算重复
+		assert.Nil(t, bs.Insert(other))
+		vectors, err := bs.Vectors()
+		assert.Nil(t, err)
+		assert.Len(t, vectors, c.count, "policy %v", c.policy)
+	}
+
+	// 默认策略允许重复
+	bs := core.NewBruteForceSearch([]Vector{first, same})
+	vectors, _ := bs.Vectors()
+	assert.Len(t, vectors, 2)
+
+	// 删除、淘汰与加载后,去重判断随之更新
+	bs = core.NewBruteForceSearch([]Vector{first, other}, core.WithDuplicateValues(core.ErrorDuplicateValues))
+	assert.Nil(t, bs.Delete(first))
+	assert.Nil(t, bs.Insert(same))
+	assert.NotNil(t, bs.Insert(first))
+
+	bs.EnableAccessTracking()
+	assert.Nil(t, bs.Insert(basic.Vector{ID: 4, Values: []float64{4, 5, 6}}))
+	assert.Equal(t, 1, bs.EvictToSize(2))
+	vectors, _ = bs.Vectors()
+	assert.Len(t, vectors, 2)
+	for _, vec := range []basic.Vector{same, other} {
+		if !containsID(vectors, vec.ID) {
+			assert.Nil(t, bs.Insert(vec), "evicted vector %d should be insertable again", vec.ID)
+		}
+	}
+
+	saveFilePath := filepath.Join(t.TempDir(), "bf_duplicates")
+	assert.Nil(t, core.NewBruteForceSearch([]Vector{first}).SaveToFile(saveFilePath))
+	assert.Nil(t, bs.LoadFromFile(saveFilePath))
+	assert.NotNil(t, bs.Insert(same))
+	assert.Nil(t, bs.Insert(other))
+}
+
+func containsID(vectors []basic.Vector, id int64) bool {
+	for _, vec := range vectors {
+		if vec.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBruteForceNearestMultiMetric(t *testing.T) {
+	// 查询 (1, 0):A 方向几乎相同但很远,B 在坐标轴方向上相差 0.9,C 在两个坐标上各相差 0.6
+	a := basic.Vector{ID: 1, Values: []float64{10, 0.5}}
+	b := basic.Vector{ID: 2, Values: []float64{1, 0.9}}
+	c := basic.Vector{ID: 3, Values: []float64{1.6, 0.6}}
+	bs := core.NewBruteForceSearch([]Vector{a, b, c})
+	query := basic.Vector{Values: []float64{1, 0}}
+
+	metrics := []core.Metric{basic.Euclidean, basic.Cosine, basic.Manhattan, basic.Euclidean}
+	nearest, err := bs.NearestMultiMetric(query, metrics)
+	assert.Nil(t, err)
+	assert.Len(t, nearest, 3)
+	assert.Equal(t, c.ID, nearest[basic.Euclidean].ID)
+	assert.Equal(t, a.ID, nearest[basic.Cosine].ID)
+	assert.Equal(t, b.ID, nearest[basic.Manhattan].ID)
+
+	// 与逐个度量单独扫描的结果一致
+	for metric, vec := range nearest {
+		expected, err := bs.KNearestReRank(query, 3, 1, metric, metric)
+		assert.Nil(t, err)
+		assert.Equal(t, expected[0].ID, vec.ID, metric.String())
+	}
+
+	_, err = bs.NearestMultiMetric(query, nil)
+	assert.NotNil(t, err)
+	_, err = core.NewBruteForceSearch(nil).NearestMultiMetric(query, metrics)
+	assert.NotNil(t, err)
+}
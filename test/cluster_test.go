@@ -0,0 +1,187 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// generateBlobs 在每个中心附近生成 perBlob 个向量,返回向量及其所属的簇编号
+func generateBlobs(centers [][]float64, perBlob int, spread float64) ([]Vector, []int) {
+	vecs := make([]Vector, 0, len(centers)*perBlob)
+	labels := make([]int, 0, len(centers)*perBlob)
+	for c, center := range centers {
+		for i := 0; i < perBlob; i++ {
+			values := make([]float64, len(center))
+			for d := range center {
+				values[d] = center[d] + (rand.Float64()*2-1)*spread
+			}
+			vecs = append(vecs, Vector{ID: int64(len(vecs)), Values: values})
+			labels = append(labels, c)
+		}
+	}
+	return vecs, labels
+}
+
+func TestSilhouetteScore(t *testing.T) {
+	centers := [][]float64{{0, 0}, {50, 50}, {-50, 50}}
+	vecs, labels := generateBlobs(centers, 100, 1.0)
+
+	score := core.SilhouetteScore(vecs, labels)
+	assert.Greater(t, score, 0.9)
+
+	// 随机分配簇时轮廓系数接近 0
+	randomLabels := make([]int, len(labels))
+	for i := range randomLabels {
+		randomLabels[i] = rand.Intn(len(centers))
+	}
+	assert.Less(t, core.SilhouetteScore(vecs, randomLabels), 0.2)
+
+	// 大数据量时走簇中心索引的路径
+	bigVecs, bigLabels := generateBlobs(centers, 1000, 1.0)
+	assert.Greater(t, core.SilhouetteScore(bigVecs, bigLabels), 0.9)
+
+	assert.Equal(t, 0.0, core.SilhouetteScore(vecs, make([]int, len(vecs))))
+	assert.InDelta(t, 1.0/3.0, basic.Centroid([]Vector{{Values: []float64{1}}, {Values: []float64{0}}, {Values: []float64{0}}}).Values[0], 1e-9)
+}
+
+func TestBuildKNNGraph(t *testing.T) {
+	vecs := []Vector{
+		{ID: 1, Values: []float64{0}},
+		{ID: 2, Values: []float64{1}},
+		{ID: 3, Values: []float64{3}},
+		{ID: 4, Values: []float64{10}},
+	}
+	graph, err := core.BuildKNNGraph(core.NewBruteForceSearch(vecs), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 3}, graph[1])
+	assert.Equal(t, []int64{1, 3}, graph[2])
+	assert.Equal(t, []int64{2, 1}, graph[3])
+	assert.Equal(t, []int64{3, 2}, graph[4])
+
+	_, err = core.BuildKNNGraph(core.NewBruteForceSearch(vecs), 0)
+	assert.NotNil(t, err)
+}
+
+func TestKDistances(t *testing.T) {
+	vecs := []Vector{
+		{ID: 1, Values: []float64{0, 0}},
+		{ID: 2, Values: []float64{3, 4}},
+		{ID: 3, Values: []float64{3, 0}},
+		{ID: 4, Values: []float64{10, 0}},
+	}
+	index := core.NewBruteForceSearch(vecs)
+	kDist, err := core.KDistances(index, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]float64{1: 3, 2: 4, 3: 3, 4: 7}, kDist)
+
+	kDist, err = core.KDistances(index, 2)
+	assert.Nil(t, err)
+	assert.InDelta(t, 5, kDist[1], 1e-9)
+	assert.InDelta(t, 5, kDist[2], 1e-9)
+	assert.InDelta(t, 4, kDist[3], 1e-9)
+	assert.InDelta(t, math.Sqrt(65), kDist[4], 1e-9)
+
+	// 排除自身后邻居不足 k 个
+	_, err = core.KDistances(index, 4)
+	assert.NotNil(t, err)
+	_, err = core.KDistances(index, 0)
+	assert.NotNil(t, err)
+}
+
+func TestKNNClusters(t *testing.T) {
+	centers := [][]float64{{0, 0}, {50, 50}, {-50, 50}}
+	vecs, labels := generateBlobs(centers, 50, 1.0)
+
+	clusters, err := core.KNNClusters(core.NewBruteForceSearch(vecs), 20)
+	assert.Nil(t, err)
+	assert.Equal(t, len(centers), len(clusters))
+
+	// 每个簇只包含同一个 blob 的向量,且恰好覆盖该 blob
+	for _, members := range clusters {
+		assert.Equal(t, 50, len(members))
+		label := labels[members[0]]
+		for _, id := range members {
+			assert.Equal(t, label, labels[id])
+		}
+	}
+}
+
+func TestDBSCAN(t *testing.T) {
+	centers := [][]float64{{0, 0}, {20, 20}}
+	vecs, labels := generateBlobs(centers, 100, 1.0)
+	// 远离两个 blob 且彼此相距较远的噪声点
+	noise := [][]float64{{10, 10}, {-15, 5}, {30, -10}, {5, 40}}
+	for _, values := range noise {
+		vecs = append(vecs, Vector{ID: int64(len(vecs)), Values: values})
+	}
+
+	result, err := core.DBSCAN(core.NewBruteForceSearch(vecs), 1.0, 4)
+	assert.Nil(t, err)
+	assert.Len(t, result, len(vecs))
+
+	// 同一个 blob 的点属于同一个簇,两个 blob 的簇不同
+	blobCluster := map[int]int{}
+	for i := range labels {
+		label := result[int64(i)]
+		assert.NotEqual(t, core.DBSCANNoise, label)
+		if cluster, found := blobCluster[labels[i]]; found {
+			assert.Equal(t, cluster, label)
+		} else {
+			blobCluster[labels[i]] = label
+		}
+	}
+	assert.Len(t, blobCluster, 2)
+	assert.NotEqual(t, blobCluster[0], blobCluster[1])
+
+	for i := len(labels); i < len(vecs); i++ {
+		assert.Equal(t, core.DBSCANNoise, result[int64(i)])
+	}
+
+	_, err = core.DBSCAN(core.NewBruteForceSearch(vecs), 0, 4)
+	assert.NotNil(t, err)
+	_, err = core.DBSCAN(core.NewBruteForceSearch(vecs), 1, 0)
+	assert.NotNil(t, err)
+}
+
+func TestDBSCANCosine(t *testing.T) {
+	// 两组方向分别约为 0° 与 90°、模长从 1 到 100 不等的向量:
+	// 欧几里得距离下沿径向稀疏分布,余弦距离下则是两个紧密的角度簇
+	r := rand.New(rand.NewSource(3))
+	var vecs []Vector
+	for _, angle := range []float64{0, math.Pi / 2} {
+		for i := 0; i < 50; i++ {
+			theta := angle + (r.Float64()*2-1)*0.05
+			norm := 1 + r.Float64()*99
+			vecs = append(vecs, Vector{ID: int64(len(vecs)), Values: []float64{norm * math.Cos(theta), norm * math.Sin(theta)}})
+		}
+	}
+	cosine := core.NewBruteForceSearch(vecs, core.WithMetric(basic.CosineDistance))
+
+	// 余弦空间下的 k-距离远小于 epsilon
+	kDist, err := core.KDistances(cosine, 3)
+	assert.Nil(t, err)
+	for _, dist := range kDist {
+		assert.Less(t, dist, 0.01)
+	}
+
+	labels, err := core.DBSCAN(cosine, 0.01, 4)
+	assert.Nil(t, err)
+	for i, vec := range vecs {
+		assert.Equal(t, i/50, labels[vec.ID])
+	}
+
+	// 同样的 epsilon 在欧几里得空间下几乎所有点都是噪声
+	euclidLabels, err := core.DBSCAN(core.NewBruteForceSearch(vecs), 0.01, 4)
+	assert.Nil(t, err)
+	noise := 0
+	for _, label := range euclidLabels {
+		if label == core.DBSCANNoise {
+			noise++
+		}
+	}
+	assert.Greater(t, noise, len(vecs)/2)
+}
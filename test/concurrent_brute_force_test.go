@@ -0,0 +1,97 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"sync"
+	"testing"
+)
+
+const concurrentProducers = 16
+
+func TestConcurrentBruteForceBatchedWriters(t *testing.T) {
+	const perProducer = 1000
+	index := core.NewConcurrentBruteForce(nil)
+
+	var wg sync.WaitGroup
+	for p := 0; p < concurrentProducers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			writer := index.NewWriter(64)
+			for i := 0; i < perProducer; i++ {
+				id := int64(p*perProducer + i)
+				assert.Nil(t, writer.Insert(basic.Vector{ID: id, Values: []float64{float64(id), 0}}))
+			}
+			// 1000 不是 64 的整数倍,剩余向量需要显式刷新
+			assert.Equal(t, perProducer%64, writer.Pending())
+			assert.Nil(t, writer.Flush())
+			assert.Equal(t, 0, writer.Pending())
+		}(p)
+	}
+	// 写入期间的查询只会看到已刷新的向量
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, err := index.KNearest(basic.Vector{Values: []float64{0, 0}}, 3)
+			assert.Nil(t, err)
+		}
+	}()
+	wg.Wait()
+
+	count, dim, indexType, err := index.Describe()
+	assert.Nil(t, err)
+	assert.Equal(t, concurrentProducers*perProducer, count)
+	assert.Equal(t, 2, dim)
+	assert.Equal(t, "concurrent_brute_force", indexType)
+
+	nearest, err := index.Nearest(basic.Vector{Values: []float64{4242.2, 0}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4242), nearest.ID)
+}
+
+// benchmarkConcurrentInsert 由 16 个生产者并发写入 b.N 个向量,可配合 -race 运行以检查数据竞争:
+// go test ./test -race -run NONE -bench ConcurrentBruteForce
+func benchmarkConcurrentInsert(b *testing.B, insert func(index *core.ConcurrentBruteForce, vecs []Vector)) {
+	vecs := make([]Vector, b.N)
+	for i := range vecs {
+		vecs[i] = basic.Vector{ID: int64(i), Values: []float64{float64(i), 1, 2, 3}}
+	}
+	index := core.NewConcurrentBruteForce(nil)
+	chunk := (b.N + concurrentProducers - 1) / concurrentProducers
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for start := 0; start < b.N; start += chunk {
+		end := start + chunk
+		if end > b.N {
+			end = b.N
+		}
+		wg.Add(1)
+		go func(part []Vector) {
+			defer wg.Done()
+			insert(index, part)
+		}(vecs[start:end])
+	}
+	wg.Wait()
+}
+
+func BenchmarkConcurrentBruteForceMutexPerInsert(b *testing.B) {
+	benchmarkConcurrentInsert(b, func(index *core.ConcurrentBruteForce, vecs []Vector) {
+		for _, vec := range vecs {
+			_ = index.Insert(vec)
+		}
+	})
+}
+
+func BenchmarkConcurrentBruteForceBatchedWriter(b *testing.B) {
+	benchmarkConcurrentInsert(b, func(index *core.ConcurrentBruteForce, vecs []Vector) {
+		writer := index.NewWriter(0)
+		for _, vec := range vecs {
+			_ = writer.Insert(vec)
+		}
+		_ = writer.Flush()
+	})
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 8, -1, 1)
+	}
+	manhattan, _ := countingManhattan()
+
+	bs := core.NewBruteForceSearchNormalized(vecs)
+	assert.Equal(t, true, bs.Config()["normalize"])
+	assert.Equal(t, "euclidean", bs.Config()["metric"])
+	assert.Equal(t, false, bs.Config()["access_tracking"])
+	maha, err := core.NewBruteForceSearchMahalanobis(vecs)
+	assert.Nil(t, err)
+	assert.Equal(t, "mahalanobis", maha.Config()["metric"])
+	assert.Equal(t, false, maha.Config()["normalize"])
+
+	kdTree := core.NewKDTreeWithMaxDepth(vecs, 5, core.WithMetric(manhattan))
+	assert.Equal(t, 5, kdTree.Config()["max_depth_limit"])
+	assert.Equal(t, "custom", kdTree.Config()["metric"])
+
+	assert.Equal(t, "custom", core.NewBallTree(vecs, core.WithMetric(manhattan)).Config()["metric"])
+	assert.Equal(t, "euclidean", core.NewVPTree(vecs).Config()["metric"])
+
+	coverTree := core.NewCoverTree(1.7)
+	assert.Equal(t, 1.7, coverTree.Config()["base"])
+	assert.Equal(t, "euclidean", coverTree.Config()["metric"])
+
+	lsh := core.NewLSH(6, 20)
+	assert.Equal(t, 6, lsh.Config()["num_hashes"])
+	assert.Equal(t, 6, lsh.Config()["num_tables"])
+	assert.Equal(t, 20, lsh.Config()["bucket_size"])
+	assert.Equal(t, 0.0, lsh.Config()["width"])
+	widthLSH := core.NewLSHWithWidth(3, 4, 8, 2.5)
+	assert.Equal(t, 3, widthLSH.Config()["num_hashes"])
+	assert.Equal(t, 4, widthLSH.Config()["num_tables"])
+	assert.Equal(t, 2.5, widthLSH.Config()["width"])
+
+	pq := core.NewPQ(4, 8, core.WithMetric(manhattan))
+	assert.Equal(t, 4, pq.Config()["m"])
+	assert.Equal(t, 8, pq.Config()["k"])
+	assert.Equal(t, false, pq.Config()["trained"])
+	assert.Equal(t, "custom", pq.Config()["metric"])
+	pq.Train(vecs, 5)
+	assert.Equal(t, true, pq.Config()["trained"])
+
+	hilbert, err := core.NewHilbertIndex(vecs, 32)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, hilbert.Config()["window"])
+	assert.Equal(t, 8, hilbert.Config()["dim"])
+	assert.Equal(t, uint(8), hilbert.Config()["bits"])
+
+	// 所有索引都实现 Configuration
+	for _, index := range []core.Configuration{bs, kdTree, coverTree, lsh, pq, hilbert} {
+		assert.NotEmpty(t, index.Config())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"hh_vectordb/basic"
 	"hh_vectordb/core"
 	"math/rand"
+	"sort"
 	"testing"
 	"time"
 )
@@ -391,3 +392,169 @@ func TestCoverTreePersistence(t *testing.T) {
 			expected[i].ID, basic.EuclidDistanceVec(query, expected[i]))
 	}
 }
+
+func TestCoverTreeNearestExcludingSelf(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	coverTree := core.NewCoverTree(1.5)
+	err := coverTree.InsertBatch(vecs)
+	assert.Nil(t, err)
+	// 查询向量与 ID 为 3 的向量完全相同,应返回次近的 ID 为 1 的向量
+	query := Vector{ID: 100, Values: []float64{4, 7}}
+	res, err := coverTree.NearestExcludingSelf(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.ID)
+}
+
+func TestNewCoverTreeAuto(t *testing.T) {
+	const numVectors = 5000
+	const dim = 2
+	const minValue = -10.0
+	const maxValue = 10.0
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, minValue, maxValue)
+	}
+	queries := make([]Vector, 200)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, minValue, maxValue)
+	}
+
+	base := core.RecommendCoverBase(vecs)
+	assert.GreaterOrEqual(t, base, 1.1)
+	assert.LessOrEqual(t, base, 4.0)
+
+	autoTree, err := core.NewCoverTreeAuto(vecs)
+	assert.Nil(t, err)
+	assert.NotNil(t, autoTree)
+	assert.Equal(t, base, autoTree.Base)
+
+	// 输入中有完全相同的向量时返回插入错误,而不是 nil 树
+	dupTree, err := core.NewCoverTreeAuto([]Vector{vecs[0], vecs[1], vecs[1]})
+	assert.NotNil(t, err)
+	assert.Nil(t, dupTree)
+
+	// 过小的 base 会退化成很深的链
+	poorTree := core.NewCoverTree(1.02)
+	assert.Nil(t, poorTree.InsertBatch(vecs))
+	assert.Less(t, autoTree.Height(), poorTree.Height())
+
+	timeQueries := func(tree *CoverTree) time.Duration {
+		start := time.Now()
+		for _, q := range queries {
+			_, err := tree.Nearest(q)
+			assert.Nil(t, err)
+		}
+		return time.Since(start)
+	}
+	fmt.Printf("auto base %.3f: height %d, query time %v\n", base, autoTree.Height(), timeQueries(autoTree))
+	fmt.Printf("poor base 1.02: height %d, query time %v\n", poorTree.Height(), timeQueries(poorTree))
+}
+
+func TestCoverTreeDeleteAndReturn(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	coverTree := core.NewCoverTree(1.5)
+	assert.Nil(t, coverTree.InsertBatch(vecs))
+	res, err := coverTree.DeleteAndReturn(2)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[2].ID, res.ID)
+	assert.True(t, res.Equals(vecs[2]))
+	remaining, err := coverTree.Vectors()
+	assert.Nil(t, err)
+	for _, vec := range remaining {
+		assert.NotEqual(t, int64(2), vec.ID)
+	}
+	_, err = coverTree.DeleteAndReturn(2)
+	assert.NotNil(t, err)
+}
+
+func TestCoverTreeSearchWithinRangeEmpty(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+	}
+	index := core.NewCoverTree(2)
+	assert.Nil(t, index.InsertBatch(vecs))
+	// 范围内没有向量不是错误,返回空结果
+	res, err := index.SearchWithinRange(Vector{ID: 99, Values: []float64{100, 100}}, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+func TestCoverTreeKNearestReversed(t *testing.T) {
+	vecs, query := generateReversedTestData()
+	index := core.NewCoverTree(2)
+	assert.Nil(t, index.InsertBatch(vecs))
+	assertKNearestReversed(t, index, query, 10)
+}
+
+func TestCoverTreeSaveLoadStream(t *testing.T) {
+	vecs := generateStreamTestData(4)
+	ct := core.NewCoverTree(2)
+	assert.Nil(t, ct.InsertBatch(vecs))
+	assertStreamRoundTrip(t, ct, core.NewCoverTree(2), 4)
+}
+
+func TestCoverTreeKNearestWithMaxDistances(t *testing.T) {
+	const dim, n, k = 16, 3000, 10
+	vecs := make([]Vector, n)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	ct := core.NewCoverTree(2)
+	assert.Nil(t, ct.InsertBatch(vecs))
+	bs := core.NewBruteForceSearch(vecs)
+
+	queries := make([]Vector, 100)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(n+i), dim, -1, 1)
+	}
+
+	// 不限制距离计算次数时结果精确
+	for _, query := range queries[:20] {
+		res, err := ct.KNearestWithMaxDistances(query, k, 0)
+		assert.Nil(t, err)
+		expected, _ := bs.KNearest(query, k)
+		assert.Len(t, res, k)
+		for i := range res {
+			assert.InDelta(t, basic.EuclidDistanceVec(query, expected[i]), basic.EuclidDistanceVec(query, res[i]), 1e-9)
+		}
+	}
+
+	// 高维均匀数据上剪枝几乎失效,限制距离计算次数后延迟的尾部明显收窄
+	p99 := func(maxDistances int) time.Duration {
+		latencies := make([]time.Duration, len(queries))
+		for i, query := range queries {
+			start := time.Now()
+			res, err := ct.KNearestWithMaxDistances(query, k, maxDistances)
+			latencies[i] = time.Since(start)
+			assert.Nil(t, err)
+			assert.Len(t, res, k)
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		return latencies[len(latencies)*99/100]
+	}
+	p99(0) // 预热
+	assert.Less(t, p99(n/30), p99(0))
+
+	_, err := ct.KNearestWithMaxDistances(queries[0], 0, 10)
+	assert.NotNil(t, err)
+	_, err = core.NewCoverTree(2).KNearestWithMaxDistances(queries[0], k, 10)
+	assert.NotNil(t, err)
+}
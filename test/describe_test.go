@@ -0,0 +1,65 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"path/filepath"
+	"testing"
+)
+
+// describedIndex 可持久化并支持 Describe 的索引
+type describedIndex interface {
+	core.Persistence
+	core.Description
+}
+
+func TestDescribeAfterLoad(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	coverTree := core.NewCoverTree(2)
+	assert.Nil(t, coverTree.InsertBatch(vecs))
+	lsh := core.NewLSHWithWidth(2, 4, dim, 4)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 5)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	hilbert, err := core.NewHilbertIndex(vecs, 32)
+	assert.Nil(t, err)
+
+	cases := []struct {
+		indexType string
+		saved     describedIndex
+		loaded    describedIndex
+	}{
+		{indexType: "brute_force", saved: core.NewBruteForceSearch(vecs), loaded: core.NewBruteForceSearch(nil)},
+		{indexType: "kd_tree", saved: core.NewKDTree(vecs), loaded: &core.KDTree{}},
+		{indexType: "ball_tree", saved: core.NewBallTree(vecs), loaded: &core.BallTree{}},
+		{indexType: "cover_tree", saved: coverTree, loaded: core.NewCoverTree(2)},
+		{indexType: "lsh", saved: lsh, loaded: &core.LSH{}},
+		{indexType: "pq", saved: pq, loaded: core.NewPQ(4, 8)},
+		{indexType: "vp_tree", saved: core.NewVPTree(vecs), loaded: &core.VPTree{}},
+		{indexType: "hilbert", saved: hilbert, loaded: &core.HilbertIndex{}},
+		{indexType: "float16_brute_force", saved: core.NewFloat16BruteForce(vecs), loaded: &core.Float16BruteForce{}},
+	}
+	for _, c := range cases {
+		filename := filepath.Join(t.TempDir(), c.indexType)
+		assert.Nil(t, c.saved.SaveToFile(filename))
+		assert.Nil(t, c.loaded.LoadFromFile(filename))
+
+		count, d, indexType, err := c.loaded.Describe()
+		assert.Nil(t, err)
+		assert.Equal(t, len(vecs), count, c.indexType)
+		assert.Equal(t, dim, d, c.indexType)
+		assert.Equal(t, c.indexType, indexType)
+	}
+
+	count, d, indexType, err := core.NewSafeIndex(core.NewVPTree(nil)).Describe()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 0, d)
+	assert.Equal(t, "vp_tree", indexType)
+}
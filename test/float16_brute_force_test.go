@@ -0,0 +1,134 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"path/filepath"
+	"testing"
+)
+
+// idRecall 返回 res 中出现在 truth 里的 ID 比例
+func idRecall(truth, res []Vector) float64 {
+	ids := make(map[int64]struct{}, len(truth))
+	for _, vec := range truth {
+		ids[vec.ID] = struct{}{}
+	}
+	hit := 0
+	for _, vec := range res {
+		if _, found := ids[vec.ID]; found {
+			hit++
+		}
+	}
+	return float64(hit) / float64(len(truth))
+}
+
+// copyVectors 深拷贝向量,使 float64 暴力搜索的内存测量包含分量数据本身
+func copyVectors(vecs []Vector) []Vector {
+	copied := make([]Vector, len(vecs))
+	for i, vec := range vecs {
+		copied[i] = Vector{ID: vec.ID, Values: append([]float64(nil), vec.Values...)}
+	}
+	return copied
+}
+
+// float16Recall 以原始 float64 数据的精确 k-近邻为真值,计算索引的平均召回率
+func float16Recall(index core.KNearestSearch, vecs, queries []Vector, k int) float64 {
+	truths := core.ExactKNNParallel(vecs, queries, k)
+	total := 0.0
+	for i, query := range queries {
+		res, _ := index.KNearest(query, k)
+		total += idRecall(truths[i], res)
+	}
+	return total / float64(len(queries))
+}
+
+func TestFloat16BruteForce(t *testing.T) {
+	const dim, n, k = 16, 5000, 10
+	vecs := make([]Vector, n)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 50)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(n+i), dim, -10, 10)
+	}
+
+	index := core.NewFloat16BruteForce(vecs)
+	recall := float16Recall(index, vecs, queries, k)
+	t.Logf("float16 recall@%d: %.3f", k, recall)
+	assert.Greater(t, recall, 0.95)
+
+	// 还原后的分量与原值的相对误差不超过半精度的舍入误差
+	nearest, err := index.Nearest(vecs[7])
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), nearest.ID)
+	for i, val := range nearest.Values {
+		assert.InDelta(t, vecs[7].Values[i], val, 10.0/2048)
+	}
+
+	// 存储占用约为 float64 暴力搜索的 1/4
+	float16Bytes, err := core.MeasureBuildMemory(func() core.NearestNeighborSearch { return core.NewFloat16BruteForce(vecs) })
+	assert.Nil(t, err)
+	float64Bytes, err := core.MeasureBuildMemory(func() core.NearestNeighborSearch { return core.NewBruteForceSearch(copyVectors(vecs)) })
+	assert.Nil(t, err)
+	t.Logf("float16: %d bytes, float64: %d bytes", float16Bytes, float64Bytes)
+	assert.Less(t, float16Bytes*3, float64Bytes)
+
+	// 删除、范围搜索与持久化
+	assert.Nil(t, index.Delete(vecs[7]))
+	assert.NotNil(t, index.Delete(vecs[7]))
+	stored, err := index.Vectors()
+	assert.Nil(t, err)
+	assert.Len(t, stored, n-1)
+	inRange, err := index.SearchWithinRange(vecs[0], 0.1)
+	assert.Nil(t, err)
+	assert.Len(t, inRange, 1)
+	assert.Equal(t, vecs[0].ID, inRange[0].ID)
+	assert.NotNil(t, index.Insert(Vector{ID: -1, Values: []float64{1}}))
+
+	filename := filepath.Join(t.TempDir(), "float16")
+	assert.Nil(t, index.SaveToFile(filename))
+	loaded := core.NewFloat16BruteForce(nil)
+	assert.Nil(t, loaded.LoadFromFile(filename))
+	expected, err := index.KNearest(queries[0], k)
+	assert.Nil(t, err)
+	res, err := loaded.KNearest(queries[0], k)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+}
+
+// BenchmarkFloat16BruteForceMemoryRecall 在 1M 向量上对比半精度、单精度与 float64 暴力搜索的内存占用与召回率
+func BenchmarkFloat16BruteForceMemoryRecall(b *testing.B) {
+	const dim, n, k = 32, 1_000_000, 10
+	vecs := make([]Vector, n)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 20)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(n+i), dim, -10, 10)
+	}
+
+	builds := map[string]func() core.NearestNeighborSearch{
+		"float64": func() core.NearestNeighborSearch { return core.NewBruteForceSearch(copyVectors(vecs)) },
+		"float32": func() core.NearestNeighborSearch { return core.NewFloat32BruteForce(vecs) },
+		"float16": func() core.NearestNeighborSearch { return core.NewFloat16BruteForce(vecs) },
+	}
+	for name, build := range builds {
+		b.Run(name, func(b *testing.B) {
+			bytes, err := core.MeasureBuildMemory(build)
+			if err != nil {
+				b.Fatal(err)
+			}
+			index := build()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = index.KNearest(queries[i%len(queries)], k)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(bytes)/n, "bytes/vector")
+			b.ReportMetric(float16Recall(index, vecs, queries, k), "recall")
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"math"
+	"testing"
+)
+
+func TestFloat16Conversion(t *testing.T) {
+	cases := map[float32]uint16{
+		0:             0x0000,
+		1:             0x3c00,
+		-2:            0xc000,
+		0.5:           0x3800,
+		65504:         0x7bff, // 最大的有限值
+		65520:         0x7c00, // 舍入后溢出为 Inf
+		6.1035156e-05: 0x0400, // 最小的规格化数
+		5.9604645e-08: 0x0001, // 最小的非规格化数
+		1e-9:          0x0000,
+	}
+	for f, h := range cases {
+		assert.Equal(t, h, basic.Float32ToFloat16(f), "%v", f)
+	}
+	assert.Equal(t, uint16(0x8000), basic.Float32ToFloat16(float32(math.Copysign(0, -1))))
+	assert.Equal(t, uint16(0xfc00), basic.Float32ToFloat16(float32(math.Inf(-1))))
+	assert.True(t, math.IsNaN(float64(basic.Float16ToFloat32(basic.Float32ToFloat16(float32(math.NaN()))))))
+
+	// 就近舍入,距离相同时取偶数:1 + 2^-11 恰好位于 1 与 1 + 2^-10 中间
+	assert.Equal(t, uint16(0x3c00), basic.Float32ToFloat16(1+1.0/2048))
+	assert.Equal(t, uint16(0x3c02), basic.Float32ToFloat16(1+3.0/2048))
+
+	// 所有非 NaN 的半精度值都能精确往返
+	for h := 0; h <= 0xffff; h++ {
+		f := basic.Float16ToFloat32(uint16(h))
+		if math.IsNaN(float64(f)) {
+			continue
+		}
+		assert.Equal(t, uint16(h), basic.Float32ToFloat16(f))
+	}
+
+	// 规格化范围内的相对误差不超过 2^-11
+	for _, f := range []float32{3.14159, -123.456, 0.001, 4096.5, 60000} {
+		back := basic.Float16ToFloat32(basic.Float32ToFloat16(f))
+		assert.LessOrEqual(t, math.Abs(float64(back-f)/float64(f)), 1.0/2048)
+	}
+}
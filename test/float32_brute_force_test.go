@@ -0,0 +1,67 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFloat32BruteForce(t *testing.T) {
+	const dim, n, k = 16, 5000, 10
+	vecs := make([]Vector, n)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 20)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(n+i), dim, -10, 10)
+	}
+
+	index := core.NewFloat32BruteForce(vecs)
+	assert.Greater(t, float16Recall(index, vecs, queries, k), 0.99)
+	nearest, err := index.Nearest(vecs[7])
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), nearest.ID)
+	assert.True(t, nearest.EqualsWithin(vecs[7], 1e-5))
+	assert.NotNil(t, index.Insert(Vector{ID: -1, Values: []float64{1}}))
+
+	// 持久化文件约为 float64 暴力搜索的一半
+	dir := t.TempDir()
+	float32File := filepath.Join(dir, "float32")
+	float64File := filepath.Join(dir, "float64")
+	assert.Nil(t, index.SaveToFile(float32File))
+	assert.Nil(t, core.NewBruteForceSearch(vecs).SaveToFile(float64File))
+	float32Info, err := os.Stat(float32File)
+	assert.Nil(t, err)
+	float64Info, err := os.Stat(float64File)
+	assert.Nil(t, err)
+	t.Logf("float32 file: %d bytes, float64 file: %d bytes", float32Info.Size(), float64Info.Size())
+	assert.Less(t, float64(float32Info.Size()), 0.6*float64(float64Info.Size()))
+
+	loaded := &core.Float32BruteForce{}
+	assert.Nil(t, loaded.LoadFromFile(float32File))
+	for _, query := range queries {
+		expected, err := index.KNearest(query, k)
+		assert.Nil(t, err)
+		res, err := loaded.KNearest(query, k)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res)
+	}
+	count, d, indexType, err := loaded.Describe()
+	assert.Nil(t, err)
+	assert.Equal(t, n, count)
+	assert.Equal(t, dim, d)
+	assert.Equal(t, "float32_brute_force", indexType)
+
+	// 删除后可以继续保存与加载
+	assert.Nil(t, loaded.Delete(vecs[3]))
+	assert.NotNil(t, loaded.Delete(vecs[3]))
+	stored, err := loaded.Vectors()
+	assert.Nil(t, err)
+	assert.Len(t, stored, n-1)
+
+	assert.NotNil(t, loaded.LoadFromFile(float64File))
+}
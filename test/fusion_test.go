@@ -0,0 +1,46 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"testing"
+)
+
+func fusionList(ids ...int64) []basic.SearchResult {
+	results := make([]basic.SearchResult, len(ids))
+	for i, id := range ids {
+		results[i] = basic.SearchResult{Vector: basic.Vector{ID: id, Values: []float64{float64(id)}}, Distance: float64(i)}
+	}
+	return results
+}
+
+func fusedIDs(results []basic.SearchResult) []int64 {
+	ids := make([]int64, len(results))
+	for i, res := range results {
+		ids[i] = res.Vector.ID
+	}
+	return ids
+}
+
+func TestFuseResults(t *testing.T) {
+	dense := fusionList(1, 2, 3)
+	sparse := fusionList(3, 4, 1)
+	lists := [][]basic.SearchResult{dense, sparse}
+
+	// 等权重时两个列表都出现的 1 与 3 排在前面,k 截断结果
+	equal := core.FuseResults(lists, nil, 2)
+	assert.Equal(t, []int64{1, 3}, fusedIDs(equal))
+
+	// 稀疏结果权重更大时,其排名第一的 3 胜出,只出现在稀疏列表中的 4 也排到了 2 之前
+	sparseHeavy := core.FuseResults(lists, []float64{1, 3}, 4)
+	assert.Equal(t, []int64{3, 1, 4, 2}, fusedIDs(sparseHeavy))
+
+	// 稠密结果权重更大时,其排名第一的 1 胜出,只出现在稠密列表中的 2 排到了 4 之前
+	denseHeavy := core.FuseResults(lists, []float64{3, 1}, 4)
+	assert.Equal(t, []int64{1, 3, 2, 4}, fusedIDs(denseHeavy))
+	assert.Less(t, denseHeavy[0].Distance, denseHeavy[1].Distance)
+
+	assert.Nil(t, core.FuseResults(lists, []float64{1}, 2))
+	assert.Nil(t, core.FuseResults(lists, nil, 0))
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"testing"
+)
+
+func TestHilbertIndexRecall(t *testing.T) {
+	const dim = 8
+	centers := make([][]float64, 20)
+	for i := range centers {
+		centers[i] = basic.GenerateRandomVector(0, dim, -50, 50).Values
+	}
+	vecs, _ := generateBlobs(centers, 250, 5)
+
+	index, err := core.NewHilbertIndex(vecs, 200)
+	assert.Nil(t, err)
+	bs := core.NewBruteForceSearch(vecs)
+
+	const k = 10
+	totalRecall := 0.0
+	const numQueries = 50
+	for i := 0; i < numQueries; i++ {
+		query := vecs[(i*37)%len(vecs)]
+		query = Vector{ID: -1, Values: append([]float64(nil), query.Values...)}
+		query.Values[0] += 0.5
+
+		res, err := index.KNearest(query, k)
+		assert.Nil(t, err)
+		assert.Equal(t, k, len(res))
+		expected, _ := bs.KNearest(query, k)
+		totalRecall += basic.TwoVectorArrIntersectionRatio(res, expected, false)
+	}
+	recall := totalRecall / numQueries
+	t.Logf("hilbert recall@%d: %.3f", k, recall)
+	assert.Greater(t, recall, 0.6)
+
+	// 窗口覆盖全部向量时结果是精确的
+	index.Window = len(vecs)
+	query := basic.GenerateRandomVector(-1, dim, -50, 50)
+	res, err := index.KNearest(query, k)
+	assert.Nil(t, err)
+	expected, _ := bs.KNearest(query, k)
+	assert.Equal(t, expected, res)
+}
+
+func TestHilbertIndexOperations(t *testing.T) {
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 3, -10, 10)
+	}
+	index, err := core.NewHilbertIndex(vecs[:100], 0)
+	assert.Nil(t, err)
+	for _, vec := range vecs[100:] {
+		assert.Nil(t, index.Insert(vec))
+	}
+	stored, err := index.Vectors()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, vecs, stored)
+
+	// 向量自身一定能被找到
+	for _, vec := range vecs[:20] {
+		nearest, err := index.Nearest(vec)
+		assert.Nil(t, err)
+		assert.Equal(t, vec, nearest)
+	}
+
+	assert.Nil(t, index.Delete(vecs[0]))
+	assert.NotNil(t, index.Delete(vecs[0]))
+	assert.Nil(t, index.DeleteBatch(vecs[1:10]))
+	stored, _ = index.Vectors()
+	assert.ElementsMatch(t, vecs[10:], stored)
+
+	query := Vector{ID: -1, Values: []float64{0, 0, 0}}
+	inRange, err := index.SearchWithinRange(query, 5)
+	assert.Nil(t, err)
+	expected, _ := core.NewBruteForceSearch(vecs[10:]).SearchWithinRange(query, 5)
+	assert.ElementsMatch(t, expected, inRange)
+
+	var buf bytes.Buffer
+	assert.Nil(t, index.Save(&buf))
+	loaded := &core.HilbertIndex{}
+	assert.Nil(t, loaded.Load(&buf))
+	want, _ := index.KNearest(query, 5)
+	got, err := loaded.KNearest(query, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = core.NewHilbertIndex(nil, 10)
+	assert.NotNil(t, err)
+	assert.NotNil(t, index.Insert(Vector{ID: 1000, Values: []float64{1}}))
+}
@@ -0,0 +1,37 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"math"
+	"testing"
+)
+
+func TestVectorHLL(t *testing.T) {
+	hll := basic.NewVectorHLL(14)
+	assert.Equal(t, uint64(0), hll.Count())
+
+	const distinct = 50000
+	vecs := make([]Vector, distinct)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -10, 10)
+	}
+	// 每个向量重复添加,ID 不同时仍视为同一个向量
+	for _, vec := range vecs {
+		hll.Add(vec)
+		hll.Add(vec)
+		hll.Add(Vector{ID: vec.ID + distinct, Values: vec.Values})
+	}
+
+	// precision=14 时标准误差约 0.8%,这里允许 5% 的误差
+	estimate := float64(hll.Count())
+	assert.Less(t, math.Abs(estimate-distinct)/distinct, 0.05)
+
+	// 小基数时线性计数修正应足够精确
+	small := basic.NewVectorHLL(14)
+	for i := 0; i < 100; i++ {
+		small.Add(vecs[i])
+		small.Add(vecs[i])
+	}
+	assert.InDelta(t, 100, float64(small.Count()), 3)
+}
@@ -1,10 +1,13 @@
 package test
 
 import (
+	"encoding/gob"
 	"github.com/stretchr/testify/assert"
 	"hh_vectordb/basic"
 	"hh_vectordb/core"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -346,3 +349,474 @@ func TestKDTreePersistence(t *testing.T) {
 	}
 
 }
+
+func TestKDTreeNearestExcludingSelf(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	kdTree := core.NewKDTree(vecs)
+	// 查询向量与 ID 为 3 的向量完全相同,应返回次近的 ID 为 1 的向量
+	query := Vector{ID: 100, Values: []float64{4, 7}}
+	res, err := kdTree.NearestExcludingSelf(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.ID)
+}
+
+func TestKDTreeDeleteAndReturn(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	kdTree := core.NewKDTree(vecs)
+	res, err := kdTree.DeleteAndReturn(4)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[4].ID, res.ID)
+	assert.True(t, res.Equals(vecs[4]))
+	remaining, err := kdTree.Vectors()
+	assert.Nil(t, err)
+	for _, vec := range remaining {
+		assert.NotEqual(t, int64(4), vec.ID)
+	}
+	_, err = kdTree.DeleteAndReturn(4)
+	assert.NotNil(t, err)
+}
+
+func TestKDTreeDeleteAndReturnDuplicateValues(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 7, Values: []float64{5, 4}},
+	}
+	kdTree := core.NewKDTree(vecs)
+	res, err := kdTree.DeleteAndReturn(7)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), res.ID)
+	remaining, err := kdTree.Vectors()
+	assert.Nil(t, err)
+	ids := make(map[int64]bool, len(remaining))
+	for _, vec := range remaining {
+		ids[vec.ID] = true
+	}
+	assert.Equal(t, 4, len(remaining))
+	assert.True(t, ids[1])
+	assert.False(t, ids[7])
+}
+
+func TestKDTreeKNearestWithinBudget(t *testing.T) {
+	const numVectors = 5_0000
+	const dim = 10
+	const k = 20
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	tree := core.NewKDTree(vecs)
+	query := basic.GenerateRandomVector(int64(numVectors), dim, -10, 10)
+
+	// 预算充足时与暴力搜索的精确结果一致
+	bs := core.NewBruteForceSearch(vecs)
+	expected, err := bs.KNearest(query, k)
+	assert.Nil(t, err)
+	res, err := tree.KNearestWithinBudget(query, k, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), len(res))
+	for i, vec := range res {
+		assert.Equal(t, expected[i].ID, vec.ID)
+	}
+
+	// 极小的预算下提前返回,结果数量不超过 k
+	res, err = tree.KNearestWithinBudget(query, k, time.Nanosecond)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, len(res), k)
+	assert.Greater(t, len(res), 0)
+
+	_, err = tree.KNearestWithinBudget(query, k, 0)
+	assert.NotNil(t, err)
+}
+
+func kdTreeDepth(node *KDNode) int {
+	if node == nil {
+		return 0
+	}
+	left, right := kdTreeDepth(node.Left), kdTreeDepth(node.Right)
+	if left > right {
+		return left + 1
+	}
+	return right + 1
+}
+
+func TestKDTreeInsertPaged(t *testing.T) {
+	vecs := make([]Vector, 1000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 3, -10, 10)
+	}
+	// 分页插入后与已有向量一起整体重建,树应保持平衡
+	tree := core.NewKDTree(vecs[:10])
+	rest := append([]Vector(nil), vecs[10:]...)
+	calls := 0
+	assert.Nil(t, tree.InsertPaged(pagedSource(rest, &calls), 100))
+	assert.Equal(t, 11, calls)
+
+	all, err := tree.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, len(vecs), len(all))
+	assert.LessOrEqual(t, kdTreeDepth(tree.Root), 11)
+
+	bs := core.NewBruteForceSearch(vecs)
+	query := basic.GenerateRandomVector(int64(len(vecs)), 3, -10, 10)
+	expected, err := bs.KNearest(query, 10)
+	assert.Nil(t, err)
+	res, err := tree.KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+
+	// 重复值较多时重建后仍能正确查找和删除
+	dup := make([]Vector, 100)
+	for i := range dup {
+		dup[i] = Vector{ID: int64(i), Values: []float64{float64(i % 3), float64(i % 5)}}
+	}
+	tree = core.NewKDTree(nil)
+	assert.Nil(t, tree.InsertPaged(pagedSource(dup, &calls), 7))
+	for _, vec := range dup {
+		assert.Nil(t, tree.Delete(vec))
+	}
+	assert.Nil(t, tree.Root)
+}
+
+func TestKDTreeSearchWithinRangeEmpty(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+	}
+	index := core.NewKDTree(vecs)
+	// 范围内没有向量不是错误,返回空结果
+	res, err := index.SearchWithinRange(Vector{ID: 99, Values: []float64{100, 100}}, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+func TestKDTreeKNearestReversed(t *testing.T) {
+	vecs, query := generateReversedTestData()
+	index := core.NewKDTree(vecs)
+	assertKNearestReversed(t, index, query, 10)
+}
+
+func TestKDTreeSearchWithinAnnulus(t *testing.T) {
+	vecs := generateAnnulusTestData()
+	assertAnnulus(t, core.NewKDTree(vecs), vecs)
+}
+
+func TestKDTreeDeleteNodeWithOnlyLeftSubtree(t *testing.T) {
+	// 根节点只有左子树,左子树内部按第二维、第一维交替切分
+	vecs := []Vector{
+		{ID: 0, Values: []float64{5, 5}},
+		{ID: 1, Values: []float64{3, 8}},
+		{ID: 2, Values: []float64{4, 2}},
+		{ID: 3, Values: []float64{1, 1}},
+	}
+	kdTree := core.NewKDTree(vecs)
+	assert.Nil(t, kdTree.Delete(vecs[0]))
+
+	// 删除根节点后,其余向量仍能按切分维度找到并删除
+	for _, vec := range vecs[1:] {
+		res, err := kdTree.Nearest(vec)
+		assert.Nil(t, err)
+		assert.Equal(t, vec.ID, res.ID)
+	}
+	for i := len(vecs) - 1; i > 0; i-- {
+		assert.Nil(t, kdTree.Delete(vecs[i]))
+	}
+	remaining, err := kdTree.Vectors()
+	assert.Nil(t, err)
+	assert.Empty(t, remaining)
+}
+
+func TestKDTreeMaxDepth(t *testing.T) {
+	const numVectors = 20000
+	const maxDepth = 16
+	// 有序输入会让普通 kd-tree 退化成链表
+	vecs := make([]Vector, numVectors)
+	for i := range vecs {
+		v := float64(i)
+		vecs[i] = Vector{ID: int64(i), Values: []float64{v, v * 0.5, -v}}
+	}
+	tree := core.NewKDTreeWithMaxDepth(vecs, maxDepth)
+	stats := tree.Stats()
+	assert.Equal(t, numVectors, stats["size"])
+	assert.LessOrEqual(t, stats["max_depth"], maxDepth)
+	assert.Greater(t, stats["bucketed"], 0)
+
+	all, err := tree.Vectors()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, vecs, all)
+
+	bs := core.NewBruteForceSearch(vecs)
+	query := Vector{ID: -1, Values: []float64{12345.2, 6000, -12000}}
+	expected, err := bs.KNearest(query, 10)
+	assert.Nil(t, err)
+	res, err := tree.KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+	nearest, err := tree.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[0], nearest)
+	inRange, err := tree.SearchWithinRange(query, 5)
+	assert.Nil(t, err)
+	expectedInRange, err := bs.SearchWithinRange(query, 5)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, expectedInRange, inRange)
+
+	// 删除分桶内外的向量后查询结果仍然正确
+	for _, id := range []int{0, 5, maxDepth, 12345, numVectors - 1} {
+		assert.Nil(t, tree.Delete(vecs[id]))
+		assert.Nil(t, bs.Delete(vecs[id]))
+	}
+	expected, err = bs.KNearest(query, 10)
+	assert.Nil(t, err)
+	res, err = tree.KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+	assert.Equal(t, numVectors-5, tree.Stats()["size"])
+
+	// 重建时同样遵守层数上限
+	assert.Nil(t, tree.Rebuild())
+	assert.LessOrEqual(t, tree.Stats()["max_depth"], maxDepth)
+	assert.Equal(t, numVectors-5, tree.Stats()["size"])
+	res, err = tree.KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+
+	// 层数上限随树一起持久化,加载后继续插入仍然遵守上限
+	saveFilePath := filepath.Join(t.TempDir(), "kd_max_depth")
+	assert.Nil(t, tree.SaveToFile(saveFilePath))
+	loaded := core.NewKDTree(nil)
+	assert.Nil(t, loaded.LoadFromFile(saveFilePath))
+	assert.Equal(t, maxDepth, loaded.Config()["max_depth_limit"])
+	for i := numVectors; i < numVectors+1000; i++ {
+		v := float64(i)
+		assert.Nil(t, loaded.Insert(Vector{ID: int64(i), Values: []float64{v, v * 0.5, -v}}))
+	}
+	assert.LessOrEqual(t, loaded.Stats()["max_depth"], maxDepth)
+	assert.Equal(t, numVectors-5+1000, loaded.Stats()["size"])
+
+	// 未限制层数时 max_depth 反映退化程度
+	assert.Equal(t, 100, core.NewKDTree(vecs[:100]).Stats()["max_depth"])
+}
+
+func TestKDTreeSaveLoadStream(t *testing.T) {
+	vecs := generateStreamTestData(4)
+	assertStreamRoundTrip(t, core.NewKDTree(vecs), &KDTree{}, 4)
+}
+
+func TestKDTreeKNearestWithStats(t *testing.T) {
+	centers := [][]float64{{0, 0, 0}, {50, 50, 50}, {-50, 50, 0}, {50, -50, 0}}
+	vecs, _ := generateBlobs(centers, 2000, 5.0)
+	tree := core.NewKDTree(vecs)
+	tree.Rebuild()
+
+	query := Vector{ID: -1, Values: []float64{1, -1, 2}}
+	stats := &core.SearchStats{}
+	res, err := tree.KNearestWithStats(query, 10, stats)
+	assert.Nil(t, err)
+	expected, _ := tree.KNearest(query, 10)
+	assert.Equal(t, expected, res)
+	t.Logf("visited %d of %d nodes, %d distance computations", stats.NodesVisited, len(vecs), stats.DistanceComputations)
+	// 平衡树上剪枝有效时只会访问很少一部分节点
+	assert.Greater(t, stats.NodesVisited, 0)
+	assert.Less(t, stats.NodesVisited*20, len(vecs))
+	assert.Equal(t, stats.NodesVisited, stats.DistanceComputations)
+}
+
+func TestKDTreeVerifiedNearest(t *testing.T) {
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 3, -10, 10)
+	}
+	tree := core.NewKDTree(vecs)
+	bs := core.NewBruteForceSearch(vecs)
+	for i := 0; i < 20; i++ {
+		query := basic.GenerateRandomVector(-1, 3, -10, 10)
+		exact, _ := bs.Nearest(query)
+		res, ok, err := tree.VerifiedNearest(query)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, exact, res)
+	}
+
+	_, _, err := (&KDTree{}).VerifiedNearest(vecs[0])
+	assert.NotNil(t, err)
+}
+
+func TestKDTreeSelfRank(t *testing.T) {
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -1, 1)
+	}
+	kdTree := core.NewKDTree(vecs)
+	for _, vec := range vecs {
+		rank, err := kdTree.SelfRank(vec.ID, 3)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, rank)
+	}
+}
+
+func TestKDTreeKNearestResults(t *testing.T) {
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -1, 1)
+	}
+	tree := core.NewKDTree(vecs)
+	query := basic.GenerateRandomVector(-1, 4, -1, 1)
+	expected, err := tree.KNearest(query, 10)
+	assert.Nil(t, err)
+	results, err := tree.KNearestResults(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, basic.ResultsToVectors(results))
+	for i, res := range results {
+		assert.InDelta(t, basic.EuclidDistanceVec(query, res.Vector), res.Distance, 1e-12)
+		if i > 0 {
+			assert.LessOrEqual(t, results[i-1].Distance, res.Distance)
+		}
+	}
+}
+
+func TestKDTreeKNearestInBox(t *testing.T) {
+	vecs := make([]Vector, 2000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 3, -1, 1)
+	}
+	kdTree := core.NewKDTree(vecs)
+
+	boxes := [][2][]float64{
+		{{-0.5, -0.5, -0.5}, {0.5, 0.5, 0.5}},
+		{{0.2, -1, 0}, {0.9, 0, 1}},
+		{{-1, -1, -1}, {1, 1, 1}},
+	}
+	for _, box := range boxes {
+		lo, hi := box[0], box[1]
+		var inside []Vector
+		for _, vec := range vecs {
+			isInside := true
+			for j, val := range vec.Values {
+				isInside = isInside && val >= lo[j] && val <= hi[j]
+			}
+			if isInside {
+				inside = append(inside, vec)
+			}
+		}
+		for q := 0; q < 20; q++ {
+			// 查询向量可能在盒子之外
+			query := basic.GenerateRandomVector(-1, 3, -1.5, 1.5)
+			expected, err := core.NewBruteForceSearch(inside).KNearest(query, 10)
+			assert.Nil(t, err)
+			results, err := kdTree.KNearestInBox(query, 10, lo, hi)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, results)
+		}
+	}
+
+	// 盒子内向量不足 k 个时全部返回
+	results, err := kdTree.KNearestInBox(vecs[0], 5, vecs[0].Values, vecs[0].Values)
+	assert.Nil(t, err)
+	assert.Equal(t, []Vector{vecs[0]}, results)
+	_, err = kdTree.KNearestInBox(vecs[0], 5, []float64{0}, []float64{1})
+	assert.NotNil(t, err)
+}
+
+func TestKDTreeValidateAndRepair(t *testing.T) {
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 3, -10, 10)
+	}
+	tree := core.NewKDTree(vecs)
+	assert.Nil(t, tree.Validate())
+	repaired, err := tree.Repair()
+	assert.Nil(t, err)
+	assert.False(t, repaired)
+
+	// 把根节点左子树中的一个向量移到切分值的另一侧,再保存,模拟损坏的文件
+	root := tree.Root
+	root.Left.Vector.Values[root.Axis] = root.Vector.Values[root.Axis] + 100
+	filename := filepath.Join(t.TempDir(), "kd_tree_corrupted")
+	assert.Nil(t, tree.SaveToFile(filename))
+
+	loaded := core.NewKDTree(nil)
+	assert.Nil(t, loaded.LoadFromFile(filename))
+	assert.NotNil(t, loaded.Validate())
+
+	repaired, err = loaded.Repair()
+	assert.Nil(t, err)
+	assert.True(t, repaired)
+	assert.Nil(t, loaded.Validate())
+
+	// 修复后的查询与暴力搜索一致,向量一个不少
+	all, err := loaded.Vectors()
+	assert.Nil(t, err)
+	assert.Len(t, all, len(vecs))
+	bs := core.NewBruteForceSearch(all)
+	for i := 0; i < 20; i++ {
+		query := basic.GenerateRandomVector(int64(-i-1), 3, -10, 10)
+		expected, err := bs.KNearest(query, 5)
+		assert.Nil(t, err)
+		got, err := loaded.KNearest(query, 5)
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, expected, got)
+	}
+}
+
+func TestKDTreeNormalizedPersistence(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{10, 0}},
+		{ID: 1, Values: []float64{0, 1}},
+		{ID: 2, Values: []float64{1, 1}},
+	}
+	tree := core.NewKDTree(vecs, core.WithNormalize())
+	saveFilePath := filepath.Join(t.TempDir(), "kd_normalized")
+	assert.Nil(t, tree.SaveToFile(saveFilePath))
+
+	loaded := core.NewKDTree(nil)
+	assert.Nil(t, loaded.LoadFromFile(saveFilePath))
+	assert.True(t, loaded.IsNormalized())
+	assert.Equal(t, true, loaded.Config()["normalize"])
+
+	// 未归一化的查询向量:欧几里得距离最近的是 ID 2,余弦相似度最高的是 ID 0
+	query := Vector{ID: 100, Values: []float64{5, 0.5}}
+	res, err := loaded.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), res.ID)
+	knVecs, err := loaded.KNearest(query, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 2, 1}, []int64{knVecs[0].ID, knVecs[1].ID, knVecs[2].ID})
+
+	plain := core.NewKDTree(vecs)
+	res, err = plain.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res.ID)
+
+	// 旧格式的文件只有根节点,加载后不是归一化模式
+	legacyPath := filepath.Join(t.TempDir(), "kd_legacy")
+	file, err := os.Create(legacyPath)
+	assert.Nil(t, err)
+	assert.Nil(t, gob.NewEncoder(file).Encode(plain.Root))
+	assert.Nil(t, file.Close())
+	legacy := core.NewKDTree(nil, core.WithNormalize())
+	assert.Nil(t, legacy.LoadFromFile(legacyPath))
+	assert.False(t, legacy.IsNormalized())
+	all, err := legacy.Vectors()
+	assert.Nil(t, err)
+	assert.Len(t, all, len(vecs))
+}
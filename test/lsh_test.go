@@ -1,11 +1,15 @@
 package test
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"hh_vectordb/basic"
 	"hh_vectordb/core"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -390,3 +394,438 @@ func TestLSHPersistence(t *testing.T) {
 			expected[i].ID, basic.EuclidDistanceVec(query, expected[i]))
 	}
 }
+
+func TestLSHNearestExcludingSelf(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	// 桶宽远大于投影范围,所有向量落在同一个桶中,结果只取决于距离
+	lsh := core.NewLSHWithWidth(1, 4, 2, 1e6)
+	err := lsh.InsertBatch(vecs)
+	assert.Nil(t, err)
+	// 查询向量与 ID 为 3 的向量完全相同,应返回次近的 ID 为 1 的向量
+	query := Vector{ID: 100, Values: []float64{4, 7}}
+	res, err := lsh.NearestExcludingSelf(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.ID)
+	assert.False(t, res.Equals(query))
+}
+
+func TestLSHSaveIncremental(t *testing.T) {
+	const numVectors = 3000
+	const minValue = -10.0
+	const maxValue = 10.0
+	const dim = 2
+	const k = 5
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, minValue, maxValue)
+	}
+	saveFilePath := filepath.Join(t.TempDir(), "lsh_incremental")
+
+	lsh := core.NewLSH(10, 10000)
+	// 第一次保存写入完整快照,之后的两次保存只追加日志
+	assert.Nil(t, lsh.InsertBatch(vecs[:1000]))
+	assert.Nil(t, lsh.SaveIncremental(saveFilePath))
+	assert.Nil(t, lsh.InsertBatch(vecs[1000:2000]))
+	assert.Nil(t, lsh.SaveIncremental(saveFilePath))
+	assert.Nil(t, lsh.InsertBatch(vecs[2000:]))
+	assert.Nil(t, lsh.Delete(vecs[0]))
+	assert.Nil(t, lsh.SaveIncremental(saveFilePath))
+	_, err := os.Stat(saveFilePath + ".log")
+	assert.Nil(t, err)
+
+	loaded := core.NewLSH(10, 10000)
+	assert.Nil(t, loaded.LoadFromFile(saveFilePath))
+	resVecs, err := loaded.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, numVectors-1, len(resVecs))
+
+	for _, query := range vecs[1:20] {
+		expected, err := lsh.KNearest(query, k)
+		assert.Nil(t, err)
+		result, err := loaded.KNearest(query, k)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, result)
+	}
+
+	// 压缩后日志文件被删除,重新加载的结果不变
+	assert.Nil(t, loaded.Compact(saveFilePath))
+	_, err = os.Stat(saveFilePath + ".log")
+	assert.True(t, os.IsNotExist(err))
+	reloaded := core.NewLSH(10, 10000)
+	assert.Nil(t, reloaded.LoadFromFile(saveFilePath))
+	resVecs, err = reloaded.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, numVectors-1, len(resVecs))
+}
+
+func TestLSHLoadTornLog(t *testing.T) {
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 2, -10, 10)
+	}
+
+	// 模拟追加最后一帧时崩溃:分别截断在帧数据中间和帧长度中间
+	for _, cut := range []int64{10, 2} {
+		saveFilePath := filepath.Join(t.TempDir(), "lsh_torn")
+		logFile := saveFilePath + ".log"
+		lsh := core.NewLSH(10, 10000)
+		assert.Nil(t, lsh.InsertBatch(vecs[:100]))
+		assert.Nil(t, lsh.SaveIncremental(saveFilePath))
+		assert.Nil(t, lsh.InsertBatch(vecs[100:200]))
+		assert.Nil(t, lsh.SaveIncremental(saveFilePath))
+		info, err := os.Stat(logFile)
+		assert.Nil(t, err)
+		assert.Nil(t, lsh.InsertBatch(vecs[200:]))
+		assert.Nil(t, lsh.SaveIncremental(saveFilePath))
+		data, err := os.ReadFile(logFile)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(logFile, data[:info.Size()+cut], 0644))
+
+		// 完整的帧被保留,残缺的尾帧被丢弃,并重写快照删除日志
+		loaded := core.NewLSH(10, 10000)
+		assert.Nil(t, loaded.LoadFromFile(saveFilePath))
+		resVecs, err := loaded.Vectors()
+		assert.Nil(t, err)
+		assert.Equal(t, 200, len(resVecs))
+		_, err = os.Stat(logFile)
+		assert.True(t, os.IsNotExist(err))
+
+		reloaded := core.NewLSH(10, 10000)
+		assert.Nil(t, reloaded.LoadFromFile(saveFilePath))
+		resVecs, err = reloaded.Vectors()
+		assert.Nil(t, err)
+		assert.Equal(t, 200, len(resVecs))
+	}
+}
+
+func TestLSHDeleteAndReturn(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	lsh := core.NewLSH(10, 10)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+	res, err := lsh.DeleteAndReturn(4)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[4].ID, res.ID)
+	assert.True(t, res.Equals(vecs[4]))
+	remaining, err := lsh.Vectors()
+	assert.Nil(t, err)
+	for _, vec := range remaining {
+		assert.NotEqual(t, int64(4), vec.ID)
+	}
+	_, err = lsh.DeleteAndReturn(4)
+	assert.NotNil(t, err)
+}
+
+func TestLSHSearchWithinRangeEmpty(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+	}
+	index := core.NewLSH(10, 100)
+	assert.Nil(t, index.InsertBatch(vecs))
+	// 范围内没有向量不是错误,返回空结果
+	res, err := index.SearchWithinRange(Vector{ID: 99, Values: []float64{100, 100}}, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+func TestLSHKNearestReversed(t *testing.T) {
+	vecs, query := generateReversedTestData()
+	index := core.NewLSH(10, 100)
+	assert.Nil(t, index.InsertBatch(vecs))
+	assertKNearestReversed(t, index, query, 10)
+}
+
+func TestLSHBucketWidth(t *testing.T) {
+	const numVectors = 5000
+	const dim = 8
+	vecs := make([]Vector, numVectors)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 100)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, -10, 10)
+	}
+
+	assert.Nil(t, core.NewLSHWithWidth(4, 8, dim, 0))
+	lsh := core.NewLSHWithWidth(4, 8, dim, 1)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+
+	// 桶越宽,每个查询的候选越多,召回率越高
+	prevCandidates, prevAccuracy := -1.0, -1.0
+	for _, w := range []float64{4, 16, 64} {
+		assert.Nil(t, lsh.SetBucketWidth(w))
+		candidates := 0
+		for _, query := range queries {
+			res, err := lsh.SearchWithinRange(query, math.Inf(1))
+			assert.Nil(t, err)
+			candidates += len(res)
+		}
+		avgCandidates := float64(candidates) / float64(len(queries))
+		accuracy, err := core.Top1Accuracy(lsh, queries)
+		assert.Nil(t, err)
+		t.Logf("w=%v candidates=%.1f top1=%.2f", w, avgCandidates, accuracy)
+		assert.Greater(t, avgCandidates, prevCandidates)
+		assert.GreaterOrEqual(t, accuracy, prevAccuracy)
+		prevCandidates, prevAccuracy = avgCandidates, accuracy
+	}
+	all, err := lsh.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, numVectors, len(all))
+
+	assert.NotNil(t, lsh.SetBucketWidth(0))
+	assert.NotNil(t, core.NewLSH(4, 100).SetBucketWidth(1))
+
+	// 持久化后保留桶宽和投影
+	filename := filepath.Join(t.TempDir(), "lsh_width")
+	assert.Nil(t, lsh.SaveToFile(filename))
+	loaded := &core.LSH{}
+	assert.Nil(t, loaded.LoadFromFile(filename))
+	assert.Equal(t, 64.0, loaded.Width)
+	for _, query := range queries[:10] {
+		expected, err := lsh.Nearest(query)
+		assert.Nil(t, err)
+		res, err := loaded.Nearest(query)
+		assert.Nil(t, err)
+		assert.Equal(t, expected.ID, res.ID)
+	}
+
+	// 增量保存后修改桶宽,下一次增量保存必须写完整快照,否则新桶宽会丢失
+	incremental := filepath.Join(t.TempDir(), "lsh_width_incremental")
+	assert.Nil(t, lsh.SaveIncremental(incremental))
+	assert.Nil(t, lsh.SetBucketWidth(8))
+	assert.Nil(t, lsh.SaveIncremental(incremental))
+	loaded = &core.LSH{}
+	assert.Nil(t, loaded.LoadFromFile(incremental))
+	assert.Equal(t, 8.0, loaded.Width)
+}
+
+func TestLSHEachBucket(t *testing.T) {
+	vecs := make([]Vector, 1000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -10, 10)
+	}
+	lsh := core.NewLSHWithWidth(2, 4, 4, 4)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+
+	buckets, entries, maxSize := 0, 0, 0
+	tables := make(map[int]struct{})
+	lsh.EachBucket(func(table int, hash int64, vectors []Vector) bool {
+		assert.NotEmpty(t, vectors)
+		buckets++
+		entries += len(vectors)
+		if len(vectors) > maxSize {
+			maxSize = len(vectors)
+		}
+		tables[table] = struct{}{}
+		return true
+	})
+	stats := lsh.BucketStats()
+	assert.Equal(t, stats.Buckets, buckets)
+	assert.Equal(t, stats.Entries, entries)
+	assert.Equal(t, stats.MaxBucketSize, maxSize)
+	assert.InDelta(t, float64(entries)/float64(buckets), stats.AvgBucketSize, 1e-9)
+	// 每个向量在每个表中各出现一次
+	assert.Equal(t, len(vecs)*4, entries)
+	assert.Equal(t, 4, len(tables))
+
+	// 回调返回 false 时立即停止
+	visited := 0
+	lsh.EachBucket(func(table int, hash int64, vectors []Vector) bool {
+		visited++
+		return visited < 3
+	})
+	assert.Equal(t, 3, visited)
+}
+
+func TestLSHSaveLoadStream(t *testing.T) {
+	vecs := generateStreamTestData(8)
+	lsh := core.NewLSHWithWidth(2, 8, 8, 30)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+	assertStreamRoundTrip(t, lsh, &core.LSH{}, 8)
+}
+
+func TestLSHSelfRank(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	lsh := core.NewLSHWithWidth(2, 8, dim, 30)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+
+	// 近似索引的排名可能大于 0 或不在 top-k 中,但大多数向量应该能找回自己
+	atZero := 0
+	for _, vec := range vecs {
+		rank, err := lsh.SelfRank(vec.ID, 10)
+		assert.Nil(t, err)
+		assert.True(t, rank >= -1 && rank < 10)
+		if rank == 0 {
+			atZero++
+		}
+	}
+	assert.Greater(t, atZero, len(vecs)*9/10)
+
+	_, err := lsh.SelfRank(-1, 10)
+	assert.NotNil(t, err)
+}
+
+func TestLSHSearchWithinRangeAcrossBuckets(t *testing.T) {
+	lsh := core.NewLSHWithWidth(2, 1, 2, 0.25)
+	query := Vector{ID: -1, Values: []float64{0.3, 0.7}}
+	// 在以查询向量为圆心、半径 0.5 的圆上找一个与查询向量不在同一个桶中的向量
+	var neighbor Vector
+	for i := 0; i < 64; i++ {
+		angle := float64(i) * 0.1
+		neighbor = Vector{ID: 1, Values: []float64{0.3 + 0.5*math.Cos(angle), 0.7 + 0.5*math.Sin(angle)}}
+		if lsh.HashFuncs[0](neighbor) != lsh.HashFuncs[0](query) {
+			break
+		}
+	}
+	assert.NotEqual(t, lsh.HashFuncs[0](query), lsh.HashFuncs[0](neighbor))
+	assert.Nil(t, lsh.Insert(neighbor))
+
+	// 只探测查询所在桶的最近邻查询找不到它
+	_, err := lsh.Nearest(query)
+	assert.NotNil(t, err)
+	results, err := lsh.SearchWithinRange(query, 0.6)
+	assert.Nil(t, err)
+	assert.Equal(t, []Vector{neighbor}, results)
+
+	// 欧几里得距离下范围搜索与暴力搜索的结果一致
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -1, 1)
+	}
+	lsh = core.NewLSHWithWidth(3, 4, 4, 0.5)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+	legacy := core.NewLSH(20, 10000)
+	assert.Nil(t, legacy.InsertBatch(vecs))
+	bs := core.NewBruteForceSearch(vecs)
+	center := Vector{ID: -1, Values: []float64{0.1, -0.2, 0.3, 0}}
+	for _, radius := range []float64{0.3, 0.8} {
+		expected, err := bs.SearchWithinRange(center, radius)
+		assert.Nil(t, err)
+		for _, index := range []*core.LSH{lsh, legacy} {
+			results, err := index.SearchWithinRange(center, radius)
+			assert.Nil(t, err)
+			assert.ElementsMatch(t, expected, results, "radius %v", radius)
+		}
+	}
+}
+
+func TestLSHMinOccupancy(t *testing.T) {
+	const dim = 4
+	vecs := make([]Vector, 1000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	lsh := core.NewLSHWithWidth(2, 8, dim, 0.8)
+	assert.Nil(t, lsh.InsertBatch(vecs))
+	query := vecs[0]
+
+	// 查询向量在各个表中所在桶的大小
+	buckets := make([][]Vector, len(lsh.HashTables))
+	maxSize, minSize := 0, len(vecs)
+	for i, hashFunc := range lsh.HashFuncs {
+		buckets[i] = lsh.HashTables[i][hashFunc(query)]
+		if len(buckets[i]) > maxSize {
+			maxSize = len(buckets[i])
+		}
+		if len(buckets[i]) < minSize {
+			minSize = len(buckets[i])
+		}
+	}
+	assert.Less(t, minSize, maxSize)
+	unionIDs := func(minOccupancy int) map[int64]bool {
+		ids := make(map[int64]bool)
+		for _, bucket := range buckets {
+			if len(bucket) < minOccupancy {
+				continue
+			}
+			for _, vec := range bucket {
+				ids[vec.ID] = true
+			}
+		}
+		return ids
+	}
+
+	// 候选集只来自桶大小不小于 MinOccupancy 的表
+	for _, minOccupancy := range []int{0, maxSize} {
+		lsh.MinOccupancy = minOccupancy
+		expected := unionIDs(minOccupancy)
+		results, err := lsh.KNearest(query, len(expected))
+		assert.Nil(t, err)
+		got := make(map[int64]bool, len(results))
+		for _, vec := range results {
+			got[vec.ID] = true
+		}
+		assert.Equal(t, expected, got, "min occupancy %d", minOccupancy)
+		_, err = lsh.KNearest(query, len(expected)+1)
+		assert.NotNil(t, err)
+	}
+	assert.Less(t, len(unionIDs(maxSize)), len(unionIDs(0)))
+
+	// 所有表都被忽略时没有候选
+	lsh.MinOccupancy = maxSize + 1
+	_, err := lsh.Nearest(query)
+	assert.NotNil(t, err)
+
+	lsh.MinOccupancy = maxSize
+	loaded := &core.LSH{}
+	var buf bytes.Buffer
+	assert.Nil(t, lsh.Save(&buf))
+	assert.Nil(t, loaded.Load(&buf))
+	assert.Equal(t, maxSize, loaded.MinOccupancy)
+	assert.Equal(t, maxSize, loaded.Config()["min_occupancy"])
+}
+
+func TestLSHNormalizedPersistence(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{10, 0}},
+		{ID: 1, Values: []float64{0, 1}},
+		{ID: 2, Values: []float64{1, 1}},
+	}
+	// 桶宽远大于归一化向量的投影范围,所有向量落在同一个桶中,结果只取决于距离
+	lsh := core.NewLSHWithWidth(1, 4, 2, 1000, core.WithNormalize())
+	assert.Nil(t, lsh.InsertBatch(vecs))
+	saveFilePath := filepath.Join(t.TempDir(), "lsh_normalized")
+	assert.Nil(t, lsh.SaveToFile(saveFilePath))
+
+	loaded := &core.LSH{}
+	assert.Nil(t, loaded.LoadFromFile(saveFilePath))
+	assert.True(t, loaded.IsNormalized())
+	assert.Equal(t, true, loaded.Config()["normalize"])
+
+	// 未归一化的查询向量:欧几里得距离最近的是 ID 2,余弦相似度最高的是 ID 0
+	query := Vector{ID: 100, Values: []float64{5, 0.5}}
+	res, err := loaded.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), res.ID)
+	knVecs, err := loaded.KNearest(query, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 2, 1}, []int64{knVecs[0].ID, knVecs[1].ID, knVecs[2].ID})
+
+	// 删除时同样先归一化
+	assert.Nil(t, loaded.Delete(vecs[0]))
+	res, err = loaded.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res.ID)
+}
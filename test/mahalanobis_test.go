@@ -0,0 +1,94 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// generateAnisotropic 生成各维度标准差不同的零均值高斯数据
+func generateAnisotropic(n int, stddevs []float64, r *rand.Rand) []Vector {
+	vecs := make([]Vector, n)
+	for i := range vecs {
+		values := make([]float64, len(stddevs))
+		for d, std := range stddevs {
+			values[d] = r.NormFloat64() * std
+		}
+		vecs[i] = Vector{ID: int64(i), Values: values}
+	}
+	return vecs
+}
+
+func TestMahalanobis(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	vecs := generateAnisotropic(5000, []float64{10, 0.1}, r)
+	m, err := basic.NewMahalanobis(vecs)
+	assert.Nil(t, err)
+
+	origin := Vector{Values: []float64{0, 0}}
+	// 距离以各维度的标准差为单位
+	assert.InDelta(t, 1.0, m.Distance(origin, Vector{Values: []float64{10, 0}}), 0.05)
+	assert.InDelta(t, 1.0, m.Distance(origin, Vector{Values: []float64{0, 0.1}}), 0.05)
+	assert.Equal(t, 0.0, m.Distance(origin, origin))
+	a, b := vecs[0], vecs[1]
+	assert.InDelta(t, m.Distance(a, b), m.Distance(b, a), 1e-9)
+
+	// 相关的维度:y = x + 噪声,沿相关方向的偏移比垂直方向的偏移更"近"
+	correlated := make([]Vector, 5000)
+	for i := range correlated {
+		x := r.NormFloat64()
+		correlated[i] = Vector{ID: int64(i), Values: []float64{x, x + 0.1*r.NormFloat64()}}
+	}
+	m, err = basic.NewMahalanobis(correlated)
+	assert.Nil(t, err)
+	along := m.Distance(origin, Vector{Values: []float64{1, 1}})
+	across := m.Distance(origin, Vector{Values: []float64{1 / math.Sqrt2, -1 / math.Sqrt2}})
+	assert.Less(t, along, across)
+
+	// 完全相同的数据也能通过正则项求逆
+	same := []Vector{{Values: []float64{1, 2}}, {Values: []float64{1, 2}}}
+	_, err = basic.NewMahalanobis(same)
+	assert.Nil(t, err)
+
+	_, err = basic.NewMahalanobis(vecs[:1])
+	assert.NotNil(t, err)
+	_, err = basic.NewMahalanobis([]Vector{{Values: []float64{1}}, {Values: []float64{1, 2}}})
+	assert.NotNil(t, err)
+}
+
+func TestMahalanobisUpdate(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	initial := generateAnisotropic(1000, []float64{1, 1}, r)
+	m, err := basic.NewMahalanobis(initial)
+	assert.Nil(t, err)
+
+	origin := Vector{Values: []float64{0, 0}}
+	point := Vector{Values: []float64{10, 0}}
+	before := m.Distance(origin, point)
+	assert.InDelta(t, 10.0, before, 1)
+
+	// 第一维的尺度变为 10 倍,流式更新后沿第一维的距离应当缩小
+	m.RefreshInterval = 50
+	shifted := generateAnisotropic(9000, []float64{10, 1}, r)
+	for i, vec := range shifted {
+		assert.Nil(t, m.Update(vec))
+		if i == 10 {
+			// 未到刷新间隔时不重新求逆
+			assert.Equal(t, before, m.Distance(origin, point))
+		}
+	}
+	after := m.Distance(origin, point)
+	// 合并后第一维的方差约为 0.1*1 + 0.9*100
+	assert.InDelta(t, 10/math.Sqrt(0.1+0.9*100), after, 0.1)
+
+	// 增量估计与一次性估计一致
+	full, err := basic.NewMahalanobis(append(initial, shifted...))
+	assert.Nil(t, err)
+	assert.Nil(t, m.Refresh())
+	assert.InDelta(t, full.Distance(origin, point), m.Distance(origin, point), 1e-6)
+
+	assert.NotNil(t, m.Update(Vector{Values: []float64{1}}))
+	assert.NotNil(t, (&basic.Mahalanobis{}).Update(origin))
+}
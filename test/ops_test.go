@@ -13,3 +13,83 @@ func TestEuclidDistance(t *testing.T) {
 	res1 := math.Sqrt(0.1*0.1 + 0.8*0.8)
 	assert.LessOrEqual(t, math.Abs(basic.EuclidDistance(arr1, arr2)-res1), 1e-6)
 }
+
+func TestManhattanDistance(t *testing.T) {
+	arr1 := []float64{0.1, 0.2}
+	arr2 := []float64{0.2, -1.0}
+	assert.InDelta(t, 1.3, basic.ManhattanDistance(arr1, arr2), 1e-9)
+	assert.InDelta(t, 1.3, basic.Manhattan.Distance(arr1, arr2), 1e-9)
+	assert.Equal(t, "manhattan", basic.Manhattan.String())
+}
+
+func TestGeometricMedian(t *testing.T) {
+	assert.Nil(t, basic.GeometricMedian(nil, 100, 1e-9).Values)
+
+	vectors := []basic.Vector{
+		{ID: 1, Values: []float64{1.0, 0.0}},
+		{ID: 2, Values: []float64{-1.0, 0.0}},
+		{ID: 3, Values: []float64{0.0, 1.0}},
+		{ID: 4, Values: []float64{0.0, -1.0}},
+		{ID: 5, Values: []float64{0.0, 0.0}},
+	}
+	median := basic.GeometricMedian(vectors, 100, 1e-9)
+	assert.LessOrEqual(t, basic.EuclidDistance(median.Values, []float64{0, 0}), 1e-6)
+
+	// 单个极端离群点会显著拉偏算术平均,但几乎不影响几何中位数
+	withOutlier := append(vectors, basic.Vector{ID: 6, Values: []float64{1000.0, 1000.0}})
+	mean := basic.Centroid(withOutlier)
+	median = basic.GeometricMedian(withOutlier, 1000, 1e-9)
+	assert.Greater(t, basic.EuclidDistance(mean.Values, []float64{0, 0}), 100.0)
+	assert.Less(t, basic.EuclidDistance(median.Values, []float64{0, 0}), 0.5)
+}
+
+func TestDiversityScore(t *testing.T) {
+	assert.Equal(t, 0.0, basic.DiversityScore(nil))
+	assert.Equal(t, 0.0, basic.DiversityScore([]basic.Vector{{ID: 1, Values: []float64{1, 1}}}))
+
+	// 三个点构成 3-4-5 直角三角形,平均两两距离为 4
+	triangle := []basic.Vector{
+		{ID: 1, Values: []float64{0, 0}},
+		{ID: 2, Values: []float64{3, 0}},
+		{ID: 3, Values: []float64{0, 4}},
+	}
+	assert.InDelta(t, 4.0, basic.DiversityScore(triangle), 1e-9)
+
+	clustered := []basic.Vector{
+		{ID: 1, Values: []float64{1.0, 1.0}},
+		{ID: 2, Values: []float64{1.1, 1.0}},
+		{ID: 3, Values: []float64{1.0, 1.1}},
+		{ID: 4, Values: []float64{1.1, 1.1}},
+	}
+	spread := []basic.Vector{
+		{ID: 1, Values: []float64{-10, -10}},
+		{ID: 2, Values: []float64{10, -10}},
+		{ID: 3, Values: []float64{-10, 10}},
+		{ID: 4, Values: []float64{10, 10}},
+	}
+	assert.Less(t, basic.DiversityScore(clustered), basic.DiversityScore(spread))
+}
+
+func TestApproxDiameter(t *testing.T) {
+	assert.Equal(t, 0.0, basic.ApproxDiameter(nil, 5))
+	assert.Equal(t, 0.0, basic.ApproxDiameter([]basic.Vector{{Values: []float64{1, 2}}}, 5))
+
+	// 单位球面上的点加上一对相距恰好为 2 的对径点,直径为 2
+	vecs := make([]basic.Vector, 0, 1002)
+	for i := 0; i < 1000; i++ {
+		vecs = append(vecs, basic.Normalize(basic.GenerateRandomVector(int64(i), 3, -1, 1)))
+	}
+	vecs = append(vecs, basic.Vector{ID: 1000, Values: []float64{0, 0, 1}}, basic.Vector{ID: 1001, Values: []float64{0, 0, -1}})
+	for i := 0; i < 10; i++ {
+		diameter := basic.ApproxDiameter(vecs, 5)
+		assert.LessOrEqual(t, diameter, 2+1e-9)
+		assert.Greater(t, diameter, 1.95)
+	}
+
+	// 线段上的点:一轮跳转即可找到一个端点,两轮得到精确直径
+	line := make([]basic.Vector, 100)
+	for i := range line {
+		line[i] = basic.Vector{ID: int64(i), Values: []float64{float64(i), 0}}
+	}
+	assert.Equal(t, 99.0, basic.ApproxDiameter(line, 2))
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"math"
+	"testing"
+)
+
+// countingManhattan 返回一个曼哈顿距离函数及其调用次数计数器
+func countingManhattan() (core.DistanceFunc, *int) {
+	calls := 0
+	return func(a, b []float64) float64 {
+		calls++
+		sum := 0.0
+		for i := range a {
+			sum += math.Abs(a[i] - b[i])
+		}
+		return sum
+	}, &calls
+}
+
+func TestWithMetric(t *testing.T) {
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -10, 10)
+	}
+	query := basic.GenerateRandomVector(-1, 4, -10, 10)
+
+	manhattan, calls := countingManhattan()
+	expected, err := core.NewBruteForceSearch(vecs, core.WithMetric(manhattan)).KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.Greater(t, *calls, 0)
+	euclidean, err := core.NewBruteForceSearch(vecs).KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.NotEqual(t, euclidean, expected)
+
+	// 满足三角不等式的度量下,树索引的结果与暴力搜索一致
+	coverTree := core.NewCoverTree(2, core.WithMetric(manhattan))
+	assert.Nil(t, coverTree.InsertBatch(vecs))
+	exactIndexes := map[string]core.NearestNeighborSearch{
+		"kd":    core.NewKDTree(vecs, core.WithMetric(manhattan)),
+		"ball":  core.NewBallTree(vecs, core.WithMetric(manhattan)),
+		"vp":    core.NewVPTree(vecs, core.WithMetric(manhattan)),
+		"cover": coverTree,
+	}
+	for name, index := range exactIndexes {
+		*calls = 0
+		res, err := index.KNearest(query, 10)
+		assert.Nil(t, err, name)
+		assert.Greater(t, *calls, 0, name)
+		assert.Equal(t, expected, res, name)
+
+		if name == "cover" {
+			continue
+		}
+		nearest, err := index.Nearest(query)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected[0], nearest, name)
+	}
+	// CoverTree.Nearest 以 Base^Level 为半径剪枝,不保证精确,用暴力校验的 VerifiedNearest 检查自定义距离
+	nearest, _, err := coverTree.VerifiedNearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[0], nearest)
+
+	// 近似索引只用自定义距离对候选集排序
+	lsh := core.NewLSHWithWidth(2, 8, 4, 30, core.WithMetric(manhattan))
+	assert.Nil(t, lsh.InsertBatch(vecs))
+	*calls = 0
+	_, err = lsh.KNearest(query, 5)
+	assert.Nil(t, err)
+	assert.Greater(t, *calls, 0)
+
+	pq := core.NewPQ(2, 8, core.WithMetric(manhattan))
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	*calls = 0
+	_, err = pq.KNearestRefined(query, 5)
+	assert.Nil(t, err)
+	assert.Greater(t, *calls, 0)
+}
+
+func TestWithNormalizeUnsupported(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{1, 0}},
+		{ID: 1, Values: []float64{0, 2}},
+	}
+	// 带错误返回的构造函数收到该选项时返回错误,不会静默退化为非余弦索引
+	_, err := core.NewBallTreeChecked(vecs, core.WithNormalize())
+	assert.NotNil(t, err)
+	_, err = core.NewVPTreeChecked(vecs, core.WithNormalize())
+	assert.NotNil(t, err)
+	_, err = core.NewCoverTreeChecked(2, core.WithNormalize())
+	assert.NotNil(t, err)
+	_, err = core.NewCoverTreeAuto(vecs, core.WithNormalize())
+	assert.NotNil(t, err)
+	_, err = core.NewHilbertIndex(vecs, 0, core.WithNormalize())
+	assert.NotNil(t, err)
+
+	// 其余构造函数忽略该选项,不会 panic
+	assert.NotPanics(t, func() { core.NewBallTree(vecs, core.WithNormalize()) })
+	assert.NotPanics(t, func() { core.NewVPTree(vecs, core.WithNormalize()) })
+	assert.NotPanics(t, func() { core.NewCoverTree(2, core.WithNormalize()) })
+
+	_, err = core.NewBallTreeChecked(vecs)
+	assert.Nil(t, err)
+	_, err = core.NewVPTreeChecked(vecs)
+	assert.Nil(t, err)
+	_, err = core.NewCoverTreeChecked(2)
+	assert.Nil(t, err)
+	_, err = core.NewHilbertIndex(vecs, 0)
+	assert.Nil(t, err)
+}
@@ -1,10 +1,14 @@
 package test
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"hh_vectordb/basic"
 	"hh_vectordb/core"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -383,3 +387,1135 @@ func TestPQLoadFromFile(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, len(resVecs), 10)
 }
+
+func TestPQNearestExcludingSelf(t *testing.T) {
+	const numVectors = 1000
+	const minValue = -5.0
+	const maxValue = 5.0
+	const dim = 10
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, minValue, maxValue)
+	}
+	pq := core.NewPQ(5, 8)
+	pq.Train(vecs, 20)
+	for _, v := range vecs {
+		assert.Nil(t, pq.Insert(v))
+	}
+
+	queryVec := vecs[10]
+	result, err := pq.NearestExcludingSelf(queryVec)
+	assert.Nil(t, err)
+	assert.NotEqual(t, queryVec.ID, result.ID)
+	assert.False(t, result.Equals(queryVec))
+}
+
+func TestPQKNearestBatch(t *testing.T) {
+	const numVectors = 2000
+	const minValue = -5.0
+	const maxValue = 5.0
+	const dim = 20
+	const k = 10
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, minValue, maxValue)
+	}
+	pq := core.NewPQ(5, 8)
+	pq.Train(vecs, 20)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	queries := vecs[:20]
+	contexts := pq.PrecomputeQueryBatch(queries)
+	assert.Equal(t, len(queries), len(contexts))
+
+	// 预计算的距离表可以重复使用,结果与逐条查询一致
+	for round := 0; round < 2; round++ {
+		results, err := pq.KNearestBatch(contexts, k)
+		assert.Nil(t, err)
+		for i, query := range queries {
+			expected, err := pq.KNearest(query, k)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, results[i])
+		}
+	}
+}
+
+func TestPQQueryContextAfterReconfigure(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -5, 5)
+	}
+	pq := core.NewPQ(2, 4)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	ctx := pq.PrecomputeQuery(vecs[0])
+	_, err := pq.KNearestWithContext(ctx, 3)
+	assert.Nil(t, err)
+
+	// 重新训练后码本变了,旧的距离表不能再用,应返回错误而不是越界
+	assert.Nil(t, pq.Reconfigure(2, 16, 10))
+	_, err = pq.KNearestWithContext(ctx, 3)
+	assert.NotNil(t, err)
+	_, err = pq.KNearestBatch([]*core.QueryContext{ctx}, 3)
+	assert.NotNil(t, err)
+
+	// 同样的 m/k 重新训练也会让旧的距离表失效
+	ctx = pq.PrecomputeQuery(vecs[0])
+	assert.Nil(t, pq.Retrain(10))
+	_, err = pq.KNearestWithContext(ctx, 3)
+	assert.NotNil(t, err)
+
+	_, err = pq.KNearestWithContext(pq.PrecomputeQuery(vecs[0]), 3)
+	assert.Nil(t, err)
+}
+
+func buildBenchmarkPQ(b *testing.B) (*core.PQ, []Vector) {
+	const numVectors = 2000
+	const numQueries = 200
+	const minValue = -5.0
+	const maxValue = 5.0
+	const dim = 64
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, minValue, maxValue)
+	}
+	pq := core.NewPQ(16, 64)
+	pq.Train(vecs, 10)
+	if err := pq.InsertBatch(vecs); err != nil {
+		b.Fatalf("Failed to insert vectors: %v", err)
+	}
+
+	queries := make([]Vector, numQueries)
+	for i := 0; i < numQueries; i++ {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, minValue, maxValue)
+	}
+	return pq, queries
+}
+
+func BenchmarkPQKNearestRecomputeTables(b *testing.B) {
+	pq, queries := buildBenchmarkPQ(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, query := range queries {
+			_, _ = pq.KNearest(query, 10)
+		}
+	}
+}
+
+func BenchmarkPQKNearestPrecomputedTables(b *testing.B) {
+	pq, queries := buildBenchmarkPQ(b)
+	contexts := pq.PrecomputeQueryBatch(queries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = pq.KNearestBatch(contexts, 10)
+	}
+}
+
+func BenchmarkPQInsertBatch(b *testing.B) {
+	const numVectors = 100_0000
+	const dim = 8
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	trained := core.NewPQ(4, 8)
+	trained.Train(vecs, 10)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pq := core.NewPQ(4, 8)
+		pq.Codebooks = trained.Codebooks
+		_ = pq.InsertBatch(vecs)
+	}
+}
+
+func TestPQKNearestAmong(t *testing.T) {
+	const numVectors = 2000
+	const dim = 10
+	const k = 10
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	pq := core.NewPQ(5, 8)
+	pq.Train(vecs, 20)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	query := basic.GenerateRandomVector(int64(numVectors), dim, -10, 10)
+
+	ids := make([]int64, 0, numVectors/3)
+	for i := 0; i < numVectors; i += 3 {
+		ids = append(ids, int64(i))
+	}
+	res, err := pq.KNearestAmong(query, k, ids)
+	assert.Nil(t, err)
+
+	bs := core.NewBruteForceSearch(vecs)
+	full, err := bs.KNearest(query, numVectors)
+	assert.Nil(t, err)
+	expected := make([]Vector, 0, k)
+	for _, vec := range full {
+		if vec.ID%3 == 0 && len(expected) < k {
+			expected = append(expected, vec)
+		}
+	}
+	assert.Equal(t, expected, res)
+
+	// 自定义度量下同样按该度量精排,结果与同度量的暴力搜索一致
+	metricPQ := core.NewPQ(5, 8, core.WithMetric(basic.InnerProduct.Distance))
+	metricPQ.Train(vecs, 20)
+	assert.Nil(t, metricPQ.InsertBatch(vecs))
+	res, err = metricPQ.KNearestAmong(query, k, ids)
+	assert.Nil(t, err)
+	full, err = core.NewBruteForceSearch(vecs, core.WithMetric(basic.InnerProduct.Distance)).KNearest(query, numVectors)
+	assert.Nil(t, err)
+	expected = expected[:0]
+	for _, vec := range full {
+		if vec.ID%3 == 0 && len(expected) < k {
+			expected = append(expected, vec)
+		}
+	}
+	assert.Equal(t, expected, res)
+}
+
+func TestPQDeleteAndReturn(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	pq := core.NewPQ(2, 3)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	res, err := pq.DeleteAndReturn(4)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[4].ID, res.ID)
+	assert.True(t, res.Equals(vecs[4]))
+	remaining, err := pq.Vectors()
+	assert.Nil(t, err)
+	for _, vec := range remaining {
+		assert.NotEqual(t, int64(4), vec.ID)
+	}
+	_, err = pq.DeleteAndReturn(4)
+	assert.NotNil(t, err)
+}
+
+func TestPQKNearestExplain(t *testing.T) {
+	const dim = 8
+	const m = 4
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	pq := core.NewPQ(m, 8)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	query := basic.GenerateRandomVector(int64(len(vecs)), dim, -10, 10)
+	expected, err := pq.KNearest(query, 5)
+	assert.Nil(t, err)
+	res, partials, err := pq.KNearestExplain(query, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+	assert.Equal(t, len(res), len(partials))
+
+	subLen := dim / m
+	prevTotal := 0.0
+	for i, vec := range res {
+		assert.Equal(t, m, len(partials[i]))
+		// 由码本独立计算估计距离,应与各子向量距离之和一致
+		codes := pq.IDs[pq.IDLookup[vec.ID]]
+		estimate, total := 0.0, 0.0
+		for j, code := range codes {
+			centroid := pq.Codebooks[j][code].Vector.Values
+			estimate += basic.EuclidDistance(query.Values[j*subLen:(j+1)*subLen], centroid)
+			total += partials[i][j]
+		}
+		assert.InDelta(t, estimate, total, 1e-9)
+		assert.GreaterOrEqual(t, total, prevTotal)
+		prevTotal = total
+	}
+}
+
+func TestPQQuantizeBatch(t *testing.T) {
+	vecs := make([]Vector, 100)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 8, -10, 10)
+	}
+	pq := core.NewPQ(4, 16)
+	pq.Train(vecs, 10)
+
+	codes := pq.QuantizeBatch(vecs)
+	assert.Equal(t, len(vecs), len(codes))
+	// 量化不会插入向量
+	stored, err := pq.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(stored))
+
+	assert.Nil(t, pq.InsertBatch(vecs))
+	for i, vec := range vecs {
+		inserted := pq.IDs[pq.IDLookup[vec.ID]]
+		assert.Equal(t, len(inserted), len(codes[i]))
+		for j, code := range codes[i] {
+			assert.Equal(t, inserted[j], int64(code))
+		}
+	}
+
+	assert.Nil(t, core.NewPQ(4, 300).QuantizeBatch(vecs))
+}
+
+func TestPQTrainWeighted(t *testing.T) {
+	// 两个等大的簇,高权重簇应把单个质心拉向自己
+	var vecs []Vector
+	var weights []float64
+	for i := 0; i < 50; i++ {
+		jitter := float64(i%5) * 0.01
+		vecs = append(vecs, Vector{ID: int64(i), Values: []float64{jitter, jitter}})
+		weights = append(weights, 1)
+		vecs = append(vecs, Vector{ID: int64(50 + i), Values: []float64{10 + jitter, 10 + jitter}})
+		weights = append(weights, 9)
+	}
+
+	unweighted := core.NewPQ(1, 1)
+	unweighted.Train(vecs, 5)
+	center := unweighted.Codebooks[0][0].Vector.Values
+	assert.InDelta(t, 5.0, center[0], 0.1)
+
+	weighted := core.NewPQ(1, 1)
+	assert.Nil(t, weighted.TrainWeighted(vecs, weights, 5))
+	center = weighted.Codebooks[0][0].Vector.Values
+	assert.InDelta(t, 9.0, center[0], 0.1)
+	assert.InDelta(t, 9.0, center[1], 0.1)
+
+	assert.NotNil(t, weighted.TrainWeighted(vecs, weights[:10], 5))
+	weights[0] = -1
+	assert.NotNil(t, weighted.TrainWeighted(vecs, weights, 5))
+}
+
+func TestPQSearchWithinRangeEmpty(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+	}
+	index := core.NewPQ(2, 3)
+	index.Train(vecs, 5)
+	assert.Nil(t, index.InsertBatch(vecs))
+	// 范围内没有向量不是错误,返回空结果
+	res, err := index.SearchWithinRange(Vector{ID: 99, Values: []float64{100, 100}}, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+func TestPQKNearestReversed(t *testing.T) {
+	// 网格数据的子向量大量重复,k-means 容易出现空簇,这里使用连续随机数据
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -10, 10)
+	}
+	query := basic.GenerateRandomVector(int64(len(vecs)), 4, -10, 10)
+	index := core.NewPQ(2, 4)
+	index.Train(vecs, 5)
+	assert.Nil(t, index.InsertBatch(vecs))
+	assertKNearestReversed(t, index, query, 10)
+}
+
+func TestPQReconfigure(t *testing.T) {
+	const numVectors = 2000
+	const dim = 20
+	vecs := make([]Vector, numVectors)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	queries := make([]Vector, 20)
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, -10, 10)
+	}
+
+	pq := core.NewPQ(5, 16)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	before, err := core.RecallCurve(pq, queries, []int{10})
+	assert.Nil(t, err)
+
+	assert.Nil(t, pq.Reconfigure(10, 16, 10))
+	stored, err := pq.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, vecs, stored)
+	assert.Equal(t, 10, len(pq.Codebooks))
+	for _, codes := range pq.IDs {
+		assert.Equal(t, 10, len(codes))
+	}
+
+	// 子向量更多时量化误差更小,召回率应提升
+	after, err := core.RecallCurve(pq, queries, []int{10})
+	assert.Nil(t, err)
+	t.Logf("recall@10 m=5: %.3f, m=10: %.3f", before[10], after[10])
+	assert.Greater(t, after[10], before[10])
+
+	assert.NotNil(t, pq.Reconfigure(3, 16, 10))
+	assert.NotNil(t, pq.Reconfigure(10, numVectors+1, 10))
+}
+
+func TestPQNeedsRetrain(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	// 与训练集同分布的数据不应触发重训
+	assert.False(t, pq.NeedsRetrain())
+
+	// 分布漂移到远离码本的区域后,平均量化误差大幅上升
+	drifted := make([]Vector, 500)
+	for i := range drifted {
+		drifted[i] = basic.GenerateRandomVector(int64(len(vecs)+i), dim, 20, 30)
+	}
+	assert.Nil(t, pq.InsertBatch(drifted))
+	assert.True(t, pq.NeedsRetrain())
+
+	// 阈值足够大时不触发
+	pq.SetMaxErrorRatio(1000)
+	assert.False(t, pq.NeedsRetrain())
+	pq.SetMaxErrorRatio(2)
+
+	// 重训后漂移统计被重置
+	assert.Nil(t, pq.Retrain(10))
+	assert.False(t, pq.NeedsRetrain())
+	assert.Equal(t, len(vecs)+len(drifted), len(pq.IDs))
+}
+
+func TestPQStaleness(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+
+	pq := core.NewPQ(4, 8)
+	assert.Equal(t, 0.0, pq.Staleness())
+	pq.Train(vecs, 10)
+	assert.Equal(t, 1.0, pq.Staleness())
+
+	// 与训练集同分布的数据,误差与训练时接近
+	assert.Nil(t, pq.InsertBatch(vecs))
+	assert.InDelta(t, 1.0, pq.Staleness(), 0.2)
+
+	// 漂移后的数据使 staleness 明显大于 1
+	drifted := make([]Vector, 500)
+	for i := range drifted {
+		drifted[i] = basic.GenerateRandomVector(int64(len(vecs)+i), dim, 3, 5)
+	}
+	assert.Nil(t, pq.InsertBatch(drifted))
+	staleness := pq.Staleness()
+	t.Logf("staleness after drift: %.2f", staleness)
+	assert.Greater(t, staleness, 1.5)
+
+	// 漂移统计随索引持久化,重启后仍能据此安排重训
+	var buf bytes.Buffer
+	assert.Nil(t, pq.Save(&buf))
+	loaded := core.NewPQ(4, 8)
+	assert.Nil(t, loaded.Load(&buf))
+	assert.Equal(t, staleness, loaded.Staleness())
+	assert.True(t, loaded.NeedsRetrain())
+	filename := filepath.Join(t.TempDir(), "pq_staleness")
+	assert.Nil(t, pq.SaveForPartialLoad(filename))
+	partial := core.NewPQ(4, 8)
+	assert.Nil(t, partial.LoadPartial(filename))
+	assert.Equal(t, staleness, partial.Staleness())
+	assert.Nil(t, partial.Close())
+
+	assert.Nil(t, pq.Retrain(10))
+	assert.Equal(t, 1.0, pq.Staleness())
+}
+
+func TestPQSaveLoadStream(t *testing.T) {
+	vecs := generateStreamTestData(8)
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	assertStreamRoundTrip(t, pq, core.NewPQ(4, 8), 8)
+}
+
+func TestPQCompressedPersistence(t *testing.T) {
+	// 量化后的数据:每个分量只取少数几个离散值
+	vecs := make([]Vector, 2000)
+	for i := range vecs {
+		values := make([]float64, 8)
+		for d := range values {
+			values[d] = float64(rand.Intn(4))
+		}
+		vecs[i] = Vector{ID: int64(i), Values: values}
+	}
+	pq := core.NewPQ(4, 3)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "pq.gob")
+	compressed := filepath.Join(dir, "pq.gob.gz")
+	assert.Nil(t, pq.SaveToFile(plain))
+	assert.Nil(t, pq.SaveToFileCompressed(compressed))
+
+	plainInfo, err := os.Stat(plain)
+	assert.Nil(t, err)
+	compressedInfo, err := os.Stat(compressed)
+	assert.Nil(t, err)
+	t.Logf("plain: %d bytes, compressed: %d bytes", plainInfo.Size(), compressedInfo.Size())
+	assert.Less(t, compressedInfo.Size()*2, plainInfo.Size())
+
+	loaded := core.NewPQ(4, 3)
+	assert.Nil(t, loaded.LoadFromFileCompressed(compressed))
+	assert.Equal(t, pq.IDs, loaded.IDs)
+	stored, err := loaded.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, vecs, stored)
+
+	// 未压缩的文件不能按压缩格式读取
+	assert.NotNil(t, core.NewPQ(4, 3).LoadFromFileCompressed(plain))
+}
+
+func TestPQKNearestConcurrentSmallDB(t *testing.T) {
+	training := make([]Vector, 50)
+	for i := range training {
+		training[i] = basic.GenerateRandomVector(int64(i), 4, -1, 1)
+	}
+	pq := core.NewPQ(2, 3)
+	pq.Train(training, 10)
+	assert.Nil(t, pq.InsertBatch(training[:3]))
+
+	query := basic.GenerateRandomVector(-1, 4, -1, 1)
+	expected, err := pq.KNearest(query, 10)
+	assert.Nil(t, err)
+	// 向量数少于并发数时,每个向量仍然恰好被计算一次
+	for _, workers := range []int{1, 2, 3, 8} {
+		res, err := pq.KNearestConcurrentWithWorkers(query, 10, workers)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(res))
+		assert.ElementsMatch(t, expected, res)
+	}
+
+	// 并发数不是正数时返回错误,而不是静默返回空结果
+	for _, workers := range []int{0, -1} {
+		_, err := pq.KNearestConcurrentWithWorkers(query, 10, workers)
+		assert.NotNil(t, err)
+	}
+
+	empty := core.NewPQ(2, 3)
+	empty.Train(training, 10)
+	res, err := empty.KNearestConcurrentWithWorkers(query, 10, 8)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+func TestPQEachVectorSnapshot(t *testing.T) {
+	const n = 500
+	vecs := make([]Vector, n)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 8, -1, 1)
+	}
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 5)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-started
+		for i := 0; i < n; i++ {
+			assert.Nil(t, pq.Insert(basic.GenerateRandomVector(int64(n+i), 8, -1, 1)))
+			if i%10 == 0 {
+				assert.Nil(t, pq.Delete(vecs[i]))
+			}
+		}
+	}()
+	var seen []int64
+	pq.EachVector(func(vec Vector) bool {
+		if len(seen) == 0 {
+			close(started)
+		}
+		seen = append(seen, vec.ID)
+		return true
+	})
+	<-done
+	assert.Len(t, seen, n)
+	for i, id := range seen {
+		assert.Equal(t, int64(i), id)
+	}
+	assert.Equal(t, 2*n-n/10, len(pq.DB))
+}
+
+func TestSelectPQSubvectors(t *testing.T) {
+	const dim = 16
+	vecs := make([]Vector, 1000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	candidates := []int{1, 2, 3, 4, 5, 8, 16}
+	bestM, err := core.SelectPQSubvectors(vecs, candidates, 10)
+	assert.Nil(t, err)
+	assert.Contains(t, candidates, bestM)
+	assert.Zero(t, dim%bestM)
+
+	// 没有候选能整除维度
+	_, err = core.SelectPQSubvectors(vecs, []int{3, 5, 7}, 10)
+	assert.NotNil(t, err)
+	_, err = core.SelectPQSubvectors(vecs, candidates, 0)
+	assert.NotNil(t, err)
+	_, err = core.SelectPQSubvectors(vecs[:10], candidates, 10)
+	assert.NotNil(t, err)
+}
+
+func TestMergePQ(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 600)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	reference := core.NewPQ(4, 8)
+	reference.Train(vecs, 10)
+	assert.Nil(t, reference.InsertBatch(vecs))
+
+	// 两个分片共用参考索引的码本
+	shardA, shardB := core.NewPQ(4, 8), core.NewPQ(4, 8)
+	shardA.Codebooks = reference.Codebooks
+	shardB.Codebooks = reference.Codebooks
+	assert.Nil(t, shardA.InsertBatch(vecs[:250]))
+	assert.Nil(t, shardB.InsertBatch(vecs[250:]))
+	assert.Nil(t, shardA.MergePQ(shardB))
+
+	assert.Equal(t, reference.DB, shardA.DB)
+	assert.Equal(t, reference.IDs, shardA.IDs)
+	assert.Equal(t, reference.IDLookup, shardA.IDLookup)
+	query := basic.GenerateRandomVector(-1, dim, -1, 1)
+	expected, err := reference.KNearest(query, 10)
+	assert.Nil(t, err)
+	merged, err := shardA.KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, merged)
+	found, err := shardA.GetByID(500)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[500], found)
+
+	// ID 冲突与码本不一致都返回错误
+	assert.NotNil(t, shardA.MergePQ(shardB))
+	other := core.NewPQ(4, 8)
+	other.Train(vecs[:100], 10)
+	assert.NotNil(t, shardA.MergePQ(other))
+	assert.Len(t, shardA.DB, len(vecs))
+}
+
+func TestPQNearestExcludingID(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	// 与 vecs[0] 非常接近的另一个向量
+	twin := Vector{ID: 1000, Values: append([]float64(nil), vecs[0].Values...)}
+	twin.Values[0] += 0.01
+	vecs = append(vecs, twin)
+
+	pq := core.NewPQ(4, 16)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	nearest, err := pq.NearestExcludingID(vecs[0], vecs[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, twin.ID, nearest.ID)
+	nearest, err = pq.NearestExcludingID(twin, twin.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[0].ID, nearest.ID)
+
+	// 不排除时返回自身
+	nearest, err = pq.NearestExcludingID(vecs[0], -1)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[0].ID, nearest.ID)
+
+	// 只有被排除的向量时返回错误
+	single := core.NewPQ(1, 1)
+	single.Train(vecs[:1], 1)
+	assert.Nil(t, single.Insert(vecs[0]))
+	_, err = single.NearestExcludingID(vecs[0], vecs[0].ID)
+	assert.NotNil(t, err)
+}
+
+func TestPQSoftDeleteAndCompact(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 400)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	// 软删除偶数 ID 的向量
+	deleted := make(map[int64]bool)
+	for id := int64(0); id < 400; id += 2 {
+		assert.Nil(t, pq.SoftDelete(id))
+		deleted[id] = true
+	}
+	assert.NotNil(t, pq.SoftDelete(0))
+	assert.InDelta(t, 0.5, pq.DeletedRatio(), 1e-12)
+	assert.Equal(t, 400, len(pq.DB))
+
+	query := basic.GenerateRandomVector(-1, dim, -1, 1)
+	results, err := pq.KNearest(query, 50)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, len(results))
+	concurrent, err := pq.KNearestConcurrentWithWorkers(query, 50, 4)
+	assert.Nil(t, err)
+	nearest, err := pq.Nearest(query)
+	assert.Nil(t, err)
+	for _, vec := range append(append(results, concurrent...), nearest) {
+		assert.False(t, deleted[vec.ID])
+	}
+	live, err := pq.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(live))
+	_, err = pq.GetByID(0)
+	assert.NotNil(t, err)
+
+	// 压缩后底层数组缩小,查询结果不变
+	pq.Compact()
+	assert.Equal(t, 0.0, pq.DeletedRatio())
+	assert.Equal(t, 200, len(pq.DB))
+	assert.Equal(t, 200, len(pq.IDs))
+	assert.Equal(t, 200, len(pq.IDLookup))
+	compacted, err := pq.KNearest(query, 50)
+	assert.Nil(t, err)
+	assert.Equal(t, results, compacted)
+	found, err := pq.GetByID(399)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[399], found)
+}
+
+func TestPQLoadClearsSoftDeletes(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 200)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	clean := core.NewPQ(4, 8)
+	clean.Train(vecs, 10)
+	assert.Nil(t, clean.InsertBatch(vecs))
+	var buf bytes.Buffer
+	assert.Nil(t, clean.Save(&buf))
+
+	// 加载前的软删除标记不能残留到新加载的数据上
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	for id := int64(0); id < 50; id++ {
+		assert.Nil(t, pq.SoftDelete(id))
+	}
+	assert.Nil(t, pq.Load(&buf))
+	assert.Equal(t, 0.0, pq.DeletedRatio())
+	live, err := pq.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(live))
+	_, err = pq.GetByID(0)
+	assert.Nil(t, err)
+}
+
+func TestPQDeleteKeepsSoftDeletedOut(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 100)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	// 硬删除排在软删除槽位之前的向量后,软删除的 ID 不能重新出现
+	assert.Nil(t, pq.SoftDelete(10))
+	assert.Nil(t, pq.Delete(vecs[3]))
+	_, err := pq.GetByID(10)
+	assert.NotNil(t, err)
+	assert.NotNil(t, pq.SoftDelete(10))
+
+	// 重新插入同一 ID 后,再次硬删除也不会让它指回已删除的槽位
+	reinserted := basic.GenerateRandomVector(10, dim, -1, 1)
+	assert.Nil(t, pq.Insert(reinserted))
+	assert.Nil(t, pq.Delete(vecs[5]))
+	found, err := pq.GetByID(10)
+	assert.Nil(t, err)
+	assert.Equal(t, reinserted, found)
+}
+
+func TestPQSearchWithinEstimatedDistance(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	// 用 KNearestExplain 取出所有向量的分段距离,手工按阈值过滤
+	query := basic.GenerateRandomVector(-1, dim, -1, 1)
+	all, partials, err := pq.KNearestExplain(query, len(vecs))
+	assert.Nil(t, err)
+	estimates := make(map[int64]float64, len(all))
+	for i, vec := range all {
+		for _, partial := range partials[i] {
+			estimates[vec.ID] += partial
+		}
+	}
+
+	for _, threshold := range []float64{0, 1.5, 2.5, 100} {
+		expected := make(map[int64]bool)
+		for id, est := range estimates {
+			if est <= threshold {
+				expected[id] = true
+			}
+		}
+		results, err := pq.SearchWithinEstimatedDistance(query, threshold)
+		assert.Nil(t, err)
+		assert.Equal(t, len(expected), len(results), "threshold %v", threshold)
+		for i, vec := range results {
+			assert.True(t, expected[vec.ID])
+			if i > 0 {
+				assert.LessOrEqual(t, estimates[results[i-1].ID], estimates[vec.ID])
+			}
+		}
+	}
+}
+
+func TestPQVectorsPage(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 1000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs[:200], 5)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	assert.Nil(t, pq.SoftDelete(7))
+
+	seen := make(map[int64]int)
+	for token := ""; ; {
+		page, next, err := pq.VectorsPage(token, 100)
+		assert.Nil(t, err)
+		for _, vec := range page {
+			seen[vec.ID]++
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	assert.Equal(t, len(vecs)-1, len(seen))
+	assert.Zero(t, seen[7])
+	for _, count := range seen {
+		assert.Equal(t, 1, count)
+	}
+}
+
+func TestPQKNearestResults(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	pq := core.NewPQ(4, 8)
+	pq.Train(vecs, 5)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	query := basic.GenerateRandomVector(-1, dim, -1, 1)
+	expected, err := pq.KNearest(query, 10)
+	assert.Nil(t, err)
+	results, err := pq.KNearestResults(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, basic.ResultsToVectors(results))
+	// 返回的是 PQ 估计距离,与 SearchWithinEstimatedDistance 的阈值一致
+	within, err := pq.SearchWithinEstimatedDistance(query, results[9].Distance)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, len(within), 10)
+}
+
+func TestPQKNearestTieredRefined(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	euclid, calls := countingEuclid()
+	pq := core.NewPQ(4, 16, core.WithMetric(euclid))
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+
+	query := basic.GenerateRandomVector(-1, dim, -1, 1)
+	*calls = 0
+	results, err := pq.KNearestTieredRefined(query, 10, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(results))
+	// 默认只精排 k 个候选:结果是 PQ top-k 按真实距离重排
+	assert.Equal(t, 10, *calls)
+	candidates, err := pq.KNearest(query, 10)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, candidates, results)
+	for i := 1; i < len(results); i++ {
+		assert.LessOrEqual(t, basic.EuclidDistanceVec(query, results[i-1]), basic.EuclidDistanceVec(query, results[i]))
+	}
+
+	// 精排数量等于 3k 时与 KNearestRefined 一致
+	*calls = 0
+	tiered, err := pq.KNearestTieredRefined(query, 10, 30)
+	assert.Nil(t, err)
+	assert.Equal(t, 30, *calls)
+	full, err := pq.KNearestRefined(query, 10)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, full, tiered)
+}
+
+// countingEuclid 返回统计调用次数的欧几里得距离函数
+func countingEuclid() (core.DistanceFunc, *int) {
+	calls := 0
+	return func(a, b []float64) float64 {
+		calls++
+		return basic.EuclidDistance(a, b)
+	}, &calls
+}
+
+// BenchmarkPQTieredRefinement 比较全量精排(3k 个候选)与分层精排(2k、k 个候选)的精确距离计算次数与召回率
+func BenchmarkPQTieredRefinement(b *testing.B) {
+	const numVectors = 5000
+	const dim = 32
+	const k = 50
+	vecs := make([]Vector, numVectors)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -5, 5)
+	}
+	euclid, calls := countingEuclid()
+	pq := core.NewPQ(8, 64, core.WithMetric(euclid))
+	pq.Train(vecs, 10)
+	if err := pq.InsertBatch(vecs); err != nil {
+		b.Fatalf("Failed to insert vectors: %v", err)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	queries := make([]Vector, 50)
+	truths := make([][]Vector, len(queries))
+	for i := range queries {
+		queries[i] = basic.GenerateRandomVector(int64(numVectors+i), dim, -5, 5)
+		truths[i], _ = bs.KNearest(queries[i], k)
+	}
+
+	search := map[string]func(query Vector) ([]Vector, error){
+		"full":      func(query Vector) ([]Vector, error) { return pq.KNearestRefined(query, k) },
+		"tiered_2k": func(query Vector) ([]Vector, error) { return pq.KNearestTieredRefined(query, k, 2*k) },
+		"tiered":    func(query Vector) ([]Vector, error) { return pq.KNearestTieredRefined(query, k, 0) },
+	}
+	for _, name := range []string{"full", "tiered_2k", "tiered"} {
+		b.Run(name, func(b *testing.B) {
+			*calls = 0
+			recall := 0.0
+			for i := 0; i < b.N; i++ {
+				for j, query := range queries {
+					res, err := search[name](query)
+					if err != nil {
+						b.Fatal(err)
+					}
+					recall += idRecall(truths[j], res)
+				}
+			}
+			queryCount := float64(b.N * len(queries))
+			b.ReportMetric(float64(*calls)/queryCount, "exact_dists/query")
+			b.ReportMetric(recall/queryCount, "recall")
+		})
+	}
+}
+
+func TestPQLoadPartial(t *testing.T) {
+	const dim = 8
+	vecs := make([]Vector, 1000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -1, 1)
+	}
+	full := core.NewPQ(4, 16)
+	full.Train(vecs, 10)
+	assert.Nil(t, full.InsertBatch(vecs))
+	assert.Nil(t, full.SoftDelete(7))
+
+	filename := filepath.Join(t.TempDir(), "pq_partial")
+	assert.Nil(t, full.SaveForPartialLoad(filename))
+
+	partial := core.NewPQ(1, 1)
+	assert.Nil(t, partial.LoadPartial(filename))
+	defer partial.Close()
+
+	// 原始向量不在内存中
+	vectors, err := partial.Vectors()
+	assert.Nil(t, err)
+	assert.Equal(t, len(vecs)-1, len(vectors))
+	assert.Nil(t, vectors[0].Values)
+
+	for q := 0; q < 20; q++ {
+		query := basic.GenerateRandomVector(int64(-q-1), dim, -1, 1)
+		expected, err := full.KNearestRefined(query, 10)
+		assert.Nil(t, err)
+		got, err := partial.KNearestRefined(query, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, got)
+
+		expected, err = full.KNearest(query, 5)
+		assert.Nil(t, err)
+		got, err = partial.KNearest(query, 5)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, got)
+	}
+
+	// 其他需要原始向量的方法同样从文件读取,结果与完整加载一致
+	query := basic.GenerateRandomVector(-100, dim, -1, 1)
+	expectedVec, err := full.GetByID(500)
+	assert.Nil(t, err)
+	gotVec, err := partial.GetByID(500)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedVec, gotVec)
+	expected, err := full.KNearestAmong(query, 3, []int64{1, 2, 3, 4, 5})
+	assert.Nil(t, err)
+	got, err := partial.KNearestAmong(query, 3, []int64{1, 2, 3, 4, 5})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, got)
+	for _, id := range []int64{0, 500, 999} {
+		expectedRank, err := full.SelfRank(id, 10)
+		assert.Nil(t, err)
+		gotRank, err := partial.SelfRank(id, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedRank, gotRank)
+	}
+	expected, err = full.SearchWithinRange(query, 1.5)
+	assert.Nil(t, err)
+	got, err = partial.SearchWithinRange(query, 1.5)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, expected, got)
+	expected, err = full.SearchWithinEstimatedDistance(query, 1)
+	assert.Nil(t, err)
+	got, err = partial.SearchWithinEstimatedDistance(query, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, got)
+	expected, err = full.KNearestConcurrentWithWorkers(query, 10, 4)
+	assert.Nil(t, err)
+	got, err = partial.KNearestConcurrentWithWorkers(query, 10, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, got)
+	expectedVec, err = full.Nearest(query)
+	assert.Nil(t, err)
+	gotVec, err = partial.Nearest(query)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedVec, gotVec)
+
+	// 硬删除与压缩会移动槽位,读取的仍是同一 ID 的向量
+	assert.Nil(t, partial.Delete(vecs[0]))
+	assert.Nil(t, partial.SoftDelete(1))
+	partial.Compact()
+	gotVec, err = partial.GetByID(500)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[500], gotVec)
+
+	assert.NotNil(t, partial.Retrain(10))
+	assert.NotNil(t, partial.SaveForPartialLoad(filepath.Join(t.TempDir(), "again")))
+
+	// 槽位中没有原始向量,普通保存会丢数据,必须返回错误且不能截断已有文件
+	var buf bytes.Buffer
+	assert.NotNil(t, partial.Save(&buf))
+	existing := filepath.Join(t.TempDir(), "existing")
+	assert.Nil(t, full.SaveToFile(existing))
+	info, err := os.Stat(existing)
+	assert.Nil(t, err)
+	assert.NotNil(t, partial.SaveToFile(existing))
+	assert.NotNil(t, partial.SaveToFileCompressed(existing))
+	after, err := os.Stat(existing)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), after.Size())
+
+	// 部分加载的 PQ 既不能合并进其他 PQ,也不能接收合并
+	empty := core.NewPQ(4, 16)
+	empty.Codebooks = full.Codebooks
+	assert.NotNil(t, partial.MergePQ(empty))
+	assert.NotNil(t, empty.MergePQ(partial))
+	assert.Nil(t, partial.Close())
+	assert.NotNil(t, core.NewPQ(1, 1).LoadPartial(filename+".missing"))
+
+	// 部分加载后再完整加载,旧文件被关闭,可以正常保存和重训
+	reloaded := core.NewPQ(4, 16)
+	assert.Nil(t, reloaded.LoadPartial(filename))
+	buf.Reset()
+	assert.Nil(t, full.Save(&buf))
+	assert.Nil(t, reloaded.Load(&buf))
+	buf.Reset()
+	assert.Nil(t, reloaded.Save(&buf))
+	assert.Nil(t, reloaded.Retrain(10))
+	assert.Nil(t, reloaded.Close())
+}
+
+func TestPQNormalizedPersistence(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{10, 0}},
+		{ID: 1, Values: []float64{0, 1}},
+		{ID: 2, Values: []float64{1, 1}},
+	}
+	pq := core.NewPQ(1, 2, core.WithNormalize())
+	pq.Train(vecs, 10)
+	assert.Nil(t, pq.InsertBatch(vecs))
+	saveFilePath := filepath.Join(t.TempDir(), "pq_normalized")
+	assert.Nil(t, pq.SaveToFile(saveFilePath))
+
+	loaded := core.NewPQ(1, 2)
+	assert.Nil(t, loaded.LoadFromFile(saveFilePath))
+	assert.True(t, loaded.Normalize)
+	assert.Equal(t, true, loaded.Config()["normalize"])
+
+	// 未归一化的查询向量:欧几里得距离最近的是 ID 2,余弦相似度最高的是 ID 0
+	query := Vector{ID: 100, Values: []float64{5, 0.5}}
+	knVecs, err := loaded.KNearestRefined(query, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 2, 1}, []int64{knVecs[0].ID, knVecs[1].ID, knVecs[2].ID})
+
+	// 分离持久化的格式同样记录归一化模式
+	partialPath := filepath.Join(t.TempDir(), "pq_normalized_partial")
+	assert.Nil(t, pq.SaveForPartialLoad(partialPath))
+	partial := core.NewPQ(1, 1)
+	assert.Nil(t, partial.LoadPartial(partialPath))
+	defer partial.Close()
+	assert.True(t, partial.Normalize)
+	partialVecs, err := partial.KNearestRefined(query, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, knVecs, partialVecs)
+
+	plain := core.NewPQ(1, 2)
+	plain.Train(vecs, 10)
+	assert.Nil(t, plain.InsertBatch(vecs))
+	res, err := plain.KNearestRefined(query, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res[0].ID)
+	assert.NotNil(t, pq.MergePQ(plain))
+
+	// 未归一化的保存加载进归一化的 PQ 后,查询不再被归一化
+	var buf bytes.Buffer
+	assert.Nil(t, plain.Save(&buf))
+	reused := core.NewPQ(1, 2, core.WithNormalize())
+	assert.Nil(t, reused.Load(&buf))
+	assert.False(t, reused.Normalize)
+	res, err = reused.KNearestRefined(query, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res[0].ID)
+}
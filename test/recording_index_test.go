@@ -0,0 +1,53 @@
+package test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/basic"
+	"hh_vectordb/core"
+	"testing"
+)
+
+func TestRecordingIndex(t *testing.T) {
+	vecs := make([]Vector, 500)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -10, 10)
+	}
+	bs := core.NewBruteForceSearch(vecs)
+	groundTruth := func(query Vector, k int) []Vector {
+		res, _ := bs.KNearest(query, k)
+		return res
+	}
+	index := core.NewRecordingIndex(core.NewKDTree(vecs), groundTruth)
+
+	const numQueries = 20
+	for i := 0; i < numQueries; i++ {
+		query := basic.GenerateRandomVector(int64(len(vecs)+i), 4, -10, 10)
+		res, err := index.KNearest(query, 5)
+		assert.Nil(t, err)
+		assert.Equal(t, 5, len(res))
+	}
+	_, err := index.Nearest(vecs[0])
+	assert.Nil(t, err)
+
+	report := index.Report()
+	assert.Equal(t, numQueries+1, len(report.Records))
+	for _, rec := range report.Records {
+		assert.Greater(t, int64(rec.Latency), int64(0))
+		// kd-tree 是精确搜索,召回率应为 1
+		assert.Equal(t, 1.0, rec.Recall)
+	}
+	assert.Equal(t, 1, report.Records[numQueries].K)
+	assert.Greater(t, int64(report.MeanLatency), int64(0))
+	assert.Equal(t, 1.0, report.MeanRecall)
+
+	// 未提供真值函数时不计算召回率
+	noTruth := core.NewRecordingIndex(core.NewKDTree(vecs), nil)
+	_, err = noTruth.KNearest(vecs[0], 3)
+	assert.Nil(t, err)
+	report = noTruth.Report()
+	assert.Equal(t, -1.0, report.Records[0].Recall)
+	assert.Equal(t, -1.0, report.MeanRecall)
+
+	noTruth.Reset()
+	assert.Equal(t, 0, len(noTruth.Report().Records))
+}
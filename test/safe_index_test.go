@@ -0,0 +1,106 @@
+package test
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"hh_vectordb/core"
+	"sync"
+	"testing"
+)
+
+func TestSafeIndexUpdateBatch(t *testing.T) {
+	const n = 1000
+	// 第一个分量作为版本号,其余分量随 ID 变化
+	versioned := func(version float64) []Vector {
+		vecs := make([]Vector, n)
+		for i := range vecs {
+			vecs[i] = Vector{ID: int64(i), Values: []float64{version, float64(i)}}
+		}
+		return vecs
+	}
+	index := core.NewSafeIndex(core.NewBruteForceSearch(versioned(0)))
+
+	// 读者只应看到全部旧值或全部新值
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				vecs, err := index.Vectors()
+				assert.Nil(t, err)
+				assert.Len(t, vecs, n)
+				for _, vec := range vecs {
+					if vec.Values[0] != vecs[0].Values[0] {
+						t.Errorf("mixed versions: %v and %v", vecs[0].Values[0], vec.Values[0])
+						return
+					}
+				}
+			}
+		}()
+	}
+	for version := 1; version <= 5; version++ {
+		assert.Nil(t, index.UpdateBatch(versioned(float64(version))))
+	}
+	close(stop)
+	wg.Wait()
+
+	vecs, err := index.Vectors()
+	assert.Nil(t, err)
+	assert.Len(t, vecs, n)
+	for _, vec := range vecs {
+		assert.Equal(t, 5.0, vec.Values[0])
+	}
+	nearest, err := index.Nearest(Vector{Values: []float64{5, 42}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), nearest.ID)
+
+	// ID 不存在或重复时不做任何修改
+	assert.NotNil(t, index.UpdateBatch([]Vector{{ID: 1, Values: []float64{6, 1}}, {ID: n, Values: []float64{6, n}}}))
+	assert.NotNil(t, index.UpdateBatch([]Vector{{ID: 1, Values: []float64{6, 1}}, {ID: 1, Values: []float64{7, 1}}}))
+	vecs, err = index.Vectors()
+	assert.Nil(t, err)
+	assert.Len(t, vecs, n)
+	for _, vec := range vecs {
+		assert.Equal(t, 5.0, vec.Values[0])
+	}
+}
+
+// failingInsertIndex 只插入批次中的第一个向量,然后返回错误,用于模拟插入中途失败
+type failingInsertIndex struct {
+	*core.BruteForceSearch
+}
+
+func (f failingInsertIndex) InsertBatch(vectors []Vector) error {
+	if len(vectors) > 0 {
+		_ = f.BruteForceSearch.Insert(vectors[0])
+	}
+	return errors.New("injected insert failure")
+}
+
+func TestSafeIndexUpdateBatchRollback(t *testing.T) {
+	// ID 1 与 ID 7 的值相同,更新 ID 7 时不能误删 ID 1
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 7, Values: []float64{5, 4}},
+	}
+	inner := core.NewBruteForceSearch(vecs)
+	index := core.NewSafeIndex(failingInsertIndex{BruteForceSearch: inner})
+	before, err := index.Vectors()
+	assert.Nil(t, err)
+
+	err = index.UpdateBatch([]Vector{{ID: 7, Values: []float64{1, 1}}, {ID: 2, Values: []float64{8, 8}}})
+	assert.NotNil(t, err)
+
+	after, err := index.Vectors()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, before, after)
+}
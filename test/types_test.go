@@ -28,3 +28,54 @@ func TestVector(t *testing.T) {
 	assert.False(t, vec1.Equals(vec2))
 	assert.True(t, vec3.Equals(vec4))
 }
+
+func TestResultOverlap(t *testing.T) {
+	a := []Vector{
+		{ID: 1, Values: []float64{1, 1}},
+		{ID: 2, Values: []float64{2, 2}},
+		{ID: 3, Values: []float64{3, 3}},
+		{ID: 4, Values: []float64{4, 4}},
+	}
+	b := []Vector{
+		{ID: 3, Values: []float64{3, 3}},
+		{ID: 5, Values: []float64{5, 5}},
+		{ID: 1, Values: []float64{1, 1}},
+		{ID: 6, Values: []float64{6, 6}},
+	}
+	jaccard, common := basic.ResultOverlap(a, b)
+	// 交集 {1, 3},并集 {1, 2, 3, 4, 5, 6}
+	assert.InDelta(t, 2.0/6.0, jaccard, 1e-9)
+	assert.Equal(t, []int64{1, 3}, common)
+
+	jaccard, common = basic.ResultOverlap(a, a)
+	assert.InDelta(t, 1.0, jaccard, 1e-9)
+	assert.Equal(t, 4, len(common))
+
+	jaccard, common = basic.ResultOverlap(nil, nil)
+	assert.Equal(t, 0.0, jaccard)
+	assert.Empty(t, common)
+}
+
+func TestVectorEqualsWithin(t *testing.T) {
+	a := Vector{ID: 1, Values: []float64{1.0, 2.0, 3.0}}
+	b := Vector{ID: 1, Values: []float64{1.0 + 1e-7, 2.0, 3.0 - 1e-7}}
+	assert.False(t, a.Equals(b))
+	assert.False(t, a.EqualsWithin(b, 1e-9))
+	assert.True(t, a.EqualsWithin(b, 1e-6))
+	assert.False(t, a.EqualsWithin(Vector{ID: 1, Values: []float64{1.0, 2.0}}, 1e-6))
+}
+
+func TestResultAdapters(t *testing.T) {
+	a := Vector{ID: 1, Values: []float64{1, 0}}
+	b := Vector{ID: 2, Values: []float64{0, 2}}
+	expected := []basic.SearchResult{{Vector: a, Distance: 1}, {Vector: b, Distance: 2}}
+
+	items := []*basic.Item{{Value: a, Distance: 1}, {Value: b, Distance: 2}}
+	assert.Equal(t, []Vector{a, b}, basic.ItemsToVectors(items))
+	assert.Equal(t, expected, basic.ItemsToResults(items))
+
+	pairs := []basic.VectorDistPair{{Vector: a, Dist: 1}, {Vector: b, Dist: 2}}
+	assert.Equal(t, expected, basic.VectorDistPairsToResults(pairs))
+	assert.Equal(t, []Vector{a, b}, basic.ResultsToVectors(expected))
+	assert.Empty(t, basic.ItemsToVectors(nil))
+}
@@ -364,3 +364,277 @@ func TestVPTreePersistence(t *testing.T) {
 			expected[i].ID, basic.EuclidDistanceVec(query, expected[i]))
 	}
 }
+
+func TestVPTreeNearestExcludingSelf(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	vpTree := core.NewVPTree(vecs)
+	// 查询向量与 ID 为 3 的向量完全相同,应返回次近的 ID 为 1 的向量
+	query := Vector{ID: 100, Values: []float64{4, 7}}
+	res, err := vpTree.NearestExcludingSelf(query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.ID)
+}
+
+func TestVPTreeDeleteAndReturn(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 4, Values: []float64{8, 1}},
+		{ID: 5, Values: []float64{7, 2}},
+	}
+	vpTree := core.NewVPTree(vecs)
+	res, err := vpTree.DeleteAndReturn(4)
+	assert.Nil(t, err)
+	assert.Equal(t, vecs[4].ID, res.ID)
+	assert.True(t, res.Equals(vecs[4]))
+	remaining, err := vpTree.Vectors()
+	assert.Nil(t, err)
+	for _, vec := range remaining {
+		assert.NotEqual(t, int64(4), vec.ID)
+	}
+	_, err = vpTree.DeleteAndReturn(4)
+	assert.NotNil(t, err)
+}
+
+func TestVPTreeDeleteAndReturnDuplicateValues(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+		{ID: 7, Values: []float64{5, 4}},
+	}
+	vpTree := core.NewVPTree(vecs)
+	res, err := vpTree.DeleteAndReturn(7)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), res.ID)
+	remaining, err := vpTree.Vectors()
+	assert.Nil(t, err)
+	ids := make(map[int64]bool, len(remaining))
+	for _, vec := range remaining {
+		ids[vec.ID] = true
+	}
+	assert.Equal(t, 4, len(remaining))
+	assert.True(t, ids[1])
+	assert.False(t, ids[7])
+}
+
+func TestVPTreeKNearestWithinBudget(t *testing.T) {
+	const numVectors = 5_0000
+	const dim = 10
+	const k = 20
+
+	vecs := make([]Vector, numVectors)
+	for i := 0; i < numVectors; i++ {
+		vecs[i] = basic.GenerateRandomVector(int64(i), dim, -10, 10)
+	}
+	tree := core.NewVPTree(vecs)
+	query := basic.GenerateRandomVector(int64(numVectors), dim, -10, 10)
+
+	// 预算充足时与暴力搜索的精确结果一致
+	bs := core.NewBruteForceSearch(vecs)
+	expected, err := bs.KNearest(query, k)
+	assert.Nil(t, err)
+	res, err := tree.KNearestWithinBudget(query, k, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), len(res))
+	for i, vec := range res {
+		assert.Equal(t, expected[i].ID, vec.ID)
+	}
+
+	// 极小的预算下提前返回,结果数量不超过 k
+	res, err = tree.KNearestWithinBudget(query, k, time.Nanosecond)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, len(res), k)
+	assert.Greater(t, len(res), 0)
+
+	_, err = tree.KNearestWithinBudget(query, k, 0)
+	assert.NotNil(t, err)
+}
+
+func TestVPTreeSearchWithinRangeEmpty(t *testing.T) {
+	vecs := []Vector{
+		{ID: 0, Values: []float64{2, 3}},
+		{ID: 1, Values: []float64{5, 4}},
+		{ID: 2, Values: []float64{9, 6}},
+		{ID: 3, Values: []float64{4, 7}},
+	}
+	index := core.NewVPTree(vecs)
+	// 范围内没有向量不是错误,返回空结果
+	res, err := index.SearchWithinRange(Vector{ID: 99, Values: []float64{100, 100}}, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+}
+
+func TestVPTreeKNearestReversed(t *testing.T) {
+	vecs, query := generateReversedTestData()
+	index := core.NewVPTree(vecs)
+	assertKNearestReversed(t, index, query, 10)
+}
+
+func TestVPTreeSearchWithinAnnulus(t *testing.T) {
+	vecs := generateAnnulusTestData()
+	assertAnnulus(t, core.NewVPTree(vecs), vecs)
+}
+
+func TestVPTreeSaveLoadStream(t *testing.T) {
+	vecs := generateStreamTestData(4)
+	assertStreamRoundTrip(t, core.NewVPTree(vecs), &VPTree{}, 4)
+}
+
+func TestVPTreeKNearestWithStats(t *testing.T) {
+	centers := [][]float64{{0, 0, 0}, {50, 50, 50}, {-50, 50, 0}, {50, -50, 0}}
+	vecs, _ := generateBlobs(centers, 2000, 5.0)
+	tree := core.NewVPTree(vecs)
+
+	query := Vector{ID: -1, Values: []float64{1, -1, 2}}
+	stats := &core.SearchStats{}
+	res, err := tree.KNearestWithStats(query, 10, stats)
+	assert.Nil(t, err)
+	expected, _ := tree.KNearest(query, 10)
+	assert.Equal(t, expected, res)
+	t.Logf("visited %d of %d nodes", stats.NodesVisited, len(vecs))
+	assert.Greater(t, stats.NodesVisited, 0)
+	assert.Less(t, stats.NodesVisited*5, len(vecs))
+}
+
+func TestVPTreeKNearestWithCache(t *testing.T) {
+	vecs := make([]Vector, 2000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -10, 10)
+	}
+	manhattan, calls := countingManhattan()
+	tree := core.NewVPTree(vecs, core.WithMetric(manhattan))
+	query := basic.GenerateRandomVector(-1, 4, -10, 10)
+
+	cache := core.NewVPDistanceCache()
+	for _, k := range []int{5, 10, 20, 40} {
+		expected, err := tree.KNearest(query, k)
+		assert.Nil(t, err)
+
+		before := *calls
+		res, err := tree.KNearestWithCache(query, k, cache)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res)
+		// 每个节点的距离只计算一次,因此新增的距离计算次数等于缓存的增量
+		assert.LessOrEqual(t, *calls-before, cache.Len())
+	}
+	cached := cache.Len()
+	before := *calls
+	_, err := tree.KNearestWithCache(query, 40, cache)
+	assert.Nil(t, err)
+	assert.Equal(t, before, *calls)
+	assert.Equal(t, cached, cache.Len())
+
+	// 换一个查询时缓存被重置
+	other := basic.GenerateRandomVector(-2, 4, -10, 10)
+	expected, _ := tree.KNearest(other, 5)
+	res, err := tree.KNearestWithCache(other, 5, cache)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+	assert.Less(t, cache.Len(), cached)
+}
+
+// BenchmarkVPTreeDistanceCache 在代价高昂的度量下按 k 递增重复查询,对比有无距离缓存
+func BenchmarkVPTreeDistanceCache(b *testing.B) {
+	vecs := make([]Vector, 20000)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 8, -10, 10)
+	}
+	// 刻意放慢的欧几里得距离
+	slow := func(x, y []float64) float64 {
+		d := 0.0
+		for r := 0; r < 50; r++ {
+			d = basic.EuclidDistance(x, y)
+		}
+		return d
+	}
+	tree := core.NewVPTree(vecs, core.WithMetric(slow))
+	query := basic.GenerateRandomVector(-1, 8, -10, 10)
+
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var cache *core.VPDistanceCache
+				if cached {
+					cache = core.NewVPDistanceCache()
+				}
+				for _, k := range []int{10, 20, 40, 80} {
+					_, _ = tree.KNearestWithCache(query, k, cache)
+				}
+			}
+		})
+	}
+}
+
+func TestVPTreeKNearestResults(t *testing.T) {
+	vecs := make([]Vector, 300)
+	for i := range vecs {
+		vecs[i] = basic.GenerateRandomVector(int64(i), 4, -1, 1)
+	}
+	tree := core.NewVPTree(vecs)
+	query := basic.GenerateRandomVector(-1, 4, -1, 1)
+	expected, err := tree.KNearest(query, 10)
+	assert.Nil(t, err)
+	results, err := tree.KNearestResults(query, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, basic.ResultsToVectors(results))
+	for i, res := range results {
+		assert.InDelta(t, basic.EuclidDistanceVec(query, res.Vector), res.Distance, 1e-12)
+		if i > 0 {
+			assert.LessOrEqual(t, results[i-1].Distance, res.Distance)
+		}
+	}
+}
+
+func TestVPTreeKNearestExplainPruning(t *testing.T) {
+	// 两个相距很远的一维簇,查询落在第一个簇内时另一个簇所在的分支应被剪掉
+	var vectors []basic.Vector
+	for i, v := range []float64{0, 1, 2, 100, 101, 102} {
+		vectors = append(vectors, basic.Vector{ID: int64(i), Values: []float64{v}})
+	}
+	tree := core.NewVPTree(vectors)
+	query := basic.Vector{Values: []float64{0.5}}
+
+	results, decisions, err := tree.KNearestExplainPruning(query, 2)
+	assert.Nil(t, err)
+	expected, err := tree.KNearest(query, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, results)
+	assert.NotEmpty(t, decisions)
+
+	pruned := 0
+	for _, d := range decisions {
+		assert.False(t, d.Bound < 0 && d.Pruned, "a branch with a negative bound cannot be pruned")
+		if d.Pruned {
+			pruned++
+			assert.Greater(t, d.Bound, 0.0)
+			assert.LessOrEqual(t, d.KthDistance, d.Bound)
+		}
+	}
+	assert.Greater(t, pruned, 0)
+
+	// 只有一个节点时没有另一侧分支,不应记录剪枝决策
+	_, decisions, err = core.NewVPTree(vectors[:1]).KNearestExplainPruning(query, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, decisions)
+
+	// 未开启 RecordPruning 时不记录
+	stats := &core.SearchStats{}
+	_, err = tree.KNearestWithStats(query, 2, stats)
+	assert.Nil(t, err)
+	assert.Empty(t, stats.PruneDecisions)
+}